@@ -0,0 +1,105 @@
+package benchmark
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/miekg/dns"
+)
+
+// SlowUpstream is upstream resolver that takes Delay for each query.
+type SlowUpstream struct {
+	Delay time.Duration
+	count int64
+}
+
+func (u *SlowUpstream) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	atomic.AddInt64(&u.count, 1)
+	time.Sleep(u.Delay)
+	return w.Add(landns.AddressRecord{Name: landns.Domain(r.Name), TTL: 3600, Address: net.ParseIP("127.0.0.1")})
+}
+
+func (u *SlowUpstream) RecursionAvailable() bool {
+	return true
+}
+
+func (u *SlowUpstream) Close() error {
+	return nil
+}
+
+// Count is getter to the number of queries that upstream received.
+func (u *SlowUpstream) Count() int64 {
+	return atomic.LoadInt64(&u.count)
+}
+
+// SerializedResolver is a resolver that holds lock during resolving, like cache without request coalescing.
+type SerializedResolver struct {
+	sync.Mutex
+	landns.Resolver
+}
+
+func (s *SerializedResolver) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.Resolver.Resolve(w, r)
+}
+
+var cacheFactories = []struct {
+	Name string
+	New  func(upstream landns.Resolver) landns.Resolver
+}{
+	{"serialized", func(upstream landns.Resolver) landns.Resolver {
+		return &SerializedResolver{Resolver: landns.NewLocalCache(upstream, landns.NewMetrics("landns"))}
+	}},
+	{"coalesced", func(upstream landns.Resolver) landns.Resolver {
+		return landns.NewLocalCache(upstream, landns.NewMetrics("landns"))
+	}},
+}
+
+func benchmarkCache(b *testing.B, name func(n int64) string) {
+	for _, factory := range cacheFactories {
+		b.Run(factory.Name, func(b *testing.B) {
+			upstream := &SlowUpstream{Delay: time.Millisecond}
+			resolver := factory.New(upstream)
+			defer resolver.Close()
+
+			var n int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req := landns.NewRequest(name(atomic.AddInt64(&n, 1)), dns.TypeA, true)
+					if err := resolver.Resolve(landns.NewResponseCallback(func(landns.Record) error { return nil }), req); err != nil {
+						b.Errorf("failed to resolve: %s", err)
+					}
+				}
+			})
+
+			b.ReportMetric(float64(upstream.Count())/float64(b.N), "upstream/op")
+		})
+	}
+}
+
+// BenchmarkCache_mixed is benchmark of cache hits that mixed with cache misses for other questions.
+func BenchmarkCache_mixed(b *testing.B) {
+	benchmarkCache(b, func(n int64) string {
+		if n%10 == 0 {
+			return fmt.Sprintf("%d.miss.example.com.", n)
+		}
+		return "hot.example.com."
+	})
+}
+
+// BenchmarkCache_burst is benchmark of concurrent cache misses for the same question.
+func BenchmarkCache_burst(b *testing.B) {
+	benchmarkCache(b, func(n int64) string {
+		return fmt.Sprintf("%d.burst.example.com.", n/64)
+	})
+}
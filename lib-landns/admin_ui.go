@@ -0,0 +1,308 @@
+package landns
+
+import (
+	"net/http"
+)
+
+// AdminUI is http.Handler that serves the single page admin UI.
+//
+// The UI uses the text APIs under /api/v1, so it works only when served on the same server as DynamicAPI, CacheAPI and StatusAPI.
+type AdminUI struct{}
+
+func (a AdminUI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		HTTPError{http.StatusMethodNotAllowed, "method not allowed"}.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write([]byte(adminUIPage))
+}
+
+const adminUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Landns</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 60em; padding: 0 1em; color: #222; }
+nav button { border: none; background: none; padding: .5em 1em; cursor: pointer; font-size: 1em; }
+nav button.active { border-bottom: 2px solid #36c; }
+section { display: none; }
+section.active { display: block; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: .3em; text-align: left; font-family: monospace; }
+td.actions { white-space: nowrap; text-align: right; }
+input[type=text], textarea { font-family: monospace; box-sizing: border-box; }
+textarea { width: 100%; }
+.down { color: #c33; }
+#message { font-family: monospace; min-height: 1.5em; }
+#message.error { color: #c33; }
+</style>
+</head>
+<body>
+<h1>Landns</h1>
+<nav>
+  <button data-tab="records" class="active">Records</button>
+  <button data-tab="static">Static zones</button>
+  <button data-tab="cache">Cache</button>
+  <button data-tab="upstream">Upstreams</button>
+  <a href="/metrics">metrics</a>
+</nav>
+<p id="message"></p>
+
+<section id="records" class="active">
+  <form id="search">
+    <select id="search-mode">
+      <option value="all">all</option>
+      <option value="suffix">suffix</option>
+      <option value="glob">glob</option>
+    </select>
+    <input type="text" id="search-query" placeholder="example.com or *.example.com">
+    <button type="submit">search</button>
+  </form>
+  <table><thead><tr><th>record</th><th>ID</th><th></th></tr></thead><tbody id="records-list"></tbody></table>
+  <h2>Add records</h2>
+  <form id="add">
+    <textarea id="add-records" rows="4" placeholder="www.example.com. 600 IN A 192.168.1.1"></textarea>
+    <button type="submit">add</button>
+  </form>
+</section>
+
+<section id="static">
+  <table><thead><tr><th>record</th></tr></thead><tbody id="static-list"></tbody></table>
+</section>
+
+<section id="cache">
+  <form id="cache-flush">
+    <input type="text" id="cache-name" placeholder="example.com">
+    <button type="submit">flush name</button>
+    <button type="button" id="cache-flush-suffix">flush suffix</button>
+    <button type="button" id="cache-flush-all">flush all</button>
+  </form>
+  <table><thead><tr><th>entry</th></tr></thead><tbody id="cache-list"></tbody></table>
+</section>
+
+<section id="upstream">
+  <table><thead><tr><th>upstream</th><th>state</th><th>fails</th><th>RTT</th></tr></thead><tbody id="upstream-list"></tbody></table>
+</section>
+
+<script>
+"use strict";
+
+const $ = id => document.getElementById(id);
+
+function showMessage(text, error) {
+  $("message").textContent = text;
+  $("message").className = error ? "error" : "";
+}
+
+async function api(method, path, body) {
+  const resp = await fetch("/api/v1" + path, {method: method, body: body});
+  const text = (await resp.text()).trim();
+  if (!resp.ok) {
+    throw new Error(text || resp.statusText);
+  }
+  return text;
+}
+
+function lines(text) {
+  return text.split("\n").filter(l => l.trim() !== "");
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(parent, label, onclick) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.onclick = onclick;
+  parent.appendChild(b);
+  return b;
+}
+
+function suffixPath(name) {
+  return name.split(".").filter(x => x !== "").reverse().map(encodeURIComponent).join("/");
+}
+
+// parseRecord splits "NAME TTL IN TYPE DATA ; ID:1 Volatile" into the record, ID and volatile marker.
+function parseRecord(line) {
+  const idx = line.lastIndexOf(" ; ");
+  if (idx < 0) {
+    return {record: line, id: null, volatile: false};
+  }
+  const annotates = line.slice(idx + 3).split(" ");
+  const id = annotates.filter(x => x.startsWith("ID:")).map(x => x.slice(3))[0];
+  return {record: line.slice(0, idx), id: id || null, volatile: annotates.includes("Volatile")};
+}
+
+async function loadRecords() {
+  const mode = $("search-mode").value;
+  const query = $("search-query").value.trim();
+
+  let path = "";
+  if (mode === "suffix" && query !== "") {
+    path = "/suffix/" + suffixPath(query);
+  } else if (mode === "glob" && query !== "") {
+    path = "/glob/" + encodeURIComponent(query);
+  }
+
+  const tbody = $("records-list");
+  tbody.textContent = "";
+  try {
+    for (const line of lines(await api("GET", path))) {
+      const r = parseRecord(line);
+      const row = tbody.insertRow();
+      const recordCell = cell(row, r.record);
+      cell(row, r.id || "");
+      const actions = cell(row, "", "actions");
+      if (r.id === null) {
+        continue;
+      }
+      button(actions, "edit", () => editRecord(recordCell, actions, r));
+      button(actions, "delete", async () => {
+        if (!confirm("delete " + r.record + "?")) {
+          return;
+        }
+        try {
+          showMessage(await api("DELETE", "/id/" + r.id));
+          loadRecords();
+        } catch (e) {
+          showMessage(e.message, true);
+        }
+      });
+    }
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+}
+
+function editRecord(recordCell, actions, r) {
+  const input = document.createElement("input");
+  input.type = "text";
+  input.size = 60;
+  input.value = r.record;
+  recordCell.textContent = "";
+  recordCell.appendChild(input);
+
+  actions.textContent = "";
+  button(actions, "save", async () => {
+    try {
+      // Disable the old record and add the new one in a single request.
+      // Volatile records like DHCP leases are kept volatile, so they still expire.
+      const record = input.value + (r.volatile ? " ; Volatile" : "");
+      showMessage(await api("POST", "", ";" + r.record + " ; ID:" + r.id + "\n" + record));
+      loadRecords();
+    } catch (e) {
+      showMessage(e.message, true);
+    }
+  });
+  button(actions, "cancel", () => loadRecords());
+}
+
+async function loadStatic() {
+  const tbody = $("static-list");
+  tbody.textContent = "";
+  try {
+    for (const line of lines(await api("GET", "/static"))) {
+      cell(tbody.insertRow(), line);
+    }
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+}
+
+async function loadCache() {
+  const tbody = $("cache-list");
+  tbody.textContent = "";
+  try {
+    for (const line of lines(await api("GET", "/cache"))) {
+      cell(tbody.insertRow(), line);
+    }
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+}
+
+async function flushCache(path) {
+  try {
+    showMessage(await api("DELETE", "/cache" + path));
+    loadCache();
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+}
+
+async function loadUpstream() {
+  const tbody = $("upstream-list");
+  tbody.textContent = "";
+  try {
+    for (const line of lines(await api("GET", "/upstream"))) {
+      // "ADDRESS ; STATE fails:N rtt:DURATION"
+      const [addr, status] = line.split(" ; ");
+      const [state, fails, rtt] = status.split(" ");
+      const row = tbody.insertRow();
+      cell(row, addr);
+      cell(row, state, state === "down" ? "down" : "");
+      cell(row, fails.slice("fails:".length));
+      cell(row, rtt.slice("rtt:".length));
+    }
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+}
+
+const loaders = {records: loadRecords, static: loadStatic, cache: loadCache, upstream: loadUpstream};
+
+for (const b of document.querySelectorAll("nav button")) {
+  b.onclick = () => {
+    for (const x of document.querySelectorAll("nav button, section")) {
+      x.classList.remove("active");
+    }
+    b.classList.add("active");
+    $(b.dataset.tab).classList.add("active");
+    showMessage("");
+    loaders[b.dataset.tab]();
+  };
+}
+
+$("search").onsubmit = e => {
+  e.preventDefault();
+  loadRecords();
+};
+
+$("add").onsubmit = async e => {
+  e.preventDefault();
+  try {
+    showMessage(await api("POST", "", $("add-records").value));
+    $("add-records").value = "";
+    loadRecords();
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+};
+
+$("cache-flush").onsubmit = e => {
+  e.preventDefault();
+  flushCache("/name/" + encodeURIComponent($("cache-name").value.trim()));
+};
+$("cache-flush-suffix").onclick = () => flushCache("/suffix/" + suffixPath($("cache-name").value));
+$("cache-flush-all").onclick = () => {
+  if (confirm("flush all cache entries?")) {
+    flushCache("");
+  }
+};
+
+loadRecords();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,425 @@
+package landns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"github.com/miekg/dns"
+)
+
+// BlockResponse is the kind of response for blocked queries.
+type BlockResponse uint8
+
+const (
+	// BlockNXDomain is response NXDOMAIN for blocked queries.
+	BlockNXDomain BlockResponse = iota
+
+	// BlockNull is response "0.0.0.0" for A query and "::" for AAAA query, and empty response for other types.
+	BlockNull
+
+	// BlockRefused is response REFUSED for blocked queries.
+	BlockRefused
+)
+
+const (
+	// DefaultBlockTTL is the default TTL for records of BlockNull response.
+	DefaultBlockTTL uint32 = 60
+
+	// DefaultBlockInterval is the default interval to check update of blocklist files.
+	DefaultBlockInterval = 5 * time.Second
+)
+
+// String is converter to human readable string.
+func (b BlockResponse) String() string {
+	switch b {
+	case BlockNXDomain:
+		return "nxdomain"
+	case BlockNull:
+		return "null"
+	case BlockRefused:
+		return "refused"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalText is parse text to BlockResponse.
+func (b *BlockResponse) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "nxdomain":
+		*b = BlockNXDomain
+	case "null", "0.0.0.0":
+		*b = BlockNull
+	case "refused":
+		*b = BlockRefused
+	default:
+		return newError(TypeArgumentError, nil, "unknown block response: %s", string(text))
+	}
+	return nil
+}
+
+// MarshalText is make bytes text.
+func (b BlockResponse) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// domainSet is set of domains for blocklists.
+type domainSet struct {
+	exact     map[string]bool // Domains that match only itself.
+	subdomain map[string]bool // Domains that match all of subdomains, but not itself.
+}
+
+func newDomainSet() domainSet {
+	return domainSet{
+		exact:     make(map[string]bool),
+		subdomain: make(map[string]bool),
+	}
+}
+
+// Len is get the number of entries.
+func (s domainSet) Len() int {
+	return len(s.exact) + len(s.subdomain)
+}
+
+// Match is check if name is in the set. Name have to be lower case and fully qualified.
+func (s domainSet) Match(name string) bool {
+	if s.exact[name] {
+		return true
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+		if s.subdomain[name] {
+			return true
+		}
+	}
+}
+
+// blocklistIgnoreNames is names in hosts format blocklists that should not be blocked.
+var blocklistIgnoreNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+}
+
+// blocklistParser is parser of domain lists for blocking.
+type blocklistParser struct {
+	block domainSet
+	allow domainSet
+}
+
+func newBlocklistParser() *blocklistParser {
+	return &blocklistParser{
+		block: newDomainSet(),
+		allow: newDomainSet(),
+	}
+}
+
+// blocklistDomain is normalize domain in blocklist. Returns false if invalid.
+func blocklistDomain(s string) (string, bool) {
+	name := Domain(strings.ToLower(s)).Normalized()
+	if name == "." || net.ParseIP(s) != nil || name.Validate() != nil || strings.ContainsAny(s, "*/") {
+		return "", false
+	}
+	return string(name), true
+}
+
+// parseAdblock is parse rule of adblock format like "||ads.example.com^". Rules that can't apply to DNS are ignored.
+func (p *blocklistParser) parseAdblock(line int, text string, allowlist bool) {
+	set := p.block
+	if strings.HasPrefix(text, "@@") {
+		set = p.allow
+		text = text[2:]
+	} else if allowlist {
+		set = p.allow
+	}
+
+	if i := strings.IndexByte(text, '$'); i >= 0 {
+		if text[i+1:] != "important" {
+			logger.Debug("skip adblock rule with options", logger.Fields{"line": line, "rule": text})
+			return
+		}
+		text = text[:i]
+	}
+
+	if !strings.HasPrefix(text, "||") || !strings.HasSuffix(text, "^") {
+		logger.Debug("skip unsupported adblock rule", logger.Fields{"line": line, "rule": text})
+		return
+	}
+
+	name, ok := blocklistDomain(text[2 : len(text)-1])
+	if !ok {
+		logger.Debug("skip invalid domain in adblock rule", logger.Fields{"line": line, "rule": text})
+		return
+	}
+	set.exact[name] = true
+	set.subdomain[name] = true
+}
+
+// Parse is read domain list into the parser.
+//
+// Supported formats are hosts format like "0.0.0.0 ads.example.com", adblock format like "||ads.example.com^", and plain format like "ads.example.com" or "*.ads.example.com".
+// Formats are detected for each lines, so a file can mix them.
+//
+// Adblock rule "||example.com^" matches example.com and all of its subdomains, and plain wildcard "*.example.com" matches only subdomains.
+// Other entries match only the exact name.
+// Adblock exception rules like "@@||example.com^" are added to allowlist. If allowlist is true, all entries are added to allowlist.
+//
+// Entries that can't parse are skipped, because public blocklists often contain rules for web browsers.
+func (p *blocklistParser) Parse(r io.Reader, allowlist bool) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || text[0] == '!' || text[0] == '[' {
+			continue
+		}
+		if strings.Contains(text, "##") || strings.Contains(text, "#@#") || strings.Contains(text, "#?#") {
+			continue
+		}
+		if strings.HasPrefix(text, "||") || strings.HasPrefix(text, "@@") {
+			p.parseAdblock(line, text, allowlist)
+			continue
+		}
+
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		set := p.block
+		if allowlist {
+			set = p.allow
+		}
+
+		if net.ParseIP(fields[0]) != nil {
+			for _, host := range fields[1:] {
+				name, ok := blocklistDomain(host)
+				if !ok || blocklistIgnoreNames[name] {
+					logger.Debug("skip hostname in blocklist", logger.Fields{"line": line, "hostname": host})
+					continue
+				}
+				set.exact[name] = true
+			}
+			continue
+		}
+
+		if len(fields) != 1 {
+			logger.Debug("skip invalid line in blocklist", logger.Fields{"line": line, "text": text})
+			continue
+		}
+
+		wildcard := strings.HasPrefix(fields[0], "*.")
+		name, ok := blocklistDomain(strings.TrimPrefix(fields[0], "*."))
+		if !ok {
+			logger.Debug("skip invalid domain in blocklist", logger.Fields{"line": line, "domain": fields[0]})
+			continue
+		}
+		if wildcard {
+			set.subdomain[name] = true
+		} else {
+			set.exact[name] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Error{TypeExternalError, err, "failed to read blocklist"}
+	}
+	return nil
+}
+
+// BlockResolver is the Resolver that blocks queries for domains in blocklists, that reloads lists when they changed.
+//
+// BlockResolver responds only for blocked queries, so it should be placed before ForwardResolver in AlternateResolver.
+// Domains in allowlists are never blocked even if they are in blocklists.
+//
+// Paths of lists can be directories. All files in the directories except hidden files are read as lists.
+type BlockResolver struct {
+	Blocklists []string
+	Allowlists []string
+	Response   BlockResponse // Response for blocked queries.
+	TTL        uint32        // TTL for records of BlockNull response.
+	Interval   time.Duration // Interval to check update of list files.
+	Clock      Clock         // Source of current time.
+	Metrics    *Metrics      // Metrics collector. Nil means disabled.
+
+	mutex   sync.RWMutex
+	block   domainSet
+	allow   domainSet
+	watcher fileWatcher
+}
+
+// NewBlockResolver is constructor of BlockResolver. Nothing is blocked until Reload or Start called.
+func NewBlockResolver(blocklists, allowlists []string, metrics *Metrics) *BlockResolver {
+	return &BlockResolver{
+		Blocklists: blocklists,
+		Allowlists: allowlists,
+		Response:   BlockNXDomain,
+		TTL:        DefaultBlockTTL,
+		Interval:   DefaultBlockInterval,
+		Clock:      DefaultClock,
+		Metrics:    metrics,
+		block:      newDomainSet(),
+		allow:      newDomainSet(),
+	}
+}
+
+// String is returns simple human readable string.
+func (br *BlockResolver) String() string {
+	return fmt.Sprintf("BlockResolver%s", br.Blocklists)
+}
+
+// files is get paths to list files, and stamp string that changes when any file updated.
+func (br *BlockResolver) files() (blocks, allows []string, stamp string, err error) {
+	blocks, blockStamp, err := listFiles("blocklist", br.Blocklists)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	allows, allowStamp, err := listFiles("allowlist", br.Allowlists)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return blocks, allows, blockStamp + "\n" + allowStamp, nil
+}
+
+// Reload is read list files and replace rules. Rules are kept if failed to read.
+func (br *BlockResolver) Reload() error {
+	blocks, allows, stamp, err := br.files()
+	if err != nil {
+		return err
+	}
+
+	p := newBlocklistParser()
+	for i, path := range append(blocks, allows...) {
+		f, err := os.Open(path)
+		if err != nil {
+			return Error{TypeExternalError, err, "failed to read list file"}
+		}
+		err = p.Parse(f, i >= len(blocks))
+		f.Close()
+		if err != nil {
+			return newError(TypeExternalError, err, "%s", path)
+		}
+	}
+
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	if br.Metrics != nil {
+		br.Metrics.BlocklistSize(p.block.Len() - br.block.Len())
+	}
+	br.block = p.block
+	br.allow = p.allow
+	br.watcher.loaded(stamp)
+	return nil
+}
+
+// stamp is get stamp string that changes when any list file updated.
+func (br *BlockResolver) stamp() (string, error) {
+	_, _, stamp, err := br.files()
+	return stamp, err
+}
+
+// Start is read list files and start watching them in background.
+func (br *BlockResolver) Start() error {
+	if err := br.Reload(); err != nil {
+		return err
+	}
+
+	br.watcher.start(br.Clock, br.Interval, "blocklists", logger.Fields{"blocklists": br.Blocklists, "allowlists": br.Allowlists}, br.stamp, br.Reload)
+	return nil
+}
+
+// Len is get the number of entries in blocklists.
+func (br *BlockResolver) Len() int {
+	br.mutex.RLock()
+	defer br.mutex.RUnlock()
+
+	return br.block.Len()
+}
+
+// IsBlocked is check if the name is blocked.
+func (br *BlockResolver) IsBlocked(name string) bool {
+	name = string(Domain(strings.ToLower(name)).Normalized())
+
+	br.mutex.RLock()
+	defer br.mutex.RUnlock()
+
+	return br.block.Match(name) && !br.allow.Match(name)
+}
+
+// Resolve is response for blocked queries. Queries that not blocked are not responded.
+func (br *BlockResolver) Resolve(w ResponseWriter, r Request) error {
+	return br.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is response for blocked queries. Queries that not blocked are not responded.
+func (br *BlockResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) error {
+	if r.Qclass != dns.ClassINET || !br.IsBlocked(r.Name) {
+		return nil
+	}
+
+	if br.Metrics != nil {
+		br.Metrics.Blocked(r, br.Response)
+	}
+
+	switch br.Response {
+	case BlockRefused:
+		w.SetRcode(dns.RcodeRefused)
+	case BlockNull:
+		name := Domain(r.Name).Normalized()
+		switch r.Qtype {
+		case dns.TypeA:
+			return w.Add(AddressRecord{Name: name, TTL: br.TTL, Address: net.IPv4zero})
+		case dns.TypeAAAA:
+			return w.Add(AddressRecord{Name: name, TTL: br.TTL, Address: net.IPv6zero})
+		default:
+			w.SetRcode(dns.RcodeSuccess)
+		}
+	default:
+		w.SetRcode(dns.RcodeNameError)
+	}
+	return nil
+}
+
+// RecursionAvailable is always returns false.
+func (br *BlockResolver) RecursionAvailable() bool {
+	return false
+}
+
+// Close is stop watching list files.
+func (br *BlockResolver) Close() error {
+	br.watcher.stop()
+
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	if br.Metrics != nil {
+		br.Metrics.BlocklistSize(-br.block.Len())
+	}
+	br.block = newDomainSet()
+	br.allow = newDomainSet()
+	return nil
+}
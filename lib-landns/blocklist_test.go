@@ -0,0 +1,237 @@
+package landns_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestBlockResponse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Text   string
+		Expect landns.BlockResponse
+		String string
+	}{
+		{"nxdomain", landns.BlockNXDomain, "nxdomain"},
+		{"NXDOMAIN", landns.BlockNXDomain, "nxdomain"},
+		{"null", landns.BlockNull, "null"},
+		{"0.0.0.0", landns.BlockNull, "null"},
+		{"refused", landns.BlockRefused, "refused"},
+	}
+
+	for _, tt := range tests {
+		var b landns.BlockResponse
+		if err := b.UnmarshalText([]byte(tt.Text)); err != nil {
+			t.Errorf("%s: failed to parse: %s", tt.Text, err)
+			continue
+		}
+		if b != tt.Expect || b.String() != tt.String {
+			t.Errorf("%s: unexpected result: %s", tt.Text, b)
+		}
+	}
+
+	var b landns.BlockResponse
+	if err := b.UnmarshalText([]byte("drop")); err == nil || err.Error() != "unknown block response: drop" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func makeBlocklists(t *testing.T) (dir string, write func(name, content string)) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "landns-blocklist")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+
+	return dir, func(name, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write list: %s", err)
+		}
+	}
+}
+
+func TestBlockResolver_IsBlocked(t *testing.T) {
+	t.Parallel()
+
+	dir, write := makeBlocklists(t)
+	defer os.RemoveAll(dir)
+
+	write("hosts", `
+# hosts format
+127.0.0.1 localhost
+::1 ip6-localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com tracker.example.com  # trailing comment
+`)
+	write("adblock", `
+[Adblock Plus 2.0]
+! adblock format
+||adblock.example.com^
+||important.example.com^$important
+||third-party.example.com^$third-party
+@@||good.adblock.example.com^
+example.com##.banner
+/banner/*
+`)
+	write("plain", `
+# plain format
+Plain.Example.com
+*.wildcard.example.com
+invalid..name
+two fields
+`)
+	write("allow", `
+allowed.wildcard.example.com
+0.0.0.0 tracker.example.com
+`)
+
+	resolver := landns.NewBlockResolver([]string{filepath.Join(dir, "hosts"), filepath.Join(dir, "adblock"), filepath.Join(dir, "plain")}, []string{filepath.Join(dir, "allow")}, nil)
+	if err := resolver.Reload(); err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	defer resolver.Close()
+
+	tests := []struct {
+		Name   string
+		Expect bool
+	}{
+		{"ads.example.com.", true},
+		{"ADS.example.com", true},
+		{"sub.ads.example.com.", false},
+		{"tracker.example.com.", false},
+		{"localhost.", false},
+		{"ip6-localhost.", false},
+		{"adblock.example.com.", true},
+		{"sub.adblock.example.com.", true},
+		{"good.adblock.example.com.", false},
+		{"sub.good.adblock.example.com.", false},
+		{"important.example.com.", true},
+		{"third-party.example.com.", false},
+		{"plain.example.com.", true},
+		{"sub.plain.example.com.", false},
+		{"wildcard.example.com.", false},
+		{"sub.wildcard.example.com.", true},
+		{"deep.sub.wildcard.example.com.", true},
+		{"allowed.wildcard.example.com.", false},
+		{"example.com.", false},
+	}
+
+	for _, tt := range tests {
+		if got := resolver.IsBlocked(tt.Name); got != tt.Expect {
+			t.Errorf("%s: expected %v but got %v", tt.Name, tt.Expect, got)
+		}
+	}
+
+	if resolver.Len() != 8 {
+		t.Errorf("unexpected number of entries: %d", resolver.Len())
+	}
+}
+
+func TestBlockResolver_Resolve(t *testing.T) {
+	t.Parallel()
+
+	dir, write := makeBlocklists(t)
+	defer os.RemoveAll(dir)
+	write("list", "||ads.example.com^\n")
+
+	metrics := landns.NewMetrics("landns")
+	resolver := landns.NewBlockResolver([]string{dir}, nil, metrics)
+	resolver.TTL = 10
+	if err := resolver.Reload(); err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	defer resolver.Close()
+
+	tests := []struct {
+		Response landns.BlockResponse
+		Qtype    uint16
+		Rcode    int
+		Records  []string
+	}{
+		{landns.BlockNXDomain, dns.TypeA, dns.RcodeNameError, nil},
+		{landns.BlockRefused, dns.TypeA, dns.RcodeRefused, nil},
+		{landns.BlockNull, dns.TypeA, dns.RcodeSuccess, []string{"ads.example.com. 10 IN A 0.0.0.0"}},
+		{landns.BlockNull, dns.TypeAAAA, dns.RcodeSuccess, []string{"ads.example.com. 10 IN AAAA ::"}},
+		{landns.BlockNull, dns.TypeMX, dns.RcodeSuccess, nil},
+	}
+
+	for _, tt := range tests {
+		resolver.Response = tt.Response
+
+		resp := testutil.NewDummyResponseWriter()
+		if err := resolver.Resolve(resp, landns.NewRequest("ads.example.com.", tt.Qtype, false)); err != nil {
+			t.Errorf("%s: failed to resolve: %s", tt.Response, err)
+			continue
+		}
+		if resp.Rcode != tt.Rcode {
+			t.Errorf("%s: unexpected rcode: %s", tt.Response, dns.RcodeToString[resp.Rcode])
+		}
+
+		var records []string
+		for _, r := range resp.Records {
+			records = append(records, r.String())
+		}
+		if strings.Join(records, "\n") != strings.Join(tt.Records, "\n") {
+			t.Errorf("%s: unexpected records: %s", tt.Response, records)
+		}
+	}
+
+	// Not blocked queries are not responded, so AlternateResolver uses the next resolver.
+	upstream := testutil.ResponseResolver{Answer: []landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 100, Address: []byte{192, 168, 1, 1}},
+	}}
+	AssertResolve(t, landns.AlternateResolver{resolver, upstream}, landns.NewRequest("example.com.", dns.TypeA, false), true, "example.com. 100 IN A 192.168.1.1")
+	resolver.Response = landns.BlockNull
+	AssertResolve(t, landns.AlternateResolver{resolver, upstream}, landns.NewRequest("ads.example.com.", dns.TypeA, false), true, "ads.example.com. 10 IN A 0.0.0.0")
+}
+
+func TestBlockResolver_Reload(t *testing.T) {
+	t.Parallel()
+
+	dir, write := makeBlocklists(t)
+	defer os.RemoveAll(dir)
+	write("list", "ads.example.com\n")
+
+	clock := testutil.NewFakeClock()
+	resolver := landns.NewBlockResolver([]string{dir}, nil, nil)
+	resolver.Clock = clock
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer resolver.Close()
+
+	if !resolver.IsBlocked("ads.example.com.") || resolver.IsBlocked("tracker.example.com.") {
+		t.Fatalf("unexpected initial state")
+	}
+
+	write("another", "tracker.example.com\n")
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Add(landns.DefaultBlockInterval)
+
+	for i := 0; i < 100 && !resolver.IsBlocked("tracker.example.com."); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !resolver.IsBlocked("tracker.example.com.") {
+		t.Errorf("blocklists was not reloaded")
+	}
+
+	if err := landns.NewBlockResolver([]string{filepath.Join(dir, "not-exists")}, nil, nil).Start(); err == nil || !strings.HasPrefix(err.Error(), "failed to read blocklist file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := landns.NewBlockResolver(nil, []string{filepath.Join(dir, "not-exists")}, nil).Start(); err == nil || !strings.HasPrefix(err.Error(), "failed to read allowlist file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package landns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheEntry is a cached response for inspection.
+type CacheEntry struct {
+	Name     Domain
+	Qtype    uint16        // dns.TypeNone if the entry is NXDOMAIN.
+	Negative bool          // true if the entry is NXDOMAIN or NODATA.
+	Rcode    int           // Response code of negative entry.
+	Records  []Record      // Cached records with remaining TTL, or SOA record if Negative.
+	TTL      time.Duration // Remaining TTL. Negative value means the entry is stale.
+}
+
+// String is make human readable string of the entry.
+//
+// Positive entry will be records that has remaining TTL, and negative entry will be comment line.
+func (e CacheEntry) String() string {
+	ttl := int64(e.TTL.Round(time.Second).Seconds())
+	stale := ""
+	if e.TTL < 1 {
+		stale = " Stale"
+	}
+
+	if e.Negative {
+		if e.Rcode == dns.RcodeNameError {
+			return fmt.Sprintf("; NXDOMAIN %s ; TTL:%d%s", e.Name, ttl, stale)
+		}
+		return fmt.Sprintf("; NODATA %s %s ; TTL:%d%s", e.Name, dns.TypeToString[e.Qtype], ttl, stale)
+	}
+
+	lines := make([]string, len(e.Records))
+	for i, r := range e.Records {
+		lines[i] = r.String()
+		if stale != "" {
+			lines[i] += " ;" + stale
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// newCacheEntry is make positive CacheEntry from VolatileRecords.
+//
+// TTL of records in result will be 0 if already expired.
+func newCacheEntry(name Domain, qtype uint16, records []VolatileRecord, now time.Time) (CacheEntry, error) {
+	entry := CacheEntry{
+		Name:    name,
+		Qtype:   qtype,
+		Records: make([]Record, len(records)),
+	}
+
+	for i, r := range records {
+		rr := dns.Copy(r.RR)
+		rr.Header().Ttl = remainingTTL(r.Expire, now)
+
+		rec, err := NewRecordFromRR(rr)
+		if err != nil {
+			return CacheEntry{}, err
+		}
+		entry.Records[i] = rec
+
+		if delta := r.Expire.Sub(now); i == 0 || delta < entry.TTL {
+			entry.TTL = delta
+		}
+	}
+
+	return entry, nil
+}
+
+// newNegativeCacheEntry is make negative CacheEntry from SOA record.
+func newNegativeCacheEntry(name Domain, qtype uint16, rcode int, soa VolatileRecord, now time.Time) (CacheEntry, error) {
+	entry, err := newCacheEntry(name, qtype, []VolatileRecord{soa}, now)
+	entry.Negative = true
+	entry.Rcode = rcode
+	return entry, err
+}
+
+// Cache is the interface of Resolver that caches responses from upstream.
+type Cache interface {
+	Resolver
+
+	Entries() ([]CacheEntry, error)         // Get all entries in the cache.
+	Flush(name Domain) (int, error)         // Remove entries for the name. Returns the number of removed entries.
+	FlushSuffix(suffix Domain) (int, error) // Remove entries for the suffix and its subdomains. Returns the number of removed entries.
+	FlushAll() (int, error)                 // Remove all entries. Returns the number of removed entries.
+}
+
+// matchCacheName is check name is the target.
+func matchCacheName(name, target Domain) bool {
+	return strings.EqualFold(name.String(), target.String())
+}
+
+// matchCacheSuffix is check name is the suffix or subdomain of suffix.
+func matchCacheSuffix(name, suffix Domain) bool {
+	return dns.IsSubDomain(suffix.String(), name.String())
+}
+
+// CacheSet is a set of Cache for inspect and flush all caches at once.
+type CacheSet []Cache
+
+// Entries is get all entries in all caches.
+func (cs CacheSet) Entries() ([]CacheEntry, error) {
+	var entries []CacheEntry
+	for _, c := range cs {
+		es, err := c.Entries()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, es...)
+	}
+	return entries, nil
+}
+
+func (cs CacheSet) flush(fn func(Cache) (int, error)) (int, error) {
+	total := 0
+	for _, c := range cs {
+		n, err := fn(c)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Flush is remove entries for the name from all caches.
+func (cs CacheSet) Flush(name Domain) (int, error) {
+	return cs.flush(func(c Cache) (int, error) {
+		return c.Flush(name)
+	})
+}
+
+// FlushSuffix is remove entries for the suffix and its subdomains from all caches.
+func (cs CacheSet) FlushSuffix(suffix Domain) (int, error) {
+	return cs.flush(func(c Cache) (int, error) {
+		return c.FlushSuffix(suffix)
+	})
+}
+
+// FlushAll is remove all entries from all caches.
+func (cs CacheSet) FlushAll() (int, error) {
+	return cs.flush(func(c Cache) (int, error) {
+		return c.FlushAll()
+	})
+}
@@ -1,11 +1,18 @@
 package landns_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
 	"github.com/miekg/dns"
 )
 
@@ -32,29 +39,654 @@ func CacheTestUpstream(t testing.TB) landns.Resolver {
 var (
 	CacheTests = []struct {
 		Name   string
-		Tester func(t testing.TB, resolver landns.Resolver)
+		Tester func(t testing.TB, resolver landns.Resolver, clock *testutil.FakeClock)
 	}{
-		{"multiTTL", func(t testing.TB, resolver landns.Resolver) {
+		{"multiTTL", func(t testing.TB, resolver landns.Resolver, clock *testutil.FakeClock) {
 			AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, false), true, "example.com. 100 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
-			time.Sleep(500 * time.Millisecond)
-			AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, false), false, "example.com. 99 IN A 127.1.2.3", "example.com. 9 IN A 127.2.3.4")
+			clock.Add(1 * time.Second)
+			AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, false), false, "example.com. 9 IN A 127.1.2.3", "example.com. 9 IN A 127.2.3.4")
 		}},
-		{"shortTTL", func(t testing.TB, resolver landns.Resolver) {
+		{"shortTTL", func(t testing.TB, resolver landns.Resolver, clock *testutil.FakeClock) {
 			AssertResolve(t, resolver, landns.NewRequest("short.example.com.", dns.TypeA, false), true, "short.example.com. 10 IN A 127.3.4.5", "short.example.com. 2 IN A 127.4.5.6")
-			time.Sleep(500 * time.Millisecond)
-			AssertResolve(t, resolver, landns.NewRequest("short.example.com.", dns.TypeA, false), false, "short.example.com. 9 IN A 127.3.4.5", "short.example.com. 1 IN A 127.4.5.6")
-			time.Sleep(1700 * time.Millisecond)
+			clock.Add(1 * time.Second)
+			AssertResolve(t, resolver, landns.NewRequest("short.example.com.", dns.TypeA, false), false, "short.example.com. 1 IN A 127.3.4.5", "short.example.com. 1 IN A 127.4.5.6")
+			clock.Add(1 * time.Second)
 			AssertResolve(t, resolver, landns.NewRequest("short.example.com.", dns.TypeA, false), true, "short.example.com. 10 IN A 127.3.4.5", "short.example.com. 2 IN A 127.4.5.6")
 		}},
-		{"noCache", func(t testing.TB, resolver landns.Resolver) {
+		{"noCache", func(t testing.TB, resolver landns.Resolver, clock *testutil.FakeClock) {
 			AssertResolve(t, resolver, landns.NewRequest("no-cache.example.com.", dns.TypeA, false), true, "no-cache.example.com. 0 IN A 127.5.6.7")
 			AssertResolve(t, resolver, landns.NewRequest("no-cache.example.com.", dns.TypeA, false), true, "no-cache.example.com. 0 IN A 127.5.6.7")
 		}},
-		{"txtType", func(t testing.TB, resolver landns.Resolver) {
+		{"txtType", func(t testing.TB, resolver landns.Resolver, clock *testutil.FakeClock) {
 			AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeTXT, false), true, "example.com. 100 IN TXT \"hello world\"")
-			time.Sleep(500 * time.Millisecond)
+			clock.Add(1 * time.Second)
 			AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeTXT, false), false, "example.com. 99 IN TXT \"hello world\"")
 		}},
-		{"parallel", ParallelResolveTest},
+		{"parallel", func(t testing.TB, resolver landns.Resolver, clock *testutil.FakeClock) {
+			ParallelResolveTest(t, resolver)
+		}},
+	}
+)
+
+// NegativeCacheTestUpstream is upstream resolver that returns negative responses for NegativeCacheTests.
+type NegativeCacheTestUpstream struct {
+	mutex sync.Mutex
+	count int
+}
+
+func (u *NegativeCacheTestUpstream) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	u.mutex.Lock()
+	u.count++
+	u.mutex.Unlock()
+
+	soa := landns.SoaRecord{Name: "example.com.", TTL: 60, Ns: "ns.example.com.", Mbox: "root.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minttl: 1}
+
+	switch r.Name {
+	case "nxdomain.example.com.":
+		w.SetRcode(dns.RcodeNameError)
+		return w.AddAuthority(soa)
+	case "nodata.example.com.":
+		if r.Qtype == dns.TypeA {
+			return w.Add(landns.AddressRecord{Name: "nodata.example.com.", TTL: 100, Address: net.ParseIP("127.1.2.3")})
+		}
+		return w.AddAuthority(soa)
+	case "no-soa.example.com.":
+		w.SetRcode(dns.RcodeNameError)
+	case "servfail.example.com.":
+		w.SetRcode(dns.RcodeServerFailure)
+		return w.AddAuthority(soa)
+	}
+	return nil
+}
+
+func (u *NegativeCacheTestUpstream) RecursionAvailable() bool {
+	return true
+}
+
+func (u *NegativeCacheTestUpstream) Close() error {
+	return nil
+}
+
+// Count is getter to the number of queries that upstream received.
+func (u *NegativeCacheTestUpstream) Count() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.count
+}
+
+func (u *NegativeCacheTestUpstream) AssertCount(t testing.TB, expect int) {
+	t.Helper()
+
+	if count := u.Count(); count != expect {
+		t.Errorf("unexpected upstream query count: expected %d but got %d", expect, count)
+	}
+}
+
+func AssertNegativeResolve(t testing.TB, resolver landns.Resolver, request landns.Request, rcode int, soaTTL uint32) {
+	t.Helper()
+
+	resp := testutil.NewDummyResponseWriter()
+	if err := resolver.Resolve(resp, request); err != nil {
+		t.Errorf("%s <- %s: failed to resolve: %s", resolver, request, err)
+		return
+	}
+
+	if resp.Rcode != rcode {
+		t.Errorf("%s <- %s: unexpected rcode: expected %s but got %s", resolver, request, dns.RcodeToString[rcode], dns.RcodeToString[resp.Rcode])
+	}
+	if len(resp.Records) != 0 {
+		t.Errorf("%s <- %s: unexpected answer: %s", resolver, request, resp.Records)
+	}
+	if len(resp.Authority) != 1 {
+		t.Errorf("%s <- %s: unexpected authority: %s", resolver, request, resp.Authority)
+	} else if soa, ok := resp.Authority[0].(landns.SoaRecord); !ok {
+		t.Errorf("%s <- %s: unexpected authority: %s", resolver, request, resp.Authority)
+	} else if soa.TTL != soaTTL {
+		t.Errorf("%s <- %s: unexpected TTL of SOA: expected %d but got %d", resolver, request, soaTTL, soa.TTL)
+	}
+}
+
+// NegativeCacheFactory is constructor of cache for NegativeCacheTests.
+type NegativeCacheFactory func(t testing.TB, upstream landns.Resolver, clock landns.Clock, minTTL, maxTTL time.Duration) landns.Resolver
+
+var (
+	NegativeCacheTests = []struct {
+		Name   string
+		Tester func(t testing.TB, makeCache NegativeCacheFactory)
+	}{
+		{"nxdomain", func(t testing.TB, makeCache NegativeCacheFactory) {
+			upstream := &NegativeCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, landns.DefaultNegativeMinTTL, landns.DefaultNegativeMaxTTL)
+			defer resolver.Close()
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 60)
+			upstream.AssertCount(t, 1)
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 1)
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeAAAA, true), dns.RcodeNameError, 1)
+			upstream.AssertCount(t, 1)
+
+			clock.Add(1 * time.Second)
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 60)
+			upstream.AssertCount(t, 2)
+		}},
+		{"nodata", func(t testing.TB, makeCache NegativeCacheFactory) {
+			upstream := &NegativeCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, landns.DefaultNegativeMinTTL, landns.DefaultNegativeMaxTTL)
+			defer resolver.Close()
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nodata.example.com.", dns.TypeAAAA, true), dns.RcodeSuccess, 60)
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nodata.example.com.", dns.TypeAAAA, true), dns.RcodeSuccess, 1)
+			upstream.AssertCount(t, 1)
+
+			AssertResolve(t, resolver, landns.NewRequest("nodata.example.com.", dns.TypeA, true), true, "nodata.example.com. 100 IN A 127.1.2.3")
+			upstream.AssertCount(t, 2)
+		}},
+		{"notCacheable", func(t testing.TB, makeCache NegativeCacheFactory) {
+			upstream := &NegativeCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, landns.DefaultNegativeMinTTL, landns.DefaultNegativeMaxTTL)
+			defer resolver.Close()
+
+			for i := 0; i < 2; i++ {
+				resp := testutil.NewDummyResponseWriter()
+				if err := resolver.Resolve(resp, landns.NewRequest("no-soa.example.com.", dns.TypeA, true)); err != nil {
+					t.Errorf("failed to resolve: %s", err)
+				} else if resp.Rcode != dns.RcodeNameError {
+					t.Errorf("unexpected rcode: %s", dns.RcodeToString[resp.Rcode])
+				}
+			}
+			upstream.AssertCount(t, 2)
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("servfail.example.com.", dns.TypeA, true), dns.RcodeServerFailure, 60)
+			AssertNegativeResolve(t, resolver, landns.NewRequest("servfail.example.com.", dns.TypeA, true), dns.RcodeServerFailure, 60)
+			upstream.AssertCount(t, 4)
+		}},
+		{"floor", func(t testing.TB, makeCache NegativeCacheFactory) {
+			upstream := &NegativeCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, 10*time.Second, landns.DefaultNegativeMaxTTL)
+			defer resolver.Close()
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 60)
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 10)
+			clock.Add(1 * time.Second)
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 9)
+			upstream.AssertCount(t, 1)
+		}},
+		{"ceiling", func(t testing.TB, makeCache NegativeCacheFactory) {
+			upstream := &NegativeCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, 30*time.Second, 5*time.Second)
+			defer resolver.Close()
+
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 60)
+			AssertNegativeResolve(t, resolver, landns.NewRequest("nxdomain.example.com.", dns.TypeA, true), dns.RcodeNameError, 5)
+			upstream.AssertCount(t, 1)
+		}},
+	}
+)
+
+// StaleCacheTestUpstream is upstream resolver for StaleCacheTests.
+//
+// StaleCacheTestUpstream returns stale.example.com. with the address that set by Set, or returns error if failing.
+type StaleCacheTestUpstream struct {
+	mutex   sync.Mutex
+	address net.IP
+	failing bool
+}
+
+func (u *StaleCacheTestUpstream) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.failing {
+		return fmt.Errorf("upstream is failing")
+	}
+
+	address := u.address
+	if address == nil {
+		address = net.ParseIP("127.0.0.1")
+	}
+
+	return w.Add(landns.AddressRecord{Name: "stale.example.com.", TTL: 2, Address: address})
+}
+
+func (u *StaleCacheTestUpstream) RecursionAvailable() bool {
+	return true
+}
+
+func (u *StaleCacheTestUpstream) Close() error {
+	return nil
+}
+
+// Set is setter to the address for response and whether upstream is failing or not.
+func (u *StaleCacheTestUpstream) Set(address string, failing bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.address = net.ParseIP(address)
+	u.failing = failing
+}
+
+// StaleCacheFactory is constructor of cache for StaleCacheTests.
+type StaleCacheFactory func(t testing.TB, upstream landns.Resolver, clock landns.Clock, prefetch, staleTTL time.Duration) landns.Resolver
+
+var (
+	StaleCacheTests = []struct {
+		Name   string
+		Tester func(t testing.TB, makeCache StaleCacheFactory)
+	}{
+		{"prefetch", func(t testing.TB, makeCache StaleCacheFactory) {
+			upstream := &StaleCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, 1500*time.Millisecond, 0)
+			defer resolver.Close()
+
+			req := landns.NewRequest("stale.example.com.", dns.TypeA, true)
+
+			AssertResolve(t, resolver, req, true, "stale.example.com. 2 IN A 127.0.0.1")
+			upstream.Set("127.0.0.2", false)
+			AssertResolve(t, resolver, req, false, "stale.example.com. 2 IN A 127.0.0.1")
+
+			clock.Add(600 * time.Millisecond)
+			AssertResolve(t, resolver, req, false, "stale.example.com. 1 IN A 127.0.0.1")
+
+			time.Sleep(100 * time.Millisecond)
+			AssertResolve(t, resolver, req, false, "stale.example.com. 2 IN A 127.0.0.2")
+		}},
+		{"serveStale", func(t testing.TB, makeCache StaleCacheFactory) {
+			upstream := &StaleCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, 0, 10*time.Second)
+			defer resolver.Close()
+
+			req := landns.NewRequest("stale.example.com.", dns.TypeA, true)
+
+			AssertResolve(t, resolver, req, true, "stale.example.com. 2 IN A 127.0.0.1")
+
+			upstream.Set("127.0.0.2", true)
+			clock.Add(3 * time.Second)
+
+			AssertResolve(t, resolver, req, false, fmt.Sprintf("stale.example.com. %d IN A 127.0.0.1", landns.StaleAnswerTTL))
+			time.Sleep(100 * time.Millisecond)
+			AssertResolve(t, resolver, req, false, fmt.Sprintf("stale.example.com. %d IN A 127.0.0.1", landns.StaleAnswerTTL))
+			time.Sleep(100 * time.Millisecond)
+
+			upstream.Set("127.0.0.2", false)
+
+			AssertResolve(t, resolver, req, false, fmt.Sprintf("stale.example.com. %d IN A 127.0.0.1", landns.StaleAnswerTTL))
+			time.Sleep(100 * time.Millisecond)
+			AssertResolve(t, resolver, req, false, "stale.example.com. 2 IN A 127.0.0.2")
+		}},
+		{"staleExpired", func(t testing.TB, makeCache StaleCacheFactory) {
+			upstream := &StaleCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, 0, 1*time.Second)
+			defer resolver.Close()
+
+			req := landns.NewRequest("stale.example.com.", dns.TypeA, true)
+
+			AssertResolve(t, resolver, req, true, "stale.example.com. 2 IN A 127.0.0.1")
+
+			upstream.Set("127.0.0.2", true)
+			clock.Add(3 * time.Second)
+
+			if err := resolver.Resolve(testutil.NewDummyResponseWriter(), req); err == nil {
+				t.Errorf("expected error but got nil")
+			}
+		}},
+		{"disabled", func(t testing.TB, makeCache StaleCacheFactory) {
+			upstream := &StaleCacheTestUpstream{}
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, upstream, clock, 0, 0)
+			defer resolver.Close()
+
+			req := landns.NewRequest("stale.example.com.", dns.TypeA, true)
+
+			AssertResolve(t, resolver, req, true, "stale.example.com. 2 IN A 127.0.0.1")
+
+			upstream.Set("127.0.0.2", true)
+			clock.Add(3 * time.Second)
+
+			if err := resolver.Resolve(testutil.NewDummyResponseWriter(), req); err == nil {
+				t.Errorf("expected error but got nil")
+			}
+		}},
+	}
+)
+
+// TTLCacheFactory is constructor of cache for TTLCacheTests.
+type TTLCacheFactory func(t testing.TB, upstream landns.Resolver, clock landns.Clock) landns.Resolver
+
+var (
+	TTLCacheTests = []struct {
+		Name   string
+		Tester func(t testing.TB, makeCache TTLCacheFactory)
+	}{
+		{"decay", func(t testing.TB, makeCache TTLCacheFactory) {
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, CacheTestUpstream(t), clock)
+			defer resolver.Close()
+
+			req := landns.NewRequest("example.com.", dns.TypeA, false)
+
+			AssertResolve(t, resolver, req, true, "example.com. 100 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
+			AssertResolve(t, resolver, req, false, "example.com. 10 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
+
+			clock.Add(3 * time.Second)
+			AssertResolve(t, resolver, req, false, "example.com. 7 IN A 127.1.2.3", "example.com. 7 IN A 127.2.3.4")
+
+			clock.Add(6 * time.Second)
+			AssertResolve(t, resolver, req, false, "example.com. 1 IN A 127.1.2.3", "example.com. 1 IN A 127.2.3.4")
+
+			clock.Add(1500 * time.Millisecond)
+			AssertResolve(t, resolver, req, true, "example.com. 100 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
+		}},
+		{"independentExpiry", func(t testing.TB, makeCache TTLCacheFactory) {
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, CacheTestUpstream(t), clock)
+			defer resolver.Close()
+
+			a := landns.NewRequest("example.com.", dns.TypeA, false)
+			txt := landns.NewRequest("example.com.", dns.TypeTXT, false)
+
+			AssertResolve(t, resolver, a, true, "example.com. 100 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
+
+			clock.Add(5 * time.Second)
+			AssertResolve(t, resolver, txt, true, `example.com. 100 IN TXT "hello world"`)
+
+			clock.Add(3 * time.Second)
+			AssertResolve(t, resolver, a, false, "example.com. 2 IN A 127.1.2.3", "example.com. 2 IN A 127.2.3.4")
+			AssertResolve(t, resolver, txt, false, `example.com. 97 IN TXT "hello world"`)
+
+			clock.Add(3 * time.Second)
+			AssertResolve(t, resolver, a, true, "example.com. 100 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
+			AssertResolve(t, resolver, txt, false, `example.com. 94 IN TXT "hello world"`)
+		}},
+		{"noReset", func(t testing.TB, makeCache TTLCacheFactory) {
+			clock := testutil.NewFakeClock()
+			resolver := makeCache(t, CacheTestUpstream(t), clock)
+			defer resolver.Close()
+
+			req := landns.NewRequest("example.com.", dns.TypeTXT, false)
+
+			AssertResolve(t, resolver, req, true, `example.com. 100 IN TXT "hello world"`)
+			for i := 1; i <= 5; i++ {
+				clock.Add(10 * time.Second)
+				AssertResolve(t, resolver, req, false, fmt.Sprintf(`example.com. %d IN TXT "hello world"`, 100-i*10))
+				AssertResolve(t, resolver, req, false, fmt.Sprintf(`example.com. %d IN TXT "hello world"`, 100-i*10))
+			}
+		}},
 	}
 )
+
+// CoalesceCacheTestUpstream is upstream resolver for CoalesceCacheTests.
+//
+// CoalesceCacheTestUpstream returns 127.0.0.1 for any name, but queries for slow.example.com. blocks until Release called or the context of request done.
+type CoalesceCacheTestUpstream struct {
+	mutex   sync.Mutex
+	counts  map[string]int
+	started chan struct{}
+	release chan struct{}
+}
+
+func NewCoalesceCacheTestUpstream() *CoalesceCacheTestUpstream {
+	return &CoalesceCacheTestUpstream{
+		counts:  make(map[string]int),
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (u *CoalesceCacheTestUpstream) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	u.mutex.Lock()
+	u.counts[r.Name]++
+	u.mutex.Unlock()
+
+	if r.Name == "slow.example.com." {
+		u.started <- struct{}{}
+		select {
+		case <-u.release:
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+
+	return w.Add(landns.AddressRecord{Name: landns.Domain(r.Name), TTL: 100, Address: net.ParseIP("127.0.0.1")})
+}
+
+func (u *CoalesceCacheTestUpstream) RecursionAvailable() bool {
+	return true
+}
+
+func (u *CoalesceCacheTestUpstream) Close() error {
+	return nil
+}
+
+// Release is unblock queries for slow.example.com.
+func (u *CoalesceCacheTestUpstream) Release() {
+	close(u.release)
+}
+
+// WaitStarted is wait until upstream receives query for slow.example.com.
+func (u *CoalesceCacheTestUpstream) WaitStarted(t testing.TB) {
+	t.Helper()
+
+	select {
+	case <-u.started:
+	case <-time.After(time.Second):
+		t.Fatalf("upstream didn't receive query")
+	}
+}
+
+func (u *CoalesceCacheTestUpstream) AssertCount(t testing.TB, name string, expect int) {
+	t.Helper()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if count := u.counts[name]; count != expect {
+		t.Errorf("unexpected upstream query count for %s: expected %d but got %d", name, expect, count)
+	}
+}
+
+// CoalesceCacheFactory is constructor of cache for CoalesceCacheTests.
+type CoalesceCacheFactory func(t testing.TB, upstream landns.Resolver) landns.Resolver
+
+var (
+	CoalesceCacheTests = []struct {
+		Name   string
+		Tester func(t testing.TB, makeCache CoalesceCacheFactory)
+	}{
+		{"sameQuestion", func(t testing.TB, makeCache CoalesceCacheFactory) {
+			upstream := NewCoalesceCacheTestUpstream()
+			resolver := makeCache(t, upstream)
+			defer resolver.Close()
+
+			req := landns.NewRequest("slow.example.com.", dns.TypeA, true)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					resp := testutil.NewDummyResponseWriter()
+					if err := resolver.Resolve(resp, req); err != nil {
+						t.Errorf("failed to resolve: %s", err)
+					} else if len(resp.Records) != 1 || resp.Records[0].String() != "slow.example.com. 100 IN A 127.0.0.1" {
+						t.Errorf("unexpected response: %v", resp.Records)
+					}
+				}()
+			}
+
+			upstream.WaitStarted(t)
+			time.Sleep(50 * time.Millisecond) // wait for other queries
+			upstream.Release()
+			wg.Wait()
+
+			upstream.AssertCount(t, "slow.example.com.", 1)
+		}},
+		{"otherQuestion", func(t testing.TB, makeCache CoalesceCacheFactory) {
+			upstream := NewCoalesceCacheTestUpstream()
+			resolver := makeCache(t, upstream)
+			defer resolver.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				AssertResolve(t, resolver, landns.NewRequest("slow.example.com.", dns.TypeA, true), true, "slow.example.com. 100 IN A 127.0.0.1")
+			}()
+			upstream.WaitStarted(t)
+
+			fast := make(chan struct{})
+			go func() {
+				defer close(fast)
+				req := landns.NewRequest("fast.example.com.", dns.TypeA, true)
+				AssertResolve(t, resolver, req, true, "fast.example.com. 100 IN A 127.0.0.1")
+				AssertResolve(t, resolver, req, false, "fast.example.com. 100 IN A 127.0.0.1")
+			}()
+
+			select {
+			case <-fast:
+			case <-time.After(time.Second):
+				t.Errorf("query for other question was blocked by in-flight query")
+			}
+
+			upstream.Release()
+			<-done
+			<-fast
+
+			upstream.AssertCount(t, "slow.example.com.", 1)
+			upstream.AssertCount(t, "fast.example.com.", 1)
+		}},
+		{"cancelledLeader", func(t testing.TB, makeCache CoalesceCacheFactory) {
+			upstream := NewCoalesceCacheTestUpstream()
+			resolver := makeCache(t, upstream)
+			defer resolver.Close()
+
+			req := landns.NewRequest("slow.example.com.", dns.TypeA, true)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			leader := make(chan struct{})
+			go func() {
+				defer close(leader)
+				if err := landns.ResolveContext(ctx, resolver, testutil.NewDummyResponseWriter(), req); !errors.Is(err, context.Canceled) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+			upstream.WaitStarted(t)
+
+			follower := make(chan struct{})
+			go func() {
+				defer close(follower)
+				AssertResolve(t, resolver, req, true, "slow.example.com. 100 IN A 127.0.0.1")
+			}()
+			time.Sleep(50 * time.Millisecond) // wait for follower
+
+			cancel()
+			<-leader
+
+			upstream.WaitStarted(t)
+			upstream.Release()
+			<-follower
+
+			upstream.AssertCount(t, "slow.example.com.", 2)
+		}},
+		{"cancelledFollower", func(t testing.TB, makeCache CoalesceCacheFactory) {
+			upstream := NewCoalesceCacheTestUpstream()
+			resolver := makeCache(t, upstream)
+			defer resolver.Close()
+
+			req := landns.NewRequest("slow.example.com.", dns.TypeA, true)
+
+			leader := make(chan struct{})
+			go func() {
+				defer close(leader)
+				AssertResolve(t, resolver, req, true, "slow.example.com. 100 IN A 127.0.0.1")
+			}()
+			upstream.WaitStarted(t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if err := landns.ResolveContext(ctx, resolver, testutil.NewDummyResponseWriter(), req); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			upstream.Release()
+			<-leader
+
+			upstream.AssertCount(t, "slow.example.com.", 1)
+		}},
+	}
+)
+
+// InspectCacheTest is test for inspection and flush of landns.Cache.
+func InspectCacheTest(t testing.TB, cache landns.Cache) {
+	resolve := func(name string, qtype uint16) {
+		t.Helper()
+
+		if err := cache.Resolve(testutil.NewDummyResponseWriter(), landns.NewRequest(name, qtype, false)); err != nil {
+			t.Fatalf("failed to resolve: %s", err)
+		}
+	}
+	assertEntries := func(expect ...string) {
+		t.Helper()
+
+		entries, err := cache.Entries()
+		if err != nil {
+			t.Fatalf("failed to get entries: %s", err)
+		}
+
+		got := make([]string, len(entries))
+		for i, e := range entries {
+			got[i] = e.String()
+		}
+		sort.Strings(got)
+		sort.Strings(expect)
+
+		if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+			t.Errorf("unexpected entries:\nexpected:\n%s\nbut got:\n%s", strings.Join(expect, "\n"), strings.Join(got, "\n"))
+		}
+	}
+	assertFlush := func(expect int, n int, err error) {
+		t.Helper()
+
+		if err != nil {
+			t.Errorf("failed to flush: %s", err)
+		} else if n != expect {
+			t.Errorf("unexpected number of flushed entries: expected %d but got %d", expect, n)
+		}
+	}
+
+	resolve("example.com.", dns.TypeA)
+	resolve("example.com.", dns.TypeTXT)
+	resolve("short.example.com.", dns.TypeA)
+
+	assertEntries(
+		"example.com. 10 IN A 127.1.2.3\nexample.com. 10 IN A 127.2.3.4",
+		`example.com. 100 IN TXT "hello world"`,
+		"short.example.com. 2 IN A 127.3.4.5\nshort.example.com. 2 IN A 127.4.5.6",
+	)
+
+	n, err := cache.Flush("short.example.com")
+	assertFlush(1, n, err)
+	assertEntries(
+		"example.com. 10 IN A 127.1.2.3\nexample.com. 10 IN A 127.2.3.4",
+		`example.com. 100 IN TXT "hello world"`,
+	)
+
+	n, err = cache.FlushSuffix("com.")
+	assertFlush(2, n, err)
+	assertEntries()
+
+	resolve("example.com.", dns.TypeA)
+	n, err = cache.FlushAll()
+	assertFlush(1, n, err)
+	assertEntries()
+}
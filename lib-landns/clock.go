@@ -0,0 +1,32 @@
+package landns
+
+import (
+	"time"
+)
+
+// Clock is the source of current time and timers.
+//
+// Every time-dependent component has a Clock field that defaults to DefaultClock, so tests can replace it with fake clock.
+type Clock interface {
+	// Now is getter to current time.
+	Now() time.Time
+
+	// After is make channel that receives current time after duration d.
+	After(d time.Duration) <-chan time.Time
+}
+
+// WallClock is Clock that uses the real time.
+type WallClock struct{}
+
+// Now is getter to current time.
+func (c WallClock) Now() time.Time {
+	return time.Now()
+}
+
+// After is the same as time.After.
+func (c WallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// DefaultClock is the Clock that used if not specified.
+var DefaultClock Clock = WallClock{}
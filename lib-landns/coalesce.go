@@ -0,0 +1,149 @@
+package landns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// responseRecorder is ResponseWriter that records response for replaying into other ResponseWriters.
+type responseRecorder struct {
+	records       []Record
+	authority     []Record
+	additional    []Record
+	authoritative bool
+	rcode         int
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{authoritative: true, rcode: dns.RcodeSuccess}
+}
+
+func (rr *responseRecorder) Add(r Record) error {
+	rr.records = append(rr.records, r)
+	return nil
+}
+
+func (rr *responseRecorder) AddAuthority(r Record) error {
+	rr.authority = append(rr.authority, r)
+	return nil
+}
+
+func (rr *responseRecorder) AddAdditional(r Record) error {
+	rr.additional = append(rr.additional, r)
+	return nil
+}
+
+func (rr *responseRecorder) IsAuthoritative() bool {
+	return rr.authoritative
+}
+
+func (rr *responseRecorder) SetNoAuthoritative() {
+	rr.authoritative = false
+}
+
+func (rr *responseRecorder) SetRcode(rcode int) {
+	rr.rcode = rcode
+}
+
+// Replay is write recorded response into ResponseWriter.
+func (rr *responseRecorder) Replay(w ResponseWriter) error {
+	if !rr.authoritative {
+		w.SetNoAuthoritative()
+	}
+	if rr.rcode != dns.RcodeSuccess {
+		w.SetRcode(rr.rcode)
+	}
+
+	for _, r := range rr.records {
+		if err := w.Add(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range rr.authority {
+		if err := w.AddAuthority(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range rr.additional {
+		if err := w.AddAdditional(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type flight struct {
+	done      chan struct{}
+	resp      *responseRecorder
+	err       error
+	cancelled bool // true if the context of the caller was done while calling.
+}
+
+// flightGroup is coalescer of concurrent requests that have the same key, like singleflight.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// flightKey is make key of flightGroup for the request.
+func flightKey(r Request) string {
+	return fmt.Sprintf("%d:%s:%v", r.Qtype, dns.CanonicalName(r.Name), r.RecursionDesired)
+}
+
+// Do is call fn and write the response into w.
+//
+// If there is another in-flight call with the same key, Do waits for it and writes the same response instead of calling fn.
+// The shared is true if the response was made by another call.
+//
+// ctx is the context of the caller that fn uses. Waiting for another call will be stopped if ctx is done.
+// If another call failed because its context was done, Do retries by itself instead of sharing the error.
+func (g *flightGroup) Do(ctx context.Context, w ResponseWriter, key string, fn func(ResponseWriter) error) (shared bool, err error) {
+	g.mutex.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mutex.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return true, Error{TypeExternalError, ctx.Err(), "failed to wait response"}
+		}
+
+		if f.cancelled && ctx.Err() == nil {
+			return g.Do(ctx, w, key, fn)
+		}
+		if f.err != nil {
+			return true, f.err
+		}
+		return true, f.resp.Replay(w)
+	}
+
+	f := &flight{done: make(chan struct{}), resp: newResponseRecorder()}
+	g.flights[key] = f
+	g.mutex.Unlock()
+
+	func() {
+		defer func() {
+			g.mutex.Lock()
+			delete(g.flights, key)
+			g.mutex.Unlock()
+
+			close(f.done)
+		}()
+
+		f.err = fn(f.resp)
+		f.cancelled = f.err != nil && ctx.Err() != nil
+	}()
+
+	if f.err != nil {
+		return false, f.err
+	}
+	return false, f.resp.Replay(w)
+}
@@ -0,0 +1,117 @@
+package landns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ConditionalRule is a rule for ConditionalResolver.
+type ConditionalRule struct {
+	Name     string
+	Suffixes []Domain
+	Resolver Resolver
+}
+
+// String is returns simple human readable string.
+func (cr ConditionalRule) String() string {
+	return fmt.Sprintf("%s%s=%s", cr.Name, cr.Suffixes, cr.Resolver)
+}
+
+// ConditionalResolver is a Resolver that selects upstream resolver by domain suffix.
+//
+// ConditionalResolver uses the rule of the longest matched suffix, or Default if no rule matched.
+type ConditionalResolver struct {
+	rules   []ConditionalRule
+	index   map[Domain]int
+	Default Resolver // Resolver for names that didn't match any rule. Nothing will resolve if nil.
+}
+
+// NewConditionalResolver is constructor of ConditionalResolver.
+func NewConditionalResolver(rules []ConditionalRule, defaultResolver Resolver) (ConditionalResolver, error) {
+	index := make(map[Domain]int)
+
+	for i, rule := range rules {
+		for _, suffix := range rule.Suffixes {
+			if err := suffix.Validate(); err != nil {
+				return ConditionalResolver{}, err
+			}
+
+			s := Domain(strings.ToLower(suffix.String()))
+			if _, ok := index[s]; ok {
+				return ConditionalResolver{}, newError(TypeArgumentError, nil, "duplicated suffix: %s", s)
+			}
+			index[s] = i
+		}
+	}
+
+	return ConditionalResolver{
+		rules:   rules,
+		index:   index,
+		Default: defaultResolver,
+	}, nil
+}
+
+// Select is getter of the Resolver for the domain.
+//
+// Returns nil if no rule matched and Default is nil.
+func (cr ConditionalResolver) Select(name Domain) Resolver {
+	n := strings.ToLower(name.String())
+
+	for _, i := range dns.Split(n) {
+		if idx, ok := cr.index[Domain(n[i:])]; ok {
+			return cr.rules[idx].Resolver
+		}
+	}
+
+	if idx, ok := cr.index["."]; ok {
+		return cr.rules[idx].Resolver
+	}
+	return cr.Default
+}
+
+// Resolve is resolver using matched upstream resolver.
+func (cr ConditionalResolver) Resolve(w ResponseWriter, r Request) error {
+	return cr.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolver using matched upstream resolver with context.
+func (cr ConditionalResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	ctx, span := startSpan(ctx, r, "ConditionalResolver.Resolve")
+	defer endSpan(span, &err)
+
+	if upstream := cr.Select(Domain(r.Name)); upstream != nil {
+		return ResolveContext(ctx, upstream, w, r)
+	}
+	return nil
+}
+
+// RecursionAvailable is returns `true` if upstream resolvers at least one returns `true`.
+func (cr ConditionalResolver) RecursionAvailable() bool {
+	for _, r := range cr.rules {
+		if r.Resolver.RecursionAvailable() {
+			return true
+		}
+	}
+	return cr.Default != nil && cr.Default.RecursionAvailable()
+}
+
+// Close is close all upstream resolvers.
+func (cr ConditionalResolver) Close() error {
+	for _, r := range cr.rules {
+		if err := r.Resolver.Close(); err != nil {
+			return err
+		}
+	}
+	if cr.Default != nil {
+		return cr.Default.Close()
+	}
+	return nil
+}
+
+// String is returns simple human readable string.
+func (cr ConditionalResolver) String() string {
+	return fmt.Sprintf("ConditionalResolver[%s default=%v]", cr.rules, cr.Default)
+}
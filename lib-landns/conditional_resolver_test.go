@@ -0,0 +1,153 @@
+package landns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func makeConditionalTestResolver(addr string) landns.Resolver {
+	return landns.ResolverSet{
+		landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "a.corp.example.com.", TTL: 10, Address: net.ParseIP(addr)},
+			landns.AddressRecord{Name: "b.dev.corp.example.com.", TTL: 10, Address: net.ParseIP(addr)},
+			landns.AddressRecord{Name: "web.service.consul.", TTL: 10, Address: net.ParseIP(addr)},
+			landns.AddressRecord{Name: "example.com.", TTL: 10, Address: net.ParseIP(addr)},
+		}),
+	}
+}
+
+func TestConditionalResolver(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := landns.NewConditionalResolver([]landns.ConditionalRule{
+		{Name: "ad", Suffixes: []landns.Domain{"corp.example.com"}, Resolver: makeConditionalTestResolver("10.0.0.1")},
+		{Name: "dev", Suffixes: []landns.Domain{"dev.corp.example.com."}, Resolver: makeConditionalTestResolver("10.0.0.2")},
+		{Name: "consul", Suffixes: []landns.Domain{"consul.", "CONSUL.local."}, Resolver: makeConditionalTestResolver("127.0.0.1")},
+	}, makeConditionalTestResolver("8.8.8.8"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+
+	AssertResolve(t, resolver, landns.NewRequest("a.corp.example.com.", dns.TypeA, true), true, "a.corp.example.com. 10 IN A 10.0.0.1")
+	AssertResolve(t, resolver, landns.NewRequest("b.dev.corp.example.com.", dns.TypeA, true), true, "b.dev.corp.example.com. 10 IN A 10.0.0.2")
+	AssertResolve(t, resolver, landns.NewRequest("web.service.consul.", dns.TypeA, true), true, "web.service.consul. 10 IN A 127.0.0.1")
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), true, "example.com. 10 IN A 8.8.8.8")
+
+	if err := resolver.Close(); err != nil {
+		t.Errorf("failed to close: %s", err)
+	}
+}
+
+func TestConditionalResolver_Select(t *testing.T) {
+	t.Parallel()
+
+	ad := &testutil.DummyResolver{}
+	dev := &testutil.DummyResolver{}
+	consul := &testutil.DummyResolver{}
+	def := &testutil.DummyResolver{}
+
+	resolver, err := landns.NewConditionalResolver([]landns.ConditionalRule{
+		{Name: "ad", Suffixes: []landns.Domain{"corp.example.com"}, Resolver: ad},
+		{Name: "dev", Suffixes: []landns.Domain{"dev.corp.example.com."}, Resolver: dev},
+		{Name: "consul", Suffixes: []landns.Domain{"consul.", "CONSUL.local."}, Resolver: consul},
+	}, def)
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+
+	for name, expect := range map[landns.Domain]landns.Resolver{
+		"a.corp.example.com.":     ad,
+		"CORP.example.com.":       ad,
+		"x.dev.corp.example.com.": dev,
+		"foo.consul.local.":       consul,
+		"consul.":                 consul,
+		"example.com.":            def,
+		"xcorp.example.com.":      def,
+	} {
+		if got := resolver.Select(name); got != expect {
+			t.Errorf("%s: unexpected resolver: expected %p but got %p", name, expect, got)
+		}
+	}
+}
+
+func TestConditionalResolver_NoDefault(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := landns.NewConditionalResolver([]landns.ConditionalRule{
+		{Name: "consul", Suffixes: []landns.Domain{"consul."}, Resolver: makeConditionalTestResolver("127.0.0.1")},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+
+	AssertResolve(t, resolver, landns.NewRequest("web.service.consul.", dns.TypeA, true), true, "web.service.consul. 10 IN A 127.0.0.1")
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), true)
+
+	if resolver.Select("example.com.") != nil {
+		t.Errorf("expected nil but got %s", resolver.Select("example.com."))
+	}
+
+	if resolver.String() != "ConditionalResolver[[consul[consul.]=ResolverSet[SimpleResolver[4 domains 1 types 4 records]]] default=<nil>]" {
+		t.Errorf("unexpected string: %s", resolver)
+	}
+
+	if err := resolver.Close(); err != nil {
+		t.Errorf("failed to close: %s", err)
+	}
+}
+
+func TestConditionalResolver_RootRule(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := landns.NewConditionalResolver([]landns.ConditionalRule{
+		{Name: "root", Suffixes: []landns.Domain{"."}, Resolver: makeConditionalTestResolver("127.0.0.1")},
+	}, makeConditionalTestResolver("8.8.8.8"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), true, "example.com. 10 IN A 127.0.0.1")
+}
+
+func TestConditionalResolver_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := landns.NewConditionalResolver([]landns.ConditionalRule{
+		{Name: "a", Suffixes: []landns.Domain{"example.com."}, Resolver: testutil.DummyResolver{}},
+		{Name: "b", Suffixes: []landns.Domain{"EXAMPLE.com"}, Resolver: testutil.DummyResolver{}},
+	}, nil)
+	if err == nil {
+		t.Errorf("expected error but got nil")
+	} else if err.Error() != "duplicated suffix: example.com." {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	_, err = landns.NewConditionalResolver([]landns.ConditionalRule{
+		{Name: "a", Suffixes: []landns.Domain{""}, Resolver: testutil.DummyResolver{}},
+	}, nil)
+	if err == nil {
+		t.Errorf("expected error but got nil")
+	} else if err.Error() != `invalid domain: ""` {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestConditionalResolver_RecursionAvailable(t *testing.T) {
+	t.Parallel()
+
+	CheckRecursionAvailable(t, func(rs []landns.Resolver) landns.Resolver {
+		rules := make([]landns.ConditionalRule, len(rs)-1)
+		for i, r := range rs[1:] {
+			rules[i] = landns.ConditionalRule{Name: "rule", Suffixes: []landns.Domain{landns.Domain(string(rune('a'+i)) + ".example.com.")}, Resolver: r}
+		}
+		resolver, err := landns.NewConditionalResolver(rules, rs[0])
+		if err != nil {
+			t.Fatalf("failed to make resolver: %s", err)
+		}
+		return resolver
+	})
+}
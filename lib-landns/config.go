@@ -3,6 +3,10 @@ package landns
 import (
 	"fmt"
 	"net"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -84,3 +88,149 @@ type ResolverConfig struct {
 	Texts     map[Domain][]string          `yaml:"text,omitempty"`
 	Services  map[Domain][]SrvRecordConfig `yaml:"service,omitempty"`
 }
+
+// Network is network address in CIDR notation like "192.168.0.0/24".
+//
+// Network accepts single address like "192.168.0.1" as a network that includes only the address.
+type Network net.IPNet
+
+// String is getter to CIDR string.
+func (n Network) String() string {
+	return (*net.IPNet)(&n).String()
+}
+
+// IPNet is converter to net.IPNet.
+func (n Network) IPNet() *net.IPNet {
+	return &net.IPNet{IP: n.IP, Mask: n.Mask}
+}
+
+// UnmarshalText is parse text to Network.
+func (n *Network) UnmarshalText(text []byte) error {
+	if _, ipnet, err := net.ParseCIDR(string(text)); err == nil {
+		*n = Network(*ipnet)
+		return nil
+	}
+
+	ip := net.ParseIP(string(text))
+	if ip == nil {
+		return newError(TypeArgumentError, nil, "invalid network: %s", string(text))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		*n = Network{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	} else {
+		*n = Network{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	return nil
+}
+
+// MarshalText is make bytes text.
+func (n Network) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+// ViewConfig is configuration for a view of split-horizon.
+//
+// Names that not found in the view are resolved by the blocklist and the upstream servers.
+// Records of the global static-zone and dynamic-zone are also used only if InheritGlobal is true.
+type ViewConfig struct {
+	Name          string    `yaml:"name"`
+	Networks      []Network `yaml:"networks"`
+	Static        []string  `yaml:"static,omitempty"`         // Paths to static-zone configuration files.
+	Dynamic       []string  `yaml:"dynamic-prefix,omitempty"` // Prefixes of dynamic-zone in etcd. Not supported with SQLite, because SQLite database has only one dynamic-zone.
+	InheritGlobal bool      `yaml:"inherit-global,omitempty"` // Whether to resolve names by the global static-zone and dynamic-zone if not found in the view.
+}
+
+// Validate is validator of ViewConfig.
+func (c ViewConfig) Validate() error {
+	if c.Name == "" {
+		return newError(TypeArgumentError, nil, "view name is required")
+	}
+	if c.Name == DefaultViewName {
+		return newError(TypeArgumentError, nil, "view name %#v is reserved", c.Name)
+	}
+	if len(c.Networks) == 0 {
+		return newError(TypeArgumentError, nil, "view %s: networks is required", c.Name)
+	}
+	return nil
+}
+
+// IPNets is getter to networks as list of net.IPNet.
+func (c ViewConfig) IPNets() []*net.IPNet {
+	ns := make([]*net.IPNet, len(c.Networks))
+	for i, n := range c.Networks {
+		ns[i] = n.IPNet()
+	}
+	return ns
+}
+
+// ViewsConfig is configuration for split-horizon views.
+type ViewsConfig struct {
+	Views []ViewConfig `yaml:"views"`
+}
+
+// NewViewsConfig is parse configuration text and make ViewsConfig.
+func NewViewsConfig(config []byte) (ViewsConfig, error) {
+	var conf ViewsConfig
+	if err := yaml.Unmarshal(config, &conf); err != nil {
+		return ViewsConfig{}, Error{TypeArgumentError, err, "failed to unmarshal views configuration"}
+	}
+
+	names := make(map[string]struct{})
+	for _, v := range conf.Views {
+		if err := v.Validate(); err != nil {
+			return ViewsConfig{}, err
+		}
+		if _, ok := names[v.Name]; ok {
+			return ViewsConfig{}, newError(TypeArgumentError, nil, "view %s: duplicated name", v.Name)
+		}
+		names[v.Name] = struct{}{}
+	}
+
+	return conf, nil
+}
+
+// ForwardGroupConfig is configuration for a group of upstream servers for conditional forwarding.
+type ForwardGroupConfig struct {
+	Domains   []Domain         `yaml:"domains"`
+	Upstreams []Upstream       `yaml:"upstreams"`
+	Timeout   time.Duration    `yaml:"timeout,omitempty"`  // Timeout for this group. Use default timeout if zero.
+	Strategy  *ForwardStrategy `yaml:"strategy,omitempty"` // Strategy for select upstream. Use default strategy if nil.
+	Cache     *bool            `yaml:"cache,omitempty"`    // Enable cache or not. Use default setting if nil.
+}
+
+// ForwardConfig is configuration for conditional forwarding.
+type ForwardConfig struct {
+	Groups map[string]ForwardGroupConfig `yaml:"forward"`
+}
+
+// NewForwardConfig is parse configuration text and make ForwardConfig.
+func NewForwardConfig(config []byte) (ForwardConfig, error) {
+	var conf ForwardConfig
+	if err := yaml.Unmarshal(config, &conf); err != nil {
+		return ForwardConfig{}, Error{TypeArgumentError, err, "failed to unmarshal forward configuration"}
+	}
+
+	for name, g := range conf.Groups {
+		if len(g.Domains) == 0 {
+			return ForwardConfig{}, newError(TypeArgumentError, nil, "forward group %s: domains is required", name)
+		}
+		if len(g.Upstreams) == 0 {
+			return ForwardConfig{}, newError(TypeArgumentError, nil, "forward group %s: upstreams is required", name)
+		}
+		if g.Timeout < 0 {
+			return ForwardConfig{}, newError(TypeArgumentError, nil, "forward group %s: invalid timeout: %s", name, g.Timeout)
+		}
+	}
+
+	return conf, nil
+}
+
+// Names is getter to sorted group names.
+func (c ForwardConfig) Names() []string {
+	names := make([]string, 0, len(c.Groups))
+	for name := range c.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,6 +2,7 @@ package landns_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/macrat/landns/lib-landns"
 )
@@ -53,3 +54,140 @@ func TestProto_Encoding(t *testing.T) {
 		t.Errorf(`unexpected error: expected 'invalid protocol: foo' but got '%s'`, err)
 	}
 }
+
+func TestNetwork_Encoding(t *testing.T) {
+	t.Parallel()
+
+	var n landns.Network
+
+	for input, expect := range map[string]string{
+		"192.168.0.0/16": "192.168.0.0/16",
+		"192.168.1.2/24": "192.168.1.0/24",
+		"10.1.2.3":       "10.1.2.3/32",
+		"fd00::/8":       "fd00::/8",
+		"fd00::1":        "fd00::1/128",
+	} {
+		if err := (&n).UnmarshalText([]byte(input)); err != nil {
+			t.Errorf("failed to unmarshal: %s: %s", input, err)
+		} else if result, err := n.MarshalText(); err != nil {
+			t.Errorf("failed to marshal: %s: %s", input, err)
+		} else if string(result) != expect {
+			t.Errorf("unexpected marshal result: expected %s but got %s", expect, string(result))
+		}
+	}
+
+	if err := (&n).UnmarshalText([]byte("foo")); err == nil {
+		t.Errorf("expected error but got nil")
+	} else if err.Error() != `invalid network: foo` {
+		t.Errorf(`unexpected error: expected 'invalid network: foo' but got '%s'`, err)
+	}
+}
+
+func TestNewViewsConfig(t *testing.T) {
+	t.Parallel()
+
+	conf, err := landns.NewViewsConfig([]byte(`views:
+  - name: office
+    networks: [192.168.0.0/16, 10.0.0.1]
+    static: [office.yml]
+  - name: docker
+    networks: [172.16.0.0/12]
+    dynamic-prefix: [/landns/docker]
+    inherit-global: true
+`))
+	if err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+
+	if len(conf.Views) != 2 {
+		t.Fatalf("unexpected views length: %d", len(conf.Views))
+	}
+	if ns := conf.Views[0].IPNets(); len(ns) != 2 || ns[0].String() != "192.168.0.0/16" || ns[1].String() != "10.0.0.1/32" {
+		t.Errorf("unexpected networks: %s", ns)
+	}
+	if len(conf.Views[0].Static) != 1 || conf.Views[0].Static[0] != "office.yml" {
+		t.Errorf("unexpected static files: %s", conf.Views[0].Static)
+	}
+	if len(conf.Views[1].Dynamic) != 1 || conf.Views[1].Dynamic[0] != "/landns/docker" {
+		t.Errorf("unexpected dynamic prefixes: %s", conf.Views[1].Dynamic)
+	}
+	if conf.Views[0].InheritGlobal || !conf.Views[1].InheritGlobal {
+		t.Errorf("unexpected inherit-global: %v, %v", conf.Views[0].InheritGlobal, conf.Views[1].InheritGlobal)
+	}
+
+	for config, expect := range map[string]string{
+		"views: [{networks: [10.0.0.0/8]}]":                                       "view name is required",
+		"views: [{name: default, networks: [10.0.0.0/8]}]":                        `view name "default" is reserved`,
+		"views: [{name: a}]":                                                      "view a: networks is required",
+		"views: [{name: a, networks: [foo]}]":                                     "failed to unmarshal views configuration: invalid network: foo",
+		"views: [{name: a, networks: [1.2.3.4]}, {name: a, networks: [1.2.3.4]}]": "view a: duplicated name",
+	} {
+		if _, err := landns.NewViewsConfig([]byte(config)); err == nil {
+			t.Errorf("%s: expected error but got nil", config)
+		} else if err.Error() != expect {
+			t.Errorf("%s: unexpected error:\nexpected: %s\nbut got:  %s", config, expect, err)
+		}
+	}
+}
+
+func TestNewForwardConfig(t *testing.T) {
+	t.Parallel()
+
+	conf, err := landns.NewForwardConfig([]byte(`forward:
+  ad:
+    domains: [corp.example.]
+    upstreams: [10.0.0.1, 10.0.0.2:53]
+    timeout: 500ms
+    strategy: fastest
+    cache: false
+  consul:
+    domains: [consul.]
+    upstreams: [127.0.0.1:8600, "tls://1.1.1.1", "https://dns.example/dns-query"]
+`))
+	if err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+
+	if names := conf.Names(); len(names) != 2 || names[0] != "ad" || names[1] != "consul" {
+		t.Fatalf("unexpected names: %s", names)
+	}
+
+	ad := conf.Groups["ad"]
+	if len(ad.Domains) != 1 || ad.Domains[0] != "corp.example." {
+		t.Errorf("unexpected domains: %s", ad.Domains)
+	}
+	if us := ad.Upstreams; len(us) != 2 || us[0].String() != "10.0.0.1:53" || us[1].String() != "10.0.0.2:53" {
+		t.Errorf("unexpected upstreams: %s", us)
+	}
+	if ad.Timeout != 500*time.Millisecond {
+		t.Errorf("unexpected timeout: %s", ad.Timeout)
+	}
+	if ad.Strategy == nil || *ad.Strategy != landns.StrategyFastest {
+		t.Errorf("unexpected strategy: %v", ad.Strategy)
+	}
+	if ad.Cache == nil || *ad.Cache != false {
+		t.Errorf("unexpected cache setting: %v", ad.Cache)
+	}
+
+	consul := conf.Groups["consul"]
+	if us := consul.Upstreams; len(us) != 3 || us[0].String() != "127.0.0.1:8600" || us[1].String() != "tls://1.1.1.1:853" || us[2].String() != "https://dns.example/dns-query" {
+		t.Errorf("unexpected upstreams: %s", us)
+	}
+	if consul.Timeout != 0 || consul.Strategy != nil || consul.Cache != nil {
+		t.Errorf("unexpected default settings: timeout=%s strategy=%v cache=%v", consul.Timeout, consul.Strategy, consul.Cache)
+	}
+
+	for config, expect := range map[string]string{
+		"forward: {a: {upstreams: [10.0.0.1]}}":                                         "forward group a: domains is required",
+		"forward: {a: {domains: [example.com.]}}":                                       "forward group a: upstreams is required",
+		"forward: {a: {domains: [example.com.], upstreams: [10.0.0.1], timeout: -1s}}":  "forward group a: invalid timeout: -1s",
+		"forward: {a: {domains: [example.com.], upstreams: [10.0.0.1], strategy: foo}}": "failed to unmarshal forward configuration: unknown strategy: foo",
+		"forward: {a: {domains: [example.com.], upstreams: [\"ftp://10.0.0.1\"]}}":      "failed to unmarshal forward configuration: invalid upstream address: ftp://10.0.0.1: unsupported protocol: ftp",
+	} {
+		if _, err := landns.NewForwardConfig([]byte(config)); err == nil {
+			t.Errorf("%s: expected error but got nil", config)
+		} else if err.Error() != expect {
+			t.Errorf("%s: unexpected error:\nexpected: %s\nbut got:  %s", config, expect, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package landns
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ContextResolver is the interface of Resolver that supports context.
+//
+// The context carries deadline and cancellation of the query, and request metadata like the client address.
+// ResolveContext uses ctx instead of the context in Request.
+type ContextResolver interface {
+	Resolver
+
+	ResolveContext(ctx context.Context, w ResponseWriter, r Request) error
+}
+
+// contextAdapter is the adapter to use Resolver that doesn't support context as ContextResolver.
+type contextAdapter struct {
+	Resolver
+}
+
+// ResolveContext is check the context and resolve request with context in it.
+func (ca contextAdapter) ResolveContext(ctx context.Context, w ResponseWriter, r Request) error {
+	if err := ctx.Err(); err != nil {
+		return Error{TypeExternalError, err, "failed to resolve"}
+	}
+	return ca.Resolver.Resolve(w, r.WithContext(ctx))
+}
+
+// String is returns description of the wrapped resolver.
+func (ca contextAdapter) String() string {
+	return fmt.Sprint(ca.Resolver)
+}
+
+// AdaptContext is make ContextResolver from Resolver.
+//
+// AdaptContext returns resolver as is if it implements ContextResolver.
+// Otherwise, returned resolver checks context before resolve, and passes the context via Request.Context.
+func AdaptContext(resolver Resolver) ContextResolver {
+	if cr, ok := resolver.(ContextResolver); ok {
+		return cr
+	}
+	return contextAdapter{resolver}
+}
+
+// ResolveContext is resolve request using resolver with the context.
+//
+// ResolveContext is the same as AdaptContext(resolver).ResolveContext(ctx, w, r).
+func ResolveContext(ctx context.Context, resolver Resolver, w ResponseWriter, r Request) error {
+	return AdaptContext(resolver).ResolveContext(ctx, w, r)
+}
+
+type clientAddressKey struct{}
+
+// ContextWithClientAddress is make a context that carries address of the client.
+func ContextWithClientAddress(ctx context.Context, addr net.IP) context.Context {
+	return context.WithValue(ctx, clientAddressKey{}, addr)
+}
+
+// ClientAddressFromContext is getter to address of the client in the context. Returns nil if not set.
+func ClientAddressFromContext(ctx context.Context) net.IP {
+	addr, _ := ctx.Value(clientAddressKey{}).(net.IP)
+	return addr
+}
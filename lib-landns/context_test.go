@@ -0,0 +1,112 @@
+package landns_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+type contextKey struct{}
+
+// ContextRecordingResolver is a Resolver that doesn't support context, and records context of the last request.
+type ContextRecordingResolver struct {
+	Context context.Context
+	Called  int
+}
+
+func (r *ContextRecordingResolver) Resolve(w landns.ResponseWriter, req landns.Request) error {
+	r.Context = req.Context()
+	r.Called++
+	return nil
+}
+
+func (r *ContextRecordingResolver) RecursionAvailable() bool {
+	return false
+}
+
+func (r *ContextRecordingResolver) Close() error {
+	return nil
+}
+
+func TestAdaptContext(t *testing.T) {
+	t.Parallel()
+
+	simple := landns.NewSimpleResolver(nil)
+	if r, ok := landns.AdaptContext(simple).(landns.SimpleResolver); !ok {
+		t.Errorf("ContextResolver should not be wrapped: %#v", r)
+	}
+
+	legacy := &ContextRecordingResolver{}
+	req := landns.NewRequest("example.com.", dns.TypeA, false)
+
+	if req.Context() != context.Background() {
+		t.Errorf("unexpected default context: %v", req.Context())
+	}
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "hello")
+	if err := landns.ResolveContext(ctx, legacy, testutil.NewDummyResponseWriter(), req); err != nil {
+		t.Fatalf("failed to resolve: %s", err)
+	}
+	if legacy.Called != 1 {
+		t.Errorf("unexpected called count: %d", legacy.Called)
+	}
+	if v := legacy.Context.Value(contextKey{}); v != "hello" {
+		t.Errorf("context was not passed to resolver: %v", v)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err := landns.ResolveContext(ctx, legacy, testutil.NewDummyResponseWriter(), req)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if legacy.Called != 1 {
+		t.Errorf("resolver should not be called if context was done")
+	}
+}
+
+func TestResolverSet_Context(t *testing.T) {
+	t.Parallel()
+
+	inner := &ContextRecordingResolver{}
+	resolvers := []landns.ContextResolver{
+		landns.ResolverSet{inner},
+		landns.AlternateResolver{inner},
+		landns.NewMeasuredResolver("test", inner, landns.NewMetrics("landns")),
+	}
+
+	for i, resolver := range resolvers {
+		ctx := context.WithValue(context.Background(), contextKey{}, i)
+		req := landns.NewRequest("example.com.", dns.TypeA, false)
+		if err := resolver.ResolveContext(ctx, testutil.NewDummyResponseWriter(), req); err != nil {
+			t.Errorf("%s: failed to resolve: %s", resolver, err)
+		}
+		if v := inner.Context.Value(contextKey{}); v != i {
+			t.Errorf("%s: context was not passed to resolver", resolver)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := resolver.ResolveContext(ctx, testutil.NewDummyResponseWriter(), req); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: unexpected error: %v", resolver, err)
+		}
+	}
+}
+
+func TestClientAddressFromContext(t *testing.T) {
+	t.Parallel()
+
+	if addr := landns.ClientAddressFromContext(context.Background()); addr != nil {
+		t.Errorf("unexpected address: %s", addr)
+	}
+
+	ctx := landns.ContextWithClientAddress(context.Background(), net.ParseIP("127.1.2.3"))
+	if addr := landns.ClientAddressFromContext(ctx); !addr.Equal(net.ParseIP("127.1.2.3")) {
+		t.Errorf("unexpected address: %s", addr)
+	}
+}
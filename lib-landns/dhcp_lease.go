@@ -0,0 +1,563 @@
+package landns
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+)
+
+// LeaseFormat is the format of DHCP lease file.
+type LeaseFormat uint8
+
+const (
+	// LeaseDnsmasq is the format of dnsmasq lease file like "/var/lib/misc/dnsmasq.leases".
+	LeaseDnsmasq LeaseFormat = iota
+
+	// LeaseISC is the format of ISC dhcpd lease file like "/var/lib/dhcp/dhcpd.leases".
+	LeaseISC
+
+	// LeaseKea is the CSV format of Kea memfile lease database like "/var/lib/kea/kea-leases4.csv".
+	LeaseKea
+)
+
+var (
+	// DefaultLeaseInterval is the default interval to check update of lease file.
+	DefaultLeaseInterval = 5 * time.Second
+
+	// DefaultLeaseTTL is the default TTL for records of leases that never expire.
+	DefaultLeaseTTL uint32 = 600
+)
+
+// String is converter to human readable string.
+func (f LeaseFormat) String() string {
+	switch f {
+	case LeaseDnsmasq:
+		return "dnsmasq"
+	case LeaseISC:
+		return "isc"
+	case LeaseKea:
+		return "kea"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalText is parse text to LeaseFormat.
+func (f *LeaseFormat) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "dnsmasq":
+		*f = LeaseDnsmasq
+	case "isc", "dhcpd":
+		*f = LeaseISC
+	case "kea":
+		*f = LeaseKea
+	default:
+		return newError(TypeArgumentError, nil, "unknown lease format: %s", string(text))
+	}
+	return nil
+}
+
+// MarshalText is make bytes text.
+func (f LeaseFormat) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// Lease is a lease of DHCP server.
+type Lease struct {
+	Hostname string    // Hostname of the client. It is FQDN if ends with ".".
+	Address  net.IP    // Leased address.
+	Expire   time.Time // Time when the lease expires. Zero means never expire.
+}
+
+// ParseLeases is parse lease file in the format.
+//
+// Leases without hostname are skipped. If there are multiple leases for the same address, the last one is used.
+func ParseLeases(format LeaseFormat, r io.Reader) ([]Lease, error) {
+	switch format {
+	case LeaseDnsmasq:
+		return ParseDnsmasqLeases(r)
+	case LeaseISC:
+		return ParseISCLeases(r)
+	case LeaseKea:
+		return ParseKeaLeases(r)
+	default:
+		return nil, newError(TypeArgumentError, nil, "unknown lease format: %s", format)
+	}
+}
+
+// leaseList is a list of leases that the last lease for the same address overrides the former one.
+type leaseList struct {
+	leases []Lease
+	index  map[string]int
+}
+
+func (ll *leaseList) set(l Lease) {
+	if ll.index == nil {
+		ll.index = make(map[string]int)
+	}
+
+	key := l.Address.String()
+	if i, ok := ll.index[key]; ok {
+		ll.leases[i] = l
+	} else {
+		ll.index[key] = len(ll.leases)
+		ll.leases = append(ll.leases, l)
+	}
+}
+
+// remove is forget lease of the address, for released leases.
+func (ll *leaseList) remove(addr net.IP) {
+	if i, ok := ll.index[addr.String()]; ok {
+		ll.leases[i].Hostname = ""
+	}
+}
+
+func (ll *leaseList) result() []Lease {
+	result := make([]Lease, 0, len(ll.leases))
+	for _, l := range ll.leases {
+		if l.Hostname != "" {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+func leaseExpire(epoch int64) time.Time {
+	if epoch == 0 {
+		return time.Time{}
+	}
+	return time.Unix(epoch, 0)
+}
+
+// ParseDnsmasqLeases is parse dnsmasq lease file.
+//
+// Each line is "EXPIRE MAC ADDRESS HOSTNAME CLIENT-ID" for IPv4, or "EXPIRE IAID ADDRESS HOSTNAME DUID" for IPv6.
+func ParseDnsmasqLeases(r io.Reader) ([]Lease, error) {
+	var ll leaseList
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, newError(TypeArgumentError, nil, "invalid dnsmasq lease at line %d", n)
+		}
+
+		expire, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, newError(TypeArgumentError, err, "invalid expire time of dnsmasq lease at line %d", n)
+		}
+		addr := net.ParseIP(fields[2])
+		if addr == nil {
+			return nil, newError(TypeArgumentError, nil, "invalid address of dnsmasq lease at line %d", n)
+		}
+
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+		ll.set(Lease{Hostname: hostname, Address: addr, Expire: leaseExpire(expire)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Error{TypeExternalError, err, "failed to read lease file"}
+	}
+
+	return ll.result(), nil
+}
+
+// tokenizeISC is split ISC dhcpd lease file into tokens. Comments are removed, and quoted strings are unquoted but escape sequences are kept as is.
+func tokenizeISC(r io.Reader) ([]string, error) {
+	var tokens []string
+	var buf strings.Builder
+	inQuote := false
+	inEscape := false
+	inComment := false
+
+	flush := func() {
+		if buf.Len() > 0 {
+			tokens = append(tokens, buf.String())
+			buf.Reset()
+		}
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to read lease file"}
+		}
+
+		switch {
+		case inComment:
+			inComment = c != '\n'
+		case inEscape:
+			buf.WriteByte(c)
+			inEscape = false
+		case inQuote:
+			if c == '\\' {
+				buf.WriteByte(c)
+				inEscape = true
+			} else if c == '"' {
+				inQuote = false
+				tokens = append(tokens, buf.String())
+				buf.Reset()
+			} else {
+				buf.WriteByte(c)
+			}
+		case c == '"':
+			flush()
+			inQuote = true
+		case c == '#':
+			flush()
+			inComment = true
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			flush()
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return nil, newError(TypeArgumentError, nil, "unterminated string in ISC lease file")
+	}
+	flush()
+
+	return tokens, nil
+}
+
+// parseISCTime is parse time of ISC dhcpd lease like "4 2020/01/02 03:04:05", "epoch 1577934245" or "never".
+func parseISCTime(args []string) (time.Time, error) {
+	switch {
+	case len(args) == 1 && args[0] == "never":
+		return time.Time{}, nil
+	case len(args) == 2 && args[0] == "epoch":
+		epoch, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return time.Time{}, newError(TypeArgumentError, err, "invalid time: %s", strings.Join(args, " "))
+		}
+		return leaseExpire(epoch), nil
+	case len(args) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", args[1]+" "+args[2])
+		if err != nil {
+			return time.Time{}, newError(TypeArgumentError, err, "invalid time: %s", strings.Join(args, " "))
+		}
+		return t, nil
+	default:
+		return time.Time{}, newError(TypeArgumentError, nil, "invalid time: %s", strings.Join(args, " "))
+	}
+}
+
+// ParseISCLeases is parse ISC dhcpd lease file.
+//
+// Only IPv4 leases in "binding state active" are used, because dhcpd doesn't record hostname of IPv6 clients.
+func ParseISCLeases(r io.Reader) ([]Lease, error) {
+	tokens, err := tokenizeISC(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var ll leaseList
+
+	// statement is read tokens until ";" or "{", and returns the tokens and the terminator.
+	statement := func() ([]string, string) {
+		for i, t := range tokens {
+			if t == ";" || t == "{" || t == "}" {
+				s := tokens[:i]
+				tokens = tokens[i+1:]
+				return s, t
+			}
+		}
+		s := tokens
+		tokens = nil
+		return s, ""
+	}
+
+	// skipBlock is skip tokens until the end of current block.
+	skipBlock := func() {
+		depth := 1
+		for depth > 0 && len(tokens) > 0 {
+			switch tokens[0] {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+			tokens = tokens[1:]
+		}
+	}
+
+	for len(tokens) > 0 {
+		s, term := statement()
+		if term != "{" {
+			continue
+		}
+		if len(s) != 2 || s[0] != "lease" {
+			skipBlock()
+			continue
+		}
+
+		addr := net.ParseIP(s[1])
+		if addr == nil {
+			return nil, newError(TypeArgumentError, nil, "invalid address of ISC lease: %s", s[1])
+		}
+
+		l := Lease{Address: addr}
+		active := false
+
+	block:
+		for len(tokens) > 0 {
+			s, term := statement()
+			switch term {
+			case "}":
+				break block
+			case "{":
+				skipBlock()
+				continue
+			}
+			if len(s) == 0 {
+				continue
+			}
+
+			switch s[0] {
+			case "ends":
+				if l.Expire, err = parseISCTime(s[1:]); err != nil {
+					return nil, err
+				}
+			case "binding":
+				active = len(s) == 3 && s[1] == "state" && s[2] == "active"
+			case "client-hostname":
+				if len(s) == 2 {
+					l.Hostname = s[1]
+				}
+			}
+		}
+
+		if active {
+			ll.set(l)
+		} else {
+			ll.remove(addr)
+		}
+	}
+
+	return ll.result(), nil
+}
+
+// ParseKeaLeases is parse Kea memfile lease database in CSV for both of DHCPv4 and DHCPv6.
+//
+// Leases that are not in the default state, or have zero valid lifetime (released) are ignored.
+func ParseKeaLeases(r io.Reader) ([]Lease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, Error{TypeArgumentError, err, "failed to parse Kea lease file"}
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "valid_lifetime", "expire", "hostname"} {
+		if _, ok := columns[name]; !ok {
+			return nil, newError(TypeArgumentError, nil, "column %s is not found in Kea lease file", name)
+		}
+	}
+
+	get := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	var ll leaseList
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, Error{TypeArgumentError, err, "failed to parse Kea lease file"}
+		}
+
+		addr := net.ParseIP(get(row, "address"))
+		if addr == nil {
+			return nil, newError(TypeArgumentError, nil, "invalid address of Kea lease: %s", get(row, "address"))
+		}
+
+		lifetime, err := strconv.ParseUint(get(row, "valid_lifetime"), 10, 32)
+		if err != nil {
+			return nil, newError(TypeArgumentError, err, "invalid valid_lifetime of Kea lease: %s", get(row, "valid_lifetime"))
+		}
+		expire, err := strconv.ParseInt(get(row, "expire"), 10, 64)
+		if err != nil {
+			return nil, newError(TypeArgumentError, err, "invalid expire of Kea lease: %s", get(row, "expire"))
+		}
+
+		if state := get(row, "state"); lifetime == 0 || (state != "" && state != "0") {
+			ll.remove(addr)
+			continue
+		}
+
+		l := Lease{Hostname: get(row, "hostname"), Address: addr, Expire: leaseExpire(expire)}
+		if lifetime == math.MaxUint32 {
+			l.Expire = time.Time{}
+		}
+		ll.set(l)
+	}
+
+	return ll.result(), nil
+}
+
+// LeaseImporter is the importer of DHCP leases into DynamicResolver.
+//
+// LeaseImporter watches the lease file, and keeps volatile A/AAAA records (and PTR records that made by DynamicResolver) for each lease that has hostname.
+// Records expire with the lease, and records of removed leases are deleted.
+type LeaseImporter struct {
+	Path     string
+	Format   LeaseFormat
+	Domain   Domain          // Domain suffix for hostnames like "lan.". Hostnames are used as top level domain if empty.
+	Resolver DynamicResolver // Destination of records.
+	TTL      uint32          // TTL for records of leases that never expire.
+	Interval time.Duration   // Interval to check update of the lease file.
+	Clock    Clock           // Source of current time.
+
+	mutex   sync.Mutex
+	sync    recordSync
+	watcher fileWatcher
+}
+
+// NewLeaseImporter is constructor of LeaseImporter.
+func NewLeaseImporter(path string, format LeaseFormat, domain Domain, resolver DynamicResolver) *LeaseImporter {
+	return &LeaseImporter{
+		Path:     path,
+		Format:   format,
+		Domain:   domain,
+		Resolver: resolver,
+		TTL:      DefaultLeaseTTL,
+		Interval: DefaultLeaseInterval,
+		Clock:    DefaultClock,
+	}
+}
+
+// String is returns simple human readable string.
+func (li *LeaseImporter) String() string {
+	return fmt.Sprintf("LeaseImporter[%s:%s]", li.Format, li.Path)
+}
+
+func (li *LeaseImporter) recordName(hostname string) (Domain, error) {
+	hostname = strings.ToLower(hostname)
+
+	var name Domain
+	if strings.HasSuffix(hostname, ".") || li.Domain == "" {
+		name = Domain(hostname).Normalized()
+	} else {
+		name = Domain(hostname + "." + strings.TrimPrefix(li.Domain.String(), "."))
+	}
+
+	return name, name.Validate()
+}
+
+// makeRecords is make records for leases that not expired yet, in order of leases.
+func (li *LeaseImporter) makeRecords(leases []Lease, now time.Time) []DynamicRecord {
+	var records []DynamicRecord
+
+	for _, l := range leases {
+		name, err := li.recordName(l.Hostname)
+		if err != nil {
+			logger.Info("skip lease that has invalid hostname", logger.Fields{"hostname": l.Hostname, "address": l.Address})
+			continue
+		}
+
+		r := DynamicRecord{Record: AddressRecord{Name: name, TTL: li.TTL, Address: l.Address}}
+		if !l.Expire.IsZero() {
+			remain := l.Expire.Sub(now)
+			if remain <= 0 {
+				continue
+			}
+			r.Record = AddressRecord{Name: name, TTL: uint32(math.Ceil(remain.Seconds())), Address: l.Address}
+			r.Volatile = true
+		}
+
+		records = append(records, r)
+	}
+
+	return records
+}
+
+// Import is read the lease file and update records in Resolver.
+func (li *LeaseImporter) Import() error {
+	li.mutex.Lock()
+	defer li.mutex.Unlock()
+
+	f, err := os.Open(li.Path)
+	if err != nil {
+		return Error{TypeExternalError, err, "failed to open lease file"}
+	}
+	defer f.Close()
+
+	var stamp string
+	if stat, err := f.Stat(); err == nil {
+		stamp = leaseStamp(stat)
+	}
+
+	leases, err := ParseLeases(li.Format, f)
+	if err != nil {
+		return err
+	}
+
+	if err := li.sync.Sync(li.Resolver, li.makeRecords(leases, li.Clock.Now())); err != nil {
+		return err
+	}
+
+	li.watcher.loaded(stamp)
+	return nil
+}
+
+// leaseStamp is make stamp string that changes when the lease file updated.
+func leaseStamp(stat os.FileInfo) string {
+	return fmt.Sprintf("%d:%d", stat.ModTime().UnixNano(), stat.Size())
+}
+
+// stamp is get stamp string of the lease file.
+func (li *LeaseImporter) stamp() (string, error) {
+	stat, err := os.Stat(li.Path)
+	if err != nil {
+		return "", Error{TypeExternalError, err, "failed to open lease file"}
+	}
+	return leaseStamp(stat), nil
+}
+
+// Start is import leases and start watching the lease file in background.
+func (li *LeaseImporter) Start() error {
+	if err := li.Import(); err != nil {
+		return err
+	}
+
+	li.watcher.start(li.Clock, li.Interval, "DHCP leases", logger.Fields{"path": li.Path}, li.stamp, li.Import)
+	return nil
+}
+
+// Close is stop watching the lease file. Imported records are kept in Resolver.
+func (li *LeaseImporter) Close() error {
+	li.watcher.stop()
+	return nil
+}
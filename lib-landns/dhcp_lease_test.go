@@ -0,0 +1,369 @@
+package landns_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func AssertLeases(t *testing.T, expect []string, got []landns.Lease) {
+	t.Helper()
+
+	ss := make([]string, len(got))
+	for i, l := range got {
+		expire := "never"
+		if !l.Expire.IsZero() {
+			expire = fmt.Sprint(l.Expire.Unix())
+		}
+		ss[i] = fmt.Sprintf("%s %s %s", l.Hostname, l.Address, expire)
+	}
+
+	if strings.Join(ss, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("unexpected leases:\nexpected:\n%s\nbut got:\n%s", strings.Join(expect, "\n"), strings.Join(ss, "\n"))
+	}
+}
+
+func TestLeaseFormat_Encoding(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		Text   string
+		Format landns.LeaseFormat
+	}{
+		{"dnsmasq", landns.LeaseDnsmasq},
+		{"isc", landns.LeaseISC},
+		{"kea", landns.LeaseKea},
+	} {
+		var f landns.LeaseFormat
+		if err := f.UnmarshalText([]byte(tt.Text)); err != nil {
+			t.Errorf("failed to parse %s: %s", tt.Text, err)
+		} else if f != tt.Format {
+			t.Errorf("unexpected format: expected %s but got %s", tt.Format, f)
+		}
+
+		if b, err := tt.Format.MarshalText(); err != nil || string(b) != tt.Text {
+			t.Errorf("unexpected text: expected %s but got %s (%v)", tt.Text, string(b), err)
+		}
+	}
+
+	var f landns.LeaseFormat
+	if err := f.UnmarshalText([]byte("unknown")); err == nil || err.Error() != "unknown lease format: unknown" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	t.Parallel()
+
+	leases, err := landns.ParseDnsmasqLeases(strings.NewReader(strings.Join([]string{
+		"1600000000 00:11:22:33:44:55 192.168.1.10 alice 01:00:11:22:33:44:55",
+		"1600000100 00:11:22:33:44:66 192.168.1.11 * *",
+		"0 00:11:22:33:44:77 192.168.1.12 printer *",
+		"duid 00:01:00:01:25:00:00:00:00:11:22:33:44:55",
+		"1600000200 1234 2001:db8::10 alice 00:01:00:01:25:00:00:00:00:11:22:33:44:55",
+		"1600000300 00:11:22:33:44:55 192.168.1.10 alice-laptop 01:00:11:22:33:44:55",
+		"",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	AssertLeases(t, []string{
+		"alice-laptop 192.168.1.10 1600000300",
+		"printer 192.168.1.12 never",
+		"alice 2001:db8::10 1600000200",
+	}, leases)
+
+	for _, tt := range []struct {
+		Input string
+		Error string
+	}{
+		{"1600000000 00:11:22:33:44:55 192.168.1.10", "invalid dnsmasq lease at line 1"},
+		{"\nabc 00:11:22:33:44:55 192.168.1.10 alice *", "invalid expire time of dnsmasq lease at line 2"},
+		{"1600000000 00:11:22:33:44:55 192.168.1 alice *", "invalid address of dnsmasq lease at line 1"},
+	} {
+		if _, err := landns.ParseDnsmasqLeases(strings.NewReader(tt.Input)); err == nil || !strings.HasPrefix(err.Error(), tt.Error) {
+			t.Errorf("unexpected error: expected %q but got %v", tt.Error, err)
+		}
+	}
+}
+
+func TestParseISCLeases(t *testing.T) {
+	t.Parallel()
+
+	leases, err := landns.ParseISCLeases(strings.NewReader(`# The format of this file is documented in the dhcpd.leases(5) manual page.
+# This lease file was written by isc-dhcp-4.4.1
+
+# authoring-byte-order entry is generated, DO NOT DELETE
+authoring-byte-order little-endian;
+
+server-duid "\000\001\000\001&\334\033\266\010\000'\232\217\223";
+
+lease 192.168.1.10 {
+  starts 3 2020/09/09 12:00:00;
+  ends 3 2020/09/09 14:00:00;
+  cltt 3 2020/09/09 12:00:00;
+  binding state active;
+  next binding state free;
+  rewind binding state free;
+  hardware ethernet 00:11:22:33:44:55;
+  uid "\001\000\021\"3DU";
+  client-hostname "alice";
+}
+lease 192.168.1.11 {
+  starts 3 2020/09/09 12:00:00;
+  ends never;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:66;
+  client-hostname "printer";
+}
+lease 192.168.1.12 {
+  starts 3 2020/09/09 12:00:00;
+  ends epoch 1599660000; # Wed Sep 09 14:00:00 2020
+  binding state active;
+  client-hostname "bob";
+}
+lease 192.168.1.13 {
+  starts 3 2020/09/09 12:00:00;
+  ends 3 2020/09/09 14:00:00;
+  binding state active;
+}
+ia-na "\001\000\000\000\000\001\000\001" {
+  cltt 3 2020/09/09 12:00:00;
+  iaaddr 2001:db8::10 {
+    binding state active;
+    preferred-life 375;
+    max-life 600;
+    ends 3 2020/09/09 12:10:00;
+  }
+}
+lease 192.168.1.11 {
+  starts 3 2020/09/09 13:00:00;
+  ends 3 2020/09/09 13:00:00;
+  binding state free;
+  client-hostname "printer";
+}
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	AssertLeases(t, []string{
+		"alice 192.168.1.10 1599660000",
+		"bob 192.168.1.12 1599660000",
+	}, leases)
+
+	for _, tt := range []struct {
+		Input string
+		Error string
+	}{
+		{"lease 192.168.1 {\n}", "invalid address of ISC lease: 192.168.1"},
+		{"lease 192.168.1.10 {\n  ends tomorrow;\n}", "invalid time: tomorrow"},
+		{"lease 192.168.1.10 {\n  client-hostname \"alice;\n}", "unterminated string in ISC lease file"},
+	} {
+		if _, err := landns.ParseISCLeases(strings.NewReader(tt.Input)); err == nil || err.Error() != tt.Error {
+			t.Errorf("unexpected error: expected %q but got %v", tt.Error, err)
+		}
+	}
+}
+
+func TestParseKeaLeases(t *testing.T) {
+	t.Parallel()
+
+	leases, err := landns.ParseKeaLeases(strings.NewReader(strings.Join([]string{
+		"address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context",
+		"192.168.1.10,00:11:22:33:44:55,,3600,1600000000,1,0,0,alice,0,",
+		"192.168.1.11,00:11:22:33:44:66,,3600,1600000000,1,1,1,bob.example.com.,0,",
+		"192.168.1.12,00:11:22:33:44:77,,3600,1600000000,1,0,0,,0,",
+		"192.168.1.13,00:11:22:33:44:88,,3600,1600000000,1,0,0,declined,1,",
+		"192.168.1.14,00:11:22:33:44:99,,4294967295,4294967295,1,0,0,printer,0,",
+		"192.168.1.15,00:11:22:33:44:aa,,3600,1600000000,1,0,0,carol,0,",
+		"192.168.1.15,00:11:22:33:44:aa,,0,1600000100,1,0,0,carol,0,",
+		"192.168.1.10,00:11:22:33:44:55,,3600,1600003600,1,0,0,alice,0,",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	AssertLeases(t, []string{
+		"alice 192.168.1.10 1600003600",
+		"bob.example.com. 192.168.1.11 1600000000",
+		"printer 192.168.1.14 never",
+	}, leases)
+
+	leases, err = landns.ParseKeaLeases(strings.NewReader(strings.Join([]string{
+		"address,duid,valid_lifetime,expire,subnet_id,pref_lifetime,lease_type,iaid,prefix_len,fqdn_fwd,fqdn_rev,hostname,hwaddr,state,user_context",
+		"2001:db8::10,00:01:00:01:25:00:00:00:00:11:22:33:44:55,3600,1600000000,1,1800,0,1,128,0,0,alice,,0,",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	AssertLeases(t, []string{"alice 2001:db8::10 1600000000"}, leases)
+
+	if leases, err := landns.ParseKeaLeases(strings.NewReader("")); err != nil || len(leases) != 0 {
+		t.Errorf("unexpected result for empty file: %v %v", leases, err)
+	}
+
+	for _, tt := range []struct {
+		Input string
+		Error string
+	}{
+		{"address,expire,hostname\n", "column valid_lifetime is not found in Kea lease file"},
+		{"address,valid_lifetime,expire,hostname\n192.168.1,3600,1600000000,alice", "invalid address of Kea lease: 192.168.1"},
+		{"address,valid_lifetime,expire,hostname\n192.168.1.10,abc,1600000000,alice", "invalid valid_lifetime of Kea lease: abc"},
+		{"address,valid_lifetime,expire,hostname\n192.168.1.10,3600,abc,alice", "invalid expire of Kea lease: abc"},
+	} {
+		if _, err := landns.ParseKeaLeases(strings.NewReader(tt.Input)); err == nil || !strings.HasPrefix(err.Error(), tt.Error) {
+			t.Errorf("unexpected error: expected %q but got %v", tt.Error, err)
+		}
+	}
+}
+
+func writeLeases(t *testing.T, path string, now time.Time, lines ...string) {
+	t.Helper()
+
+	for i := range lines {
+		lines[i] = strings.ReplaceAll(lines[i], "$NOW", fmt.Sprint(now.Unix()))
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatalf("failed to write lease file: %s", err)
+	}
+}
+
+func TestLeaseImporter(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-lease")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsmasq.leases")
+
+	clock := testutil.NewFakeClock()
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+	resolver.Clock = clock
+
+	importer := landns.NewLeaseImporter(path, landns.LeaseDnsmasq, "lan.", resolver)
+	importer.Clock = clock
+
+	if err := importer.Import(); err == nil || !strings.HasPrefix(err.Error(), "failed to open lease file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	writeLeases(t, path, clock.Now().Add(100*time.Second),
+		"$NOW 00:11:22:33:44:55 192.168.1.10 Alice *",
+		"0 00:11:22:33:44:66 192.168.1.11 printer *",
+		"$NOW 00:11:22:33:44:77 192.168.1.12 * *",
+		"$NOW 00:11:22:33:44:88 192.168.1.13 invalid..name *",
+		"$NOW 1234 2001:db8::10 alice *",
+	)
+	if err := importer.Import(); err != nil {
+		t.Fatalf("failed to import: %s", err)
+	}
+
+	records, err := resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	AssertDynamicRecordSet(t, []string{
+		"alice.lan. 100 IN A 192.168.1.10 ; ID:1 Volatile",
+		"10.1.168.192.in-addr.arpa. 100 IN PTR alice.lan. ; ID:2 Volatile",
+		"printer.lan. 600 IN A 192.168.1.11 ; ID:3",
+		"11.1.168.192.in-addr.arpa. 600 IN PTR printer.lan. ; ID:4",
+		"alice.lan. 100 IN AAAA 2001:db8::10 ; ID:5 Volatile",
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 100 IN PTR alice.lan. ; ID:6 Volatile",
+	}, records)
+
+	clock.Add(40 * time.Second)
+
+	writeLeases(t, path, clock.Now().Add(200*time.Second),
+		"$NOW 00:11:22:33:44:55 192.168.1.10 alice *",
+		"$NOW 1234 2001:db8::10 alice *",
+	)
+	if err := importer.Import(); err != nil {
+		t.Fatalf("failed to import: %s", err)
+	}
+
+	records, err = resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	AssertDynamicRecordSet(t, []string{
+		"alice.lan. 200 IN A 192.168.1.10 ; ID:1 Volatile",
+		"10.1.168.192.in-addr.arpa. 200 IN PTR alice.lan. ; ID:2 Volatile",
+		"alice.lan. 200 IN AAAA 2001:db8::10 ; ID:5 Volatile",
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 200 IN PTR alice.lan. ; ID:6 Volatile",
+	}, records)
+
+	clock.Add(201 * time.Second)
+
+	records, err = resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	AssertDynamicRecordSet(t, []string{}, records)
+}
+
+func TestLeaseImporter_Watch(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-lease")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kea-leases4.csv")
+
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+
+	header := "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context"
+	writeLeases(t, path, time.Now(), header, "192.168.1.10,00:11:22:33:44:55,,4294967295,4294967295,1,0,0,alice,0,")
+
+	importer := landns.NewLeaseImporter(path, landns.LeaseKea, "", resolver)
+	importer.Interval = 10 * time.Millisecond
+	if err := importer.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer importer.Close()
+
+	AssertResolve(t, resolver, landns.NewRequest("alice.", dns.TypeA, false), true, "alice. 600 IN A 192.168.1.10")
+
+	writeLeases(t, path, time.Now().Add(time.Hour), header, "192.168.1.11,00:11:22:33:44:66,,3600,$NOW,1,0,0,bob,0,")
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if rs, err := resolver.SearchRecords("bob."); err == nil && len(rs) > 0 {
+			break
+		}
+	}
+
+	records, err := resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	if len(records) != 2 || records[0].Record.GetName() != "bob." || !records[0].Record.(landns.AddressRecord).Address.Equal(net.ParseIP("192.168.1.11")) {
+		t.Errorf("unexpected records: %s", records)
+	}
+
+	if err := importer.Close(); err != nil {
+		t.Errorf("failed to close: %s", err)
+	}
+}
@@ -0,0 +1,478 @@
+package landns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDNSSECValidity is the default validity period of signatures.
+	DefaultDNSSECValidity = 7 * 24 * time.Hour
+
+	// DefaultDNSSECInterval is the default interval to check update of key files.
+	DefaultDNSSECInterval = 30 * time.Second
+
+	// DefaultDNSSECNegativeTTL is the default TTL of SOA and NSEC records in negative responses.
+	DefaultDNSSECNegativeTTL uint32 = 60
+
+	// dnssecInceptionOffset is how long before now the signatures are valid from, to allow clock skew of validators.
+	dnssecInceptionOffset = time.Hour
+
+	// typeNXNAME is the pseudo type for NXDOMAIN in compact denial of existence (RFC 9824).
+	typeNXNAME uint16 = 128
+)
+
+// dnssecRecordTypes is the record types that can exist in local zones. They are checked for the type bitmap of NSEC records.
+var dnssecRecordTypes = []uint16{dns.TypeA, dns.TypeNS, dns.TypeCNAME, dns.TypePTR, dns.TypeMX, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV}
+
+// DNSSECKey is the key pair for signing a zone, that loaded from BIND style key files.
+//
+// Zero time of Publish, Activate, Inactive or Delete means not scheduled.
+type DNSSECKey struct {
+	DNSKEY   *dns.DNSKEY
+	Signer   crypto.Signer
+	Publish  time.Time // Time when the DNSKEY starts to be published.
+	Activate time.Time // Time when the key starts to sign.
+	Inactive time.Time // Time when the key stops to sign.
+	Delete   time.Time // Time when the DNSKEY stops to be published.
+}
+
+// LoadDNSSECKey is load key from the public key file like "Kexample.com.+013+12345.key" and the private key file that has ".private" suffix instead of ".key".
+//
+// Timing metadata like "Activate: 20200101000000" in the private key file are used for key rollover.
+func LoadDNSSECKey(path string) (DNSSECKey, error) {
+	pub, err := ioutil.ReadFile(path)
+	if err != nil {
+		return DNSSECKey{}, Error{TypeExternalError, err, "failed to read DNSSEC key file"}
+	}
+
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return DNSSECKey{}, newError(TypeArgumentError, err, "invalid DNSSEC key file: %s", path)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return DNSSECKey{}, newError(TypeArgumentError, nil, "invalid DNSSEC key file: %s", path)
+	}
+	dnskey.Hdr.Name = strings.ToLower(dnskey.Hdr.Name)
+
+	privPath := strings.TrimSuffix(path, ".key") + ".private"
+	priv, err := ioutil.ReadFile(privPath)
+	if err != nil {
+		return DNSSECKey{}, Error{TypeExternalError, err, "failed to read DNSSEC private key file"}
+	}
+
+	pk, err := dnskey.ReadPrivateKey(bytes.NewReader(priv), privPath)
+	if err != nil {
+		return DNSSECKey{}, newError(TypeArgumentError, err, "invalid DNSSEC private key file: %s", privPath)
+	}
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return DNSSECKey{}, newError(TypeArgumentError, nil, "unsupported DNSSEC private key: %s", privPath)
+	}
+
+	key := DNSSECKey{DNSKEY: dnskey, Signer: signer}
+
+	scanner := bufio.NewScanner(bytes.NewReader(priv))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		var t *time.Time
+		switch strings.TrimSpace(fields[0]) {
+		case "Publish":
+			t = &key.Publish
+		case "Activate":
+			t = &key.Activate
+		case "Inactive":
+			t = &key.Inactive
+		case "Delete":
+			t = &key.Delete
+		default:
+			continue
+		}
+
+		if *t, err = time.Parse("20060102150405", strings.TrimSpace(fields[1])); err != nil {
+			return DNSSECKey{}, newError(TypeArgumentError, err, "invalid timing of DNSSEC key: %s", privPath)
+		}
+	}
+
+	return key, nil
+}
+
+// Zone is getter of the zone name of the key.
+func (k DNSSECKey) Zone() Domain {
+	return Domain(k.DNSKEY.Hdr.Name)
+}
+
+// IsKSK is check if the key is key signing key that has SEP flag.
+func (k DNSSECKey) IsKSK() bool {
+	return k.DNSKEY.Flags&dns.SEP != 0
+}
+
+// Published is check if the DNSKEY should be published at the time.
+func (k DNSSECKey) Published(t time.Time) bool {
+	return (k.Publish.IsZero() || !t.Before(k.Publish)) && (k.Delete.IsZero() || t.Before(k.Delete))
+}
+
+// Active is check if the key should sign at the time.
+func (k DNSSECKey) Active(t time.Time) bool {
+	return k.Published(t) && (k.Activate.IsZero() || !t.Before(k.Activate)) && (k.Inactive.IsZero() || t.Before(k.Inactive))
+}
+
+// String is returns simple human readable string.
+func (k DNSSECKey) String() string {
+	role := "ZSK"
+	if k.IsKSK() {
+		role = "KSK"
+	}
+	return fmt.Sprintf("%s %s %s %d", k.Zone(), role, dns.AlgorithmToString[k.DNSKEY.Algorithm], k.DNSKEY.KeyTag())
+}
+
+// DNSSECSigner is the online signer of responses for zones, that reloads key files when they changed.
+//
+// Zones are decided by owner names of keys. Keys with SEP flag (KSK) sign DNSKEY records, and the other keys (ZSK) sign other records.
+// If a zone has only one kind of keys, they sign all records.
+//
+// Paths can be directories. All "*.key" files in the directories are read as keys.
+type DNSSECSigner struct {
+	Paths       []string
+	Validity    time.Duration // Validity period of signatures.
+	NegativeTTL uint32        // TTL of SOA and NSEC records in negative responses.
+	Interval    time.Duration // Interval to check update of key files.
+	Clock       Clock         // Source of current time.
+
+	mutex   sync.RWMutex
+	zones   map[string][]DNSSECKey
+	watcher fileWatcher
+}
+
+// NewDNSSECSigner is constructor of DNSSECSigner. Nothing is signed until Reload or Start called.
+func NewDNSSECSigner(paths []string) *DNSSECSigner {
+	return &DNSSECSigner{
+		Paths:       paths,
+		Validity:    DefaultDNSSECValidity,
+		NegativeTTL: DefaultDNSSECNegativeTTL,
+		Interval:    DefaultDNSSECInterval,
+		Clock:       DefaultClock,
+	}
+}
+
+// String is returns simple human readable string.
+func (s *DNSSECSigner) String() string {
+	return fmt.Sprintf("DNSSECSigner%s", s.Paths)
+}
+
+// files is get paths to public key files, and stamp string that changes when any file updated.
+func (s *DNSSECSigner) files() (keys []string, stamp string, err error) {
+	files, stamp, err := listFiles("DNSSEC key", s.Paths)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f, ".key") {
+			keys = append(keys, f)
+		}
+	}
+	return keys, stamp, nil
+}
+
+// Reload is read key files and replace keys. Keys are kept if failed to read.
+func (s *DNSSECSigner) Reload() error {
+	files, stamp, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	zones := make(map[string][]DNSSECKey)
+	for _, path := range files {
+		key, err := LoadDNSSECKey(path)
+		if err != nil {
+			return err
+		}
+		zones[key.Zone().String()] = append(zones[key.Zone().String()], key)
+
+		if key.IsKSK() {
+			logger.Info("loaded DNSSEC key", logger.Fields{"key": key.String(), "ds": key.DNSKEY.ToDS(dns.SHA256).String()})
+		} else {
+			logger.Info("loaded DNSSEC key", logger.Fields{"key": key.String()})
+		}
+	}
+
+	s.mutex.Lock()
+	s.zones = zones
+	s.mutex.Unlock()
+
+	s.watcher.loaded(stamp)
+	return nil
+}
+
+// stamp is get stamp string that changes when any key file updated.
+func (s *DNSSECSigner) stamp() (string, error) {
+	_, stamp, err := s.files()
+	return stamp, err
+}
+
+// Start is read key files and start watching them in background.
+func (s *DNSSECSigner) Start() error {
+	if err := s.Reload(); err != nil {
+		return err
+	}
+
+	s.watcher.start(s.Clock, s.Interval, "DNSSEC keys", logger.Fields{"paths": s.Paths}, s.stamp, s.Reload)
+	return nil
+}
+
+// Close is stop watching key files.
+func (s *DNSSECSigner) Close() error {
+	s.watcher.stop()
+	return nil
+}
+
+// Zones is getter of names of signed zones in order of name.
+func (s *DNSSECSigner) Zones() []Domain {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	zones := make([]Domain, 0, len(s.zones))
+	for z := range s.zones {
+		zones = append(zones, Domain(z))
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i] < zones[j]
+	})
+	return zones
+}
+
+// findZone is find the closest zone that includes the name.
+func (s *DNSSECSigner) findZone(name string) (string, []DNSSECKey) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for {
+		if keys, ok := s.zones[name]; ok {
+			return name, keys
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return "", nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// inZone is check if the name is the zone or a subdomain of the zone.
+func inZone(name, zone string) bool {
+	name = strings.ToLower(name)
+	return name == zone || zone == "." || strings.HasSuffix(name, "."+zone)
+}
+
+// DNSKEYs is get DNSKEY records that published at the time.
+func (s *DNSSECSigner) DNSKEYs(zone Domain, t time.Time) []dns.RR {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var rrs []dns.RR
+	for _, k := range s.zones[zone.Normalized().String()] {
+		if k.Published(t) {
+			rrs = append(rrs, k.DNSKEY)
+		}
+	}
+	return rrs
+}
+
+// signingKeys is select keys to sign RRset of the type at the time.
+func signingKeys(keys []DNSSECKey, rrtype uint16, t time.Time) []DNSSECKey {
+	var ksk, zsk []DNSSECKey
+	for _, k := range keys {
+		if !k.Active(t) {
+			continue
+		}
+		if k.IsKSK() {
+			ksk = append(ksk, k)
+		} else {
+			zsk = append(zsk, k)
+		}
+	}
+
+	if (rrtype == dns.TypeDNSKEY && len(ksk) > 0) || len(zsk) == 0 {
+		return ksk
+	}
+	return zsk
+}
+
+// signSection is append RRSIG records for all RRsets in the zone in the section.
+func (s *DNSSECSigner) signSection(section []dns.RR, zone string, keys []DNSSECKey, now time.Time) []dns.RR {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+		class  uint16
+	}
+
+	var order []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT || !inZone(h.Name, zone) {
+			continue
+		}
+		k := rrsetKey{strings.ToLower(h.Name), h.Rrtype, h.Class}
+		if _, ok := rrsets[k]; !ok {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+
+	for _, k := range order {
+		rrset := rrsets[k]
+		for _, key := range signingKeys(keys, k.rrtype, now) {
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+				Algorithm:  key.DNSKEY.Algorithm,
+				KeyTag:     key.DNSKEY.KeyTag(),
+				SignerName: zone,
+				Inception:  uint32(now.Add(-dnssecInceptionOffset).Unix()),
+				Expiration: uint32(now.Add(s.Validity).Unix()),
+			}
+			if err := sig.Sign(key.Signer, rrset); err != nil {
+				logger.Warn("failed to sign", logger.Fields{"key": key.String(), "name": k.name, "type": QtypeToString(k.rrtype), "reason": err})
+				continue
+			}
+			section = append(section, sig)
+		}
+	}
+
+	return section
+}
+
+// existingTypes is get record types at the name except qtype by resolving each type of dnssecRecordTypes.
+func existingTypes(ctx context.Context, resolver Resolver, name string, qtype uint16) []uint16 {
+	var types []uint16
+
+	for _, t := range dnssecRecordTypes {
+		if t == qtype {
+			continue
+		}
+
+		found := false
+		req := Request{Question: dns.Question{Name: name, Qtype: t, Qclass: dns.ClassINET}, ctx: ctx}
+		err := ResolveContext(ctx, resolver, NewResponseCallback(func(r Record) error {
+			if r.GetQtype() == t && strings.EqualFold(r.GetName().String(), name) {
+				found = true
+			}
+			return nil
+		}), req)
+		if err != nil {
+			logger.Warn("failed to check record types for NSEC", logger.Fields{"name": name, "type": dns.TypeToString[t], "reason": err})
+		}
+		if found {
+			types = append(types, t)
+		}
+	}
+
+	return types
+}
+
+// denial is make SOA and NSEC records for negative response by compact denial of existence (RFC 9824).
+//
+// NSEC record covers only the query name, so zone can't be enumerated.
+// The type bitmap of NSEC lists types that exist at the name, so validators that use aggressive NSEC (RFC 8198) don't deny them.
+func (s *DNSSECSigner) denial(ctx context.Context, resolver Resolver, msg *dns.Msg, zone string, now time.Time) {
+	q := msg.Question[0]
+	name := strings.ToLower(q.Name)
+
+	var soa *dns.SOA
+	var ns []dns.RR
+	for _, rr := range msg.Ns {
+		if x, ok := rr.(*dns.SOA); ok && soa == nil {
+			soa = x
+		} else if rr.Header().Rrtype != dns.TypeNSEC {
+			ns = append(ns, rr)
+		}
+	}
+	if soa == nil {
+		soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.NegativeTTL},
+			Ns:      zone,
+			Mbox:    "hostmaster." + zone,
+			Serial:  uint32(now.Unix()),
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  s.NegativeTTL,
+		}
+	}
+
+	types := append(existingTypes(ctx, resolver, name, q.Qtype), dns.TypeRRSIG, dns.TypeNSEC)
+	if msg.Rcode == dns.RcodeNameError && len(types) == 2 {
+		types = append(types, typeNXNAME)
+	} else if name == zone {
+		for _, t := range []uint16{dns.TypeSOA, dns.TypeDNSKEY} {
+			if t != q.Qtype {
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: soa.Minttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: types,
+	}
+
+	msg.Rcode = dns.RcodeSuccess
+	msg.Ns = append([]dns.RR{soa, nsec}, ns...)
+}
+
+// Sign is sign the response message if the query name is in the signed zones.
+//
+// DNSKEY query for apex of the zone is answered even if dnssecOK is false.
+// Other records are signed only if dnssecOK is true and the message is authoritative.
+// Negative responses get NSEC proof and NXDOMAIN is converted to NODATA, like compact denial of existence (RFC 9824).
+// The resolver is used to check record types that exist at the query name for the NSEC record.
+func (s *DNSSECSigner) Sign(ctx context.Context, resolver Resolver, msg *dns.Msg, dnssecOK bool) {
+	if len(msg.Question) == 0 {
+		return
+	}
+	q := msg.Question[0]
+
+	zone, keys := s.findZone(strings.ToLower(q.Name))
+	if zone == "" {
+		return
+	}
+	now := s.Clock.Now()
+
+	if q.Qtype == dns.TypeDNSKEY && strings.ToLower(q.Name) == zone && len(msg.Answer) == 0 {
+		msg.Rcode = dns.RcodeSuccess
+		msg.Authoritative = true
+		msg.Answer = s.DNSKEYs(Domain(zone), now)
+	}
+
+	if !dnssecOK || !msg.Authoritative {
+		return
+	}
+
+	if msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0) {
+		s.denial(ctx, resolver, msg, zone, now)
+	}
+
+	msg.Answer = s.signSection(msg.Answer, zone, keys, now)
+	msg.Ns = s.signSection(msg.Ns, zone, keys, now)
+	msg.Extra = s.signSection(msg.Extra, zone, keys, now)
+}
@@ -0,0 +1,284 @@
+package landns_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+// generateDNSSECKey is make BIND style key files of ECDSAP256SHA256 into dir. timing is appended to the private key file.
+func generateDNSSECKey(t *testing.T, dir, zone string, flags uint16, timing string) *dns.DNSKEY {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+	if err := ioutil.WriteFile(base+".key", []byte("; This is a key file.\n"+key.String()+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+	if err := ioutil.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)+timing), 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+
+	return key
+}
+
+func makeKeyDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "landns-dnssec")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// assertSigned is check that RRset of name and rrtype in rrs is signed by the key and the signature is valid at the time.
+func assertSigned(t *testing.T, rrs []dns.RR, name string, rrtype uint16, key *dns.DNSKEY, now time.Time) {
+	t.Helper()
+
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if rr.Header().Name != name {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == rrtype {
+			rrset = append(rrset, rr)
+		}
+	}
+
+	if len(rrset) == 0 || len(sigs) != 1 {
+		t.Errorf("%s %s: unexpected records: %s", name, dns.TypeToString[rrtype], rrs)
+		return
+	}
+	if sigs[0].KeyTag != key.KeyTag() {
+		t.Errorf("%s %s: signed by unexpected key: expected %d but got %d", name, dns.TypeToString[rrtype], key.KeyTag(), sigs[0].KeyTag)
+	}
+	if err := sigs[0].Verify(key, rrset); err != nil {
+		t.Errorf("%s %s: failed to verify: %s", name, dns.TypeToString[rrtype], err)
+	}
+	if !sigs[0].ValidityPeriod(now) {
+		t.Errorf("%s %s: signature is not valid at %s", name, dns.TypeToString[rrtype], now)
+	}
+}
+
+func TestLoadDNSSECKey(t *testing.T) {
+	t.Parallel()
+
+	dir, closer := makeKeyDir(t)
+	defer closer()
+
+	dnskey := generateDNSSECKey(t, dir, "example.com.", 257, "Created: 20200101000000\nPublish: 20200101000000\nActivate: 20200102000000\n")
+	path := filepath.Join(dir, fmt.Sprintf("Kexample.com.+013+%05d.key", dnskey.KeyTag()))
+
+	key, err := landns.LoadDNSSECKey(path)
+	if err != nil {
+		t.Fatalf("failed to load key: %s", err)
+	}
+	if key.Zone() != "example.com." || !key.IsKSK() || key.DNSKEY.KeyTag() != dnskey.KeyTag() {
+		t.Errorf("unexpected key: %s", key)
+	}
+	if key.String() != fmt.Sprintf("example.com. KSK ECDSAP256SHA256 %d", dnskey.KeyTag()) {
+		t.Errorf("unexpected string: %s", key)
+	}
+
+	publish := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !key.Publish.Equal(publish) || !key.Activate.Equal(publish.Add(24*time.Hour)) || !key.Inactive.IsZero() || !key.Delete.IsZero() {
+		t.Errorf("unexpected timing: %s %s %s %s", key.Publish, key.Activate, key.Inactive, key.Delete)
+	}
+	if key.Published(publish.Add(-time.Second)) || !key.Published(publish) || key.Active(publish) || !key.Active(publish.Add(24*time.Hour)) {
+		t.Errorf("unexpected state")
+	}
+
+	if err := os.Remove(strings.TrimSuffix(path, ".key") + ".private"); err != nil {
+		t.Fatalf("failed to remove private key: %s", err)
+	}
+	if _, err := landns.LoadDNSSECKey(path); err == nil || !strings.HasPrefix(err.Error(), "failed to read DNSSEC private key file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDNSSECSigner_Sign(t *testing.T) {
+	t.Parallel()
+
+	dir, closer := makeKeyDir(t)
+	defer closer()
+
+	ksk := generateDNSSECKey(t, dir, "example.com.", 257, "")
+	zsk := generateDNSSECKey(t, dir, "example.com.", 256, "")
+
+	clock := testutil.NewFakeClock()
+	signer := landns.NewDNSSECSigner([]string{dir})
+	signer.Clock = clock
+	if err := signer.Reload(); err != nil {
+		t.Fatalf("failed to load keys: %s", err)
+	}
+	if zones := signer.Zones(); len(zones) != 1 || zones[0] != "example.com." {
+		t.Errorf("unexpected zones: %s", zones)
+	}
+	now := clock.Now()
+
+	zone := landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "www.example.com.", TTL: 60, Address: net.ParseIP("192.168.1.1")},
+		landns.TxtRecord{Name: "www.example.com.", TTL: 60, Text: "hello"},
+	})
+
+	// Positive response.
+	msg := makeResponse("www.example.com.", dns.TypeA, "www.example.com. 60 IN A 192.168.1.1", "www.example.com. 60 IN A 192.168.1.2")
+	msg.Authoritative = true
+	signer.Sign(context.Background(), zone, msg, true)
+	if len(msg.Answer) != 3 {
+		t.Errorf("unexpected answer: %s", msg.Answer)
+	}
+	assertSigned(t, msg.Answer, "www.example.com.", dns.TypeA, zsk, now)
+
+	// DNSKEY is signed by KSK.
+	msg = makeResponse("example.com.", dns.TypeDNSKEY)
+	msg.Authoritative = true
+	signer.Sign(context.Background(), zone, msg, true)
+	if len(msg.Answer) != 3 {
+		t.Errorf("unexpected answer: %s", msg.Answer)
+	}
+	assertSigned(t, msg.Answer, "example.com.", dns.TypeDNSKEY, ksk, now)
+
+	// DNSKEY is answered but not signed without DO bit.
+	msg = makeResponse("example.com.", dns.TypeDNSKEY)
+	signer.Sign(context.Background(), zone, msg, false)
+	if len(msg.Answer) != 2 || !msg.Authoritative {
+		t.Errorf("unexpected answer: %s", msg.Answer)
+	}
+
+	// NXDOMAIN is converted to NODATA with NSEC.
+	msg = makeResponse("notfound.example.com.", dns.TypeA)
+	msg.Authoritative = true
+	msg.Rcode = dns.RcodeNameError
+	signer.Sign(context.Background(), zone, msg, true)
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 || len(msg.Ns) != 4 {
+		t.Errorf("unexpected response: %s", msg)
+	}
+	assertSigned(t, msg.Ns, "example.com.", dns.TypeSOA, zsk, now)
+	assertSigned(t, msg.Ns, "notfound.example.com.", dns.TypeNSEC, zsk, now)
+	if nsec, ok := msg.Ns[1].(*dns.NSEC); !ok || nsec.NextDomain != "\\000.notfound.example.com." || fmt.Sprint(nsec.TypeBitMap) != "[46 47 128]" {
+		t.Errorf("unexpected NSEC: %s", msg.Ns[1])
+	}
+
+	// NODATA lists types that exist at the name.
+	msg = makeResponse("www.example.com.", dns.TypeAAAA)
+	msg.Authoritative = true
+	signer.Sign(context.Background(), zone, msg, true)
+	if nsec, ok := msg.Ns[1].(*dns.NSEC); !ok || fmt.Sprint(nsec.TypeBitMap) != "[1 16 46 47]" {
+		t.Errorf("unexpected NSEC: %s", msg.Ns)
+	}
+	assertSigned(t, msg.Ns, "www.example.com.", dns.TypeNSEC, zsk, now)
+
+	// NXDOMAIN for a name that has other types is NODATA.
+	msg = makeResponse("www.example.com.", dns.TypeAAAA)
+	msg.Authoritative = true
+	msg.Rcode = dns.RcodeNameError
+	signer.Sign(context.Background(), zone, msg, true)
+	if nsec, ok := msg.Ns[1].(*dns.NSEC); !ok || msg.Rcode != dns.RcodeSuccess || fmt.Sprint(nsec.TypeBitMap) != "[1 16 46 47]" {
+		t.Errorf("unexpected NSEC: %s", msg.Ns)
+	}
+
+	// NODATA at apex.
+	msg = makeResponse("example.com.", dns.TypeA)
+	msg.Authoritative = true
+	signer.Sign(context.Background(), zone, msg, true)
+	if nsec, ok := msg.Ns[1].(*dns.NSEC); !ok || nsec.Hdr.Name != "example.com." || fmt.Sprint(nsec.TypeBitMap) != "[6 46 47 48]" {
+		t.Errorf("unexpected NSEC: %s", msg.Ns)
+	}
+
+	// Not signed without DO bit, or not authoritative, or out of zones.
+	for _, tt := range []struct {
+		Name          string
+		Authoritative bool
+		DO            bool
+	}{
+		{"www.example.com.", true, false},
+		{"www.example.com.", false, true},
+		{"www.example.org.", true, true},
+	} {
+		msg := makeResponse(tt.Name, dns.TypeA, tt.Name+" 60 IN A 192.168.1.1")
+		msg.Authoritative = tt.Authoritative
+		signer.Sign(context.Background(), zone, msg, tt.DO)
+		if len(msg.Answer) != 1 || len(msg.Ns) != 0 {
+			t.Errorf("%s: unexpected response: %s", tt.Name, msg)
+		}
+	}
+}
+
+func TestDNSSECSigner_Rollover(t *testing.T) {
+	t.Parallel()
+
+	dir, closer := makeKeyDir(t)
+	defer closer()
+
+	clock := testutil.NewFakeClock()
+	now := clock.Now().UTC()
+	timing := func(name string, d time.Duration) string {
+		return fmt.Sprintf("%s: %s\n", name, now.Add(d).Format("20060102150405"))
+	}
+
+	generateDNSSECKey(t, dir, "example.com.", 257, "")
+	oldZSK := generateDNSSECKey(t, dir, "example.com.", 256, timing("Inactive", time.Hour)+timing("Delete", 2*time.Hour))
+	newZSK := generateDNSSECKey(t, dir, "example.com.", 256, timing("Publish", -time.Hour)+timing("Activate", time.Hour))
+
+	signer := landns.NewDNSSECSigner([]string{dir})
+	signer.Clock = clock
+	if err := signer.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer signer.Close()
+
+	zone := landns.NewSimpleResolver(nil)
+	sign := func() *dns.Msg {
+		msg := makeResponse("www.example.com.", dns.TypeA, "www.example.com. 60 IN A 192.168.1.1")
+		msg.Authoritative = true
+		signer.Sign(context.Background(), zone, msg, true)
+		return msg
+	}
+
+	if n := len(signer.DNSKEYs("example.com.", clock.Now())); n != 3 {
+		t.Errorf("unexpected number of DNSKEY: %d", n)
+	}
+	assertSigned(t, sign().Answer, "www.example.com.", dns.TypeA, oldZSK, clock.Now())
+
+	clock.Add(90 * time.Minute)
+	if n := len(signer.DNSKEYs("example.com.", clock.Now())); n != 3 {
+		t.Errorf("unexpected number of DNSKEY: %d", n)
+	}
+	assertSigned(t, sign().Answer, "www.example.com.", dns.TypeA, newZSK, clock.Now())
+
+	clock.Add(time.Hour)
+	if n := len(signer.DNSKEYs("example.com.", clock.Now())); n != 2 {
+		t.Errorf("unexpected number of DNSKEY: %d", n)
+	}
+
+	if err := landns.NewDNSSECSigner([]string{filepath.Join(dir, "not-exists")}).Start(); err == nil || !strings.HasPrefix(err.Error(), "failed to read DNSSEC key file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package landns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// DnstapContentType is the content type of Frame Streams that written by DnstapQueryLogSink.
+const DnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Field numbers and enum values of dnstap.proto.
+const (
+	dnstapFieldIdentity = 1
+	dnstapFieldVersion  = 2
+	dnstapFieldMessage  = 14
+	dnstapFieldType     = 15
+
+	dnstapMessageType             = 1
+	dnstapMessageSocketFamily     = 2
+	dnstapMessageSocketProtocol   = 3
+	dnstapMessageQueryAddress     = 4
+	dnstapMessageResponseAddress  = 5
+	dnstapMessageQueryPort        = 6
+	dnstapMessageResponsePort     = 7
+	dnstapMessageQueryTimeSec     = 8
+	dnstapMessageQueryTimeNsec    = 9
+	dnstapMessageQueryMessage     = 10
+	dnstapMessageResponseTimeSec  = 12
+	dnstapMessageResponseTimeNsec = 13
+	dnstapMessageResponseMessage  = 14
+
+	dnstapTypeMessage = 1
+
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+)
+
+// Control frame types and fields of Frame Streams.
+const (
+	fstrmControlStart = 2
+	fstrmControlStop  = 3
+
+	fstrmFieldContentType = 1
+)
+
+// protoBuffer is a minimal encoder of Protocol Buffers.
+type protoBuffer []byte
+
+func (b protoBuffer) varint(v uint64) protoBuffer {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func (b protoBuffer) uint(field int, v uint64) protoBuffer {
+	return b.varint(uint64(field<<3 | 0)).varint(v)
+}
+
+func (b protoBuffer) fixed32(field int, v uint32) protoBuffer {
+	b = b.varint(uint64(field<<3 | 5))
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func (b protoBuffer) bytes(field int, v []byte) protoBuffer {
+	b = b.varint(uint64(field<<3 | 2)).varint(uint64(len(v)))
+	return append(b, v...)
+}
+
+// frameWriter is io.Writer that writes header and footer into each file by itself, like RotatingFile.
+type frameWriter interface {
+	io.Writer
+	SetFrame(header, footer []byte) error
+}
+
+// DnstapQueryLogSink is QueryLogSink that writes entries in dnstap format.
+//
+// Each entry is written as two messages of CLIENT_QUERY and CLIENT_RESPONSE, in unidirectional Frame Streams.
+type DnstapQueryLogSink struct {
+	Writer   io.Writer // Writer for output. It will be closed when closing sink if it implements io.Closer.
+	Identity string    // Identity of this server. Omitted if empty.
+	Version  string    // Version of this server. Omitted if empty.
+
+	framed bool
+}
+
+// NewDnstapQueryLogSink is constructor of DnstapQueryLogSink. It writes the start frame of Frame Streams into w.
+//
+// If w has SetFrame method like RotatingFile, the start and stop frames are written by w into each file instead.
+func NewDnstapQueryLogSink(w io.Writer, identity string) (*DnstapQueryLogSink, error) {
+	s := &DnstapQueryLogSink{
+		Writer:   w,
+		Identity: identity,
+		Version:  "landns",
+	}
+
+	start := make([]byte, 12, 12+len(DnstapContentType))
+	binary.BigEndian.PutUint32(start[0:], fstrmControlStart)
+	binary.BigEndian.PutUint32(start[4:], fstrmFieldContentType)
+	binary.BigEndian.PutUint32(start[8:], uint32(len(DnstapContentType)))
+	start = append(start, DnstapContentType...)
+
+	if fw, ok := w.(frameWriter); ok {
+		if err := fw.SetFrame(controlFrame(start), controlFrame(fstrmStopFrame())); err != nil {
+			return nil, Error{TypeExternalError, err, "failed to write dnstap"}
+		}
+		s.framed = true
+		return s, nil
+	}
+
+	if err := s.writeControl(start); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func fstrmStopFrame() []byte {
+	stop := make([]byte, 4)
+	binary.BigEndian.PutUint32(stop, fstrmControlStop)
+	return stop
+}
+
+// controlFrame is make bytes of control frame of Frame Streams, that starts with the escape sequence.
+func controlFrame(frame []byte) []byte {
+	buf := make([]byte, 8, 8+len(frame))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(frame)))
+	return append(buf, frame...)
+}
+
+func (s *DnstapQueryLogSink) writeControl(frame []byte) error {
+	if _, err := s.Writer.Write(controlFrame(frame)); err != nil {
+		return Error{TypeExternalError, err, "failed to write dnstap"}
+	}
+	return nil
+}
+
+func (s *DnstapQueryLogSink) writeFrame(payload []byte) error {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+
+	if _, err := s.Writer.Write(append(buf, payload...)); err != nil {
+		return Error{TypeExternalError, err, "failed to write dnstap"}
+	}
+	return nil
+}
+
+func dnstapAddress(addr net.Addr) (ip net.IP, port int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	default:
+		return nil, 0
+	}
+}
+
+func dnstapTime(msg protoBuffer, secField, nsecField int, t time.Time) protoBuffer {
+	return msg.uint(secField, uint64(t.Unix())).fixed32(nsecField, uint32(t.Nanosecond()))
+}
+
+func (s *DnstapQueryLogSink) encode(entry QueryLogEntry, typ uint64) ([]byte, error) {
+	msg := protoBuffer(nil).uint(dnstapMessageType, typ)
+
+	remote, remotePort := dnstapAddress(entry.Remote)
+	local, localPort := dnstapAddress(entry.Local)
+	if remote != nil {
+		if ip := remote.To4(); ip != nil {
+			msg = msg.uint(dnstapMessageSocketFamily, dnstapFamilyINET).bytes(dnstapMessageQueryAddress, ip)
+		} else {
+			msg = msg.uint(dnstapMessageSocketFamily, dnstapFamilyINET6).bytes(dnstapMessageQueryAddress, remote.To16())
+		}
+		msg = msg.uint(dnstapMessageQueryPort, uint64(remotePort))
+	}
+	if local != nil {
+		if ip := local.To4(); ip != nil && remote.To4() != nil {
+			msg = msg.bytes(dnstapMessageResponseAddress, ip)
+		} else {
+			msg = msg.bytes(dnstapMessageResponseAddress, local.To16())
+		}
+		msg = msg.uint(dnstapMessageResponsePort, uint64(localPort))
+	}
+
+	switch entry.Protocol() {
+	case "udp":
+		msg = msg.uint(dnstapMessageSocketProtocol, dnstapProtocolUDP)
+	case "tcp":
+		msg = msg.uint(dnstapMessageSocketProtocol, dnstapProtocolTCP)
+	}
+
+	msg = dnstapTime(msg, dnstapMessageQueryTimeSec, dnstapMessageQueryTimeNsec, entry.Time)
+	if entry.Query != nil {
+		q, err := entry.Query.Pack()
+		if err != nil {
+			return nil, Error{TypeInternalError, err, "failed to encode dnstap"}
+		}
+		msg = msg.bytes(dnstapMessageQueryMessage, q)
+	}
+
+	if typ == dnstapClientResponse {
+		msg = dnstapTime(msg, dnstapMessageResponseTimeSec, dnstapMessageResponseTimeNsec, entry.Time.Add(entry.Latency))
+		if entry.Response != nil {
+			r, err := entry.Response.Pack()
+			if err != nil {
+				return nil, Error{TypeInternalError, err, "failed to encode dnstap"}
+			}
+			msg = msg.bytes(dnstapMessageResponseMessage, r)
+		}
+	}
+
+	var tap protoBuffer
+	if s.Identity != "" {
+		tap = tap.bytes(dnstapFieldIdentity, []byte(s.Identity))
+	}
+	if s.Version != "" {
+		tap = tap.bytes(dnstapFieldVersion, []byte(s.Version))
+	}
+	return tap.bytes(dnstapFieldMessage, msg).uint(dnstapFieldType, dnstapTypeMessage), nil
+}
+
+// Write is write the query and the response of entry as dnstap messages.
+func (s *DnstapQueryLogSink) Write(entry QueryLogEntry) error {
+	for _, typ := range []uint64{dnstapClientQuery, dnstapClientResponse} {
+		payload, err := s.encode(entry, typ)
+		if err != nil {
+			return err
+		}
+		if err := s.writeFrame(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is write the stop frame of Frame Streams, and close Writer if it implements io.Closer.
+func (s *DnstapQueryLogSink) Close() error {
+	var err error
+	if !s.framed {
+		err = s.writeControl(fstrmStopFrame())
+	}
+
+	if c, ok := s.Writer.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package landns_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/miekg/dns"
+)
+
+// readProto is a minimal decoder of Protocol Buffers for tests. It returns fields as map of field number to values.
+func readProto(t *testing.T, b []byte) map[int][]interface{} {
+	t.Helper()
+
+	varint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("failed to read varint")
+		}
+		b = b[n:]
+		return v
+	}
+
+	fields := make(map[int][]interface{})
+	for len(b) > 0 {
+		key := varint()
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case 0:
+			fields[field] = append(fields[field], varint())
+		case 2:
+			l := varint()
+			fields[field] = append(fields[field], b[:l])
+			b = b[l:]
+		case 5:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type: %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestDnstapQueryLogSink(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	sink, err := landns.NewDnstapQueryLogSink(buf, "test-server")
+	if err != nil {
+		t.Fatalf("failed to make sink: %s", err)
+	}
+
+	query := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg).SetReply(query)
+	start := time.Unix(1600000000, 123456789)
+
+	err = sink.Write(landns.QueryLogEntry{
+		Time:     start,
+		Remote:   &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 12345},
+		Local:    &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+		Query:    query,
+		Response: response,
+		Latency:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	b := buf.Bytes()
+	readUint32 := func() uint32 {
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		return v
+	}
+	readFrame := func() (control bool, payload []byte) {
+		l := readUint32()
+		if l == 0 {
+			control = true
+			l = readUint32()
+		}
+		payload = b[:l]
+		b = b[l:]
+		return
+	}
+
+	if control, payload := readFrame(); !control || !bytes.Equal(payload, append([]byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, byte(len(landns.DnstapContentType))}, landns.DnstapContentType...)) {
+		t.Fatalf("unexpected start frame: %v", payload)
+	}
+
+	for _, typ := range []uint64{5, 6} {
+		control, payload := readFrame()
+		if control {
+			t.Fatalf("unexpected control frame: %v", payload)
+		}
+
+		tap := readProto(t, payload)
+		if string(tap[1][0].([]byte)) != "test-server" || string(tap[2][0].([]byte)) != "landns" || tap[15][0] != uint64(1) {
+			t.Errorf("unexpected dnstap: %v", tap)
+		}
+
+		msg := readProto(t, tap[14][0].([]byte))
+		if msg[1][0] != typ {
+			t.Errorf("unexpected message type: expected %d but got %v", typ, msg[1][0])
+		}
+		if msg[2][0] != uint64(1) || msg[3][0] != uint64(1) {
+			t.Errorf("unexpected socket family or protocol: %v %v", msg[2], msg[3])
+		}
+		if !net.IP(msg[4][0].([]byte)).Equal(net.ParseIP("127.1.2.3")) || msg[6][0] != uint64(12345) {
+			t.Errorf("unexpected query address: %v:%v", msg[4], msg[6])
+		}
+		if !net.IP(msg[5][0].([]byte)).Equal(net.ParseIP("127.0.0.1")) || msg[7][0] != uint64(53) {
+			t.Errorf("unexpected response address: %v:%v", msg[5], msg[7])
+		}
+		if msg[8][0] != uint64(1600000000) || msg[9][0] != uint32(123456789) {
+			t.Errorf("unexpected query time: %v.%v", msg[8], msg[9])
+		}
+
+		var q dns.Msg
+		if err := q.Unpack(msg[10][0].([]byte)); err != nil || q.Question[0].Name != "example.com." {
+			t.Errorf("unexpected query message: %v", err)
+		}
+
+		if typ == 5 {
+			if len(msg[12]) != 0 || len(msg[14]) != 0 {
+				t.Errorf("query message has response fields: %v", msg)
+			}
+			continue
+		}
+
+		if msg[12][0] != uint64(1600000000) || msg[13][0] != uint32(124456789) {
+			t.Errorf("unexpected response time: %v.%v", msg[12], msg[13])
+		}
+
+		var r dns.Msg
+		if err := r.Unpack(msg[14][0].([]byte)); err != nil || !r.Response || r.Id != query.Id {
+			t.Errorf("unexpected response message: %v", err)
+		}
+	}
+
+	if control, payload := readFrame(); !control || !bytes.Equal(payload, []byte{0, 0, 0, 3}) {
+		t.Fatalf("unexpected stop frame: %v", payload)
+	}
+	if len(b) != 0 {
+		t.Errorf("unexpected trailing bytes: %v", b)
+	}
+}
+
+func TestDnstapQueryLogSink_Rotate(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-dnstap")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.tap")
+	if err := ioutil.WriteFile(path, []byte("previous stream"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	f, err := landns.NewRotatingFile(path, 400, 20)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+	sink, err := landns.NewDnstapQueryLogSink(f, "test-server")
+	if err != nil {
+		t.Fatalf("failed to make sink: %s", err)
+	}
+
+	query := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 5; i++ {
+		err := sink.Write(landns.QueryLogEntry{
+			Time:     time.Now(),
+			Remote:   &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 12345},
+			Query:    query,
+			Response: new(dns.Msg).SetReply(query),
+		})
+		if err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	if b, err := ioutil.ReadFile(path + ".1"); err != nil || len(b) == 0 {
+		t.Fatalf("file was not rotated: %v", err)
+	}
+
+	messages := 0
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		if string(b) == "previous stream" {
+			continue
+		}
+
+		var frames []string
+		for len(b) > 0 {
+			l := binary.BigEndian.Uint32(b)
+			b = b[4:]
+			if l != 0 {
+				frames = append(frames, "data")
+				b = b[l:]
+				continue
+			}
+			l = binary.BigEndian.Uint32(b)
+			switch binary.BigEndian.Uint32(b[4:]) {
+			case 2:
+				frames = append(frames, "start")
+			case 3:
+				frames = append(frames, "stop")
+			}
+			b = b[4+l:]
+		}
+
+		if len(frames) < 3 || frames[0] != "start" || frames[len(frames)-1] != "stop" {
+			t.Errorf("%s: unexpected frames: %v", name, frames)
+			continue
+		}
+		for _, f := range frames[1 : len(frames)-1] {
+			if f != "data" {
+				t.Errorf("%s: unexpected frames: %v", name, frames)
+			}
+		}
+		messages += len(frames) - 2
+	}
+	if messages != 10 {
+		t.Errorf("unexpected number of messages: %d", messages)
+	}
+}
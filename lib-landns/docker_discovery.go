@@ -0,0 +1,376 @@
+package landns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+)
+
+const (
+	// DefaultDockerSocket is the default path to the unix socket of Docker Engine API.
+	DefaultDockerSocket = "/var/run/docker.sock"
+
+	// DefaultDockerDomain is the default domain suffix for records of containers.
+	DefaultDockerDomain Domain = "docker."
+
+	// DefaultDockerTTL is the default TTL for records of containers.
+	DefaultDockerTTL uint32 = 60
+
+	// DefaultDockerInterval is the default interval to re-synchronize all containers.
+	DefaultDockerInterval = 30 * time.Second
+)
+
+// DockerContainer is the container information from Docker Engine API.
+type DockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// Hostnames is get hostnames of container without domain suffix.
+//
+// A container that made by docker-compose has "SERVICE.PROJECT", and every container has its container name.
+func (c DockerContainer) Hostnames() []string {
+	var names []string
+
+	service := c.Labels["com.docker.compose.service"]
+	project := c.Labels["com.docker.compose.project"]
+	if service != "" && project != "" {
+		names = append(names, service+"."+project)
+	}
+
+	for _, name := range c.Names {
+		if name = strings.Trim(name, "/"); name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Addresses is get IP addresses of container in all networks.
+func (c DockerContainer) Addresses() []net.IP {
+	networks := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+
+	var addrs []net.IP
+	for _, name := range networks {
+		n := c.NetworkSettings.Networks[name]
+		for _, s := range []string{n.IPAddress, n.GlobalIPv6Address} {
+			if ip := net.ParseIP(s); ip != nil {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs
+}
+
+// dockerEvent is the event from Docker Engine API.
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// ContainerID is get ID of the container that related to the event.
+func (e dockerEvent) ContainerID() string {
+	if e.Type == "network" {
+		return e.Actor.Attributes["container"]
+	}
+	return e.Actor.ID
+}
+
+// DockerDiscovery is the service discovery of Docker containers into DynamicResolver.
+//
+// DockerDiscovery watches container events via Docker Engine API, and keeps volatile A/AAAA records (and PTR records that made by DynamicResolver) for each running container.
+// Records are refreshed every Interval, so they will expire even if DockerDiscovery stopped without cleanup.
+type DockerDiscovery struct {
+	Socket   string          // Path to the unix socket of Docker Engine API.
+	Domain   Domain          // Domain suffix for containers like "docker.".
+	Resolver DynamicResolver // Destination of records.
+	TTL      uint32          // TTL for records. This should be longer than Interval.
+	Interval time.Duration   // Interval to re-synchronize all containers.
+	Clock    Clock           // Source of current time.
+
+	client     *http.Client
+	mutex      sync.Mutex
+	sync       recordSync
+	containers map[string]DockerContainer
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// NewDockerDiscovery is constructor of DockerDiscovery.
+func NewDockerDiscovery(socket string, domain Domain, resolver DynamicResolver) *DockerDiscovery {
+	dd := &DockerDiscovery{
+		Socket:     socket,
+		Domain:     domain,
+		Resolver:   resolver,
+		TTL:        DefaultDockerTTL,
+		Interval:   DefaultDockerInterval,
+		Clock:      DefaultClock,
+		containers: make(map[string]DockerContainer),
+	}
+
+	dd.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dd.Socket)
+			},
+		},
+	}
+
+	return dd
+}
+
+// String is returns simple human readable string.
+func (dd *DockerDiscovery) String() string {
+	return fmt.Sprintf("DockerDiscovery[%s]", dd.Socket)
+}
+
+func (dd *DockerDiscovery) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, Error{TypeInternalError, err, "failed to make request"}
+	}
+
+	resp, err := dd.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to connect to Docker"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newError(TypeExternalError, nil, "unexpected response from Docker: %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+func dockerFilters(filters map[string][]string) url.Values {
+	b, _ := json.Marshal(filters)
+	return url.Values{"filters": {string(b)}}
+}
+
+// listContainers is get running containers. Returns all running containers if id is empty.
+func (dd *DockerDiscovery) listContainers(ctx context.Context, id string) ([]DockerContainer, error) {
+	var query url.Values
+	if id != "" {
+		query = dockerFilters(map[string][]string{"id": {id}})
+	}
+
+	resp, err := dd.get(ctx, "/containers/json", query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var cs []DockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&cs); err != nil {
+		return nil, Error{TypeExternalError, err, "failed to parse containers"}
+	}
+	return cs, nil
+}
+
+func (dd *DockerDiscovery) recordName(hostname string) (Domain, error) {
+	name := Domain(strings.ToLower(hostname) + "." + strings.TrimPrefix(dd.Domain.Normalized().String(), "."))
+	return name, name.Validate()
+}
+
+// makeRecords is make records for containers, in order of container IDs.
+func (dd *DockerDiscovery) makeRecords() []DynamicRecord {
+	ids := make([]string, 0, len(dd.containers))
+	for id := range dd.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var records []DynamicRecord
+	for _, id := range ids {
+		c := dd.containers[id]
+		for _, hostname := range c.Hostnames() {
+			name, err := dd.recordName(hostname)
+			if err != nil {
+				logger.Info("skip container that has invalid name", logger.Fields{"container": c.ID, "name": hostname})
+				continue
+			}
+
+			for _, addr := range c.Addresses() {
+				records = append(records, DynamicRecord{
+					Record:   AddressRecord{Name: name, TTL: dd.TTL, Address: addr},
+					Volatile: true,
+				})
+			}
+		}
+	}
+	return records
+}
+
+// Sync is get all running containers and update records in Resolver.
+func (dd *DockerDiscovery) Sync(ctx context.Context) error {
+	cs, err := dd.listContainers(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	dd.containers = make(map[string]DockerContainer)
+	for _, c := range cs {
+		dd.containers[c.ID] = c
+	}
+
+	return dd.sync.Sync(dd.Resolver, dd.makeRecords())
+}
+
+// update is get the container and update records in Resolver.
+func (dd *DockerDiscovery) update(ctx context.Context, id string) error {
+	cs, err := dd.listContainers(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	delete(dd.containers, id)
+	for _, c := range cs {
+		if c.ID == id {
+			dd.containers[id] = c
+		}
+	}
+
+	return dd.sync.Sync(dd.Resolver, dd.makeRecords())
+}
+
+// watchEvents is read container events and send them into ch until the stream closed.
+func (dd *DockerDiscovery) watchEvents(ctx context.Context, ch chan<- dockerEvent) error {
+	resp, err := dd.get(ctx, "/events", dockerFilters(map[string][]string{
+		"type":  {"container", "network"},
+		"event": {"start", "unpause", "pause", "die", "destroy", "rename", "connect", "disconnect"},
+	}))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e dockerEvent
+		if err := dec.Decode(&e); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return Error{TypeExternalError, err, "failed to read events"}
+		}
+
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Start is synchronize containers and start watching events in background.
+func (dd *DockerDiscovery) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := dd.Sync(ctx); err != nil {
+		cancel()
+		return err
+	}
+
+	dd.cancel = cancel
+	dd.done = make(chan struct{})
+
+	go func() {
+		defer close(dd.done)
+
+		for ctx.Err() == nil {
+			events := make(chan dockerEvent)
+			closed := make(chan error, 1)
+			go func() {
+				closed <- dd.watchEvents(ctx, events)
+			}()
+
+			dd.handleEvents(ctx, events, closed)
+		}
+	}()
+
+	return nil
+}
+
+// handleEvents is handle events and re-synchronize periodically until the event stream closed.
+func (dd *DockerDiscovery) handleEvents(ctx context.Context, events <-chan dockerEvent, closed <-chan error) {
+	timer := dd.Clock.After(dd.Interval)
+
+	for {
+		select {
+		case e := <-events:
+			if id := e.ContainerID(); id != "" {
+				if err := dd.update(ctx, id); err != nil && ctx.Err() == nil {
+					logger.Warn("failed to update container", logger.Fields{"container": id, "reason": err})
+				}
+			}
+		case <-timer:
+			timer = dd.Clock.After(dd.Interval)
+			if err := dd.Sync(ctx); err != nil && ctx.Err() == nil {
+				logger.Warn("failed to synchronize containers", logger.Fields{"socket": dd.Socket, "reason": err})
+			}
+		case err := <-closed:
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("lost Docker events", logger.Fields{"socket": dd.Socket, "reason": err})
+
+			// Retry after Interval, and re-synchronize for catch up missed events.
+			select {
+			case <-timer:
+			case <-ctx.Done():
+				return
+			}
+			if err := dd.Sync(ctx); err != nil && ctx.Err() == nil {
+				logger.Warn("failed to synchronize containers", logger.Fields{"socket": dd.Socket, "reason": err})
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close is stop watching containers. Records are kept in Resolver until expire.
+func (dd *DockerDiscovery) Close() error {
+	if dd.cancel != nil {
+		dd.cancel()
+		<-dd.done
+		dd.cancel = nil
+	}
+	return nil
+}
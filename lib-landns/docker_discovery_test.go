@@ -0,0 +1,265 @@
+package landns_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+)
+
+type FakeDockerContainer struct {
+	ID      string
+	Name    string
+	Service string
+	Project string
+	Address string
+}
+
+func (c FakeDockerContainer) MarshalJSON() ([]byte, error) {
+	labels := map[string]string{}
+	if c.Service != "" {
+		labels["com.docker.compose.service"] = c.Service
+		labels["com.docker.compose.project"] = c.Project
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"Id":     c.ID,
+		"Names":  []string{"/" + c.Name},
+		"Labels": labels,
+		"NetworkSettings": map[string]interface{}{
+			"Networks": map[string]interface{}{
+				"default": map[string]string{"IPAddress": c.Address, "GlobalIPv6Address": ""},
+			},
+		},
+	})
+}
+
+// FakeDocker is a fake of Docker Engine API that serves containers and events.
+type FakeDocker struct {
+	sync.Mutex
+
+	Containers []FakeDockerContainer
+	Events     chan string
+}
+
+func StartFakeDocker(t *testing.T, containers ...FakeDockerContainer) (*FakeDocker, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "landns-docker")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	fake := &FakeDocker{Containers: containers, Events: make(chan string)}
+	server := &http.Server{Handler: fake}
+	go server.Serve(l)
+
+	return fake, socket, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (f *FakeDocker) Set(containers ...FakeDockerContainer) {
+	f.Lock()
+	defer f.Unlock()
+	f.Containers = containers
+}
+
+func (f *FakeDocker) Send(typ, action, id string) {
+	actor := fmt.Sprintf(`{"ID":%q,"Attributes":{}}`, id)
+	if typ == "network" {
+		actor = fmt.Sprintf(`{"ID":"network-id","Attributes":{"container":%q}}`, id)
+	}
+	f.Events <- fmt.Sprintf(`{"Type":%q,"Action":%q,"Actor":%s}`, typ, action, actor)
+}
+
+func (f *FakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/containers/json":
+		var filters struct {
+			ID []string `json:"id"`
+		}
+		if s := r.URL.Query().Get("filters"); s != "" {
+			if err := json.Unmarshal([]byte(s), &filters); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		f.Lock()
+		cs := []FakeDockerContainer{}
+		for _, c := range f.Containers {
+			if len(filters.ID) == 0 || filters.ID[0] == c.ID {
+				cs = append(cs, c)
+			}
+		}
+		f.Unlock()
+
+		json.NewEncoder(w).Encode(cs)
+	case "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case e := <-f.Events:
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func waitRecords(t *testing.T, resolver landns.DynamicResolver, expect []string) {
+	t.Helper()
+
+	var got []string
+	for i := 0; i < 100; i++ {
+		records, err := resolver.Records()
+		if err != nil {
+			t.Fatalf("failed to get records: %s", err)
+		}
+
+		got = nil
+		for _, r := range records {
+			if !strings.HasSuffix(r.Record.GetName().String(), ".arpa.") {
+				got = append(got, r.Record.String())
+			}
+		}
+		if strings.Join(got, "\n") == strings.Join(expect, "\n") {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("unexpected records:\nexpected:\n%s\nbut got:\n%s", strings.Join(expect, "\n"), strings.Join(got, "\n"))
+}
+
+func TestDockerContainer(t *testing.T) {
+	t.Parallel()
+
+	var c landns.DockerContainer
+	raw := `{"Id":"abc","Names":["/proj_web_1","/other/link"],"Labels":{"com.docker.compose.service":"web","com.docker.compose.project":"proj"},"NetworkSettings":{"Networks":{"b":{"IPAddress":"172.19.0.2","GlobalIPv6Address":"2001:db8::2"},"a":{"IPAddress":"172.18.0.2","GlobalIPv6Address":""},"none":{"IPAddress":"","GlobalIPv6Address":""}}}}`
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	if names := strings.Join(c.Hostnames(), " "); names != "web.proj proj_web_1" {
+		t.Errorf("unexpected hostnames: %s", names)
+	}
+
+	addrs := make([]string, len(c.Addresses()))
+	for i, a := range c.Addresses() {
+		addrs[i] = a.String()
+	}
+	if s := strings.Join(addrs, " "); s != "172.18.0.2 172.19.0.2 2001:db8::2" {
+		t.Errorf("unexpected addresses: %s", s)
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	t.Parallel()
+
+	web := FakeDockerContainer{ID: "web-id", Name: "proj_web_1", Service: "web", Project: "proj", Address: "172.18.0.2"}
+	db := FakeDockerContainer{ID: "db-id", Name: "db", Address: "172.18.0.3"}
+
+	fake, socket, stop := StartFakeDocker(t, web)
+	defer stop()
+
+	clock := testutil.NewFakeClock()
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+	resolver.Clock = clock
+
+	discovery := landns.NewDockerDiscovery(socket, landns.DefaultDockerDomain, resolver)
+	discovery.Clock = clock
+	if err := discovery.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer discovery.Close()
+
+	records, err := resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	AssertDynamicRecordSet(t, []string{
+		"web.proj.docker. 60 IN A 172.18.0.2 ; ID:1 Volatile",
+		"2.0.18.172.in-addr.arpa. 60 IN PTR web.proj.docker. ; ID:2 Volatile",
+		"proj_web_1.docker. 60 IN A 172.18.0.2 ; ID:3 Volatile",
+		"2.0.18.172.in-addr.arpa. 60 IN PTR proj_web_1.docker. ; ID:4 Volatile",
+	}, records)
+
+	fake.Set(web, db)
+	fake.Send("container", "start", "db-id")
+	waitRecords(t, resolver, []string{
+		"web.proj.docker. 60 IN A 172.18.0.2",
+		"proj_web_1.docker. 60 IN A 172.18.0.2",
+		"db.docker. 60 IN A 172.18.0.3",
+	})
+
+	fake.Set(db)
+	fake.Send("container", "die", "web-id")
+	waitRecords(t, resolver, []string{
+		"db.docker. 60 IN A 172.18.0.3",
+	})
+
+	db.Address = "172.18.0.4"
+	fake.Set(db)
+	fake.Send("network", "connect", "db-id")
+	waitRecords(t, resolver, []string{
+		"db.docker. 60 IN A 172.18.0.4",
+	})
+
+	// Containers that stopped without event are removed by periodic synchronization.
+	fake.Set()
+	for clock.Timers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Add(landns.DefaultDockerInterval)
+	waitRecords(t, resolver, nil)
+
+	if err := discovery.Close(); err != nil {
+		t.Errorf("failed to close: %s", err)
+	}
+}
+
+func TestDockerDiscovery_ConnectionError(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+
+	discovery := landns.NewDockerDiscovery("/no/such/docker.sock", landns.DefaultDockerDomain, resolver)
+	if err := discovery.Start(); err == nil || !strings.HasPrefix(err.Error(), "failed to connect to Docker") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -114,9 +114,14 @@ func (r DynamicRecord) MarshalText() ([]byte, error) {
 
 // VolatileRecord is make VolatileRecord from DynamicRecord.
 func (r DynamicRecord) VolatileRecord() (VolatileRecord, error) {
+	return r.VolatileRecordAt(DefaultClock.Now())
+}
+
+// VolatileRecordAt is make VolatileRecord from DynamicRecord that created at now.
+func (r DynamicRecord) VolatileRecordAt(now time.Time) (VolatileRecord, error) {
 	var ttl time.Time
 	if r.Volatile {
-		ttl = time.Now().Add(time.Duration(r.Record.GetTTL()) * time.Second)
+		ttl = now.Add(time.Duration(r.Record.GetTTL()) * time.Second)
 	}
 
 	rr, err := r.Record.ToRR()
@@ -191,3 +196,46 @@ type DynamicResolver interface {
 	GetRecord(int) (DynamicRecordSet, error)
 	RemoveRecord(int) error
 }
+
+// recordSync is keep records in DynamicResolver same as the last synced set.
+//
+// It is used by importers that own their records, like LeaseImporter and DockerDiscovery.
+type recordSync struct {
+	records map[string]DynamicRecord
+}
+
+// Sync is set records into resolver, and remove records that synced last time but not included in rs.
+//
+// Volatile records are always set again for extend expiration.
+func (s *recordSync) Sync(resolver DynamicResolver, rs []DynamicRecord) error {
+	records := make(map[string]DynamicRecord)
+
+	var set DynamicRecordSet
+	for _, r := range rs {
+		key := r.Record.WithoutTTL()
+		if _, ok := records[key]; ok {
+			continue
+		}
+		records[key] = r
+
+		if old, ok := s.records[key]; ok && !old.Volatile && !r.Volatile && old.Record.GetTTL() == r.Record.GetTTL() {
+			continue
+		}
+		set = append(set, r)
+	}
+	for key, r := range s.records {
+		if _, ok := records[key]; !ok {
+			r.Disabled = true
+			set = append(set, r)
+		}
+	}
+
+	if len(set) > 0 {
+		if err := resolver.SetRecords(set); err != nil {
+			return err
+		}
+	}
+
+	s.records = records
+	return nil
+}
@@ -631,7 +631,25 @@ func DynamicResolverTest_RemoveRecord(t testing.TB, resolver landns.DynamicResol
 	}
 }
 
+// useFakeClock is replace Clock of the resolver with testutil.FakeClock.
+func useFakeClock(t testing.TB, resolver landns.DynamicResolver) *testutil.FakeClock {
+	t.Helper()
+
+	clock := testutil.NewFakeClock()
+	switch r := resolver.(type) {
+	case *landns.SqliteResolver:
+		r.Clock = clock
+	case *landns.EtcdResolver:
+		r.Clock = clock
+	default:
+		t.Fatalf("unsupported resolver: %s", resolver)
+	}
+	return clock
+}
+
 func DynamicResolverTest_Volatile(t testing.TB, resolver landns.DynamicResolver) {
+	clock := useFakeClock(t, resolver)
+
 	records, err := landns.NewDynamicRecordSet(`
 		fixed.example.com. 100 IN TXT "fixed"
 		long.example.com. 100 IN TXT "long" ; Volatile
@@ -645,7 +663,7 @@ func DynamicResolverTest_Volatile(t testing.TB, resolver landns.DynamicResolver)
 		t.Errorf("failed to set records: %s", err)
 	}
 
-	time.Sleep(1500 * time.Millisecond)
+	clock.Add(2 * time.Second)
 
 	rs, err := resolver.Records()
 	if err != nil {
@@ -87,6 +87,11 @@ func (e Error) Unwrap() error {
 // ErrorSet is list of errors.
 type ErrorSet []error
 
+// Unwrap is getter of errors in the set.
+func (e ErrorSet) Unwrap() []error {
+	return e
+}
+
 // Error is getter for description string.
 func (e ErrorSet) Error() string {
 	xs := make([]string, len(e))
@@ -11,7 +11,7 @@ import (
 
 	"github.com/macrat/landns/lib-landns/logger"
 	"github.com/miekg/dns"
-	"go.etcd.io/etcd/clientv3"
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 func init() {
@@ -26,6 +26,7 @@ type EtcdResolver struct {
 
 	Timeout time.Duration
 	Prefix  string
+	Clock   Clock // Source of current time.
 }
 
 // NewEtcdResolver is constructor of EtcdResolver.
@@ -42,6 +43,7 @@ func NewEtcdResolver(endpoints []string, prefix string, timeout time.Duration, m
 		client:  c,
 		Timeout: timeout,
 		Prefix:  prefix,
+		Clock:   DefaultClock,
 	}, nil
 }
 
@@ -50,8 +52,9 @@ func (er *EtcdResolver) String() string {
 	return fmt.Sprintf("EtcdResolver%s", er.client.Endpoints())
 }
 
-func (er *EtcdResolver) makeContext() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), er.Timeout)
+// makeContext is make context for an operation to etcd. The deadline will be earlier one of parent's or Timeout.
+func (er *EtcdResolver) makeContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, er.Timeout)
 }
 
 func (er *EtcdResolver) getKey(r DynamicRecord) string {
@@ -96,7 +99,7 @@ func (er *EtcdResolver) findKey(ctx context.Context, r DynamicRecord, withTTL bo
 			return DynamicRecord{}, "", Error{TypeInternalError, err, "failed to parse record"}
 		}
 
-		rec, err := r2.Record()
+		rec, err := r2.RecordAt(er.Clock.Now())
 		if err != nil {
 			return DynamicRecord{}, "", Error{TypeInternalError, err, "failed to parse record"}
 		}
@@ -142,8 +145,13 @@ func (er *EtcdResolver) readResponses(resp *clientv3.GetResponse) (DynamicRecord
 			}
 		}
 
+		now := er.Clock.Now()
+		if vr.Expire.Unix() > 0 && vr.Expire.Before(now) {
+			continue
+		}
+
 		var dr DynamicRecord
-		dr.Record, err = vr.Record()
+		dr.Record, err = vr.RecordAt(now)
 		if err != nil {
 			return nil, err
 		}
@@ -214,7 +222,7 @@ func (er *EtcdResolver) insertSingleRecord(ctx context.Context, r DynamicRecord)
 		options = append(options, clientv3.WithLease(resp.ID))
 	}
 
-	vr, err := r.VolatileRecord()
+	vr, err := r.VolatileRecordAt(er.Clock.Now())
 	if err != nil {
 		return err
 	}
@@ -255,7 +263,7 @@ func (er *EtcdResolver) insertRecord(ctx context.Context, r DynamicRecord) error
 
 // SetRecords is DynamicRecord setter.
 func (er *EtcdResolver) SetRecords(rs DynamicRecordSet) error {
-	ctx, cancel := er.makeContext()
+	ctx, cancel := er.makeContext(context.Background())
 	defer cancel()
 
 	for _, r := range rs {
@@ -277,7 +285,7 @@ func (er *EtcdResolver) SetRecords(rs DynamicRecordSet) error {
 
 // Records is DynamicRecord getter.
 func (er *EtcdResolver) Records() (DynamicRecordSet, error) {
-	ctx, cancel := er.makeContext()
+	ctx, cancel := er.makeContext(context.Background())
 	defer cancel()
 
 	resp, err := er.client.Get(ctx, er.Prefix+"/records/", clientv3.WithPrefix())
@@ -290,7 +298,11 @@ func (er *EtcdResolver) Records() (DynamicRecordSet, error) {
 
 // SearchRecords is search records by domain prefix.
 func (er *EtcdResolver) SearchRecords(d Domain) (DynamicRecordSet, error) {
-	ctx, cancel := er.makeContext()
+	return er.searchRecords(context.Background(), d)
+}
+
+func (er *EtcdResolver) searchRecords(ctx context.Context, d Domain) (DynamicRecordSet, error) {
+	ctx, cancel := er.makeContext(ctx)
 	defer cancel()
 
 	resp, err := er.client.Get(ctx, er.Prefix+"/records"+d.ToPath(), clientv3.WithPrefix())
@@ -366,7 +378,7 @@ func (er *EtcdResolver) GetRecord(id int) (DynamicRecordSet, error) {
 
 // RemoveRecord is remove record by id.
 func (er *EtcdResolver) RemoveRecord(id int) error {
-	ctx, cancel := er.makeContext()
+	ctx, cancel := er.makeContext(context.Background())
 	defer cancel()
 
 	rs, err := er.Records()
@@ -395,9 +407,17 @@ func (er *EtcdResolver) Close() error {
 
 // Resolve is resolver using etcd.
 func (er *EtcdResolver) Resolve(w ResponseWriter, r Request) error {
+	return er.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolver using etcd with context.
+func (er *EtcdResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	ctx, span := startSpan(ctx, r, "EtcdResolver.Resolve")
+	defer endSpan(span, &err)
+
 	name := Domain(r.Name)
 
-	rs, err := er.SearchRecords(name)
+	rs, err := er.searchRecords(ctx, name)
 	if err != nil {
 		return err
 	}
@@ -1,15 +1,20 @@
 package landns_test
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/macrat/landns/lib-landns"
 	"github.com/macrat/landns/lib-landns/logger"
-	"go.etcd.io/etcd/clientv3"
-	"go.etcd.io/etcd/integration"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	etcdAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2379}
 )
 
 func init() {
@@ -19,24 +24,50 @@ func init() {
 	})
 }
 
+func cleanEtcdPrefix(t testing.TB, prefix string) {
+	t.Helper()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdAddr.String()},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect etcd: %s", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := client.Delete(ctx, prefix+"/", clientv3.WithPrefix()); err != nil {
+		t.Fatalf("failed to clean etcd: %s", err)
+	}
+}
+
 func CreateEtcdResolver(t testing.TB) (*landns.EtcdResolver, []string, func()) {
-	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1, SkipCreatingClient: true})
+	t.Helper()
 
-	addrs := make([]string, len(clus.Members))
-	for i, m := range clus.Members {
-		addrs[i] = m.GRPCAddr()
+	conn, err := net.DialTimeout(etcdAddr.Network(), etcdAddr.String(), time.Second)
+	if err != nil {
+		t.Skip("etcd server was not found")
 	}
+	conn.Close()
+
+	prefix := "/landns-test/" + t.Name()
+	cleanEtcdPrefix(t, prefix)
+
+	addrs := []string{etcdAddr.String()}
 
-	resolver, err := landns.NewEtcdResolver(addrs, "/landns", time.Second, landns.NewMetrics("metrics"))
+	resolver, err := landns.NewEtcdResolver(addrs, prefix, time.Second, landns.NewMetrics("metrics"))
 	if err != nil {
 		t.Fatalf("failed to make etcd resolver: %s", err)
 	}
 
 	return resolver, addrs, func() {
-		clus.Terminate(t)
 		if err := resolver.Close(); err != nil {
 			t.Errorf("failed to close: %s", err)
 		}
+		cleanEtcdPrefix(t, prefix)
 	}
 }
 
@@ -0,0 +1,123 @@
+package landns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+)
+
+// listFiles is get paths to files in paths, and stamp string that changes when any file updated.
+//
+// Paths can be directories. All files in the directories except hidden files and backup files are listed. kind is used in error messages like "hosts".
+func listFiles(kind string, paths []string) (files []string, stamp string, err error) {
+	var stamps []string
+
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, "", newError(TypeExternalError, err, "failed to read %s file", kind)
+		}
+
+		if !stat.IsDir() {
+			files = append(files, path)
+			stamps = append(stamps, fmt.Sprintf("%s:%d:%d", path, stat.ModTime().UnixNano(), stat.Size()))
+			continue
+		}
+
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, "", newError(TypeExternalError, err, "failed to read %s directory", kind)
+		}
+		stamps = append(stamps, fmt.Sprintf("%s:%d", path, stat.ModTime().UnixNano()))
+		for _, info := range infos {
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") || strings.HasSuffix(info.Name(), "~") {
+				continue
+			}
+			p := filepath.Join(path, info.Name())
+			files = append(files, p)
+			stamps = append(stamps, fmt.Sprintf("%s:%d:%d", p, info.ModTime().UnixNano(), info.Size()))
+		}
+	}
+
+	sort.Strings(stamps)
+	return files, strings.Join(stamps, "\n"), nil
+}
+
+// fileWatcher is the helper to poll update of files and reload them.
+//
+// The owner calls loaded with the stamp of files after each successful reload.
+// While started, the current stamp is checked every interval, and the files are reloaded if it differs from the loaded stamp.
+type fileWatcher struct {
+	mutex  sync.Mutex
+	stamp  string
+	closer chan struct{}
+	done   chan struct{}
+}
+
+// loaded is record the stamp of loaded files.
+func (fw *fileWatcher) loaded(stamp string) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	fw.stamp = stamp
+}
+
+// changed is check if stamp differs from the loaded stamp. It is true if failed to get stamp, for report the error by reloading.
+func (fw *fileWatcher) changed(stamp func() (string, error)) bool {
+	s, err := stamp()
+	if err != nil {
+		return true
+	}
+
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	return s != fw.stamp
+}
+
+// start is start checking stamp and reloading in background. name and fields are used in log messages like "hosts files".
+func (fw *fileWatcher) start(clock Clock, interval time.Duration, name string, fields logger.Fields, stamp func() (string, error), reload func() error) {
+	fw.closer = make(chan struct{})
+	fw.done = make(chan struct{})
+
+	go func(closer, done chan struct{}) {
+		defer close(done)
+
+		for {
+			select {
+			case <-clock.After(interval):
+			case <-closer:
+				return
+			}
+
+			if !fw.changed(stamp) {
+				continue
+			}
+			if err := reload(); err != nil {
+				fs := logger.Fields{"reason": err}
+				for k, v := range fields {
+					fs[k] = v
+				}
+				logger.Warn("failed to reload "+name, fs)
+			} else {
+				logger.Info("reloaded "+name, fields)
+			}
+		}
+	}(fw.closer, fw.done)
+}
+
+// stop is stop watching. It does nothing if not started.
+func (fw *fileWatcher) stop() {
+	if fw.closer != nil {
+		close(fw.closer)
+		<-fw.done
+		fw.closer = nil
+	}
+}
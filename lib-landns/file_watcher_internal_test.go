@@ -0,0 +1,76 @@
+package landns
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+)
+
+func TestFileWatcher(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	current, stampErr := "v1", error(nil)
+	reloaded := make(chan string, 10)
+
+	var fw fileWatcher
+	stamp := func() (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return current, stampErr
+	}
+	reload := func() error {
+		s, err := stamp()
+		if err != nil {
+			return err
+		}
+		fw.loaded(s)
+		reloaded <- s
+		return nil
+	}
+
+	if err := reload(); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	<-reloaded
+
+	fw.start(DefaultClock, time.Millisecond, "test files", logger.Fields{}, stamp, reload)
+	defer fw.stop()
+
+	select {
+	case s := <-reloaded:
+		t.Fatalf("reloaded without change: %s", s)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	mutex.Lock()
+	current = "v2"
+	mutex.Unlock()
+
+	select {
+	case s := <-reloaded:
+		if s != "v2" {
+			t.Errorf("unexpected stamp: %s", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not reloaded after change")
+	}
+
+	if fw.changed(stamp) {
+		t.Errorf("expected not changed after reload")
+	}
+
+	mutex.Lock()
+	stampErr = errors.New("test error")
+	mutex.Unlock()
+
+	if !fw.changed(stamp) {
+		t.Errorf("expected changed if failed to get stamp")
+	}
+
+	fw.stop()
+	fw.stop()
+}
@@ -1,39 +1,388 @@
 package landns
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/macrat/landns/lib-landns/logger"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// ForwardStrategy is the strategy for select upstream server in ForwardResolver.
+type ForwardStrategy uint8
+
+const (
+	// StrategySequential is the strategy that tries upstreams in order of the list.
+	StrategySequential ForwardStrategy = iota
+
+	// StrategyRandom is the strategy that tries upstreams in random order.
+	StrategyRandom
+
+	// StrategyFastest is the strategy that tries upstreams in order of the average RTT.
+	StrategyFastest
+
+	// StrategyRace is the strategy that send query to all upstreams at the same time and use the first response.
+	StrategyRace
+)
+
+// String is converter to human readable string.
+func (s ForwardStrategy) String() string {
+	switch s {
+	case StrategySequential:
+		return "sequential"
+	case StrategyRandom:
+		return "random"
+	case StrategyFastest:
+		return "fastest"
+	case StrategyRace:
+		return "race"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalText is parse text to ForwardStrategy.
+func (s *ForwardStrategy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "sequential":
+		*s = StrategySequential
+	case "random":
+		*s = StrategyRandom
+	case "fastest":
+		*s = StrategyFastest
+	case "race":
+		*s = StrategyRace
+	default:
+		return newError(TypeArgumentError, nil, "unknown strategy: %s", string(text))
+	}
+	return nil
+}
+
+// MarshalText is make bytes text.
+func (s ForwardStrategy) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+const (
+	// DefaultMaxFails is the default number of continuous failure to mark upstream as down.
+	DefaultMaxFails = 3
+
+	// DefaultFailTimeout is the default duration for skip upstream that marked as down.
+	DefaultFailTimeout = 30 * time.Second
+)
+
+type upstreamState struct {
+	fails     int
+	downUntil time.Time
+	rtt       time.Duration
+}
+
+// upstreamHealth is passive health tracker for upstream servers.
+type upstreamHealth struct {
+	mutex  sync.Mutex
+	states map[string]*upstreamState
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{states: make(map[string]*upstreamState)}
+}
+
+func (uh *upstreamHealth) get(addr string) *upstreamState {
+	s, ok := uh.states[addr]
+	if !ok {
+		s = &upstreamState{}
+		uh.states[addr] = s
+	}
+	return s
+}
+
+func (uh *upstreamHealth) success(addr string, rtt time.Duration) {
+	uh.mutex.Lock()
+	defer uh.mutex.Unlock()
+
+	s := uh.get(addr)
+	s.fails = 0
+	s.downUntil = time.Time{}
+	if s.rtt == 0 {
+		s.rtt = rtt
+	} else {
+		s.rtt = (s.rtt*7 + rtt) / 8
+	}
+}
+
+// failure is record a failure and returns true if the upstream became down.
+func (uh *upstreamHealth) failure(addr string, maxFails int, failTimeout time.Duration, now time.Time) bool {
+	uh.mutex.Lock()
+	defer uh.mutex.Unlock()
+
+	s := uh.get(addr)
+	s.fails++
+	if maxFails > 0 && s.fails >= maxFails && !s.downUntil.After(now) {
+		s.downUntil = now.Add(failTimeout)
+		return true
+	}
+	return false
+}
+
+func (uh *upstreamHealth) isDown(addr string, now time.Time) bool {
+	uh.mutex.Lock()
+	defer uh.mutex.Unlock()
+
+	return uh.get(addr).downUntil.After(now)
+}
+
+func (uh *upstreamHealth) rtt(addr string) time.Duration {
+	uh.mutex.Lock()
+	defer uh.mutex.Unlock()
+
+	return uh.get(addr).rtt
+}
+
+// UpstreamStatus is the health status of an upstream server.
+type UpstreamStatus struct {
+	Upstream Upstream
+	Down     bool          // Whether the upstream is skipped because of continuous failures.
+	Fails    int           // Number of continuous failures.
+	RTT      time.Duration // Average round trip time. 0 if never succeeded.
+}
+
+// String is returns human readable string like "8.8.8.8:53 ; up fails:0 rtt:12ms".
+func (s UpstreamStatus) String() string {
+	state := "up"
+	if s.Down {
+		state = "down"
+	}
+	return fmt.Sprintf("%s ; %s fails:%d rtt:%s", s.Upstream, state, s.Fails, s.RTT)
+}
+
+func (uh *upstreamHealth) status(u Upstream, now time.Time) UpstreamStatus {
+	uh.mutex.Lock()
+	defer uh.mutex.Unlock()
+
+	s := uh.get(u.String())
+	return UpstreamStatus{
+		Upstream: u,
+		Down:     s.downUntil.After(now),
+		Fails:    s.fails,
+		RTT:      s.rtt,
+	}
+}
+
 // ForwardResolver is recursion resolver.
 type ForwardResolver struct {
-	client *dns.Client
+	transports *upstreamTransports
+	health     *upstreamHealth
 
-	Upstreams []*net.UDPAddr
-	Metrics   *Metrics
+	Upstreams   []Upstream
+	Strategy    ForwardStrategy
+	MaxFails    int           // Number of continuous failures to mark upstream as down. Never mark as down if 0.
+	FailTimeout time.Duration // Duration for skip upstream that marked as down.
+	TLSConfig   *tls.Config   // TLS configuration for tls:// and https:// upstreams. Have to set before the first query.
+	Clock       Clock         // Source of current time for health tracking.
+	Metrics     *Metrics
 }
 
-// NewForwardResolver is make new ForwardResolver.
+// NewForwardResolver is make new ForwardResolver that uses UDP upstreams.
 func NewForwardResolver(upstreams []*net.UDPAddr, timeout time.Duration, metrics *Metrics) ForwardResolver {
+	us := make([]Upstream, len(upstreams))
+	for i, u := range upstreams {
+		us[i] = UDPUpstream(u)
+	}
+	return NewForwardResolverWithUpstreams(us, timeout, metrics)
+}
+
+// NewForwardResolverWithUpstreams is make new ForwardResolver that uses any protocol upstreams.
+func NewForwardResolverWithUpstreams(upstreams []Upstream, timeout time.Duration, metrics *Metrics) ForwardResolver {
 	return ForwardResolver{
-		client: &dns.Client{
-			Dialer: &net.Dialer{
-				Timeout: timeout,
-			},
-		},
-		Upstreams: upstreams,
-		Metrics:   metrics,
+		transports:  newUpstreamTransports(timeout),
+		health:      newUpstreamHealth(),
+		Upstreams:   upstreams,
+		Strategy:    StrategySequential,
+		MaxFails:    DefaultMaxFails,
+		FailTimeout: DefaultFailTimeout,
+		Clock:       DefaultClock,
+		Metrics:     metrics,
+	}
+}
+
+// Status is getter of health status of each upstream in order of Upstreams.
+func (fr ForwardResolver) Status() []UpstreamStatus {
+	now := fr.Clock.Now()
+
+	status := make([]UpstreamStatus, len(fr.Upstreams))
+	for i, u := range fr.Upstreams {
+		status[i] = fr.health.status(u, now)
 	}
+	return status
+}
+
+// orderedUpstreams is returns upstreams in order of the strategy.
+//
+// Upstreams that marked as down will be placed at the end of the list.
+func (fr ForwardResolver) orderedUpstreams() []Upstream {
+	alive := make([]Upstream, 0, len(fr.Upstreams))
+	down := make([]Upstream, 0)
+
+	for _, u := range fr.Upstreams {
+		if fr.health.isDown(u.String(), fr.Clock.Now()) {
+			down = append(down, u)
+		} else {
+			alive = append(alive, u)
+		}
+	}
+
+	switch fr.Strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(alive), func(i, j int) {
+			alive[i], alive[j] = alive[j], alive[i]
+		})
+	case StrategyFastest:
+		rtts := make(map[string]time.Duration, len(alive))
+		for _, u := range alive {
+			rtts[u.String()] = fr.health.rtt(u.String())
+		}
+		sort.SliceStable(alive, func(i, j int) bool {
+			return rtts[alive[i].String()] < rtts[alive[j].String()]
+		})
+	}
+
+	return append(alive, down...)
+}
+
+type exchangeResult struct {
+	Upstream Upstream
+	Msg      *dns.Msg
+	Err      error
+}
+
+func (fr ForwardResolver) exchange(ctx context.Context, r Request, msg *dns.Msg, upstream Upstream) exchangeResult {
+	addr := upstream.String()
+
+	ctx, span := startSpan(ctx, r, "ForwardResolver.exchange", attribute.String("landns.upstream", addr))
+
+	in, rtt, err := fr.transports.get(upstream, fr.TLSConfig).Exchange(ctx, msg.Copy())
+	if err == nil {
+		span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[in.Rcode]))
+	}
+	endSpan(span, &err)
+
+	if ctx.Err() != nil {
+		// The query was cancelled. It is not a fault of upstream.
+		return exchangeResult{upstream, nil, err}
+	}
+
+	fr.Metrics.UpstreamResult(addr, rtt, err)
+
+	if err != nil {
+		logger.Debug("failed to resolve by upstream", logger.Fields{"upstream": addr, "reason": err})
+		if fr.health.failure(addr, fr.MaxFails, fr.FailTimeout, fr.Clock.Now()) {
+			logger.Warn("upstream marked as down", logger.Fields{"upstream": addr, "reason": err, "duration": fr.FailTimeout})
+		}
+		return exchangeResult{upstream, nil, err}
+	}
+
+	fr.health.success(addr, rtt)
+	fr.Metrics.UpstreamTime(rtt)
+
+	if in.Rcode == dns.RcodeServerFailure || in.Rcode == dns.RcodeRefused {
+		// The upstream is working but can not answer this domain. Try other upstreams without marking it as down.
+		err = newError(TypeExternalError, nil, "upstream returns %s", dns.RcodeToString[in.Rcode])
+		logger.Debug("failed to resolve by upstream", logger.Fields{"upstream": addr, "reason": err})
+		return exchangeResult{upstream, in, err}
+	}
+
+	return exchangeResult{upstream, in, nil}
+}
+
+// lastAnswer is returns the last received message if all upstreams answered with the same rcode, otherwise returns nil.
+func lastAnswer(results []exchangeResult) *dns.Msg {
+	var last *dns.Msg
+	for _, result := range results {
+		if result.Msg == nil || (last != nil && last.Rcode != result.Msg.Rcode) {
+			return nil
+		}
+		last = result.Msg
+	}
+	return last
+}
+
+func (fr ForwardResolver) exchangeSequential(ctx context.Context, r Request, msg *dns.Msg, upstreams []Upstream) (*dns.Msg, error) {
+	errors := ErrorSet{}
+	failed := make([]exchangeResult, 0, len(upstreams))
+
+	for _, upstream := range upstreams {
+		if err := ctx.Err(); err != nil {
+			return nil, append(errors, err)
+		}
+
+		result := fr.exchange(ctx, r, msg, upstream)
+		if result.Err == nil {
+			return result.Msg, nil
+		}
+		errors = append(errors, newError(TypeExternalError, result.Err, "%s", upstream))
+		failed = append(failed, result)
+	}
+
+	if in := lastAnswer(failed); in != nil {
+		return in, nil
+	}
+	return nil, errors
+}
+
+func (fr ForwardResolver) exchangeRace(ctx context.Context, r Request, msg *dns.Msg, upstreams []Upstream) (*dns.Msg, error) {
+	// Cancel other queries when got the first response.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan exchangeResult, len(upstreams))
+
+	for _, upstream := range upstreams {
+		go func(upstream Upstream) {
+			ch <- fr.exchange(ctx, r, msg, upstream)
+		}(upstream)
+	}
+
+	errors := ErrorSet{}
+	failed := make([]exchangeResult, 0, len(upstreams))
+	for range upstreams {
+		result := <-ch
+		if result.Err == nil {
+			return result.Msg, nil
+		}
+		errors = append(errors, newError(TypeExternalError, result.Err, "%s", result.Upstream))
+		failed = append(failed, result)
+	}
+
+	if in := lastAnswer(failed); in != nil {
+		return in, nil
+	}
+	return nil, errors
 }
 
 // Resolve is resolver using upstream DNS servers.
 func (fr ForwardResolver) Resolve(w ResponseWriter, r Request) error {
-	if !r.RecursionDesired {
+	return fr.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolver using upstream DNS servers with context.
+//
+// Queries to upstream will be cancelled when ctx is done.
+func (fr ForwardResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	if !r.RecursionDesired || len(fr.Upstreams) == 0 {
 		return nil
 	}
 
+	ctx, span := startSpan(ctx, r, "ForwardResolver.Resolve", attribute.String("landns.strategy", fr.Strategy.String()))
+	defer endSpan(span, &err)
+
 	msg := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:               dns.Id(),
@@ -44,34 +393,74 @@ func (fr ForwardResolver) Resolve(w ResponseWriter, r Request) error {
 		},
 	}
 
-	for _, upstream := range fr.Upstreams {
-		in, rtt, err := fr.client.Exchange(msg, upstream.String())
+	var in *dns.Msg
+	if fr.Strategy == StrategyRace {
+		in, err = fr.exchangeRace(ctx, r, msg, fr.orderedUpstreams())
+	} else {
+		in, err = fr.exchangeSequential(ctx, r, msg, fr.orderedUpstreams())
+	}
+	if err != nil {
+		return Error{TypeExternalError, err, "failed to resolve by all upstreams"}
+	}
+
+	w.SetNoAuthoritative()
+
+	if in.Rcode != dns.RcodeSuccess {
+		w.SetRcode(in.Rcode)
+	}
+
+	for _, answer := range in.Answer {
+		record, err := NewRecordFromRR(answer)
 		if err != nil {
-			continue
+			return err
+		}
+		if err := w.Add(record); err != nil {
+			return err
 		}
-		fr.Metrics.UpstreamTime(rtt)
-		for _, answer := range in.Answer {
-			record, err := NewRecordFromRR(answer)
-			if err != nil {
+	}
+
+	for _, rr := range in.Ns {
+		if record, ok := forwardableRecord(rr); ok {
+			if err := w.AddAuthority(record); err != nil {
 				return err
 			}
-			w.SetNoAuthoritative()
-			if err := w.Add(record); err != nil {
+		}
+	}
+
+	for _, rr := range in.Extra {
+		if record, ok := forwardableRecord(rr); ok {
+			if err := w.AddAdditional(record); err != nil {
 				return err
 			}
 		}
-		break
 	}
 
 	return nil
 }
 
+// forwardableRecord is convert RR in authority or additional section to Record.
+//
+// Returns false if the RR is pseudo-record like OPT, or not supported type.
+func forwardableRecord(rr dns.RR) (Record, bool) {
+	if rr.Header().Rrtype == dns.TypeOPT {
+		return nil, false
+	}
+	record, err := NewRecordFromRR(rr)
+	if err != nil {
+		return nil, false
+	}
+	return record, true
+}
+
 // RecursionAvailable is always returns true.
 func (fr ForwardResolver) RecursionAvailable() bool {
 	return true
 }
 
-// Close is closer to ForwardResolver.
+// Close is close connections to upstream servers.
 func (fr ForwardResolver) Close() error {
-	return nil
+	if fr.transports == nil {
+		return nil
+	}
+	return fr.transports.Close()
 }
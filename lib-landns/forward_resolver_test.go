@@ -2,7 +2,9 @@ package landns_test
 
 import (
 	"context"
+	"errors"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -85,3 +87,308 @@ func TestForwardResolver_Parallel(t *testing.T) {
 
 	ParallelResolveTest(t, resolver)
 }
+
+type SlowResolver struct {
+	landns.Resolver
+	Delay time.Duration
+}
+
+func (sr SlowResolver) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	time.Sleep(sr.Delay)
+	return sr.Resolver.Resolve(w, r)
+}
+
+type RcodeResolver struct {
+	landns.Resolver
+	Name  string
+	Rcode int
+}
+
+func (rr RcodeResolver) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	if r.Name == rr.Name {
+		w.SetRcode(rr.Rcode)
+		return nil
+	}
+	return rr.Resolver.Resolve(w, r)
+}
+
+func TestForwardStrategy_Encoding(t *testing.T) {
+	t.Parallel()
+
+	var s landns.ForwardStrategy
+
+	for input, expect := range map[string]string{"": "sequential", "sequential": "sequential", "random": "random", "Fastest": "fastest", "race": "race"} {
+		if err := (&s).UnmarshalText([]byte(input)); err != nil {
+			t.Errorf("failed to unmarshal: %s: %s", input, err)
+		} else if result, err := s.MarshalText(); err != nil {
+			t.Errorf("failed to marshal: %s: %s", input, err)
+		} else if string(result) != expect {
+			t.Errorf("unexpected marshal result: expected %s but got %s", expect, string(result))
+		}
+	}
+
+	if err := (&s).UnmarshalText([]byte("foo")); err == nil {
+		t.Errorf("expected error but got nil")
+	} else if err.Error() != "unknown strategy: foo" {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestForwardResolver_Strategy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := []landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+	}
+	fast := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver(records))
+	slow := testutil.StartDNSServer(ctx, t, SlowResolver{landns.NewSimpleResolver(records), 50 * time.Millisecond})
+
+	for _, strategy := range []landns.ForwardStrategy{landns.StrategySequential, landns.StrategyRandom, landns.StrategyFastest, landns.StrategyRace} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			resolver := landns.NewForwardResolver([]*net.UDPAddr{slow.Addr, fast.Addr}, 1*time.Second, landns.NewMetrics("landns"))
+			resolver.Strategy = strategy
+
+			for i := 0; i < 5; i++ {
+				AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+			}
+		})
+	}
+}
+
+func TestForwardResolver_Fastest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := []landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+	}
+	fast := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver(records))
+	slow := testutil.StartDNSServer(ctx, t, SlowResolver{landns.NewSimpleResolver(records), 50 * time.Millisecond})
+	metrics := testutil.StartMetricsServer(ctx, t, "landns")
+
+	resolver := landns.NewForwardResolver([]*net.UDPAddr{slow.Addr, fast.Addr}, 1*time.Second, metrics.Metrics)
+	resolver.Strategy = landns.StrategyFastest
+
+	for i := 0; i < 5; i++ {
+		AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+	}
+
+	metrics.Get(t).Assert(t, "landns_upstream_request_count", testutil.MetricsLabels{"upstream": slow.Addr.String(), "result": "success"}, 1)
+	metrics.Get(t).Assert(t, "landns_upstream_request_count", testutil.MetricsLabels{"upstream": fast.Addr.String(), "result": "success"}, 4)
+}
+
+func TestForwardResolver_Race(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fast := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+	}))
+	slow := testutil.StartDNSServer(ctx, t, SlowResolver{landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.2")},
+	}), 100 * time.Millisecond})
+
+	resolver := landns.NewForwardResolver([]*net.UDPAddr{{IP: net.ParseIP("127.0.0.1"), Port: 5321}, slow.Addr, fast.Addr}, 1*time.Second, landns.NewMetrics("landns"))
+	resolver.Strategy = landns.StrategyRace
+
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+}
+
+func TestForwardResolver_Health(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+	}))
+	metrics := testutil.StartMetricsServer(ctx, t, "landns")
+	dead := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5321}
+
+	resolver := landns.NewForwardResolver([]*net.UDPAddr{dead, srv.Addr}, 1*time.Second, metrics.Metrics)
+	resolver.MaxFails = 2
+	resolver.FailTimeout = 200 * time.Millisecond
+	clock := testutil.NewFakeClock()
+	resolver.Clock = clock
+
+	for i := 0; i < 5; i++ {
+		AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+	}
+
+	metrics.Get(t).Assert(t, "landns_upstream_request_count", testutil.MetricsLabels{"upstream": dead.String(), "result": "failure"}, 2)
+	metrics.Get(t).Assert(t, "landns_upstream_request_count", testutil.MetricsLabels{"upstream": srv.Addr.String(), "result": "success"}, 5)
+
+	status := resolver.Status()
+	if len(status) != 2 {
+		t.Fatalf("unexpected number of status: %d", len(status))
+	}
+	if status[0].Upstream.String() != dead.String() || !status[0].Down || status[0].Fails != 2 {
+		t.Errorf("unexpected status of dead upstream: %s", status[0])
+	}
+	if status[1].Upstream.String() != srv.Addr.String() || status[1].Down || status[1].Fails != 0 || status[1].RTT <= 0 {
+		t.Errorf("unexpected status of alive upstream: %s", status[1])
+	}
+
+	clock.Add(250 * time.Millisecond)
+
+	if status := resolver.Status(); status[0].Down {
+		t.Errorf("upstream is still down after fail timeout: %s", status[0])
+	}
+
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+	metrics.Get(t).Assert(t, "landns_upstream_request_count", testutil.MetricsLabels{"upstream": dead.String(), "result": "failure"}, 3)
+}
+
+func TestForwardResolver_HealthRcode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, rcode := range []int{dns.RcodeRefused, dns.RcodeServerFailure} {
+		refuse := testutil.StartDNSServer(ctx, t, RcodeResolver{
+			Resolver: landns.NewSimpleResolver([]landns.Record{
+				landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+			}),
+			Name:  "broken.example.com.",
+			Rcode: rcode,
+		})
+		other := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.2")},
+			landns.AddressRecord{Name: "broken.example.com.", TTL: 123, Address: net.ParseIP("127.0.0.2")},
+		}))
+
+		resolver := landns.NewForwardResolver([]*net.UDPAddr{refuse.Addr, other.Addr}, 1*time.Second, landns.NewMetrics("landns"))
+		resolver.MaxFails = 2
+
+		for i := 0; i < 5; i++ {
+			AssertResolve(t, resolver, landns.NewRequest("broken.example.com.", dns.TypeA, true), false, "broken.example.com. 123 IN A 127.0.0.2")
+		}
+
+		if status := resolver.Status(); status[0].Down || status[0].Fails != 0 {
+			t.Errorf("%s: upstream marked as down by rcode: %s", dns.RcodeToString[rcode], status[0])
+		}
+
+		AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+	}
+}
+
+func TestForwardResolver_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow := testutil.StartDNSServer(ctx, t, SlowResolver{landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+	}), 500 * time.Millisecond})
+
+	for _, strategy := range []landns.ForwardStrategy{landns.StrategySequential, landns.StrategyRace} {
+		resolver := landns.NewForwardResolver([]*net.UDPAddr{slow.Addr}, 5*time.Second, landns.NewMetrics("landns"))
+		resolver.Strategy = strategy
+		resolver.MaxFails = 1
+
+		qctx, qcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		start := time.Now()
+		err := resolver.ResolveContext(qctx, testutil.NewDummyResponseWriter(), landns.NewRequest("example.com.", dns.TypeA, true))
+		qcancel()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: unexpected error: %v", strategy, err)
+		}
+		if d := time.Since(start); d > 200*time.Millisecond {
+			t.Errorf("%s: resolve was not cancelled: took %s", strategy, d)
+		}
+
+		// upstream is still usable after cancelled.
+		AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+	}
+}
+
+func TestForwardResolver_AllFailed(t *testing.T) {
+	t.Parallel()
+
+	resolver := landns.NewForwardResolver([]*net.UDPAddr{{IP: net.ParseIP("127.0.0.1"), Port: 5321}}, 1*time.Second, landns.NewMetrics("landns"))
+
+	err := resolver.Resolve(testutil.NewDummyResponseWriter(), landns.NewRequest("example.com.", dns.TypeA, true))
+	if err == nil {
+		t.Fatalf("expected error but got nil")
+	}
+	if !strings.HasPrefix(err.Error(), "failed to resolve by all upstreams: 127.0.0.1:5321: ") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestForwardResolver_Rcode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	soa := landns.SoaRecord{Name: "example.com.", TTL: 60, Ns: "ns.example.com.", Mbox: "root.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minttl: 5}
+	ns := landns.AddressRecord{Name: "ns.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")}
+	upstream := testutil.StartDNSServer(ctx, t, testutil.ResponseResolver{
+		Rcode:      dns.RcodeNameError,
+		Authority:  []landns.Record{soa},
+		Additional: []landns.Record{ns},
+	})
+
+	resolver := landns.NewForwardResolver([]*net.UDPAddr{upstream.Addr}, 1*time.Second, landns.NewMetrics("landns"))
+
+	w := testutil.NewDummyResponseWriter()
+	if err := resolver.Resolve(w, landns.NewRequest("notfound.example.com.", dns.TypeA, true)); err != nil {
+		t.Fatalf("failed to resolve: %s", err)
+	}
+	if w.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %d but got %d", dns.RcodeNameError, w.Rcode)
+	}
+	if len(w.Authority) != 1 || w.Authority[0].String() != soa.String() {
+		t.Errorf("unexpected authority: %s", w.Authority)
+	}
+	if len(w.Additional) != 1 || w.Additional[0].String() != ns.String() {
+		t.Errorf("unexpected additional: %s", w.Additional)
+	}
+	if w.Authoritative {
+		t.Errorf("forwarded response must not be authoritative")
+	}
+
+	srv := testutil.StartDNSServer(ctx, t, resolver)
+	in, err := srv.Exchange(new(dns.Msg).SetQuestion("notfound.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("failed to exchange: %s", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %s but got %s", dns.RcodeToString[dns.RcodeNameError], dns.RcodeToString[in.Rcode])
+	}
+	if len(in.Ns) != 1 || in.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("unexpected authority: %s", in.Ns)
+	}
+}
+
+func TestForwardResolver_RcodePassthrough(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	refused := testutil.StartDNSServer(ctx, t, testutil.ResponseResolver{Rcode: dns.RcodeRefused})
+	servfail := testutil.StartDNSServer(ctx, t, testutil.ResponseResolver{Rcode: dns.RcodeServerFailure})
+
+	tests := []struct {
+		Name      string
+		Upstreams []*net.UDPAddr
+		Rcode     int
+	}{
+		{"refused", []*net.UDPAddr{refused.Addr, refused.Addr}, dns.RcodeRefused},
+		{"servfail", []*net.UDPAddr{servfail.Addr}, dns.RcodeServerFailure},
+		{"mixed", []*net.UDPAddr{refused.Addr, servfail.Addr}, dns.RcodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		for _, strategy := range []landns.ForwardStrategy{landns.StrategySequential, landns.StrategyRace} {
+			resolver := landns.NewForwardResolver(tt.Upstreams, 1*time.Second, landns.NewMetrics("landns"))
+			resolver.Strategy = strategy
+
+			srv := testutil.StartDNSServer(ctx, t, resolver)
+			in, err := srv.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if err != nil {
+				t.Fatalf("%s/%s: failed to exchange: %s", tt.Name, strategy, err)
+			}
+			if in.Rcode != tt.Rcode {
+				t.Errorf("%s/%s: unexpected rcode: expected %s but got %s", tt.Name, strategy, dns.RcodeToString[tt.Rcode], dns.RcodeToString[in.Rcode])
+			}
+		}
+	}
+}
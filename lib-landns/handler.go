@@ -1,15 +1,33 @@
 package landns
 
 import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
 	"github.com/macrat/landns/lib-landns/logger"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Handler is the implements of dns.Handler of package github.com/miekg/dns.
 type Handler struct {
 	Resolver           Resolver
+	Views              ViewSet // Views for split-horizon. Handler will use Resolver if no view matched to client.
 	Metrics            *Metrics
 	RecursionAvailable bool
+	Timeout            time.Duration // Timeout for resolving each message. 0 means unlimited.
+	QueryLog           *QueryLogger  // Logger for record each message. Query log is disabled if nil.
+	Policy             RPZSet        // Response policy zones that applied to responses after resolve. Nothing is applied if empty.
+	Signer             *DNSSECSigner // Signer for DNSSEC. Responses are not signed if nil.
+	TrustedForwarders  []*net.IPNet  // Networks of forwarders that allowed to tell client address by EDNS Client Subnet option. The option is ignored if empty.
+
+	// BaseContext is the function to get the parent context of each message, like http.Server.BaseContext.
+	// Resolving will be cancelled when the parent context is done. context.Background will be used if nil.
+	BaseContext func() context.Context
 }
 
 // NewHandler is constructor of Handler.
@@ -21,12 +39,67 @@ func NewHandler(resolver Resolver, metrics *Metrics) Handler {
 	}
 }
 
+func (h Handler) selectView(client net.IP) (name string, resolver Resolver, recursionAvailable bool) {
+	if v, ok := h.Views.Find(client); ok {
+		return v.Name, v.Resolver, v.Resolver.RecursionAvailable()
+	}
+	return DefaultViewName, h.Resolver, h.RecursionAvailable
+}
+
+func (h Handler) logFields(view string, q dns.Question) logger.Fields {
+	fields := logger.Fields{"proto": "dns", "name": q.Name, "type": QtypeToString(q.Qtype)}
+	if len(h.Views) > 0 {
+		fields["view"] = view
+	}
+	return fields
+}
+
+func (h Handler) makeContext(client net.IP) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if h.BaseContext != nil {
+		ctx = h.BaseContext()
+	}
+
+	if client != nil {
+		ctx = ContextWithClientAddress(ctx, client)
+	}
+
+	if h.Timeout > 0 {
+		return context.WithTimeout(ctx, h.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 // ServeDNS is the method for resolve record.
 func (h Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	end := h.Metrics.Start(r)
+	start := time.Now()
+
+	client := ClientAddress(w, r, h.TrustedForwarders)
+	view, resolver, recursionAvailable := h.selectView(client)
+
+	ctx, cancel := h.makeContext(client)
+	defer cancel()
 
-	req := Request{RecursionDesired: r.RecursionDesired}
-	resp := NewMessageBuilder(r, h.RecursionAvailable)
+	var answered *answerer
+	if h.QueryLog != nil {
+		ctx, answered = contextWithAnswerer(ctx)
+	}
+
+	ctx, span := tracer().Start(
+		ctx,
+		"Handler.ServeDNS",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("landns.view", view)),
+	)
+	defer span.End()
+	if addr := ClientAddressFromContext(ctx); addr != nil {
+		span.SetAttributes(attribute.String("landns.client.address", addr.String()))
+	}
+
+	end := h.Metrics.StartView(view, r)
+
+	req := Request{RecursionDesired: r.RecursionDesired, ctx: ctx}
+	resp := NewMessageBuilder(r, recursionAvailable)
 
 	errored := false
 
@@ -34,8 +107,10 @@ func (h Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		for _, q := range r.Question {
 			req.Question = q
 
-			if err := h.Resolver.Resolve(resp, req); err != nil {
-				logger.Warn("failed to resolve", logger.Fields{"proto": "dns", "name": q.Name, "type": QtypeToString(q.Qtype), "reason": err})
+			if err := ResolveContext(ctx, resolver, resp, req); err != nil {
+				fields := h.logFields(view, q)
+				fields["reason"] = err
+				logger.Warn("failed to resolve", fields)
 				h.Metrics.Error(req, err)
 				errored = true
 			}
@@ -43,13 +118,168 @@ func (h Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	msg := resp.Build()
-	if err := w.WriteMsg(msg); err != nil {
-		logger.Error("failed to write msg", nil)
+	if errored && len(msg.Answer) == 0 {
+		msg.Rcode = dns.RcodeServerFailure
+		span.SetStatus(codes.Error, "failed to resolve")
+	}
+	if r.Opcode == dns.OpcodeQuery && len(h.Policy) > 0 && !errored {
+		msg = h.applyPolicy(ctx, w, view, resolver, req, msg)
+	}
+	if msg != nil && h.Signer != nil {
+		h.Signer.Sign(ctx, resolver, msg, resp.DNSSECOK())
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok && msg != nil {
+		msg.Truncate(resp.UDPSize())
+	}
+
+	if msg != nil {
+		span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[msg.Rcode]))
+		if err := w.WriteMsg(msg); err != nil {
+			logger.Error("failed to write msg", nil)
+		}
 	}
 	end(msg)
 
-	if !errored && len(msg.Answer) == 0 && len(msg.Question) > 0 {
+	if h.QueryLog != nil {
+		h.QueryLog.Log(QueryLogEntry{
+			Time:     start,
+			Client:   ClientAddressFromContext(ctx),
+			Remote:   w.RemoteAddr(),
+			Local:    w.LocalAddr(),
+			View:     view,
+			Query:    r,
+			Response: msg,
+			Resolver: answered.Name(),
+			Latency:  time.Since(start),
+		})
+	}
+
+	if msg != nil && !errored && len(msg.Answer) == 0 && len(msg.Question) > 0 {
 		q := msg.Question[0]
-		logger.Info("not found", logger.Fields{"proto": "dns", "name": q.Name, "type": QtypeToString(q.Qtype)})
+		logger.Info("not found", h.logFields(view, q))
 	}
 }
+
+// applyPolicy is rewrite the response message by response policy zones. Returns nil if the message should be dropped.
+func (h Handler) applyPolicy(ctx context.Context, w dns.ResponseWriter, view string, resolver Resolver, req Request, msg *dns.Msg) *dns.Msg {
+	hit, ok := h.Policy.Match(msg)
+	if !ok {
+		return msg
+	}
+
+	fields := h.logFields(view, msg.Question[0])
+	fields["zone"] = hit.Zone
+	fields["trigger"] = hit.Trigger
+	fields["rule"] = hit.Rule
+	fields["action"] = hit.Action.String()
+	logger.Info("response policy applied", fields)
+
+	h.Metrics.PolicyHit(hit)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("landns.rpz.zone", hit.Zone.String()),
+		attribute.String("landns.rpz.action", hit.Action.String()),
+	)
+
+	switch hit.Action {
+	case RPZPassthru:
+		return msg
+	case RPZDrop:
+		return nil
+	case RPZTCPOnly:
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+			return msg
+		}
+		msg.Truncated = true
+	case RPZNXDomain:
+		msg.Rcode = dns.RcodeNameError
+	case RPZNoData:
+		msg.Rcode = dns.RcodeSuccess
+	case RPZLocalData:
+		msg.Rcode = dns.RcodeSuccess
+		msg.Answer = h.policyLocalData(ctx, resolver, req, msg, hit)
+		msg.Ns = nil
+		msg.Extra = ednsOnly(msg.Extra)
+		return msg
+	}
+
+	msg.Answer = nil
+	msg.Ns = nil
+	msg.Extra = ednsOnly(msg.Extra)
+	return msg
+}
+
+// ednsOnly is pick OPT records of EDNS0 from the additional section.
+func ednsOnly(extra []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// cnameChain is pick CNAME records that chain from name to target. CNAME records after target are not included.
+func cnameChain(answer []dns.RR, name, target string) []dns.RR {
+	var chain []dns.RR
+
+	for len(chain) < len(answer) && !strings.EqualFold(name, target) {
+		var next *dns.CNAME
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+
+		chain = append(chain, next)
+		name = next.Target
+	}
+
+	return chain
+}
+
+// policyLocalData is make answer records for RPZLocalData. The target is resolved if the local data is CNAME, like redirect to walled garden.
+func (h Handler) policyLocalData(ctx context.Context, resolver Resolver, req Request, msg *dns.Msg, hit RPZHit) []dns.RR {
+	q := msg.Question[0]
+
+	answer := cnameChain(msg.Answer, q.Name, hit.Name)
+
+	target := ""
+	for _, rr := range hit.Records {
+		rrtype := rr.Header().Rrtype
+		if rrtype != q.Qtype && rrtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+			continue
+		}
+
+		x := dns.Copy(rr)
+		x.Header().Name = hit.Name
+		answer = append(answer, x)
+
+		if cname, ok := x.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+			target = cname.Target
+		}
+	}
+
+	if target != "" {
+		sub := req
+		sub.Question = dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}
+
+		err := ResolveContext(ctx, resolver, NewResponseCallback(func(r Record) error {
+			rr, err := r.ToRR()
+			if err != nil {
+				return err
+			}
+			answer = append(answer, rr)
+			return nil
+		}), sub)
+		if err != nil {
+			logger.Warn("failed to resolve target of response policy", logger.Fields{"name": target, "reason": err})
+		}
+	}
+
+	return answer
+}
@@ -74,4 +74,310 @@ func TestHandler_ErrorHandling(t *testing.T) {
 	if err := lt.Test([]logtest.Entry{{Level: logger.WarnLevel, Message: "failed to resolve", Fields: logger.Fields{"proto": "dns", "reason": "test error", "name": "example.com.", "type": "A"}}}); err != nil {
 		t.Error(err)
 	}
+
+	if in, err := srv.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err != nil {
+		t.Errorf("failed to exchange: %s", err)
+	} else if in.Rcode != dns.RcodeServerFailure {
+		t.Errorf("unexpected rcode: expected %s but got %s", dns.RcodeToString[dns.RcodeServerFailure], dns.RcodeToString[in.Rcode])
+	}
+}
+
+// BlockingResolver is a Resolver that blocks until the context of request done.
+type BlockingResolver struct {
+	ClientAddress net.IP
+}
+
+func (br *BlockingResolver) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	br.ClientAddress = landns.ClientAddressFromContext(r.Context())
+	<-r.Context().Done()
+	return r.Context().Err()
+}
+
+func (br *BlockingResolver) RecursionAvailable() bool {
+	return false
+}
+
+func (br *BlockingResolver) Close() error {
+	return nil
+}
+
+func TestHandler_Context(t *testing.T) {
+	t.Parallel()
+
+	resolver := &BlockingResolver{}
+	handler := landns.NewHandler(resolver, landns.NewMetrics("landns"))
+	handler.Timeout = 50 * time.Millisecond
+
+	w := testutil.NewDummyDNSResponseWriter(&net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 12345})
+	start := time.Now()
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+	if d := time.Since(start); d < 50*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("unexpected duration: %s", d)
+	}
+	if len(w.Messages) != 1 || w.Messages[0].Rcode != dns.RcodeServerFailure {
+		t.Errorf("unexpected response: %v", w.Messages)
+	}
+	if !resolver.ClientAddress.Equal(net.ParseIP("127.1.2.3")) {
+		t.Errorf("unexpected client address: %s", resolver.ClientAddress)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler.Timeout = 0
+	handler.BaseContext = func() context.Context {
+		return ctx
+	}
+
+	w = testutil.NewDummyDNSResponseWriter(&net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 12345})
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if len(w.Messages) != 1 || w.Messages[0].Rcode != dns.RcodeServerFailure {
+		t.Errorf("unexpected response: %v", w.Messages)
+	}
+}
+
+func TestHandler_Views(t *testing.T) {
+	t.Parallel()
+
+	makeResolver := func(addr string) landns.Resolver {
+		return landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP(addr)},
+		})
+	}
+
+	handler := landns.NewHandler(makeResolver("127.0.0.1"), landns.NewMetrics("landns"))
+	handler.Views = landns.ViewSet{
+		{Name: "office", Networks: []*net.IPNet{mustParseCIDR(t, "192.168.0.0/16")}, Resolver: makeResolver("192.168.1.1")},
+		{Name: "vpn", Networks: []*net.IPNet{mustParseCIDR(t, "10.8.0.0/24")}, Resolver: makeResolver("10.8.0.1")},
+	}
+	handler.TrustedForwarders = []*net.IPNet{mustParseCIDR(t, "172.16.0.0/16"), mustParseCIDR(t, "192.168.2.3/32")}
+
+	tests := []struct {
+		Remote string
+		Subnet string
+		Expect string
+	}{
+		{"192.168.2.3", "", "example.com.\t123\tIN\tA\t192.168.1.1"},
+		{"10.8.0.5", "", "example.com.\t123\tIN\tA\t10.8.0.1"},
+		{"172.16.0.1", "", "example.com.\t123\tIN\tA\t127.0.0.1"},
+		{"172.16.0.1", "10.8.0.0", "example.com.\t123\tIN\tA\t10.8.0.1"},
+		{"192.168.2.3", "172.16.0.0", "example.com.\t123\tIN\tA\t127.0.0.1"},
+		{"10.8.0.5", "192.168.0.0", "example.com.\t123\tIN\tA\t10.8.0.1"},
+		{"10.8.0.5", "172.16.0.0", "example.com.\t123\tIN\tA\t10.8.0.1"},
+	}
+
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if tt.Subnet != "" {
+			req.SetEdns0(4096, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP(tt.Subnet),
+			})
+		}
+
+		w := testutil.NewDummyDNSResponseWriter(&net.UDPAddr{IP: net.ParseIP(tt.Remote), Port: 1234})
+		handler.ServeDNS(w, req)
+
+		if len(w.Messages) != 1 {
+			t.Errorf("%s/%s: unexpected messages length: %d", tt.Remote, tt.Subnet, len(w.Messages))
+			continue
+		}
+		if len(w.Messages[0].Answer) != 1 || w.Messages[0].Answer[0].String() != tt.Expect {
+			t.Errorf("%s/%s: unexpected answer:\nexpected: %s\nbut got:  %s", tt.Remote, tt.Subnet, tt.Expect, w.Messages[0].Answer)
+		}
+	}
+}
+
+func TestHandler_Policy(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path, closer := writeRPZ(t, rpzZone)
+	defer closer()
+
+	rpz := landns.NewRPZ(landns.RPZFile{Path: path})
+	if err := rpz.Reload(); err != nil {
+		t.Fatalf("failed to load RPZ: %s", err)
+	}
+
+	metrics := testutil.StartMetricsServer(ctx, t, "landns")
+
+	handler := landns.NewHandler(landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "www.example.com.", TTL: 123, Address: net.ParseIP("198.0.0.1")},
+		landns.AddressRecord{Name: "ok.example.com.", TTL: 123, Address: net.ParseIP("192.0.2.1")},
+		landns.AddressRecord{Name: "walled.lan.", TTL: 123, Address: net.ParseIP("10.9.9.9")},
+	}), metrics.Metrics)
+	handler.Policy = landns.RPZSet{rpz}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+	tcp := &net.TCPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+
+	tests := []struct {
+		Name      string
+		Remote    net.Addr
+		Rcode     int
+		Truncated bool
+		Answer    []string
+	}{
+		{"ok.example.com.", udp, dns.RcodeSuccess, false, []string{"ok.example.com.\t123\tIN\tA\t192.0.2.1"}},
+		{"nxdomain.example.com.", udp, dns.RcodeNameError, false, nil},
+		{"nodata.example.com.", udp, dns.RcodeSuccess, false, nil},
+		{"tcp.example.com.", udp, dns.RcodeSuccess, true, nil},
+		{"tcp.example.com.", tcp, dns.RcodeSuccess, false, nil},
+		{"garden.example.com.", udp, dns.RcodeSuccess, false, []string{"garden.example.com.\t60\tIN\tA\t10.0.0.1"}},
+		{"redirect.example.com.", udp, dns.RcodeSuccess, false, []string{"redirect.example.com.\t60\tIN\tCNAME\twalled.lan.", "walled.lan.\t123\tIN\tA\t10.9.9.9"}},
+		{"www.example.com.", udp, dns.RcodeSuccess, false, []string{"www.example.com.\t60\tIN\tA\t10.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		w := testutil.NewDummyDNSResponseWriter(tt.Remote)
+		handler.ServeDNS(w, new(dns.Msg).SetQuestion(tt.Name, dns.TypeA))
+
+		if len(w.Messages) != 1 {
+			t.Errorf("%s: unexpected messages length: %d", tt.Name, len(w.Messages))
+			continue
+		}
+		msg := w.Messages[0]
+		if msg.Rcode != tt.Rcode || msg.Truncated != tt.Truncated {
+			t.Errorf("%s: unexpected response: %s", tt.Name, msg)
+		}
+		assertRRs(t, tt.Name, tt.Answer, msg.Answer)
+	}
+
+	w := testutil.NewDummyDNSResponseWriter(udp)
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("drop.example.com.", dns.TypeA))
+	if len(w.Messages) != 0 {
+		t.Errorf("expected dropped but got: %v", w.Messages)
+	}
+	metrics.Get(t).Assert(t, "landns_response_count", testutil.MetricsLabels{"rcode": "DROPPED", "view": "default"}, 1)
+	metrics.Get(t).Assert(t, "landns_resolve_count", testutil.MetricsLabels{"source": "dropped", "type": "A", "view": "default"}, 1)
+
+	// Policy is not applied to failed responses, for not hide errors.
+	failed := landns.NewHandler(&testutil.DummyResolver{Error: true}, landns.NewMetrics("landns"))
+	failed.Policy = landns.RPZSet{rpz}
+
+	for _, name := range []string{"nxdomain.example.com.", "nodata.example.com.", "garden.example.com.", "drop.example.com."} {
+		w = testutil.NewDummyDNSResponseWriter(udp)
+		failed.ServeDNS(w, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		if len(w.Messages) != 1 {
+			t.Errorf("%s: unexpected messages length: %d", name, len(w.Messages))
+		} else if w.Messages[0].Rcode != dns.RcodeServerFailure || len(w.Messages[0].Answer) != 0 {
+			t.Errorf("%s: expected SERVFAIL but got: %s", name, w.Messages[0])
+		}
+	}
+
+	// CNAME records after the rewritten name are removed.
+	chain := landns.NewHandler(testutil.ResponseResolver{Answer: []landns.Record{
+		landns.CnameRecord{Name: "chain.example.com.", TTL: 123, Target: "garden.example.com."},
+		landns.CnameRecord{Name: "garden.example.com.", TTL: 123, Target: "origin.example.com."},
+		landns.AddressRecord{Name: "origin.example.com.", TTL: 123, Address: net.ParseIP("192.0.2.2")},
+	}}, landns.NewMetrics("landns"))
+	chain.Policy = landns.RPZSet{rpz}
+
+	w = testutil.NewDummyDNSResponseWriter(udp)
+	chain.ServeDNS(w, new(dns.Msg).SetQuestion("chain.example.com.", dns.TypeA))
+	if len(w.Messages) != 1 {
+		t.Fatalf("unexpected messages length: %d", len(w.Messages))
+	}
+	assertRRs(t, "chain.example.com.", []string{
+		"chain.example.com.\t123\tIN\tCNAME\tgarden.example.com.",
+		"garden.example.com.\t60\tIN\tA\t10.0.0.1",
+	}, w.Messages[0].Answer)
+}
+
+func TestHandler_DNSSEC(t *testing.T) {
+	t.Parallel()
+
+	dir, closer := makeKeyDir(t)
+	defer closer()
+
+	generateDNSSECKey(t, dir, "example.com.", 257, "")
+	zsk := generateDNSSECKey(t, dir, "example.com.", 256, "")
+
+	signer := landns.NewDNSSECSigner([]string{dir})
+	if err := signer.Reload(); err != nil {
+		t.Fatalf("failed to load keys: %s", err)
+	}
+
+	handler := landns.NewHandler(landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "www.example.com.", TTL: 123, Address: net.ParseIP("192.0.2.1")},
+	}), landns.NewMetrics("landns"))
+	handler.Signer = signer
+
+	udp := &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	w := testutil.NewDummyDNSResponseWriter(udp)
+	handler.ServeDNS(w, req)
+	if len(w.Messages) != 1 {
+		t.Fatalf("unexpected messages length: %d", len(w.Messages))
+	}
+	msg := w.Messages[0]
+	if opt := msg.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != landns.EdnsBufferSize {
+		t.Errorf("unexpected OPT record: %s", msg)
+	}
+	assertSigned(t, msg.Answer, "www.example.com.", dns.TypeA, zsk, time.Now())
+
+	w = testutil.NewDummyDNSResponseWriter(udp)
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA))
+	if len(w.Messages) != 1 {
+		t.Fatalf("unexpected messages length: %d", len(w.Messages))
+	}
+	msg = w.Messages[0]
+	if msg.IsEdns0() != nil || len(msg.Answer) != 1 {
+		t.Errorf("unexpected response: %s", msg)
+	}
+}
+
+func TestHandler_Truncate(t *testing.T) {
+	t.Parallel()
+
+	var records []landns.Record
+	for i := 0; i < 100; i++ {
+		records = append(records, landns.AddressRecord{Name: "many.example.com.", TTL: 60, Address: net.IPv4(192, 0, 2, byte(i))})
+	}
+	handler := landns.NewHandler(landns.NewSimpleResolver(records), landns.NewMetrics("landns"))
+
+	udp := &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+	tcp := &net.TCPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+
+	edns := new(dns.Msg).SetQuestion("many.example.com.", dns.TypeA)
+	edns.SetEdns0(4096, false)
+
+	tests := []struct {
+		Name      string
+		Remote    net.Addr
+		Request   *dns.Msg
+		Truncated bool
+		MaxSize   int
+	}{
+		{"udp", udp, new(dns.Msg).SetQuestion("many.example.com.", dns.TypeA), true, dns.MinMsgSize},
+		{"udp/edns", udp, edns, true, landns.EdnsBufferSize},
+		{"tcp", tcp, new(dns.Msg).SetQuestion("many.example.com.", dns.TypeA), false, dns.MaxMsgSize},
+	}
+
+	for _, tt := range tests {
+		w := testutil.NewDummyDNSResponseWriter(tt.Remote)
+		handler.ServeDNS(w, tt.Request)
+		if len(w.Messages) != 1 {
+			t.Errorf("%s: unexpected messages length: %d", tt.Name, len(w.Messages))
+			continue
+		}
+
+		msg := w.Messages[0]
+		if msg.Truncated != tt.Truncated || msg.Len() > tt.MaxSize {
+			t.Errorf("%s: unexpected response: truncated=%v size=%d", tt.Name, msg.Truncated, msg.Len())
+		}
+		if !tt.Truncated && len(msg.Answer) != 100 {
+			t.Errorf("%s: unexpected answer length: %d", tt.Name, len(msg.Answer))
+		}
+	}
 }
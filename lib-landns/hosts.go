@@ -0,0 +1,248 @@
+package landns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+)
+
+const (
+	// DefaultHostsTTL is the default TTL for records from hosts files.
+	DefaultHostsTTL uint32 = 300
+
+	// DefaultHostsInterval is the default interval to check update of hosts files.
+	DefaultHostsInterval = 5 * time.Second
+)
+
+// hostsParser is parser of hosts file format like /etc/hosts.
+type hostsParser struct {
+	addresses map[Domain][]net.IP
+	sinkholes map[Domain]bool
+}
+
+func newHostsParser() *hostsParser {
+	return &hostsParser{
+		addresses: make(map[Domain][]net.IP),
+		sinkholes: make(map[Domain]bool),
+	}
+}
+
+// Parse is read entries like "192.168.1.1 host.example.com host" into the parser.
+//
+// Entries for unspecified address like "0.0.0.0 ads.example.com" are recorded as sinkhole, for use blocklists in hosts format.
+// Lines with unsupported address like zone-scoped "fe80::1%lo0" are skipped.
+func (p *hostsParser) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			logger.Debug("skip invalid address in hosts file", logger.Fields{"line": line, "address": fields[0]})
+			continue
+		}
+
+		for _, host := range fields[1:] {
+			name := Domain(strings.ToLower(host)).Normalized()
+			if net.ParseIP(host) != nil || name.Validate() != nil {
+				logger.Debug("skip invalid hostname in hosts file", logger.Fields{"line": line, "hostname": host})
+				continue
+			}
+
+			if ip.IsUnspecified() {
+				p.sinkholes[name] = true
+			} else if !containsIP(p.addresses[name], ip) {
+				p.addresses[name] = append(p.addresses[name], ip)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Error{TypeExternalError, err, "failed to read hosts file"}
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Records is make A/AAAA records and PTR records for parsed entries.
+//
+// Sinkhole entries have both of A record "0.0.0.0" and AAAA record "::", and have no PTR records.
+// Sinkhole is ignored if the same name has other addresses.
+func (p *hostsParser) Records(ttl uint32) ([]Record, error) {
+	var records []Record
+
+	for name, ips := range p.addresses {
+		for _, ip := range ips {
+			records = append(records, AddressRecord{Name: name, TTL: ttl, Address: ip})
+		}
+	}
+
+	reverse, err := makeReverseMap(p.addresses, ttl)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, reverse...)
+
+	for name := range p.sinkholes {
+		if _, ok := p.addresses[name]; ok {
+			continue
+		}
+		records = append(records,
+			AddressRecord{Name: name, TTL: ttl, Address: net.IPv4zero},
+			AddressRecord{Name: name, TTL: ttl, Address: net.IPv6zero},
+		)
+	}
+
+	return records, nil
+}
+
+// NewSimpleResolverFromHosts is make SimpleResolver from hosts file format text like /etc/hosts.
+func NewSimpleResolverFromHosts(hosts []byte, ttl uint32) (SimpleResolver, error) {
+	p := newHostsParser()
+	if err := p.Parse(bytes.NewReader(hosts)); err != nil {
+		return SimpleResolver{}, err
+	}
+
+	records, err := p.Records(ttl)
+	if err != nil {
+		return SimpleResolver{}, err
+	}
+	return NewSimpleResolver(records), nil
+}
+
+// HostsResolver is the Resolver for hosts files, that reloads files when they changed.
+//
+// Paths can be directories. All files in the directories except hidden files are read as hosts files.
+type HostsResolver struct {
+	Paths    []string
+	TTL      uint32        // TTL for records. Changes are applied at the next reload.
+	Interval time.Duration // Interval to check update of hosts files.
+	Clock    Clock         // Source of current time.
+
+	mutex    sync.RWMutex
+	resolver SimpleResolver
+	watcher  fileWatcher
+}
+
+// NewHostsResolver is constructor of HostsResolver. Records are empty until Reload or Start called.
+func NewHostsResolver(paths []string) *HostsResolver {
+	return &HostsResolver{
+		Paths:    paths,
+		TTL:      DefaultHostsTTL,
+		Interval: DefaultHostsInterval,
+		Clock:    DefaultClock,
+	}
+}
+
+// String is returns simple human readable string.
+func (hr *HostsResolver) String() string {
+	return fmt.Sprintf("HostsResolver%s", hr.Paths)
+}
+
+// Reload is read hosts files and replace records. Records are kept if failed to read.
+func (hr *HostsResolver) Reload() error {
+	files, stamp, err := listFiles("hosts", hr.Paths)
+	if err != nil {
+		return err
+	}
+
+	p := newHostsParser()
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return Error{TypeExternalError, err, "failed to read hosts file"}
+		}
+		err = p.Parse(f)
+		f.Close()
+		if err != nil {
+			return newError(TypeArgumentError, err, "%s", path)
+		}
+	}
+
+	records, err := p.Records(hr.TTL)
+	if err != nil {
+		return err
+	}
+
+	hr.mutex.Lock()
+	hr.resolver = NewSimpleResolver(records)
+	hr.mutex.Unlock()
+
+	hr.watcher.loaded(stamp)
+	return nil
+}
+
+// stamp is get stamp string that changes when any hosts file updated.
+func (hr *HostsResolver) stamp() (string, error) {
+	_, stamp, err := listFiles("hosts", hr.Paths)
+	return stamp, err
+}
+
+// Start is read hosts files and start watching them in background.
+func (hr *HostsResolver) Start() error {
+	if err := hr.Reload(); err != nil {
+		return err
+	}
+
+	hr.watcher.start(hr.Clock, hr.Interval, "hosts files", logger.Fields{"paths": hr.Paths}, hr.stamp, hr.Reload)
+	return nil
+}
+
+// SimpleResolver is getter to the current records as SimpleResolver.
+func (hr *HostsResolver) SimpleResolver() SimpleResolver {
+	hr.mutex.RLock()
+	defer hr.mutex.RUnlock()
+
+	return hr.resolver
+}
+
+// Records is getter of all records in order of name and type.
+func (hr *HostsResolver) Records() []Record {
+	return hr.SimpleResolver().Records()
+}
+
+// Resolve is resolve matched records.
+func (hr *HostsResolver) Resolve(w ResponseWriter, r Request) error {
+	return hr.SimpleResolver().Resolve(w, r)
+}
+
+// ResolveContext is resolve matched records.
+func (hr *HostsResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) error {
+	return hr.SimpleResolver().ResolveContext(ctx, w, r)
+}
+
+// RecursionAvailable is always returns false.
+func (hr *HostsResolver) RecursionAvailable() bool {
+	return false
+}
+
+// Close is stop watching hosts files.
+func (hr *HostsResolver) Close() error {
+	hr.watcher.stop()
+	return nil
+}
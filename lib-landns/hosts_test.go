@@ -0,0 +1,156 @@
+package landns_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestNewSimpleResolverFromHosts(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := landns.NewSimpleResolverFromHosts([]byte(`
+# comment line
+127.0.0.1   localhost
+192.168.1.10 Alice.example.com alice  # trailing comment
+192.168.1.11 bob.example.com
+2001:db8::10 alice.example.com
+192.168.1.10 alice.example.com
+
+0.0.0.0 ads.example.com
+0.0.0.0 0.0.0.0
+:: tracker.example.com
+0.0.0.0 bob.example.com
+192.168.1.12 invalid..name
+fe80::1%lo0 localhost
+broken line
+`), 100)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	var records []string
+	for _, r := range resolver.Records() {
+		records = append(records, r.String())
+	}
+	expect := []string{
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 100 IN PTR alice.example.com.",
+		"1.0.0.127.in-addr.arpa. 100 IN PTR localhost.",
+		"10.1.168.192.in-addr.arpa. 100 IN PTR alice.",
+		"10.1.168.192.in-addr.arpa. 100 IN PTR alice.example.com.",
+		"11.1.168.192.in-addr.arpa. 100 IN PTR bob.example.com.",
+		"ads.example.com. 100 IN A 0.0.0.0",
+		"ads.example.com. 100 IN AAAA ::",
+		"alice. 100 IN A 192.168.1.10",
+		"alice.example.com. 100 IN A 192.168.1.10",
+		"alice.example.com. 100 IN AAAA 2001:db8::10",
+		"bob.example.com. 100 IN A 192.168.1.11",
+		"localhost. 100 IN A 127.0.0.1",
+		"tracker.example.com. 100 IN A 0.0.0.0",
+		"tracker.example.com. 100 IN AAAA ::",
+	}
+	if strings.Join(records, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("unexpected records:\nexpected:\n%s\nbut got:\n%s", strings.Join(expect, "\n"), strings.Join(records, "\n"))
+	}
+
+	AssertResolve(t, resolver, landns.NewRequest("ads.example.com.", dns.TypeA, false), true, "ads.example.com. 100 IN A 0.0.0.0")
+
+	if _, err := landns.NewSimpleResolverFromHosts([]byte("127.0.0.1 "+strings.Repeat("a", 100000)+"\n"), 100); err == nil || !strings.HasPrefix(err.Error(), "failed to read hosts file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHostsResolver(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-hosts")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostsDir := filepath.Join(dir, "hosts.d")
+	if err := os.Mkdir(hostsDir, 0755); err != nil {
+		t.Fatalf("failed to make directory: %s", err)
+	}
+
+	write := func(path, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write hosts file: %s", err)
+		}
+	}
+	write(filepath.Join(dir, "hosts"), "192.168.1.10 alice.example.com\n")
+	write(filepath.Join(hostsDir, "blocklist"), "0.0.0.0 ads.example.com\n")
+	write(filepath.Join(hostsDir, ".hidden"), "192.168.1.99 hidden.example.com\n")
+
+	clock := testutil.NewFakeClock()
+	resolver := landns.NewHostsResolver([]string{filepath.Join(dir, "hosts"), hostsDir})
+	resolver.TTL = 100
+	resolver.Clock = clock
+
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer resolver.Close()
+
+	AssertResolve(t, resolver, landns.NewRequest("alice.example.com.", dns.TypeA, false), true, "alice.example.com. 100 IN A 192.168.1.10")
+	AssertResolve(t, resolver, landns.NewRequest("ads.example.com.", dns.TypeA, false), true, "ads.example.com. 100 IN A 0.0.0.0")
+	AssertResolve(t, resolver, landns.NewRequest("hidden.example.com.", dns.TypeA, false), true)
+	AssertResolve(t, resolver, landns.NewRequest("bob.example.com.", dns.TypeA, false), true)
+
+	waitReload := func(name, expect string) {
+		t.Helper()
+
+		for clock.Timers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Add(landns.DefaultHostsInterval)
+
+		for i := 0; i < 100; i++ {
+			resp := testutil.NewDummyResponseWriter()
+			if err := resolver.Resolve(resp, landns.NewRequest(name, dns.TypeA, false)); err != nil {
+				t.Fatalf("failed to resolve: %s", err)
+			}
+			if (len(resp.Records) > 0) == (expect != "") {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if expect != "" {
+			AssertResolve(t, resolver, landns.NewRequest(name, dns.TypeA, false), true, expect)
+		} else {
+			AssertResolve(t, resolver, landns.NewRequest(name, dns.TypeA, false), true)
+		}
+	}
+
+	write(filepath.Join(hostsDir, "team"), "192.168.1.11 bob.example.com\n")
+	waitReload("bob.example.com.", "bob.example.com. 100 IN A 192.168.1.11")
+
+	if err := os.Remove(filepath.Join(hostsDir, "blocklist")); err != nil {
+		t.Fatalf("failed to remove hosts file: %s", err)
+	}
+	waitReload("ads.example.com.", "")
+
+	// Records are kept if failed to reload.
+	write(filepath.Join(dir, "hosts"), "192.168.1.10 "+strings.Repeat("a", 100000)+"\n")
+	if err := resolver.Reload(); err == nil || !strings.HasSuffix(err.Error(), "hosts: failed to read hosts file: bufio.Scanner: token too long") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	AssertResolve(t, resolver, landns.NewRequest("alice.example.com.", dns.TypeA, false), true, "alice.example.com. 100 IN A 192.168.1.10")
+
+	if len(resolver.Records()) != 4 {
+		t.Errorf("unexpected records: %s", resolver.Records())
+	}
+
+	if err := landns.NewHostsResolver([]string{filepath.Join(dir, "not-exists")}).Start(); err == nil || !strings.HasPrefix(err.Error(), "failed to read hosts file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,724 @@
+package landns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultKubernetesDomain is the default cluster domain for records of Kubernetes services.
+	DefaultKubernetesDomain Domain = "cluster.local."
+
+	// DefaultKubernetesTTL is the default TTL for records of Kubernetes services.
+	DefaultKubernetesTTL uint32 = 60
+
+	// DefaultKubernetesInterval is the default interval to refresh records of Kubernetes services.
+	DefaultKubernetesInterval = 20 * time.Second
+
+	// DefaultKubernetesResyncInterval is the default interval to reload all Kubernetes services while watching changes.
+	DefaultKubernetesResyncInterval = 5 * time.Minute
+
+	// DefaultKubernetesTimeout is the default timeout for each request to Kubernetes API server.
+	DefaultKubernetesTimeout = 10 * time.Second
+
+	// DefaultKubernetesWatchTimeout is the default duration of each watch request to Kubernetes API server.
+	DefaultKubernetesWatchTimeout = 5 * time.Minute
+
+	// KubernetesServiceAccountDir is the directory of service account credentials in Kubernetes pods.
+	KubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// KubernetesObject is a Service, Endpoints or List object of Kubernetes.
+//
+// Only fields that needed for making records are included.
+type KubernetesObject struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name            string `yaml:"name"`
+		Namespace       string `yaml:"namespace"`
+		ResourceVersion string `yaml:"resourceVersion"`
+	} `yaml:"metadata"`
+
+	// Spec is the spec of Service.
+	Spec struct {
+		ClusterIP    string           `yaml:"clusterIP"`
+		ExternalName string           `yaml:"externalName"`
+		Ports        []KubernetesPort `yaml:"ports"`
+	} `yaml:"spec"`
+
+	// Subsets is the subsets of Endpoints.
+	Subsets []struct {
+		Addresses []struct {
+			IP       string `yaml:"ip"`
+			Hostname string `yaml:"hostname"`
+		} `yaml:"addresses"`
+		Ports []KubernetesPort `yaml:"ports"`
+	} `yaml:"subsets"`
+
+	// Items is the items of List.
+	Items []KubernetesObject `yaml:"items"`
+
+	// Message is the message of Status.
+	Message string `yaml:"message"`
+}
+
+// KubernetesPort is a port of Service or Endpoints.
+type KubernetesPort struct {
+	Name     string `yaml:"name"`
+	Port     uint16 `yaml:"port"`
+	Protocol string `yaml:"protocol"`
+}
+
+// srvName is make name of SRV record like "_http._tcp.".
+func (p KubernetesPort) srvName() string {
+	proto := strings.ToLower(p.Protocol)
+	if proto == "" {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("_%s._%s.", strings.ToLower(p.Name), proto)
+}
+
+// Key is get "NAMESPACE/NAME" string of object.
+func (o KubernetesObject) Key() string {
+	ns := o.Metadata.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+	return ns + "/" + o.Metadata.Name
+}
+
+// flatten is expand List objects.
+func (o KubernetesObject) flatten() []KubernetesObject {
+	if o.Items == nil && !strings.HasSuffix(o.Kind, "List") {
+		return []KubernetesObject{o}
+	}
+
+	var objs []KubernetesObject
+	for _, item := range o.Items {
+		objs = append(objs, item.flatten()...)
+	}
+	return objs
+}
+
+// parseKubernetesObjects is parse YAML or JSON that includes one or more objects.
+func parseKubernetesObjects(r io.Reader) ([]KubernetesObject, error) {
+	var objs []KubernetesObject
+
+	dec := yaml.NewDecoder(r)
+	for {
+		var o KubernetesObject
+		if err := dec.Decode(&o); err == io.EOF {
+			return objs, nil
+		} else if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to parse Kubernetes object"}
+		}
+		objs = append(objs, o.flatten()...)
+	}
+}
+
+// KubernetesSource is the source of Kubernetes objects.
+type KubernetesSource interface {
+	Objects(context.Context) ([]KubernetesObject, error)
+}
+
+// KubernetesEvent is a change of Kubernetes object.
+type KubernetesEvent struct {
+	Type   string // "ADDED", "MODIFIED" or "DELETED".
+	Object KubernetesObject
+}
+
+// KubernetesWatcher is KubernetesSource that can watch changes of objects.
+type KubernetesWatcher interface {
+	KubernetesSource
+
+	// Watch is send changes since the last Objects call into ch, until ctx done or failed to watch.
+	Watch(ctx context.Context, ch chan<- KubernetesEvent) error
+}
+
+// KubernetesManifests is KubernetesSource that reads manifest files (*.yaml, *.yml or *.json) in a directory.
+type KubernetesManifests struct {
+	Dir string
+}
+
+// String is returns simple human readable string.
+func (m KubernetesManifests) String() string {
+	return fmt.Sprintf("KubernetesManifests[%s]", m.Dir)
+}
+
+// Objects is read all objects in manifest files.
+func (m KubernetesManifests) Objects(ctx context.Context) ([]KubernetesObject, error) {
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to read manifests directory"}
+	}
+
+	var objs []KubernetesObject
+	for _, f := range files {
+		switch filepath.Ext(f.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(m.Dir, f.Name()))
+		if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to read manifest"}
+		}
+
+		xs, err := parseKubernetesObjects(bytes.NewReader(b))
+		if err != nil {
+			return nil, newError(TypeExternalError, err, "%s", f.Name())
+		}
+		objs = append(objs, xs...)
+	}
+
+	return objs, nil
+}
+
+// kubernetesResources is the resources that KubernetesAPI gets.
+var kubernetesResources = []struct {
+	Path string
+	Kind string
+}{
+	{"/api/v1/services", "Service"},
+	{"/api/v1/endpoints", "Endpoints"},
+}
+
+// KubernetesAPI is KubernetesWatcher that gets objects from Kubernetes API server.
+type KubernetesAPI struct {
+	Server       string        // URL of API server like "https://10.0.0.1:443".
+	TokenFile    string        // Path to bearer token file. The file is read on each request, because tokens can be rotated.
+	Client       *http.Client  // HTTP client for API server. The timeout of Client is extended by WatchTimeout for watch requests.
+	WatchTimeout time.Duration // Duration of each watch request. Watch is re-connected after this duration.
+
+	mutex    sync.Mutex
+	versions map[string]string
+}
+
+// NewKubernetesAPI is constructor of KubernetesAPI.
+//
+// The server certificate is verified by caFile if it is not empty, or system CAs otherwise.
+func NewKubernetesAPI(server, tokenFile, caFile string) (*KubernetesAPI, error) {
+	api := &KubernetesAPI{
+		Server:       strings.TrimRight(server, "/"),
+		TokenFile:    tokenFile,
+		Client:       &http.Client{Timeout: DefaultKubernetesTimeout},
+		WatchTimeout: DefaultKubernetesWatchTimeout,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to read CA file"}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, newError(TypeArgumentError, nil, "invalid CA file: %s", caFile)
+		}
+		api.Client = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   DefaultKubernetesTimeout,
+		}
+	}
+
+	return api, nil
+}
+
+// NewInClusterKubernetesAPI is make KubernetesAPI using service account of the pod that Landns running in.
+func NewInClusterKubernetesAPI() (*KubernetesAPI, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, newError(TypeArgumentError, nil, "not running in Kubernetes cluster")
+	}
+
+	return NewKubernetesAPI(
+		"https://"+net.JoinHostPort(host, port),
+		filepath.Join(KubernetesServiceAccountDir, "token"),
+		filepath.Join(KubernetesServiceAccountDir, "ca.crt"),
+	)
+}
+
+// String is returns simple human readable string.
+func (api *KubernetesAPI) String() string {
+	return fmt.Sprintf("KubernetesAPI[%s]", api.Server)
+}
+
+func (api *KubernetesAPI) get(ctx context.Context, client *http.Client, path string, query url.Values) (*http.Response, error) {
+	u := api.Server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, Error{TypeInternalError, err, "failed to make request"}
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if api.TokenFile != "" {
+		token, err := ioutil.ReadFile(api.TokenFile)
+		if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to read token file"}
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to connect to Kubernetes"}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newError(TypeExternalError, nil, "unexpected response from Kubernetes: %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// list is get objects and resource version of the list.
+func (api *KubernetesAPI) list(ctx context.Context, path string) ([]KubernetesObject, string, error) {
+	resp, err := api.get(ctx, api.Client, path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list KubernetesObject
+	if err := yaml.NewDecoder(resp.Body).Decode(&list); err != nil && err != io.EOF {
+		return nil, "", Error{TypeExternalError, err, "failed to parse Kubernetes object"}
+	}
+
+	return list.flatten(), list.Metadata.ResourceVersion, nil
+}
+
+// Objects is get all Services and Endpoints in the cluster.
+func (api *KubernetesAPI) Objects(ctx context.Context) ([]KubernetesObject, error) {
+	var objs []KubernetesObject
+	versions := make(map[string]string)
+
+	for _, r := range kubernetesResources {
+		xs, version, err := api.list(ctx, r.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range xs {
+			xs[i].Kind = r.Kind
+		}
+		objs = append(objs, xs...)
+		versions[r.Path] = version
+	}
+
+	api.mutex.Lock()
+	api.versions = versions
+	api.mutex.Unlock()
+
+	return objs, nil
+}
+
+// Watch is send changes of Services and Endpoints since the last Objects call into ch, until ctx done or failed to watch.
+//
+// Watch requests are re-connected every WatchTimeout, from the last seen resource version.
+func (api *KubernetesAPI) Watch(ctx context.Context, ch chan<- KubernetesEvent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(kubernetesResources))
+	for _, r := range kubernetesResources {
+		go func(path, kind string) {
+			for ctx.Err() == nil {
+				if err := api.watch(ctx, path, kind, ch); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(r.Path, r.Kind)
+	}
+
+	err := <-errs
+	cancel()
+	for i := 1; i < len(kubernetesResources); i++ {
+		<-errs
+	}
+	return err
+}
+
+// watch is send changes of a resource into ch, until the watch request ends.
+func (api *KubernetesAPI) watch(ctx context.Context, path, kind string, ch chan<- KubernetesEvent) error {
+	api.mutex.Lock()
+	version := api.versions[path]
+	api.mutex.Unlock()
+
+	client := *api.Client
+	client.Timeout = 0
+	wctx, cancel := context.WithTimeout(ctx, api.WatchTimeout+api.Client.Timeout)
+	defer cancel()
+
+	resp, err := api.get(wctx, &client, path, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(api.WatchTimeout / time.Second))},
+	})
+	if err != nil {
+		if wctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&e); err == io.EOF || wctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return Error{TypeExternalError, err, "failed to read Kubernetes events"}
+		}
+
+		var o KubernetesObject
+		if err := yaml.Unmarshal(e.Object, &o); err != nil {
+			return Error{TypeExternalError, err, "failed to parse Kubernetes object"}
+		}
+
+		switch e.Type {
+		case "ERROR":
+			return newError(TypeExternalError, nil, "failed to watch Kubernetes: %s", o.Message)
+		case "ADDED", "MODIFIED", "DELETED":
+			o.Kind = kind
+			select {
+			case ch <- KubernetesEvent{Type: e.Type, Object: o}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		if o.Metadata.ResourceVersion != "" {
+			api.mutex.Lock()
+			if api.versions == nil {
+				api.versions = make(map[string]string)
+			}
+			api.versions[path] = o.Metadata.ResourceVersion
+			api.mutex.Unlock()
+		}
+	}
+}
+
+// KubernetesDiscovery is the service discovery of Kubernetes services into DynamicResolver.
+//
+// KubernetesDiscovery makes records in the same schema as CoreDNS:
+//
+//	SERVICE.NAMESPACE.svc.DOMAIN                    A/AAAA of ClusterIP, or addresses of endpoints if headless.
+//	HOSTNAME.SERVICE.NAMESPACE.svc.DOMAIN           A/AAAA of endpoint that has hostname, in headless service.
+//	_PORT._PROTO.SERVICE.NAMESPACE.svc.DOMAIN       SRV for each named ports.
+//	SERVICE.NAMESPACE.svc.DOMAIN                    CNAME to external name, if ExternalName service.
+//
+// If Source is KubernetesWatcher, changes are applied as soon as notified and all objects are reloaded every ResyncInterval.
+// Otherwise, all objects are reloaded every Interval.
+//
+// Records are volatile and refreshed every Interval, so they will expire even if KubernetesDiscovery stopped without cleanup.
+type KubernetesDiscovery struct {
+	Source         KubernetesSource
+	Domain         Domain          // Cluster domain like "cluster.local.".
+	Resolver       DynamicResolver // Destination of records.
+	TTL            uint32          // TTL for records. This should be longer than Interval.
+	Interval       time.Duration   // Interval to refresh records.
+	ResyncInterval time.Duration   // Interval to reload all objects while watching changes.
+	Clock          Clock           // Source of current time.
+
+	mutex   sync.Mutex
+	sync    recordSync
+	objects map[string]KubernetesObject
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewKubernetesDiscovery is constructor of KubernetesDiscovery.
+func NewKubernetesDiscovery(source KubernetesSource, domain Domain, resolver DynamicResolver) *KubernetesDiscovery {
+	return &KubernetesDiscovery{
+		Source:         source,
+		Domain:         domain,
+		Resolver:       resolver,
+		TTL:            DefaultKubernetesTTL,
+		Interval:       DefaultKubernetesInterval,
+		ResyncInterval: DefaultKubernetesResyncInterval,
+		Clock:          DefaultClock,
+		objects:        make(map[string]KubernetesObject),
+	}
+}
+
+// String is returns simple human readable string.
+func (kd *KubernetesDiscovery) String() string {
+	return fmt.Sprintf("KubernetesDiscovery[%s]", kd.Source)
+}
+
+func (kd *KubernetesDiscovery) name(labels ...string) (Domain, error) {
+	name := Domain(strings.ToLower(strings.Join(labels, ".")) + "." + strings.TrimPrefix(kd.Domain.Normalized().String(), "."))
+	return name, name.Validate()
+}
+
+// makeRecords is make records for objects, in order of services.
+func (kd *KubernetesDiscovery) makeRecords(objs []KubernetesObject) []Record {
+	var services []KubernetesObject
+	endpoints := make(map[string]KubernetesObject)
+	for _, o := range objs {
+		switch o.Kind {
+		case "Service":
+			services = append(services, o)
+		case "Endpoints":
+			endpoints[o.Key()] = o
+		}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Key() < services[j].Key()
+	})
+
+	var records []Record
+	for _, svc := range services {
+		ns := strings.SplitN(svc.Key(), "/", 2)[0]
+		base, err := kd.name(svc.Metadata.Name, ns, "svc")
+		if err != nil {
+			logger.Info("skip service that has invalid name", logger.Fields{"service": svc.Key()})
+			continue
+		}
+
+		switch {
+		case svc.Spec.ExternalName != "":
+			records = append(records, CnameRecord{Name: base, TTL: kd.TTL, Target: Domain(svc.Spec.ExternalName).Normalized()})
+
+		case svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None":
+			ip := net.ParseIP(svc.Spec.ClusterIP)
+			if ip == nil {
+				continue
+			}
+			records = append(records, AddressRecord{Name: base, TTL: kd.TTL, Address: ip})
+
+			for _, p := range svc.Spec.Ports {
+				if p.Name != "" {
+					records = append(records, SrvRecord{Name: Domain(p.srvName() + base.String()), TTL: kd.TTL, Weight: 100, Port: p.Port, Target: base})
+				}
+			}
+
+		default:
+			for _, subset := range endpoints[svc.Key()].Subsets {
+				for _, addr := range subset.Addresses {
+					ip := net.ParseIP(addr.IP)
+					if ip == nil {
+						continue
+					}
+					records = append(records, AddressRecord{Name: base, TTL: kd.TTL, Address: ip})
+
+					// CoreDNS uses dashed IP address as hostname if the endpoint has no hostname.
+					hostname := addr.Hostname
+					if hostname == "" {
+						hostname = strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+					}
+					target := Domain(strings.ToLower(hostname) + "." + base.String())
+					if target.Validate() != nil {
+						continue
+					}
+					records = append(records, AddressRecord{Name: target, TTL: kd.TTL, Address: ip})
+
+					for _, p := range subset.Ports {
+						if p.Name != "" {
+							records = append(records, SrvRecord{Name: Domain(p.srvName() + base.String()), TTL: kd.TTL, Weight: 100, Port: p.Port, Target: target})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return records
+}
+
+// update is update records in Resolver by current objects. The caller must hold mutex.
+func (kd *KubernetesDiscovery) update() error {
+	objs := make([]KubernetesObject, 0, len(kd.objects))
+	for _, o := range kd.objects {
+		objs = append(objs, o)
+	}
+
+	var rs []DynamicRecord
+	for _, r := range kd.makeRecords(objs) {
+		rs = append(rs, DynamicRecord{Record: r, Volatile: true})
+	}
+
+	return kd.sync.Sync(kd.Resolver, rs)
+}
+
+// Sync is load objects from Source and update records in Resolver.
+func (kd *KubernetesDiscovery) Sync(ctx context.Context) error {
+	objs, err := kd.Source.Objects(ctx)
+	if err != nil {
+		return err
+	}
+
+	kd.mutex.Lock()
+	defer kd.mutex.Unlock()
+
+	kd.objects = make(map[string]KubernetesObject)
+	for _, o := range objs {
+		kd.objects[o.Kind+":"+o.Key()] = o
+	}
+
+	return kd.update()
+}
+
+// refresh is set records again for extend expiration, without reloading objects.
+func (kd *KubernetesDiscovery) refresh() error {
+	kd.mutex.Lock()
+	defer kd.mutex.Unlock()
+
+	return kd.update()
+}
+
+// apply is apply a change of object and update records in Resolver.
+func (kd *KubernetesDiscovery) apply(e KubernetesEvent) error {
+	kd.mutex.Lock()
+	defer kd.mutex.Unlock()
+
+	key := e.Object.Kind + ":" + e.Object.Key()
+	if e.Type == "DELETED" {
+		delete(kd.objects, key)
+	} else {
+		kd.objects[key] = e.Object
+	}
+
+	return kd.update()
+}
+
+// Start is load objects and start watching or reloading in background.
+func (kd *KubernetesDiscovery) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := kd.Sync(ctx); err != nil {
+		cancel()
+		return err
+	}
+
+	kd.cancel = cancel
+	kd.done = make(chan struct{})
+
+	watcher, ok := kd.Source.(KubernetesWatcher)
+	if !ok {
+		go kd.poll(ctx)
+		return nil
+	}
+
+	go func() {
+		defer close(kd.done)
+
+		for {
+			wctx, wcancel := context.WithCancel(ctx)
+			events := make(chan KubernetesEvent)
+			closed := make(chan error, 1)
+			go func() {
+				closed <- watcher.Watch(wctx, events)
+				close(closed)
+			}()
+
+			kd.handleEvents(ctx, events, closed)
+			wcancel()
+			for range closed {
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+			if err := kd.Sync(ctx); err != nil && ctx.Err() == nil {
+				logger.Warn("failed to load Kubernetes services", logger.Fields{"source": kd.Source, "reason": err})
+			}
+		}
+	}()
+
+	return nil
+}
+
+// poll is reload objects every Interval.
+func (kd *KubernetesDiscovery) poll(ctx context.Context) {
+	defer close(kd.done)
+
+	for {
+		select {
+		case <-kd.Clock.After(kd.Interval):
+		case <-ctx.Done():
+			return
+		}
+
+		if err := kd.Sync(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to load Kubernetes services", logger.Fields{"source": kd.Source, "reason": err})
+		}
+	}
+}
+
+// handleEvents is apply changes and refresh records periodically, until time to re-synchronize or the watch closed.
+func (kd *KubernetesDiscovery) handleEvents(ctx context.Context, events <-chan KubernetesEvent, closed <-chan error) {
+	refresh := kd.Clock.After(kd.Interval)
+	resync := kd.Clock.After(kd.ResyncInterval)
+
+	for {
+		select {
+		case e := <-events:
+			if err := kd.apply(e); err != nil {
+				logger.Warn("failed to update Kubernetes services", logger.Fields{"source": kd.Source, "reason": err})
+			}
+		case <-refresh:
+			refresh = kd.Clock.After(kd.Interval)
+			if err := kd.refresh(); err != nil {
+				logger.Warn("failed to refresh Kubernetes services", logger.Fields{"source": kd.Source, "reason": err})
+			}
+		case <-resync:
+			return
+		case err := <-closed:
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("lost Kubernetes watch", logger.Fields{"source": kd.Source, "reason": err})
+
+			// Retry after Interval, and re-synchronize for catch up missed changes.
+			select {
+			case <-refresh:
+			case <-ctx.Done():
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close is stop watching and reloading. Records are kept in Resolver until expire.
+func (kd *KubernetesDiscovery) Close() error {
+	if kd.cancel != nil {
+		kd.cancel()
+		<-kd.done
+		kd.cancel = nil
+	}
+	return nil
+}
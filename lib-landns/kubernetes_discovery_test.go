@@ -0,0 +1,300 @@
+package landns_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+)
+
+const kubernetesManifest = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: shop
+spec:
+  clusterIP: 10.96.0.10
+  ports:
+  - name: http
+    port: 80
+  - port: 8080
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: db
+spec:
+  clusterIP: None
+  ports:
+  - name: pg
+    port: 5432
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: search
+spec:
+  type: ExternalName
+  externalName: search.example.com
+`
+
+const kubernetesEndpoints = `{
+  "kind": "List",
+  "items": [{
+    "kind": "Endpoints",
+    "metadata": {"name": "db", "namespace": "default"},
+    "subsets": [{
+      "addresses": [{"ip": "10.244.0.5", "hostname": "db-0"}, {"ip": "10.244.0.6"}],
+      "ports": [{"name": "pg", "port": 5432, "protocol": "TCP"}]
+    }]
+  }]
+}`
+
+func TestKubernetesManifests(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-kubernetes")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"services.yaml":  kubernetesManifest,
+		"endpoints.json": kubernetesEndpoints,
+		"README.md":      "this is not a manifest",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write manifest: %s", err)
+		}
+	}
+
+	objs, err := landns.KubernetesManifests{Dir: dir}.Objects(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read manifests: %s", err)
+	}
+
+	var keys []string
+	for _, o := range objs {
+		keys = append(keys, o.Kind+":"+o.Key())
+	}
+	expect := "Endpoints:default/db Service:shop/web Service:default/db Service:default/search"
+	if strings.Join(keys, " ") != expect {
+		t.Errorf("unexpected objects:\nexpected: %s\nbut got:  %s", expect, strings.Join(keys, " "))
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.yml"), []byte("kind: [Service"), 0644); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+	if _, err := (landns.KubernetesManifests{Dir: dir}).Objects(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "broken.yml: failed to parse Kubernetes object") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := (landns.KubernetesManifests{Dir: filepath.Join(dir, "not-exists")}).Objects(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "failed to read manifests directory") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestKubernetesAPI(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/api/v1/services":
+			w.Write([]byte(`{"kind":"ServiceList","items":[{"metadata":{"name":"web","namespace":"shop"},"spec":{"clusterIP":"10.96.0.10"}}]}`))
+		case "/api/v1/endpoints":
+			w.Write([]byte(`{"kind":"EndpointsList","items":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "landns-kubernetes")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	api, err := landns.NewKubernetesAPI(srv.URL+"/", tokenFile, "")
+	if err != nil {
+		t.Fatalf("failed to make client: %s", err)
+	}
+	if api.Client.Timeout != landns.DefaultKubernetesTimeout {
+		t.Errorf("unexpected timeout: %s", api.Client.Timeout)
+	}
+
+	if _, err := api.Objects(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "failed to read token file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("wrong-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %s", err)
+	}
+	if _, err := api.Objects(context.Background()); err == nil || err.Error() != "unexpected response from Kubernetes: 401 Unauthorized" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %s", err)
+	}
+	objs, err := api.Objects(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get objects: %s", err)
+	}
+	if len(objs) != 1 || objs[0].Kind != "Service" || objs[0].Key() != "shop/web" || objs[0].Spec.ClusterIP != "10.96.0.10" {
+		t.Errorf("unexpected objects: %#v", objs)
+	}
+
+	if _, err := landns.NewKubernetesAPI(srv.URL, "", tokenFile); err == nil || !strings.HasPrefix(err.Error(), "invalid CA file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-kubernetes")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "services.yaml"), []byte(kubernetesManifest), 0644); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "endpoints.json"), []byte(kubernetesEndpoints), 0644); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+
+	clock := testutil.NewFakeClock()
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+	resolver.Clock = clock
+
+	discovery := landns.NewKubernetesDiscovery(landns.KubernetesManifests{Dir: dir}, landns.DefaultKubernetesDomain, resolver)
+	discovery.Clock = clock
+	if err := discovery.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer discovery.Close()
+
+	waitRecords(t, resolver, []string{
+		"db.default.svc.cluster.local. 60 IN A 10.244.0.5",
+		"db-0.db.default.svc.cluster.local. 60 IN A 10.244.0.5",
+		"_pg._tcp.db.default.svc.cluster.local. 60 IN SRV 0 100 5432 db-0.db.default.svc.cluster.local.",
+		"db.default.svc.cluster.local. 60 IN A 10.244.0.6",
+		"10-244-0-6.db.default.svc.cluster.local. 60 IN A 10.244.0.6",
+		"_pg._tcp.db.default.svc.cluster.local. 60 IN SRV 0 100 5432 10-244-0-6.db.default.svc.cluster.local.",
+		"search.default.svc.cluster.local. 60 IN CNAME search.example.com.",
+		"web.shop.svc.cluster.local. 60 IN A 10.96.0.10",
+		"_http._tcp.web.shop.svc.cluster.local. 60 IN SRV 0 100 80 web.shop.svc.cluster.local.",
+	})
+
+	if err := os.Remove(filepath.Join(dir, "endpoints.json")); err != nil {
+		t.Fatalf("failed to remove manifest: %s", err)
+	}
+	for clock.Timers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Add(landns.DefaultKubernetesInterval)
+
+	waitRecords(t, resolver, []string{
+		"search.default.svc.cluster.local. 60 IN CNAME search.example.com.",
+		"web.shop.svc.cluster.local. 60 IN A 10.96.0.10",
+		"_http._tcp.web.shop.svc.cluster.local. 60 IN SRV 0 100 80 web.shop.svc.cluster.local.",
+	})
+
+	if err := discovery.Close(); err != nil {
+		t.Errorf("failed to close: %s", err)
+	}
+}
+
+func TestKubernetesDiscovery_Watch(t *testing.T) {
+	t.Parallel()
+
+	watches := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			switch r.URL.Path {
+			case "/api/v1/services":
+				w.Write([]byte(`{"kind":"ServiceList","metadata":{"resourceVersion":"10"},"items":[{"metadata":{"name":"web","namespace":"shop"},"spec":{"clusterIP":"10.96.0.10"}}]}`))
+			case "/api/v1/endpoints":
+				w.Write([]byte(`{"kind":"EndpointsList","metadata":{"resourceVersion":"10"},"items":[]}`))
+			}
+			return
+		}
+
+		watches <- r.URL.Path + "@" + r.URL.Query().Get("resourceVersion")
+
+		switch r.URL.Path + "@" + r.URL.Query().Get("resourceVersion") {
+		case "/api/v1/services@10":
+			// Close after an event, like timeout of watch.
+			w.Write([]byte(`{"type":"ADDED","object":{"kind":"Service","metadata":{"name":"api","namespace":"shop","resourceVersion":"11"},"spec":{"clusterIP":"10.96.0.20"}}}` + "\n"))
+			return
+		case "/api/v1/services@11":
+			w.Write([]byte(`{"type":"DELETED","object":{"kind":"Service","metadata":{"name":"web","namespace":"shop","resourceVersion":"12"},"spec":{"clusterIP":"10.96.0.10"}}}` + "\n"))
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	api, err := landns.NewKubernetesAPI(srv.URL, "", "")
+	if err != nil {
+		t.Fatalf("failed to make client: %s", err)
+	}
+
+	clock := testutil.NewFakeClock()
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+	resolver.Clock = clock
+
+	discovery := landns.NewKubernetesDiscovery(api, landns.DefaultKubernetesDomain, resolver)
+	discovery.Clock = clock
+	if err := discovery.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer discovery.Close()
+
+	waitRecords(t, resolver, []string{
+		"api.shop.svc.cluster.local. 60 IN A 10.96.0.20",
+	})
+
+	if err := discovery.Close(); err != nil {
+		t.Errorf("failed to close: %s", err)
+	}
+
+	srv.Close()
+	close(watches)
+	got := make(map[string]bool)
+	for w := range watches {
+		got[w] = true
+	}
+	for _, w := range []string{"/api/v1/services@10", "/api/v1/services@11", "/api/v1/endpoints@10"} {
+		if !got[w] {
+			t.Errorf("%s was not watched: %v", w, got)
+		}
+	}
+}
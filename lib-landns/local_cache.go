@@ -1,6 +1,8 @@
 package landns
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -8,14 +10,110 @@ import (
 	"github.com/miekg/dns"
 )
 
+const (
+	// DefaultCacheMaxEntries is the default maximum number of entries in LocalCache.
+	DefaultCacheMaxEntries = 10000
+
+	// DefaultCacheMaxBytes is the default maximum size of records in LocalCache. 0 means unlimited.
+	DefaultCacheMaxBytes = 0
+)
+
+type cacheKey struct {
+	Qtype uint16 // dns.TypeNone if NXDOMAIN.
+	Name  Domain
+}
+
+// cacheEntry is an entry of LocalCache.
+//
+// cacheEntry is positive entry that has Records, or negative entry that has Rcode and SOA.
+type cacheEntry struct {
+	Key      cacheKey
+	Records  []VolatileRecord
+	Negative bool
+	Rcode    int
+	SOA      VolatileRecord
+	Size     int
+
+	Refreshing bool // true while refreshing in background.
+}
+
+// TTL is getter to the duration until the first record in the entry will expire.
+func (e *cacheEntry) TTL(now time.Time) time.Duration {
+	if e.Negative {
+		return e.SOA.Expire.Sub(now)
+	}
+
+	ttl := time.Duration(-1)
+	for i, r := range e.Records {
+		if delta := r.Expire.Sub(now); i == 0 || delta < ttl {
+			ttl = delta
+		}
+	}
+	return ttl
+}
+
+func (e *cacheEntry) add(r VolatileRecord) {
+	e.Records = append(e.Records, r)
+	e.Size += dns.Len(r.RR)
+}
+
+// Write is write records in the entry into ResponseWriter.
+//
+// Records will have remaining TTL at now, or StaleAnswerTTL if stale is true.
+func (e *cacheEntry) Write(w ResponseWriter, now time.Time, stale bool) error {
+	if e.Negative {
+		soa := e.SOA
+		if stale {
+			soa = staleRecord(soa, now)
+		}
+		return writeNegative(w, e.Rcode, soa, now)
+	}
+
+	w.SetNoAuthoritative()
+
+	for _, cache := range e.Records {
+		if stale {
+			cache = staleRecord(cache, now)
+		}
+
+		record, err := cache.RecordAt(now)
+		if err != nil {
+			return err
+		}
+
+		if err := w.Add(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // LocalCache is in-memory cache manager for Resolver.
+//
+// LocalCache evicts the least recently used entry if the number of entries or the size of records exceeds limit.
+// Concurrent cache misses for the same question share one upstream request, and the upstream request doesn't block lookups of other questions.
+// Entries that will expire soon are refreshed in background if Prefetch is set, and expired entries are served as stale (RFC 8767) while refreshing if StaleTTL is set.
 type LocalCache struct {
-	mutex    sync.Mutex
-	entries  map[uint16]map[Domain][]VolatileRecord
-	invoke   chan struct{}
-	closer   chan struct{}
-	upstream Resolver
-	metrics  *Metrics
+	mutex      sync.Mutex
+	entries    map[cacheKey]*list.Element
+	lru        *list.List
+	bytes      int
+	invoke     chan struct{}
+	closer     chan struct{}
+	closed     bool           // Whether Close was called. Entries are not stored after closed.
+	refreshing sync.WaitGroup // Background refreshing that Close waits for.
+	flights    *flightGroup
+	upstream   Resolver
+	metrics    *Metrics
+
+	MaxEntries     int           // Maximum number of entries. Unlimited if 0.
+	MaxBytes       int           // Maximum size of records in bytes. Unlimited if 0.
+	Prefetch       time.Duration // Refresh entry in background if it hit when remaining TTL is shorter than this. Disabled if 0.
+	StaleTTL       time.Duration // Duration to keep expired entries for serve-stale. Disabled if 0.
+	NegativeMinTTL time.Duration // Floor of TTL for negative cache.
+	NegativeMaxTTL time.Duration // Ceiling of TTL for negative cache. Unlimited if 0.
+	Clock          Clock         // Source of current time.
 }
 
 // NewLocalCache is constructor of LocalCache.
@@ -23,15 +121,21 @@ type LocalCache struct {
 // LocalCache will start background goroutine. So you have to ensure to call LocalCache.Close.
 func NewLocalCache(upstream Resolver, metrics *Metrics) *LocalCache {
 	lc := &LocalCache{
-		entries:  make(map[uint16]map[Domain][]VolatileRecord),
-		invoke:   make(chan struct{}, 100),
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+		invoke:   make(chan struct{}, 1),
 		closer:   make(chan struct{}),
+		flights:  newFlightGroup(),
 		upstream: upstream,
 		metrics:  metrics,
-	}
 
-	for _, t := range []uint16{dns.TypeA, dns.TypeNS, dns.TypeCNAME, dns.TypePTR, dns.TypeMX, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV} {
-		lc.entries[t] = make(map[Domain][]VolatileRecord)
+		MaxEntries:     DefaultCacheMaxEntries,
+		MaxBytes:       DefaultCacheMaxBytes,
+		Prefetch:       DefaultCachePrefetch,
+		StaleTTL:       DefaultCacheStaleTTL,
+		NegativeMinTTL: DefaultNegativeMinTTL,
+		NegativeMaxTTL: DefaultNegativeMaxTTL,
+		Clock:          DefaultClock,
 	}
 
 	go lc.manage()
@@ -46,139 +150,390 @@ func (lc *LocalCache) String() string {
 
 	domains := make(map[Domain]struct{})
 	records := 0
-	for _, xs := range lc.entries {
-		for name, x := range xs {
-			domains[name] = struct{}{}
-			records += len(x)
+	for key, elm := range lc.entries {
+		entry := elm.Value.(*cacheEntry)
+		if entry.Negative {
+			continue
 		}
+		domains[key.Name] = struct{}{}
+		records += len(entry.Records)
 	}
 
 	return fmt.Sprintf("LocalCache[%d domains %d records]", len(domains), records)
 }
 
+// Len is getter to the number of entries in the cache.
+func (lc *LocalCache) Len() int {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	return lc.lru.Len()
+}
+
+// Bytes is getter to the size of records in the cache.
+func (lc *LocalCache) Bytes() int {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	return lc.bytes
+}
+
+// Entries is getter to all entries in the cache, in order of most recently used.
+func (lc *LocalCache) Entries() ([]CacheEntry, error) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	now := lc.Clock.Now()
+	entries := make([]CacheEntry, 0, lc.lru.Len())
+	for elm := lc.lru.Front(); elm != nil; elm = elm.Next() {
+		e := elm.Value.(*cacheEntry)
+		if e.TTL(now)+lc.StaleTTL < 1 {
+			continue
+		}
+
+		var entry CacheEntry
+		var err error
+		if e.Negative {
+			entry, err = newNegativeCacheEntry(e.Key.Name, e.Key.Qtype, e.Rcode, e.SOA, now)
+		} else {
+			entry, err = newCacheEntry(e.Key.Name, e.Key.Qtype, e.Records, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// flush is remove entries that matched to fn.
+func (lc *LocalCache) flush(fn func(Domain) bool) (int, error) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	n := 0
+	for key, elm := range lc.entries {
+		if fn(key.Name) {
+			lc.remove(elm)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Flush is remove entries for the name.
+func (lc *LocalCache) Flush(name Domain) (int, error) {
+	return lc.flush(func(n Domain) bool {
+		return matchCacheName(n, name)
+	})
+}
+
+// FlushSuffix is remove entries for the suffix and its subdomains.
+func (lc *LocalCache) FlushSuffix(suffix Domain) (int, error) {
+	return lc.flush(func(n Domain) bool {
+		return matchCacheSuffix(n, suffix)
+	})
+}
+
+// FlushAll is remove all entries.
+func (lc *LocalCache) FlushAll() (int, error) {
+	return lc.flush(func(Domain) bool {
+		return true
+	})
+}
+
 // Close is closer to LocalCache.
+//
+// Close waits for background refreshing, and responses of upstream after closed are not stored.
 func (lc *LocalCache) Close() error {
 	close(lc.closer)
-	close(lc.invoke)
+
+	lc.mutex.Lock()
+	lc.closed = true
+	lc.metrics.CacheSize(-lc.lru.Len(), -lc.bytes)
+	lc.entries = make(map[cacheKey]*list.Element)
+	lc.lru.Init()
+	lc.bytes = 0
+	lc.mutex.Unlock()
+
+	lc.refreshing.Wait()
+
 	return nil
 }
 
-func (lc *LocalCache) manageTask() (next time.Duration) {
-	next = 10 * time.Second
+func (lc *LocalCache) notify() {
+	select {
+	case lc.invoke <- struct{}{}:
+	default:
+	}
+}
 
-	lc.mutex.Lock()
-	defer lc.mutex.Unlock()
+func (lc *LocalCache) remove(elm *list.Element) {
+	entry := lc.lru.Remove(elm).(*cacheEntry)
+	delete(lc.entries, entry.Key)
+	lc.bytes -= entry.Size
+	lc.metrics.CacheSize(-1, -entry.Size)
+}
+
+// store is put entry into the cache and evicts old entries if exceeded limit.
+func (lc *LocalCache) store(entry *cacheEntry) {
+	if elm, ok := lc.entries[entry.Key]; ok {
+		lc.remove(elm)
+	}
 
-	for _, domains := range lc.entries {
-		for name, entries := range domains {
-			sweep := false
+	lc.entries[entry.Key] = lc.lru.PushFront(entry)
+	lc.bytes += entry.Size
+	lc.metrics.CacheSize(1, entry.Size)
 
-			for _, entry := range entries {
-				delta := time.Until(entry.Expire)
-				if delta < 1 {
-					sweep = true
-					break
-				} else if next > delta {
-					next = delta
-				}
-			}
+	lc.evict()
+	lc.notify()
+}
 
-			if sweep {
-				delete(domains, name)
-			}
+// evict is remove least recently used entries until satisfy the limit.
+func (lc *LocalCache) evict() {
+	evicted := 0
+	for lc.lru.Len() > 1 && ((lc.MaxEntries > 0 && lc.lru.Len() > lc.MaxEntries) || (lc.MaxBytes > 0 && lc.bytes > lc.MaxBytes)) {
+		lc.remove(lc.lru.Back())
+		evicted++
+	}
+
+	if evicted > 0 {
+		lc.metrics.CacheEvicted(evicted)
+	}
+}
+
+// manageTask is remove expired entries, and returns timer for the next task.
+//
+// The timer will be nil if the cache is empty, because the next task will be invoked when stored entry.
+func (lc *LocalCache) manageTask() <-chan time.Time {
+	next := 10 * time.Second
+
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	now := lc.Clock.Now()
+	for _, elm := range lc.entries {
+		delta := elm.Value.(*cacheEntry).TTL(now) + lc.StaleTTL
+		if delta < 1 {
+			lc.remove(elm)
+		} else if next > delta {
+			next = delta
 		}
 	}
 
-	return next
+	if len(lc.entries) == 0 {
+		return nil
+	}
+	return lc.Clock.After(next)
 }
 
 func (lc *LocalCache) manage() {
-	for {
-		lc.manageTask()
+	var timer <-chan time.Time
 
+	for {
 		select {
-		case <-time.After(lc.manageTask()):
+		case <-timer:
 		case <-lc.invoke:
 		case <-lc.closer:
 			return
 		}
+
+		timer = lc.manageTask()
 	}
 }
 
-func (lc *LocalCache) add(r Record) error {
-	if r.GetTTL() == 0 {
+// fetch is resolve request using upstream resolver, and make cache entries from the response.
+func (lc *LocalCache) fetch(ctx context.Context, w ResponseWriter, r Request) ([]*cacheEntry, error) {
+	now := lc.Clock.Now()
+	var entries []*cacheEntry
+	index := make(map[cacheKey]*cacheEntry)
+
+	var nr negativeResponse
+	hook := nr.Hook(w, func(record Record) error {
+		if record.GetTTL() == 0 {
+			return nil
+		}
+
+		rr, err := record.ToRR()
+		if err != nil {
+			return err
+		}
+
+		key := cacheKey{record.GetQtype(), record.GetName()}
+		entry, ok := index[key]
+		if !ok {
+			entry = &cacheEntry{Key: key}
+			index[key] = entry
+			entries = append(entries, entry)
+		}
+		entry.add(VolatileRecord{rr, now.Add(time.Duration(record.GetTTL()) * time.Second)})
+
 		return nil
+	})
+
+	if err := ResolveContext(ctx, lc.upstream, hook, r); err != nil {
+		return nil, err
 	}
 
-	rr, err := r.ToRR()
-	if err != nil {
-		return err
+	for _, entry := range entries {
+		shareMinimumTTL(entry.Records)
 	}
 
-	if _, ok := lc.entries[r.GetQtype()][r.GetName()]; !ok {
-		lc.entries[r.GetQtype()][r.GetName()] = []VolatileRecord{
-			{rr, time.Now().Add(time.Duration(r.GetTTL()) * time.Second)},
-		}
-	} else {
-		lc.entries[r.GetQtype()][r.GetName()] = append(
-			lc.entries[r.GetQtype()][r.GetName()],
-			VolatileRecord{rr, time.Now().Add(time.Duration(r.GetTTL()) * time.Second)},
-		)
+	ttl, ok := nr.TTL(lc.NegativeMinTTL, lc.NegativeMaxTTL)
+	if !ok {
+		return entries, nil
 	}
 
-	lc.invoke <- struct{}{}
+	soa, err := nr.Entry(ttl, now)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	key := cacheKey{r.Qtype, Domain(r.Name)}
+	if nr.rcode == dns.RcodeNameError {
+		key.Qtype = dns.TypeNone
+	}
+	entries = append(entries, &cacheEntry{
+		Key:      key,
+		Negative: true,
+		Rcode:    nr.rcode,
+		SOA:      soa,
+		Size:     dns.Len(soa.RR),
+	})
+
+	return entries, nil
 }
 
-func (lc *LocalCache) resolveFromUpstream(w ResponseWriter, r Request) error {
+// resolveFromUpstream is resolve request using upstream resolver and store the response.
+//
+// resolveFromUpstream have to be called without holding the mutex.
+func (lc *LocalCache) resolveFromUpstream(ctx context.Context, w ResponseWriter, r Request) error {
 	lc.metrics.CacheMiss(r)
 
-	wh := ResponseWriterHook{
-		Writer: w,
-		OnAdd:  lc.add,
-	}
+	shared, err := lc.flights.Do(ctx, w, flightKey(r), func(w ResponseWriter) error {
+		entries, err := lc.fetch(ctx, w, r)
+		if err != nil {
+			return err
+		}
+
+		lc.mutex.Lock()
+		defer lc.mutex.Unlock()
+
+		if lc.closed {
+			return nil
+		}
+		for _, entry := range entries {
+			lc.store(entry)
+		}
 
-	return lc.upstream.Resolve(wh, r)
+		return nil
+	})
+	if shared {
+		lc.metrics.CacheCoalesced(r)
+	}
+	return err
 }
 
-func (lc *LocalCache) resolveFromCache(w ResponseWriter, r Request, records []VolatileRecord) error {
-	lc.metrics.CacheHit(r)
+// refresh is start refreshing entry in background.
+//
+// The entry keeps serving until refreshing succeeded.
+// Refreshing will not be cancelled even if the query that triggered it was finished, but LocalCache.Close waits for it.
+//
+// refresh have to be called with holding the mutex.
+func (lc *LocalCache) refresh(ctx context.Context, entry *cacheEntry, r Request) {
+	if entry.Refreshing || lc.closed {
+		return
+	}
+	entry.Refreshing = true
+
+	lc.refreshing.Add(1)
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer lc.refreshing.Done()
 
-	w.SetNoAuthoritative()
+		entries, err := lc.fetch(ctx, discardResponseWriter(), r)
 
-	for _, cache := range records {
-		record, err := cache.Record()
-		if err != nil {
-			return err
+		lc.mutex.Lock()
+		defer lc.mutex.Unlock()
+
+		entry.Refreshing = false
+		if err != nil || lc.closed {
+			return
 		}
 
-		if err := w.Add(record); err != nil {
-			return err
+		for _, e := range entries {
+			lc.store(e)
 		}
+	}()
+}
+
+func (lc *LocalCache) resolveFromCache(ctx context.Context, w ResponseWriter, r Request, entry *cacheEntry, now time.Time, stale bool) error {
+	switch {
+	case stale:
+		lc.metrics.CacheStaleHit(r)
+		lc.refresh(ctx, entry, r)
+	case entry.Negative:
+		lc.metrics.CacheNegativeHit(r)
+	default:
+		lc.metrics.CacheHit(r)
 	}
 
-	return nil
+	if !stale && entry.TTL(now) < lc.Prefetch {
+		lc.metrics.CachePrefetch(r)
+		lc.refresh(ctx, entry, r)
+	}
+
+	return entry.Write(w, now, stale)
+}
+
+// lookup is find cache entry for the request.
+//
+// lookup returns expired entry as stale if it is kept for serve-stale.
+func (lc *LocalCache) lookup(r Request, now time.Time) (entry *cacheEntry, stale bool, ok bool) {
+	for _, key := range []cacheKey{{r.Qtype, Domain(r.Name)}, {dns.TypeNone, Domain(r.Name)}} {
+		elm, ok := lc.entries[key]
+		if !ok {
+			continue
+		}
+
+		entry := elm.Value.(*cacheEntry)
+		ttl := entry.TTL(now)
+		if ttl+lc.StaleTTL < 1 {
+			lc.remove(elm)
+			continue
+		}
+
+		lc.lru.MoveToFront(elm)
+		return entry, ttl < 1, true
+	}
+	return nil, false, false
 }
 
 // Resolve is resolver using cache or the upstream resolver.
 func (lc *LocalCache) Resolve(w ResponseWriter, r Request) error {
-	lc.mutex.Lock()
-	defer lc.mutex.Unlock()
+	return lc.ResolveContext(r.Context(), w, r)
+}
 
-	records, ok := lc.entries[r.Qtype][Domain(r.Name)]
-	if !ok {
-		return lc.resolveFromUpstream(w, r)
-	}
+// ResolveContext is resolver using cache or the upstream resolver with context.
+func (lc *LocalCache) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	ctx, span := startSpan(ctx, r, "LocalCache.Resolve")
+	defer endSpan(span, &err)
 
-	for _, cache := range records {
-		if time.Until(cache.Expire) < 1 {
-			delete(lc.entries[r.Qtype], Domain(r.Name))
-			return lc.resolveFromUpstream(w, r)
-		}
+	// Metrics records the cache result into the span via the context in Request.
+	r = r.WithContext(ctx)
+
+	lc.mutex.Lock()
+
+	now := lc.Clock.Now()
+	if entry, stale, ok := lc.lookup(r, now); ok {
+		defer lc.mutex.Unlock()
+		return lc.resolveFromCache(ctx, w, r, entry, now, stale)
 	}
 
-	return lc.resolveFromCache(w, r, records)
+	lc.mutex.Unlock()
+	return lc.resolveFromUpstream(ctx, w, r)
 }
 
 // RecursionAvailable is returns same as upstream.
@@ -1,14 +1,48 @@
 package landns_test
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/macrat/landns/lib-landns"
 	"github.com/macrat/landns/lib-landns/testutil"
 	"github.com/miekg/dns"
 )
 
+// GatedResolver is upstream resolver that blocks queries until the gate closed, if the gate is set.
+type GatedResolver struct {
+	landns.Resolver
+
+	mutex   sync.Mutex
+	gate    chan struct{}
+	started chan struct{}
+}
+
+func (gr *GatedResolver) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	gr.mutex.Lock()
+	gate := gr.gate
+	gr.mutex.Unlock()
+
+	if gate != nil {
+		gr.started <- struct{}{}
+		<-gate
+	}
+	return gr.Resolver.Resolve(w, r)
+}
+
+// SetGate is start blocking queries until the returned channel closed.
+func (gr *GatedResolver) SetGate() chan struct{} {
+	gr.mutex.Lock()
+	defer gr.mutex.Unlock()
+
+	gr.gate = make(chan struct{})
+	return gr.gate
+}
+
 func TestLocalCache(t *testing.T) {
 	for _, tt := range CacheTests {
 		tester := tt.Tester
@@ -17,16 +51,86 @@ func TestLocalCache(t *testing.T) {
 			t.Parallel()
 
 			resolver := landns.NewLocalCache(CacheTestUpstream(t), landns.NewMetrics("landns"))
+			clock := testutil.NewFakeClock()
+			resolver.Clock = clock
 			defer func() {
 				if err := resolver.Close(); err != nil {
 					t.Fatalf("failed to close: %s", err)
 				}
 			}()
 
-			tester(t, resolver)
+			tester(t, resolver, clock)
 		})
 	}
 
+	for _, tt := range NegativeCacheTests {
+		tester := tt.Tester
+
+		t.Run("negative/"+tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			tester(t, func(t testing.TB, upstream landns.Resolver, clock landns.Clock, minTTL, maxTTL time.Duration) landns.Resolver {
+				resolver := landns.NewLocalCache(upstream, landns.NewMetrics("landns"))
+				resolver.Clock = clock
+				resolver.NegativeMinTTL = minTTL
+				resolver.NegativeMaxTTL = maxTTL
+				return resolver
+			})
+		})
+	}
+
+	for _, tt := range StaleCacheTests {
+		tester := tt.Tester
+
+		t.Run("stale/"+tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			tester(t, func(t testing.TB, upstream landns.Resolver, clock landns.Clock, prefetch, staleTTL time.Duration) landns.Resolver {
+				resolver := landns.NewLocalCache(upstream, landns.NewMetrics("landns"))
+				resolver.Clock = clock
+				resolver.Prefetch = prefetch
+				resolver.StaleTTL = staleTTL
+				return resolver
+			})
+		})
+	}
+
+	for _, tt := range TTLCacheTests {
+		tester := tt.Tester
+
+		t.Run("ttl/"+tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			tester(t, func(t testing.TB, upstream landns.Resolver, clock landns.Clock) landns.Resolver {
+				resolver := landns.NewLocalCache(upstream, landns.NewMetrics("landns"))
+				resolver.Clock = clock
+				return resolver
+			})
+		})
+	}
+
+	for _, tt := range CoalesceCacheTests {
+		tester := tt.Tester
+
+		t.Run("coalesce/"+tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			tester(t, func(t testing.TB, upstream landns.Resolver) landns.Resolver {
+				return landns.NewLocalCache(upstream, landns.NewMetrics("landns"))
+			})
+		})
+	}
+
+	t.Run("inspect", func(t *testing.T) {
+		t.Parallel()
+
+		resolver := landns.NewLocalCache(CacheTestUpstream(t), landns.NewMetrics("landns"))
+		resolver.Clock = testutil.NewFakeClock()
+		defer resolver.Close()
+
+		InspectCacheTest(t, resolver)
+	})
+
 	t.Run("String", func(t *testing.T) {
 		t.Parallel()
 
@@ -48,6 +152,69 @@ func TestLocalCache(t *testing.T) {
 		}
 	})
 
+	t.Run("Eviction", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		metrics := testutil.StartMetricsServer(ctx, t, "landns")
+
+		var records []landns.Record
+		for i := 0; i < 4; i++ {
+			records = append(records, landns.AddressRecord{Name: landns.Domain(fmt.Sprintf("host%d.example.com.", i)), TTL: 100, Address: net.ParseIP("127.0.0.1")})
+		}
+		resolver := landns.NewLocalCache(landns.NewSimpleResolver(records), metrics.Metrics)
+		resolver.MaxEntries = 3
+		defer func() {
+			if err := resolver.Close(); err != nil {
+				t.Fatalf("failed to close: %s", err)
+			}
+		}()
+
+		resolve := func(i int, cached bool) {
+			t.Helper()
+			name := fmt.Sprintf("host%d.example.com.", i)
+			AssertResolve(t, resolver, landns.NewRequest(name, dns.TypeA, false), !cached, name+" 100 IN A 127.0.0.1")
+		}
+		assertMiss := func(expect int) {
+			t.Helper()
+			metrics.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "miss", "type": "A"}, float64(expect))
+		}
+
+		resolve(0, false)
+		resolve(1, false)
+		resolve(2, false)
+		resolve(0, true)  // host0 becomes most recently used.
+		resolve(3, false) // host1 is evicted.
+
+		if n := resolver.Len(); n != 3 {
+			t.Errorf("unexpected number of entries: %d", n)
+		}
+		assertMiss(4)
+
+		resolve(0, true)
+		resolve(2, true)
+		resolve(3, true)
+		assertMiss(4)
+
+		resolve(1, false) // host0 is evicted.
+		assertMiss(5)
+
+		m := metrics.Get(t)
+		m.Assert(t, "landns_cache_entries", testutil.MetricsLabels{}, 3)
+		m.Assert(t, "landns_cache_bytes", testutil.MetricsLabels{}, float64(resolver.Bytes()))
+		m.Assert(t, "landns_cache_eviction_count", testutil.MetricsLabels{}, 2)
+
+		resolver.MaxEntries = 0
+		resolver.MaxBytes = resolver.Bytes() / 3
+		resolve(0, false)
+		if n := resolver.Len(); n != 1 {
+			t.Errorf("unexpected number of entries after shrink MaxBytes: %d", n)
+		}
+		metrics.Get(t).Assert(t, "landns_cache_eviction_count", testutil.MetricsLabels{}, 5)
+	})
+
 	t.Run("RecursionAvailable", func(t *testing.T) {
 		t.Parallel()
 
@@ -55,6 +222,66 @@ func TestLocalCache(t *testing.T) {
 			return landns.NewLocalCache(landns.ResolverSet(rs), landns.NewMetrics("landns"))
 		})
 	})
+
+	t.Run("CloseWhileRefreshing", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		metrics := testutil.StartMetricsServer(ctx, t, "landns")
+
+		upstream := &GatedResolver{
+			Resolver: landns.NewSimpleResolver([]landns.Record{
+				landns.AddressRecord{Name: "example.com.", TTL: 100, Address: net.ParseIP("127.0.0.1")},
+			}),
+			started: make(chan struct{}, 1),
+		}
+		resolver := landns.NewLocalCache(upstream, metrics.Metrics)
+		clock := testutil.NewFakeClock()
+		resolver.Clock = clock
+		resolver.Prefetch = 50 * time.Second
+
+		req := landns.NewRequest("example.com.", dns.TypeA, false)
+		AssertResolve(t, resolver, req, true, "example.com. 100 IN A 127.0.0.1")
+
+		gate := upstream.SetGate()
+		clock.Add(60 * time.Second)
+		AssertResolve(t, resolver, req, false, "example.com. 40 IN A 127.0.0.1")
+
+		select {
+		case <-upstream.started:
+		case <-time.After(time.Second):
+			t.Fatalf("refreshing was not started")
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			if err := resolver.Close(); err != nil {
+				t.Errorf("failed to close: %s", err)
+			}
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+			t.Fatalf("closed without waiting for refreshing")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(gate)
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("failed to close after refreshing finished")
+		}
+
+		if n := resolver.Len(); n != 0 {
+			t.Errorf("refreshed entries are stored after closed: %d", n)
+		}
+		metrics.Get(t).Assert(t, "landns_cache_entries", testutil.MetricsLabels{}, 0)
+	})
 }
 
 func BenchmarkLocalCache(b *testing.B) {
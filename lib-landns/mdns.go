@@ -0,0 +1,522 @@
+package landns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultMdnsTimeout is the default timeout to wait responses for mDNS query.
+	DefaultMdnsTimeout = 500 * time.Millisecond
+
+	// DefaultMdnsPublishInterval is the default interval to reload records to publish by mDNS.
+	DefaultMdnsPublishInterval = 5 * time.Second
+
+	// mdnsUnicastTTL is the maximum TTL for responses to legacy unicast queries. (RFC 6762 section 6.7)
+	mdnsUnicastTTL = 10
+
+	// mdnsCacheFlush is the cache-flush bit in class of mDNS records. (RFC 6762 section 10.2)
+	mdnsCacheFlush = 1 << 15
+)
+
+var (
+	// DefaultMdnsAddr is the multicast address and port of mDNS.
+	DefaultMdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+	// LoopbackMdnsAddr is the address for loopback-only mode that uses unicast instead of multicast.
+	LoopbackMdnsAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+)
+
+// IsMdnsName is check if name is under "local." domain.
+func IsMdnsName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(dns.Fqdn(name)), ".local.")
+}
+
+// mdnsInterfaceAddr is get IPv4 address of the interface for send multicast packets via it.
+func mdnsInterfaceAddr(ifi *net.Interface) (*net.UDPAddr, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to get interface address"}
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	return nil, newError(TypeArgumentError, nil, "interface has no IPv4 address: %s", ifi.Name)
+}
+
+// MdnsResolver is the Resolver that resolves ".local." names by querying multicast DNS on demand.
+//
+// MdnsResolver sends one-shot queries from an ephemeral port, so mDNS responders reply by unicast. (RFC 6762 section 5.1)
+// Names outside of ".local." are ignored.
+type MdnsResolver struct {
+	Addr      *net.UDPAddr   // Destination of queries. DefaultMdnsAddr in default, or LoopbackMdnsAddr for loopback-only mode.
+	Interface *net.Interface // Interface to send queries. nil means the system default.
+	Timeout   time.Duration  // Timeout to wait responses.
+}
+
+// NewMdnsResolver is constructor of MdnsResolver.
+func NewMdnsResolver(addr *net.UDPAddr, ifi *net.Interface) *MdnsResolver {
+	return &MdnsResolver{
+		Addr:      addr,
+		Interface: ifi,
+		Timeout:   DefaultMdnsTimeout,
+	}
+}
+
+// String is returns simple human readable string.
+func (mr *MdnsResolver) String() string {
+	if mr.Interface != nil {
+		return fmt.Sprintf("MdnsResolver[%s%%%s]", mr.Addr, mr.Interface.Name)
+	}
+	return fmt.Sprintf("MdnsResolver[%s]", mr.Addr)
+}
+
+func (mr *MdnsResolver) listen() (*net.UDPConn, error) {
+	var laddr *net.UDPAddr
+	if mr.Interface != nil && mr.Addr.IP.IsMulticast() {
+		// Linux chooses the interface of multicast packets by the source address.
+		var err error
+		if laddr, err = mdnsInterfaceAddr(mr.Interface); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to open socket"}
+	}
+	return conn, nil
+}
+
+// exchange is send query and collect answers until timeout.
+//
+// It returns early when got the first answer, except for PTR query that may be answered by many responders.
+func (mr *MdnsResolver) exchange(ctx context.Context, q dns.Question) ([]dns.RR, error) {
+	conn, err := mr.listen()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(mr.Timeout))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	msg := &dns.Msg{MsgHdr: dns.MsgHdr{Id: dns.Id()}, Question: []dns.Question{q}}
+	packet, err := msg.Pack()
+	if err != nil {
+		return nil, Error{TypeInternalError, err, "failed to pack query"}
+	}
+	if _, err := conn.WriteTo(packet, mr.Addr); err != nil {
+		return nil, Error{TypeExternalError, err, "failed to send query"}
+	}
+
+	var answers []dns.RR
+	seen := make(map[string]bool)
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, Error{TypeExternalError, ctx.Err(), "failed to resolve by mDNS"}
+			}
+			// Timed out. Returns answers that received until now.
+			return answers, nil
+		}
+
+		var in dns.Msg
+		if err := in.Unpack(buf[:n]); err != nil || !in.Response || (in.Id != msg.Id && in.Id != 0) {
+			continue
+		}
+
+		for _, rr := range in.Answer {
+			rr.Header().Class &^= mdnsCacheFlush
+			if !strings.EqualFold(rr.Header().Name, q.Name) || seen[rr.String()] {
+				continue
+			}
+			seen[rr.String()] = true
+			answers = append(answers, rr)
+		}
+
+		if len(answers) > 0 && q.Qtype != dns.TypePTR {
+			return answers, nil
+		}
+	}
+}
+
+// Resolve is resolver using mDNS.
+func (mr *MdnsResolver) Resolve(w ResponseWriter, r Request) error {
+	return mr.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolver using mDNS with context.
+func (mr *MdnsResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	if !IsMdnsName(r.Name) {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, r, "MdnsResolver.Resolve")
+	defer endSpan(span, &err)
+
+	answers, err := mr.exchange(ctx, dns.Question{Name: r.Name, Qtype: r.Qtype, Qclass: dns.ClassINET})
+	if err != nil {
+		return err
+	}
+
+	if len(answers) > 0 {
+		w.SetNoAuthoritative()
+	}
+	for _, rr := range answers {
+		if record, ok := forwardableRecord(rr); ok {
+			if err := w.Add(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RecursionAvailable is always returns false.
+func (mr *MdnsResolver) RecursionAvailable() bool {
+	return false
+}
+
+// Close is do nothing.
+func (mr *MdnsResolver) Close() error {
+	return nil
+}
+
+// MdnsPublisher is the mDNS responder that publishes records in DynamicResolver.
+//
+// Records in Zone are published under "local." like "printer.lan." as "printer.local.".
+// SRV records named like "_ipp._tcp.printer.lan." are published as DNS-SD service "printer._ipp._tcp.local.", with TXT records of the same name.
+//
+// Records are loaded from Resolver when Start, and reloaded every Interval.
+type MdnsPublisher struct {
+	Resolver  DynamicResolver // Source of records.
+	Zone      Domain          // Zone of records to publish like "lan.".
+	Addr      *net.UDPAddr    // Address to listen. DefaultMdnsAddr in default, or LoopbackMdnsAddr for loopback-only mode.
+	Interface *net.Interface  // Interface to listen multicast. nil means the system default.
+	Interval  time.Duration   // Interval to reload records.
+	Clock     Clock           // Source of current time.
+
+	mutex sync.Mutex
+	rrs   []dns.RR
+	conn  *net.UDPConn
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewMdnsPublisher is constructor of MdnsPublisher.
+func NewMdnsPublisher(resolver DynamicResolver, zone Domain, addr *net.UDPAddr, ifi *net.Interface) *MdnsPublisher {
+	return &MdnsPublisher{
+		Resolver:  resolver,
+		Zone:      zone,
+		Addr:      addr,
+		Interface: ifi,
+		Interval:  DefaultMdnsPublishInterval,
+		Clock:     DefaultClock,
+	}
+}
+
+// String is returns simple human readable string.
+func (mp *MdnsPublisher) String() string {
+	return fmt.Sprintf("MdnsPublisher[%s %s]", mp.Zone, mp.Addr)
+}
+
+// localName is convert name in Zone to name under "local.". Returns false if name is not in Zone.
+func (mp *MdnsPublisher) localName(name Domain) (string, bool) {
+	zone := "." + strings.TrimPrefix(mp.Zone.Normalized().String(), ".")
+	n := strings.ToLower(name.Normalized().String())
+	if !strings.HasSuffix(n, zone) || len(n) == len(zone) {
+		return "", false
+	}
+	return strings.TrimSuffix(n, zone) + ".local.", true
+}
+
+// records is make mDNS records from records in Resolver.
+func (mp *MdnsPublisher) records() ([]dns.RR, error) {
+	rs, err := mp.Resolver.SearchRecords(mp.Zone)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make(map[string][]string)
+	for _, r := range rs {
+		if t, ok := r.Record.(TxtRecord); ok {
+			name := strings.ToLower(t.Name.Normalized().String())
+			txts[name] = append(txts[name], t.Text)
+		}
+	}
+
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	add := func(rr dns.RR) {
+		if !seen[rr.String()] {
+			seen[rr.String()] = true
+			rrs = append(rrs, rr)
+		}
+	}
+
+	for _, r := range rs {
+		name, ok := mp.localName(r.Record.GetName())
+		if !ok {
+			continue
+		}
+		ttl := r.Record.GetTTL()
+
+		switch x := r.Record.(type) {
+		case AddressRecord:
+			rr, err := x.ToRR()
+			if err != nil {
+				return nil, err
+			}
+			rr.Header().Name = name
+			add(rr)
+
+		case SrvRecord:
+			labels := dns.SplitDomainName(name)
+			if len(labels) != 4 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+				continue
+			}
+			service := labels[0] + "." + labels[1] + ".local."
+			instance := labels[2] + "." + service
+
+			target := x.Target.Normalized().String()
+			if t, ok := mp.localName(x.Target); ok {
+				target = t
+			}
+
+			texts := txts[strings.ToLower(x.Name.Normalized().String())]
+			if len(texts) == 0 {
+				texts = []string{""}
+			}
+
+			add(&dns.PTR{Hdr: dns.RR_Header{Name: "_services._dns-sd._udp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: service})
+			add(&dns.PTR{Hdr: dns.RR_Header{Name: service, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: instance})
+			add(&dns.SRV{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl}, Priority: x.Priority, Weight: x.Weight, Port: x.Port, Target: target})
+			add(&dns.TXT{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}, Txt: texts})
+		}
+	}
+
+	return rrs, nil
+}
+
+// reload is load records from Resolver for publish.
+func (mp *MdnsPublisher) reload() error {
+	rrs, err := mp.records()
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	mp.rrs = rrs
+	mp.mutex.Unlock()
+
+	return nil
+}
+
+// mdnsAnswer is make answers and additional records for the question.
+func mdnsAnswer(rrs []dns.RR, q dns.Question) (answers, extras []dns.RR) {
+	find := func(name string, types ...uint16) (found []dns.RR) {
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			for _, t := range types {
+				if t == dns.TypeANY || rr.Header().Rrtype == t {
+					found = append(found, rr)
+					break
+				}
+			}
+		}
+		return found
+	}
+
+	answers = find(q.Name, q.Qtype)
+	for _, rr := range answers {
+		switch x := rr.(type) {
+		case *dns.PTR:
+			for _, s := range find(x.Ptr, dns.TypeSRV, dns.TypeTXT) {
+				extras = append(extras, s)
+				if srv, ok := s.(*dns.SRV); ok {
+					extras = append(extras, find(srv.Target, dns.TypeA, dns.TypeAAAA)...)
+				}
+			}
+		case *dns.SRV:
+			extras = append(extras, find(x.Target, dns.TypeA, dns.TypeAAAA)...)
+		}
+	}
+	return answers, extras
+}
+
+// respond is make response for query. Returns nil if nothing to answer.
+func (mp *MdnsPublisher) respond(query *dns.Msg, unicast bool) *dns.Msg {
+	mp.mutex.Lock()
+	rrs := mp.rrs
+	mp.mutex.Unlock()
+
+	resp := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Authoritative: true}}
+	for _, q := range query.Question {
+		answers, extras := mdnsAnswer(rrs, q)
+		for _, rr := range answers {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+		for _, rr := range extras {
+			resp.Extra = append(resp.Extra, dns.Copy(rr))
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+
+	// RRs are copied from the cache, so it is safe to modify them.
+	if unicast {
+		// Legacy unicast response. (RFC 6762 section 6.7)
+		resp.Id = query.Id
+		resp.Question = query.Question
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			if rr.Header().Ttl > mdnsUnicastTTL {
+				rr.Header().Ttl = mdnsUnicastTTL
+			}
+		}
+	} else {
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			if rr.Header().Rrtype != dns.TypePTR {
+				rr.Header().Class |= mdnsCacheFlush
+			}
+		}
+	}
+
+	return resp
+}
+
+// Start is load records and start listening mDNS queries in background.
+func (mp *MdnsPublisher) Start() error {
+	if err := mp.reload(); err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	var err error
+	if mp.Addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", mp.Interface, mp.Addr)
+	} else {
+		conn, err = net.ListenUDP("udp4", mp.Addr)
+	}
+	if err != nil {
+		return Error{TypeExternalError, err, "failed to listen mDNS"}
+	}
+
+	mp.mutex.Lock()
+	mp.conn = conn
+	mp.stop = make(chan struct{})
+	mp.mutex.Unlock()
+
+	mp.wg.Add(2)
+	go mp.serve(conn)
+	go mp.reloadLoop(mp.stop)
+
+	return nil
+}
+
+// reloadLoop is reload records every Interval until stop closed.
+func (mp *MdnsPublisher) reloadLoop(stop chan struct{}) {
+	defer mp.wg.Done()
+
+	for {
+		select {
+		case <-mp.Clock.After(mp.Interval):
+		case <-stop:
+			return
+		}
+
+		if err := mp.reload(); err != nil {
+			logger.Warn("failed to load records for mDNS", logger.Fields{"zone": mp.Zone, "reason": err})
+		}
+	}
+}
+
+func (mp *MdnsPublisher) serve(conn *net.UDPConn) {
+	defer mp.wg.Done()
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil || query.Response || query.Opcode != dns.OpcodeQuery {
+			continue
+		}
+
+		// Queries from other than the mDNS port are one-shot queries that expect unicast response.
+		unicast := src.Port != mp.Addr.Port || !mp.Addr.IP.IsMulticast()
+
+		resp := mp.respond(&query, unicast)
+		if resp == nil {
+			continue
+		}
+
+		packet, err := resp.Pack()
+		if err != nil {
+			logger.Warn("failed to pack mDNS response", logger.Fields{"reason": err})
+			continue
+		}
+
+		dest := mp.Addr
+		if unicast {
+			dest = src
+		}
+		if _, err := conn.WriteToUDP(packet, dest); err != nil {
+			logger.Debug("failed to send mDNS response", logger.Fields{"reason": err, "destination": dest})
+		}
+	}
+}
+
+// LocalAddr is get the address that listening.
+func (mp *MdnsPublisher) LocalAddr() net.Addr {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if mp.conn == nil {
+		return nil
+	}
+	return mp.conn.LocalAddr()
+}
+
+// Close is stop listening.
+func (mp *MdnsPublisher) Close() error {
+	mp.mutex.Lock()
+	conn, stop := mp.conn, mp.stop
+	mp.conn = nil
+	mp.mutex.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	err := conn.Close()
+	close(stop)
+	mp.wg.Wait()
+	return wrapError(err, TypeExternalError, "failed to close mDNS socket")
+}
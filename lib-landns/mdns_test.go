@@ -0,0 +1,225 @@
+package landns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestIsMdnsName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name   string
+		Expect bool
+	}{
+		{"printer.local.", true},
+		{"Printer.LOCAL", true},
+		{"_ipp._tcp.local.", true},
+		{"local.", false},
+		{"printer.local.example.com.", false},
+		{"example.com.", false},
+	}
+
+	for _, tt := range tests {
+		if got := landns.IsMdnsName(tt.Name); got != tt.Expect {
+			t.Errorf("%s: expected %v but got %v", tt.Name, tt.Expect, got)
+		}
+	}
+}
+
+func startMdnsPublisher(t *testing.T) (*landns.MdnsPublisher, func()) {
+	t.Helper()
+
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+
+	rs, err := landns.NewDynamicRecordSet(`
+		printer.lan. 600 IN A 192.168.1.20
+		_ipp._tcp.printer.lan. 600 IN SRV 0 0 631 printer.lan.
+		_ipp._tcp.printer.lan. 600 IN TXT "rp=ipp/print"
+		nas.lan. 600 IN AAAA 2001:db8::30
+		example.com. 600 IN A 192.168.1.40
+	`)
+	if err != nil {
+		t.Fatalf("failed to parse records: %s", err)
+	}
+	if err := resolver.SetRecords(rs); err != nil {
+		t.Fatalf("failed to set records: %s", err)
+	}
+
+	publisher := landns.NewMdnsPublisher(resolver, "lan.", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	if err := publisher.Start(); err != nil {
+		resolver.Close()
+		t.Fatalf("failed to start publisher: %s", err)
+	}
+
+	return publisher, func() {
+		if err := publisher.Close(); err != nil {
+			t.Errorf("failed to close publisher: %s", err)
+		}
+		resolver.Close()
+	}
+}
+
+func TestMdnsPublisher(t *testing.T) {
+	t.Parallel()
+
+	publisher, stop := startMdnsPublisher(t)
+	defer stop()
+
+	tests := []struct {
+		Name   string
+		Qtype  uint16
+		Answer []string
+		Extra  []string
+	}{
+		{"printer.local.", dns.TypeA, []string{"printer.local.\t10\tIN\tA\t192.168.1.20"}, nil},
+		{"nas.local.", dns.TypeAAAA, []string{"nas.local.\t10\tIN\tAAAA\t2001:db8::30"}, nil},
+		{"_services._dns-sd._udp.local.", dns.TypePTR, []string{"_services._dns-sd._udp.local.\t10\tIN\tPTR\t_ipp._tcp.local."}, nil},
+		{"_ipp._tcp.local.", dns.TypePTR, []string{"_ipp._tcp.local.\t10\tIN\tPTR\tprinter._ipp._tcp.local."}, []string{
+			"printer._ipp._tcp.local.\t10\tIN\tSRV\t0 0 631 printer.local.",
+			"printer.local.\t10\tIN\tA\t192.168.1.20",
+			"printer._ipp._tcp.local.\t10\tIN\tTXT\t\"rp=ipp/print\"",
+		}},
+		{"printer._ipp._tcp.local.", dns.TypeSRV, []string{"printer._ipp._tcp.local.\t10\tIN\tSRV\t0 0 631 printer.local."}, []string{
+			"printer.local.\t10\tIN\tA\t192.168.1.20",
+		}},
+	}
+
+	for _, tt := range tests {
+		query := new(dns.Msg).SetQuestion(tt.Name, tt.Qtype)
+		in, err := dns.Exchange(query, publisher.LocalAddr().String())
+		if err != nil {
+			t.Errorf("%s: failed to exchange: %s", tt.Name, err)
+			continue
+		}
+
+		if in.Id != query.Id || !in.Authoritative || len(in.Question) != 1 {
+			t.Errorf("%s: unexpected header: %s", tt.Name, in)
+		}
+		assertRRs(t, tt.Name+" answer", tt.Answer, in.Answer)
+		assertRRs(t, tt.Name+" extra", tt.Extra, in.Extra)
+	}
+
+	// Names that not published are not answered.
+	client := &dns.Client{Timeout: 100 * time.Millisecond}
+	for _, name := range []string{"notfound.local.", "example.local.", "lan.local."} {
+		if in, _, err := client.Exchange(new(dns.Msg).SetQuestion(name, dns.TypeA), publisher.LocalAddr().String()); err == nil {
+			t.Errorf("%s: expected no response but got: %s", name, in)
+		}
+	}
+}
+
+func TestMdnsPublisher_Reload(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	if err != nil {
+		t.Fatalf("failed to make resolver: %s", err)
+	}
+	defer resolver.Close()
+
+	clock := testutil.NewFakeClock()
+	publisher := landns.NewMdnsPublisher(resolver, "lan.", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	publisher.Clock = clock
+	if err := publisher.Start(); err != nil {
+		t.Fatalf("failed to start publisher: %s", err)
+	}
+	defer publisher.Close()
+
+	rs, err := landns.NewDynamicRecordSet("printer.lan. 600 IN A 192.168.1.20")
+	if err != nil {
+		t.Fatalf("failed to parse records: %s", err)
+	}
+	if err := resolver.SetRecords(rs); err != nil {
+		t.Fatalf("failed to set records: %s", err)
+	}
+
+	client := &dns.Client{Timeout: 100 * time.Millisecond}
+	query := new(dns.Msg).SetQuestion("printer.local.", dns.TypeA)
+	if in, _, err := client.Exchange(query, publisher.LocalAddr().String()); err == nil {
+		t.Errorf("expected no response before reload but got: %s", in)
+	}
+
+	for clock.Timers() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Add(landns.DefaultMdnsPublishInterval)
+
+	for i := 0; ; i++ {
+		in, _, err := client.Exchange(query, publisher.LocalAddr().String())
+		if err == nil {
+			assertRRs(t, "answer", []string{"printer.local.\t10\tIN\tA\t192.168.1.20"}, in.Answer)
+			break
+		} else if i >= 10 {
+			t.Fatalf("failed to exchange after reload: %s", err)
+		}
+	}
+}
+
+func assertRRs(t *testing.T, name string, expect []string, got []dns.RR) {
+	t.Helper()
+
+	if len(got) != len(expect) {
+		t.Errorf("%s: unexpected number of records: expected %d but got %d: %s", name, len(expect), len(got), got)
+		return
+	}
+	for i := range expect {
+		if got[i].String() != expect[i] {
+			t.Errorf("%s: unexpected record:\nexpected: %s\nbut got:  %s", name, expect[i], got[i])
+		}
+	}
+}
+
+func TestMdnsResolver(t *testing.T) {
+	t.Parallel()
+
+	publisher, stop := startMdnsPublisher(t)
+	defer stop()
+
+	resolver := landns.NewMdnsResolver(publisher.LocalAddr().(*net.UDPAddr), nil)
+	resolver.Timeout = 100 * time.Millisecond
+
+	AssertResolve(t, resolver, landns.NewRequest("printer.local.", dns.TypeA, false), false, "printer.local. 10 IN A 192.168.1.20")
+	AssertResolve(t, resolver, landns.NewRequest("_ipp._tcp.local.", dns.TypePTR, false), false, "_ipp._tcp.local. 10 IN PTR printer._ipp._tcp.local.")
+	AssertResolve(t, resolver, landns.NewRequest("printer._ipp._tcp.local.", dns.TypeTXT, false), false, `printer._ipp._tcp.local. 10 IN TXT "rp=ipp/print"`)
+	AssertResolve(t, resolver, landns.NewRequest("notfound.local.", dns.TypeA, false), true)
+
+	// Names outside of .local. are not queried.
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, false), true)
+}
+
+func TestMdnsResolver_Context(t *testing.T) {
+	t.Parallel()
+
+	// Nobody answers to this address.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer conn.Close()
+
+	resolver := landns.NewMdnsResolver(conn.LocalAddr().(*net.UDPAddr), nil)
+	resolver.Timeout = 10 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	req := landns.NewRequest("printer.local.", dns.TypeA, false)
+	err = resolver.ResolveContext(ctx, testutil.NewDummyResponseWriter(), req)
+	if err == nil || err.Error() != "failed to resolve by mDNS: context deadline exceeded" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("resolve was not cancelled: %s", time.Since(start))
+	}
+}
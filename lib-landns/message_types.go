@@ -1,6 +1,7 @@
 package landns
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/miekg/dns"
@@ -15,6 +16,8 @@ func QtypeToString(qtype uint16) string {
 		return "NS"
 	case dns.TypeCNAME:
 		return "CNAME"
+	case dns.TypeSOA:
+		return "SOA"
 	case dns.TypePTR:
 		return "PTR"
 	case dns.TypeMX:
@@ -35,11 +38,29 @@ type Request struct {
 	dns.Question
 
 	RecursionDesired bool
+
+	ctx context.Context
 }
 
 // NewRequest is constructor for Request.
 func NewRequest(name string, qtype uint16, recursionDesired bool) Request {
-	return Request{dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, recursionDesired}
+	return Request{Question: dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, RecursionDesired: recursionDesired}
+}
+
+// Context is getter to the context of request.
+//
+// The context carries span of tracing. It will be context.Background if not set.
+func (req Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// WithContext is make a copy of request with the context.
+func (req Request) WithContext(ctx context.Context) Request {
+	req.ctx = ctx
+	return req
 }
 
 // QtypeString is getter to human readable record type.
@@ -54,25 +75,41 @@ func (req Request) String() string {
 
 // ResponseWriter is interface for Resolver.
 type ResponseWriter interface {
-	Add(Record) error      // Add new record into response.
-	IsAuthoritative() bool // Check current response is authoritative or not.
-	SetNoAuthoritative()   // Set no authoritative.
+	Add(Record) error           // Add new record into response.
+	AddAuthority(Record) error  // Add new record into authority section of response.
+	AddAdditional(Record) error // Add new record into additional section of response.
+	IsAuthoritative() bool      // Check current response is authoritative or not.
+	SetNoAuthoritative()        // Set no authoritative.
+	SetRcode(int)               // Set response code like dns.RcodeNameError of package github.com/miekg/dns.
 }
 
 // ResponseCallback is one implements of ResponseWriter for callback function.
 type ResponseCallback struct {
 	Callback      func(Record) error
 	Authoritative bool
+	Rcode         int
+	Authority     []Record
+	Additional    []Record
 }
 
 func NewResponseCallback(callback func(Record) error) *ResponseCallback {
-	return &ResponseCallback{Callback: callback, Authoritative: true}
+	return &ResponseCallback{Callback: callback, Authoritative: true, Rcode: dns.RcodeSuccess}
 }
 
 func (rc *ResponseCallback) Add(r Record) error {
 	return rc.Callback(r)
 }
 
+func (rc *ResponseCallback) AddAuthority(r Record) error {
+	rc.Authority = append(rc.Authority, r)
+	return nil
+}
+
+func (rc *ResponseCallback) AddAdditional(r Record) error {
+	rc.Additional = append(rc.Additional, r)
+	return nil
+}
+
 func (rc *ResponseCallback) IsAuthoritative() bool {
 	return rc.Authoritative
 }
@@ -81,10 +118,17 @@ func (rc *ResponseCallback) SetNoAuthoritative() {
 	rc.Authoritative = false
 }
 
+func (rc *ResponseCallback) SetRcode(rcode int) {
+	rc.Rcode = rcode
+}
+
 // ResponseWriterHook is a wrapper of ResponseWriter for hook events.
 type ResponseWriterHook struct {
-	Writer ResponseWriter
-	OnAdd  func(Record) error
+	Writer          ResponseWriter
+	OnAdd           func(Record) error
+	OnAddAuthority  func(Record) error
+	OnAddAdditional func(Record) error
+	OnSetRcode      func(int)
 }
 
 func (rh ResponseWriterHook) Add(r Record) error {
@@ -96,6 +140,24 @@ func (rh ResponseWriterHook) Add(r Record) error {
 	return rh.Writer.Add(r)
 }
 
+func (rh ResponseWriterHook) AddAuthority(r Record) error {
+	if rh.OnAddAuthority != nil {
+		if err := rh.OnAddAuthority(r); err != nil {
+			return err
+		}
+	}
+	return rh.Writer.AddAuthority(r)
+}
+
+func (rh ResponseWriterHook) AddAdditional(r Record) error {
+	if rh.OnAddAdditional != nil {
+		if err := rh.OnAddAdditional(r); err != nil {
+			return err
+		}
+	}
+	return rh.Writer.AddAdditional(r)
+}
+
 func (rh ResponseWriterHook) IsAuthoritative() bool {
 	return rh.Writer.IsAuthoritative()
 }
@@ -104,12 +166,26 @@ func (rh ResponseWriterHook) SetNoAuthoritative() {
 	rh.Writer.SetNoAuthoritative()
 }
 
+func (rh ResponseWriterHook) SetRcode(rcode int) {
+	if rh.OnSetRcode != nil {
+		rh.OnSetRcode(rcode)
+	}
+	rh.Writer.SetRcode(rcode)
+}
+
+// EdnsBufferSize is the UDP payload size that advertised in EDNS0 of responses.
+const EdnsBufferSize = 1232
+
 // MessageBuilder is one implements of ResponseWriter for make dns.Msg of package github.com/miekg/dns.
 type MessageBuilder struct {
 	request            *dns.Msg
 	records            []dns.RR
+	authority          []dns.RR
+	additional         []dns.RR
 	authoritative      bool
 	recursionAvailable bool
+	rcode              int
+	edns               *dns.OPT
 }
 
 func NewMessageBuilder(request *dns.Msg, recursionAvailable bool) *MessageBuilder {
@@ -118,7 +194,32 @@ func NewMessageBuilder(request *dns.Msg, recursionAvailable bool) *MessageBuilde
 		records:            make([]dns.RR, 0, 10),
 		authoritative:      true,
 		recursionAvailable: recursionAvailable,
+		rcode:              dns.RcodeSuccess,
+		edns:               request.IsEdns0(),
+	}
+}
+
+// DNSSECOK is check if the request has DO bit of EDNS0, that means the client wants DNSSEC records.
+func (mb *MessageBuilder) DNSSECOK() bool {
+	return mb.edns != nil && mb.edns.Do()
+}
+
+// UDPSize is get the maximum size of UDP response for the request.
+//
+// It is the buffer size of the client in EDNS0, but not larger than EdnsBufferSize for avoid fragmentation. Requests without EDNS0 use dns.MinMsgSize.
+func (mb *MessageBuilder) UDPSize() int {
+	if mb.edns == nil {
+		return dns.MinMsgSize
+	}
+
+	size := int(mb.edns.UDPSize())
+	if size > EdnsBufferSize {
+		size = EdnsBufferSize
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
 	}
+	return size
 }
 
 func (mb *MessageBuilder) Add(r Record) error {
@@ -131,6 +232,26 @@ func (mb *MessageBuilder) Add(r Record) error {
 	return nil
 }
 
+func (mb *MessageBuilder) AddAuthority(r Record) error {
+	rr, err := r.ToRR()
+	if err != nil {
+		return err
+	}
+
+	mb.authority = append(mb.authority, rr)
+	return nil
+}
+
+func (mb *MessageBuilder) AddAdditional(r Record) error {
+	rr, err := r.ToRR()
+	if err != nil {
+		return err
+	}
+
+	mb.additional = append(mb.additional, rr)
+	return nil
+}
+
 func (mb *MessageBuilder) IsAuthoritative() bool {
 	return mb.authoritative
 }
@@ -139,15 +260,36 @@ func (mb *MessageBuilder) SetNoAuthoritative() {
 	mb.authoritative = false
 }
 
+func (mb *MessageBuilder) SetRcode(rcode int) {
+	mb.rcode = rcode
+}
+
 // Build is builder of dns.Msg.
 func (mb *MessageBuilder) Build() *dns.Msg {
+	rcode := mb.rcode
+	if rcode == dns.RcodeNameError && len(mb.records) > 0 {
+		// Other resolver found the name even if some resolver says NXDOMAIN.
+		rcode = dns.RcodeSuccess
+	}
+
 	msg := new(dns.Msg)
-	msg.SetReply(mb.request)
+	msg.SetRcode(mb.request, rcode)
 
 	msg.Answer = dns.Dedup(mb.records, nil)
+	if len(mb.authority) > 0 {
+		msg.Ns = dns.Dedup(mb.authority, nil)
+	}
+	if len(mb.additional) > 0 {
+		msg.Extra = dns.Dedup(mb.additional, nil)
+	}
 
 	msg.Authoritative = mb.authoritative
 	msg.RecursionAvailable = mb.recursionAvailable
 
+	if mb.edns != nil {
+		// Reply EDNS0 with the same DO bit, because the client that sets DO bit expects OPT record in the response.
+		msg.SetEdns0(EdnsBufferSize, mb.edns.Do())
+	}
+
 	return msg
 }
@@ -212,3 +212,135 @@ func TestMessageBuilder(t *testing.T) {
 		t.Errorf("unexpected recurtion available: %v", msg.RecursionAvailable)
 	}
 }
+
+func TestResponseCallback_Sections(t *testing.T) {
+	t.Parallel()
+
+	rc := landns.NewResponseCallback(func(r landns.Record) error {
+		return nil
+	})
+
+	if rc.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected default rcode: %d", rc.Rcode)
+	}
+	rc.SetRcode(dns.RcodeNameError)
+	if rc.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %d but got %d", dns.RcodeNameError, rc.Rcode)
+	}
+
+	if err := rc.AddAuthority(landns.NsRecord{Name: "example.com.", Target: "ns.example.com."}); err != nil {
+		t.Errorf("failed to add authority: %s", err)
+	}
+	if err := rc.AddAdditional(landns.AddressRecord{Name: "ns.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Errorf("failed to add additional: %s", err)
+	}
+
+	if len(rc.Authority) != 1 || rc.Authority[0].String() != "example.com. IN NS ns.example.com." {
+		t.Errorf("unexpected authority: %s", rc.Authority)
+	}
+	if len(rc.Additional) != 1 || rc.Additional[0].String() != "ns.example.com. 10 IN A 127.0.0.1" {
+		t.Errorf("unexpected additional: %s", rc.Additional)
+	}
+}
+
+func TestResponseWriterHook_Sections(t *testing.T) {
+	t.Parallel()
+
+	upstream := testutil.NewDummyResponseWriter()
+
+	var authority, additional []landns.Record
+	rcode := -1
+	hook := landns.ResponseWriterHook{
+		Writer: upstream,
+		OnAddAuthority: func(r landns.Record) error {
+			authority = append(authority, r)
+			return nil
+		},
+		OnAddAdditional: func(r landns.Record) error {
+			additional = append(additional, r)
+			return nil
+		},
+		OnSetRcode: func(r int) {
+			rcode = r
+		},
+	}
+
+	hook.SetRcode(dns.RcodeNameError)
+	if rcode != dns.RcodeNameError || upstream.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: hook=%d upstream=%d", rcode, upstream.Rcode)
+	}
+
+	ns := landns.NsRecord{Name: "example.com.", Target: "ns.example.com."}
+	if err := hook.AddAuthority(ns); err != nil {
+		t.Errorf("failed to add authority: %s", err)
+	}
+	if len(authority) != 1 || len(upstream.Authority) != 1 {
+		t.Errorf("unexpected authority: hook=%s upstream=%s", authority, upstream.Authority)
+	}
+
+	a := landns.AddressRecord{Name: "ns.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")}
+	if err := hook.AddAdditional(a); err != nil {
+		t.Errorf("failed to add additional: %s", err)
+	}
+	if len(additional) != 1 || len(upstream.Additional) != 1 {
+		t.Errorf("unexpected additional: hook=%s upstream=%s", additional, upstream.Additional)
+	}
+
+	testError := fmt.Errorf("test error")
+	hook = landns.ResponseWriterHook{
+		Writer: testutil.EmptyResponseWriter{},
+		OnAddAuthority: func(r landns.Record) error {
+			return testError
+		},
+		OnAddAdditional: func(r landns.Record) error {
+			return testError
+		},
+	}
+	if err := hook.AddAuthority(ns); err != testError {
+		t.Errorf("unexpected error\nexpected: %#v\nbut got: %#v", testError, err)
+	}
+	if err := hook.AddAdditional(a); err != testError {
+		t.Errorf("unexpected error\nexpected: %#v\nbut got: %#v", testError, err)
+	}
+}
+
+func TestMessageBuilder_Sections(t *testing.T) {
+	t.Parallel()
+
+	request := new(dns.Msg).SetQuestion("notfound.example.com.", dns.TypeA)
+	builder := landns.NewMessageBuilder(request, true)
+
+	if msg := builder.Build(); msg.Rcode != dns.RcodeSuccess || msg.Ns != nil || msg.Extra != nil {
+		t.Errorf("unexpected message: %s", msg)
+	}
+
+	builder.SetRcode(dns.RcodeNameError)
+	soa := landns.SoaRecord{Name: "example.com.", TTL: 60, Ns: "ns.example.com.", Mbox: "root.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minttl: 5}
+	if err := builder.AddAuthority(soa); err != nil {
+		t.Errorf("failed to add authority: %s", err)
+	}
+	if err := builder.AddAdditional(landns.AddressRecord{Name: "ns.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Errorf("failed to add additional: %s", err)
+	}
+
+	msg := builder.Build()
+	if msg.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %s but got %s", dns.RcodeToString[dns.RcodeNameError], dns.RcodeToString[msg.Rcode])
+	}
+	if msg.Id != request.Id || len(msg.Question) != 1 {
+		t.Errorf("unexpected reply header: %s", msg)
+	}
+	if len(msg.Ns) != 1 || msg.Ns[0].String() != "example.com.\t60\tIN\tSOA\tns.example.com. root.example.com. 1 2 3 4 5" {
+		t.Errorf("unexpected authority: %s", msg.Ns)
+	}
+	if len(msg.Extra) != 1 || msg.Extra[0].String() != "ns.example.com.\t10\tIN\tA\t127.0.0.1" {
+		t.Errorf("unexpected additional: %s", msg.Extra)
+	}
+
+	if err := builder.Add(landns.AddressRecord{Name: "notfound.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.2")}); err != nil {
+		t.Errorf("failed to add record: %s", err)
+	}
+	if msg := builder.Build(); msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("NXDOMAIN with answer must be NOERROR but got %s", dns.RcodeToString[msg.Rcode])
+	}
+}
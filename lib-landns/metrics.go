@@ -11,17 +11,27 @@ import (
 )
 
 // Metrics is the metrics collector for the Prometheus.
+//
+// Counters and histograms are labeled by query type like "A" or "MX". Types that unknown to package github.com/miekg/dns are counted as "other".
 type Metrics struct {
-	queryCount        prometheus.Counter
-	skipCount         prometheus.Counter
-	resolveCounters   map[string]prometheus.Counter
-	unauthCounters    map[string]prometheus.Counter
-	missCounters      map[string]prometheus.Counter
-	errorCounters     map[string]prometheus.Counter
-	cacheHitCounters  map[string]prometheus.Counter
-	cacheMissCounters map[string]prometheus.Counter
-	resolveTime       prometheus.Summary
-	upstreamTime      prometheus.Summary
+	messageCounter  *prometheus.CounterVec
+	resolveCounter  *prometheus.CounterVec
+	responseCounter *prometheus.CounterVec
+	errorCounter    *prometheus.CounterVec
+	cacheCounter    *prometheus.CounterVec
+	resolverCounter *prometheus.CounterVec
+	resolveTime     *prometheus.HistogramVec
+	resolverTime    *prometheus.HistogramVec
+	upstreamTime    prometheus.Histogram
+	upstreamCounter *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	cacheEntries    prometheus.Gauge
+	cacheBytes      prometheus.Gauge
+	cacheEvictions  prometheus.Counter
+	queryLogDropped prometheus.Counter
+	blockCounter    *prometheus.CounterVec
+	blockEntries    prometheus.Gauge
+	rpzCounter      *prometheus.CounterVec
 }
 
 func newCounter(namespace, name string, labels prometheus.Labels) prometheus.Counter {
@@ -32,47 +42,122 @@ func newCounter(namespace, name string, labels prometheus.Labels) prometheus.Cou
 	})
 }
 
+func newCounterVec(namespace, name string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      fmt.Sprintf("%s_count", name),
+	}, labels)
+}
+
+func newHistogramVec(namespace, name string, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      fmt.Sprintf("%s_duration_seconds", name),
+		Buckets:   MetricsBuckets,
+	}, labels)
+}
+
+var (
+	// MetricsBuckets is buckets of histograms for resolve duration in seconds.
+	//
+	// Buckets covers from cache hit in 100 microseconds to upstream timeout in 5 seconds.
+	MetricsBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+	// metricsQtypes is query types that initialized when start.
+	metricsQtypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "PTR", "SOA", "SRV", "TXT", "other"}
+
+	metricsRcodes = []int{dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeServerFailure, dns.RcodeRefused}
+
+	metricsCaches = []string{"hit", "miss", "negative-hit", "stale-hit", "prefetch", "coalesced"}
+)
+
+// metricsQtype is make label for query type.
+func metricsQtype(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "other"
+}
+
+// metricsRcode is make label for response code.
+func metricsRcode(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return "other"
+}
+
 // NewMetrics is constructor for Metrics.
 func NewMetrics(namespace string) *Metrics {
-	resolves := map[string]prometheus.Counter{}
-	unauthes := map[string]prometheus.Counter{}
-	misses := map[string]prometheus.Counter{}
-	errors := map[string]prometheus.Counter{}
-	cacheHits := map[string]prometheus.Counter{}
-	cacheMisses := map[string]prometheus.Counter{}
-
-	for _, qtype := range []string{"A", "AAAA", "PTR", "SRV", "TXT"} {
-		resolves[qtype] = newCounter(namespace, "resolve", prometheus.Labels{"type": qtype, "source": "local"})
-		unauthes[qtype] = newCounter(namespace, "resolve", prometheus.Labels{"type": qtype, "source": "upstream"})
-		misses[qtype] = newCounter(namespace, "resolve", prometheus.Labels{"type": qtype, "source": "not-found"})
-		errors[qtype] = newCounter(namespace, "resolve_error", prometheus.Labels{"type": qtype})
-		cacheHits[qtype] = newCounter(namespace, "cache", prometheus.Labels{"type": qtype, "cache": "hit"})
-		cacheMisses[qtype] = newCounter(namespace, "cache", prometheus.Labels{"type": qtype, "cache": "miss"})
-	}
+	m := &Metrics{
+		messageCounter:  newCounterVec(namespace, "received_message", "type", "view"),
+		resolveCounter:  newCounterVec(namespace, "resolve", "type", "source", "view"),
+		responseCounter: newCounterVec(namespace, "response", "rcode", "view"),
+		errorCounter:    newCounterVec(namespace, "resolve_error", "type"),
+		cacheCounter:    newCounterVec(namespace, "cache", "type", "cache"),
+		resolverCounter: newCounterVec(namespace, "resolver", "resolver", "type", "result"),
+		resolveTime:     newHistogramVec(namespace, "resolve", "type", "source", "view"),
+		resolverTime:    newHistogramVec(namespace, "resolver", "resolver"),
+
+		upstreamTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_resolve_duration_seconds",
+			Buckets:   MetricsBuckets,
+		}),
+
+		upstreamCounter: newCounterVec(namespace, "upstream_request", "upstream", "result"),
+		upstreamLatency: newHistogramVec(namespace, "upstream_request", "upstream"),
 
-	return &Metrics{
-		queryCount: newCounter(namespace, "received_message", prometheus.Labels{"type": "query"}),
-		skipCount:  newCounter(namespace, "received_message", prometheus.Labels{"type": "another"}),
-
-		resolveCounters:   resolves,
-		unauthCounters:    unauthes,
-		missCounters:      misses,
-		errorCounters:     errors,
-		cacheHitCounters:  cacheHits,
-		cacheMissCounters: cacheMisses,
-
-		resolveTime: prometheus.NewSummary(prometheus.SummaryOpts{
-			Namespace:  namespace,
-			Name:       "resolve_duration_seconds",
-			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		cacheEntries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_entries",
 		}),
 
-		upstreamTime: prometheus.NewSummary(prometheus.SummaryOpts{
-			Namespace:  namespace,
-			Name:       "upstream_resolve_duration_seconds",
-			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		cacheBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_bytes",
 		}),
+
+		cacheEvictions:  newCounter(namespace, "cache_eviction", nil),
+		queryLogDropped: newCounter(namespace, "query_log_dropped", nil),
+		blockCounter:    newCounterVec(namespace, "blocked_query", "type", "response"),
+		rpzCounter:      newCounterVec(namespace, "rpz_hit", "zone", "trigger", "action"),
+
+		blockEntries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "blocklist_entries",
+		}),
+	}
+
+	for _, qtype := range metricsQtypes {
+		m.errorCounter.WithLabelValues(qtype)
+		for _, cache := range metricsCaches {
+			m.cacheCounter.WithLabelValues(qtype, cache)
+		}
 	}
+
+	m.RegisterView(DefaultViewName)
+
+	return m
+}
+
+// RegisterView is initialize counters for the view.
+//
+// Counters of unregistered view will be made when first time used.
+func (m *Metrics) RegisterView(view string) {
+	m.messageCounter.WithLabelValues("query", view)
+	m.messageCounter.WithLabelValues("another", view)
+
+	for _, qtype := range metricsQtypes {
+		for _, source := range []string{"local", "upstream", "not-found", "dropped"} {
+			m.resolveCounter.WithLabelValues(qtype, source, view)
+		}
+	}
+
+	for _, rcode := range metricsRcodes {
+		m.responseCounter.WithLabelValues(metricsRcode(rcode), view)
+	}
+	m.responseCounter.WithLabelValues("DROPPED", view)
 }
 
 // HTTPHandler is make http.Handler.
@@ -86,99 +171,112 @@ func (m *Metrics) HTTPHandler() (http.Handler, error) {
 	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
 }
 
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.messageCounter,
+		m.resolveCounter,
+		m.responseCounter,
+		m.errorCounter,
+		m.cacheCounter,
+		m.resolverCounter,
+		m.resolveTime,
+		m.resolverTime,
+		m.upstreamTime,
+		m.upstreamCounter,
+		m.upstreamLatency,
+		m.cacheEntries,
+		m.cacheBytes,
+		m.cacheEvictions,
+		m.queryLogDropped,
+		m.blockCounter,
+		m.blockEntries,
+		m.rpzCounter,
+	}
+}
+
 // Describe is register descriptions to the Prometheus.
 func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
-	m.queryCount.Describe(ch)
-	m.skipCount.Describe(ch)
-
-	for _, c := range m.resolveCounters {
+	for _, c := range m.collectors() {
 		c.Describe(ch)
 	}
-	for _, c := range m.unauthCounters {
-		c.Describe(ch)
-	}
-	for _, c := range m.missCounters {
-		c.Describe(ch)
-	}
-	for _, c := range m.errorCounters {
-		c.Describe(ch)
-	}
-	for _, c := range m.cacheHitCounters {
-		c.Describe(ch)
-	}
-	for _, c := range m.cacheMissCounters {
-		c.Describe(ch)
-	}
-
-	m.resolveTime.Describe(ch)
-	m.upstreamTime.Describe(ch)
 }
 
 // Collect is collect metrics to the Prometheus.
 func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
-	m.queryCount.Collect(ch)
-	m.skipCount.Collect(ch)
-
-	for _, c := range m.resolveCounters {
+	for _, c := range m.collectors() {
 		c.Collect(ch)
 	}
-	for _, c := range m.unauthCounters {
-		c.Collect(ch)
-	}
-	for _, c := range m.missCounters {
-		c.Collect(ch)
-	}
-	for _, c := range m.errorCounters {
-		c.Collect(ch)
-	}
-	for _, c := range m.cacheHitCounters {
-		c.Collect(ch)
-	}
-	for _, c := range m.cacheMissCounters {
-		c.Collect(ch)
-	}
-
-	m.resolveTime.Collect(ch)
-	m.upstreamTime.Collect(ch)
 }
 
-func (m *Metrics) makeTimer(skipped bool) func(*dns.Msg) {
-	timer := prometheus.NewTimer(m.resolveTime)
+func (m *Metrics) makeTimer(view string, request *dns.Msg, skipped bool) func(*dns.Msg) {
+	start := time.Now()
 	return func(response *dns.Msg) {
-		timer.ObserveDuration()
+		duration := time.Since(start).Seconds()
 
-		counters := m.resolveCounters
-		if !response.Authoritative {
-			counters = m.unauthCounters
-		}
-		if len(response.Answer) == 0 {
-			counters = m.missCounters
-		}
+		source := "dropped"
+		rcode := "DROPPED"
+		questions := request.Question
 
-		for _, q := range response.Question {
-			if counter, ok := counters[QtypeToString(q.Qtype)]; ok {
-				counter.Inc()
+		if response != nil {
+			source = "local"
+			if !response.Authoritative {
+				source = "upstream"
 			}
+			if len(response.Answer) == 0 {
+				source = "not-found"
+			}
+			rcode = metricsRcode(response.Rcode)
+			questions = response.Question
+		}
+
+		m.responseCounter.WithLabelValues(rcode, view).Inc()
+
+		for _, q := range questions {
+			qtype := metricsQtype(q.Qtype)
+			m.resolveCounter.WithLabelValues(qtype, source, view).Inc()
+			m.resolveTime.WithLabelValues(qtype, source, view).Observe(duration)
 		}
 	}
 }
 
 // Start is starter timer for collect resolve duration.
+//
+// Start is the same as StartView with DefaultViewName.
 func (m *Metrics) Start(request *dns.Msg) func(*dns.Msg) {
+	return m.StartView(DefaultViewName, request)
+}
+
+// StartView is starter timer for collect resolve duration of request that served by the view.
+//
+// The returned function have to be called with the response message, or with nil if the request was dropped without response.
+func (m *Metrics) StartView(view string, request *dns.Msg) func(*dns.Msg) {
 	if request.Opcode != dns.OpcodeQuery {
-		m.skipCount.Inc()
-		return m.makeTimer(true)
+		m.messageCounter.WithLabelValues("another", view).Inc()
+		return m.makeTimer(view, request, true)
 	}
 
-	m.queryCount.Inc()
-	return m.makeTimer(false)
+	m.messageCounter.WithLabelValues("query", view).Inc()
+	return m.makeTimer(view, request, false)
 }
 
 // Error is collector of error.
 func (m *Metrics) Error(req Request, err error) {
-	if counter, ok := m.errorCounters[req.QtypeString()]; ok {
-		counter.Inc()
+	m.errorCounter.WithLabelValues(metricsQtype(req.Qtype)).Inc()
+}
+
+// ResolverResult is collector of result of each Resolver that labeled by name like "static" or "cache".
+//
+// The result label will be "answered" if resolver responded some records, "empty" if not, or "error".
+func (m *Metrics) ResolverResult(resolver string, req Request, duration time.Duration, answered bool, err error) {
+	result := "answered"
+	if err != nil {
+		result = "error"
+	} else if !answered {
+		result = "empty"
 	}
+
+	m.resolverCounter.WithLabelValues(resolver, metricsQtype(req.Qtype), result).Inc()
+	m.resolverTime.WithLabelValues(resolver).Observe(duration.Seconds())
 }
 
 // UpstreamTime is collector of recursion resolve.
@@ -186,16 +284,84 @@ func (m *Metrics) UpstreamTime(duration time.Duration) {
 	m.upstreamTime.Observe(duration.Seconds())
 }
 
+// UpstreamResult is collector of result of each request to upstream server.
+func (m *Metrics) UpstreamResult(upstream string, duration time.Duration, err error) {
+	if err != nil {
+		m.upstreamCounter.WithLabelValues(upstream, "failure").Inc()
+		return
+	}
+
+	m.upstreamCounter.WithLabelValues(upstream, "success").Inc()
+	m.upstreamLatency.WithLabelValues(upstream).Observe(duration.Seconds())
+}
+
+// cache is collector of cache result. The result will also be recorded into the span of request.
+func (m *Metrics) cache(req Request, cache string) {
+	traceCache(req, cache)
+	m.cacheCounter.WithLabelValues(metricsQtype(req.Qtype), cache).Inc()
+}
+
 // CacheHit is collector of cache hit rate.
 func (m *Metrics) CacheHit(req Request) {
-	if counter, ok := m.cacheHitCounters[req.QtypeString()]; ok {
-		counter.Inc()
-	}
+	m.cache(req, "hit")
 }
 
 // CacheMiss is collector of cache hit rate.
 func (m *Metrics) CacheMiss(req Request) {
-	if counter, ok := m.cacheMissCounters[req.QtypeString()]; ok {
-		counter.Inc()
-	}
+	m.cache(req, "miss")
+}
+
+// CacheNegativeHit is collector of cache hit rate of negative cache (NXDOMAIN or NODATA).
+func (m *Metrics) CacheNegativeHit(req Request) {
+	m.cache(req, "negative-hit")
+}
+
+// CacheStaleHit is collector of the number of stale records that served (RFC 8767).
+func (m *Metrics) CacheStaleHit(req Request) {
+	m.cache(req, "stale-hit")
+}
+
+// CachePrefetch is collector of the number of prefetch that refreshes cache before expire.
+func (m *Metrics) CachePrefetch(req Request) {
+	m.cache(req, "prefetch")
+}
+
+// CacheCoalesced is collector of the number of cache misses that shared upstream request with another concurrent miss.
+func (m *Metrics) CacheCoalesced(req Request) {
+	m.cache(req, "coalesced")
+}
+
+// CacheSize is collector of size of cache.
+//
+// Arguments are difference from previous state, so multiple caches can share the same Metrics.
+func (m *Metrics) CacheSize(entries, bytes int) {
+	m.cacheEntries.Add(float64(entries))
+	m.cacheBytes.Add(float64(bytes))
+}
+
+// CacheEvicted is collector of the number of entries that evicted by size limit of cache.
+func (m *Metrics) CacheEvicted(n int) {
+	m.cacheEvictions.Add(float64(n))
+}
+
+// QueryLogDropped is collector of the number of query log entries that dropped because the buffer was full.
+func (m *Metrics) QueryLogDropped() {
+	m.queryLogDropped.Inc()
+}
+
+// Blocked is collector of the number of queries that blocked by blocklists, labeled by query type and response like "nxdomain".
+func (m *Metrics) Blocked(req Request, response BlockResponse) {
+	m.blockCounter.WithLabelValues(metricsQtype(req.Qtype), response.String()).Inc()
+}
+
+// BlocklistSize is collector of the number of entries in blocklists.
+//
+// Argument is difference from previous state, so multiple blocklists can share the same Metrics.
+func (m *Metrics) BlocklistSize(entries int) {
+	m.blockEntries.Add(float64(entries))
+}
+
+// PolicyHit is collector of the number of responses that rewritten by response policy zones, labeled by zone, trigger and action.
+func (m *Metrics) PolicyHit(hit RPZHit) {
+	m.rpzCounter.WithLabelValues(hit.Zone.String(), hit.Trigger, hit.Action.String()).Inc()
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/macrat/landns/lib-landns"
 	"github.com/macrat/landns/lib-landns/testutil"
@@ -24,12 +25,12 @@ func TestMetrics(t *testing.T) {
 		Authoritative  bool
 		ResponseLength int
 	}{
-		{"landns_resolve_count", testutil.MetricsLabels{"source": "local", "type": "A"}, true, 1},
-		{"landns_resolve_count", testutil.MetricsLabels{"source": "upstream", "type": "A"}, false, 1},
-		{"landns_resolve_count", testutil.MetricsLabels{"source": "not-found", "type": "A"}, true, 0},
+		{"landns_resolve_count", testutil.MetricsLabels{"source": "local", "type": "A", "view": "default"}, true, 1},
+		{"landns_resolve_count", testutil.MetricsLabels{"source": "upstream", "type": "A", "view": "default"}, false, 1},
+		{"landns_resolve_count", testutil.MetricsLabels{"source": "not-found", "type": "A", "view": "default"}, true, 0},
 	} {
 		srv.Get(t).Assert(t, tt.Name, tt.Labels, 0)
-		srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query"}, float64(i))
+		srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query", "view": "default"}, float64(i))
 
 		req := &dns.Msg{
 			MsgHdr: dns.MsgHdr{Id: dns.Id()},
@@ -52,7 +53,7 @@ func TestMetrics(t *testing.T) {
 		srv.Metrics.Start(req)(resp)
 
 		srv.Get(t).Assert(t, tt.Name, tt.Labels, 1)
-		srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query"}, float64(i+1))
+		srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query", "view": "default"}, float64(i+1))
 	}
 
 	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "hit", "type": "A"}, 0)
@@ -63,20 +64,101 @@ func TestMetrics(t *testing.T) {
 	srv.Metrics.CacheMiss(landns.NewRequest("example.com.", dns.TypeA, true))
 	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "miss", "type": "A"}, 1)
 
-	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "another"}, 0)
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "negative-hit", "type": "A"}, 0)
+	srv.Metrics.CacheNegativeHit(landns.NewRequest("example.com.", dns.TypeA, true))
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "negative-hit", "type": "A"}, 1)
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "hit", "type": "A"}, 1)
+
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "stale-hit", "type": "A"}, 0)
+	srv.Metrics.CacheStaleHit(landns.NewRequest("example.com.", dns.TypeA, true))
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "stale-hit", "type": "A"}, 1)
+
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "prefetch", "type": "A"}, 0)
+	srv.Metrics.CachePrefetch(landns.NewRequest("example.com.", dns.TypeA, true))
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "prefetch", "type": "A"}, 1)
+
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "coalesced", "type": "A"}, 0)
+	srv.Metrics.CacheCoalesced(landns.NewRequest("example.com.", dns.TypeA, true))
+	srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "coalesced", "type": "A"}, 1)
+
+	srv.Get(t).Assert(t, "landns_cache_entries", testutil.MetricsLabels{}, 0)
+	srv.Metrics.CacheSize(2, 100)
+	srv.Metrics.CacheSize(-1, -30)
+	srv.Get(t).Assert(t, "landns_cache_entries", testutil.MetricsLabels{}, 1)
+	srv.Get(t).Assert(t, "landns_cache_bytes", testutil.MetricsLabels{}, 70)
+
+	srv.Get(t).Assert(t, "landns_cache_eviction_count", testutil.MetricsLabels{}, 0)
+	srv.Metrics.CacheEvicted(3)
+	srv.Get(t).Assert(t, "landns_cache_eviction_count", testutil.MetricsLabels{}, 3)
+
+	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "another", "view": "default"}, 0)
 	req := &dns.Msg{
 		MsgHdr: dns.MsgHdr{Id: dns.Id(), Opcode: dns.OpcodeNotify},
 	}
 	resp := new(dns.Msg)
 	resp.SetReply(req)
 	srv.Metrics.Start(req)(resp)
-	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "another"}, 1)
+	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "another", "view": "default"}, 1)
 
 	srv.Get(t).Assert(t, "landns_resolve_error_count", testutil.MetricsLabels{"type": "A"}, 0)
 	srv.Metrics.Error(landns.NewRequest("example.com.", dns.TypeA, true), fmt.Errorf("test error"))
 	srv.Get(t).Assert(t, "landns_resolve_error_count", testutil.MetricsLabels{"type": "A"}, 1)
 }
 
+func TestMetrics_Labels(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testutil.StartMetricsServer(ctx, t, "landns")
+
+	for _, qtype := range []string{"A", "AAAA", "CNAME", "MX", "NS", "PTR", "SOA", "SRV", "TXT", "other"} {
+		srv.Get(t).Assert(t, "landns_resolve_count", testutil.MetricsLabels{"source": "not-found", "type": qtype, "view": "default"}, 0)
+		srv.Get(t).Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "hit", "type": qtype}, 0)
+	}
+	for _, rcode := range []string{"NOERROR", "NXDOMAIN", "SERVFAIL", "REFUSED"} {
+		srv.Get(t).Assert(t, "landns_response_count", testutil.MetricsLabels{"rcode": rcode, "view": "default"}, 0)
+	}
+
+	for _, tt := range []struct {
+		Qtype uint16
+		Label string
+		Rcode int
+	}{
+		{dns.TypeMX, "MX", dns.RcodeSuccess},
+		{dns.TypeNS, "NS", dns.RcodeNameError},
+		{dns.TypeCAA, "CAA", dns.RcodeServerFailure},
+		{65000, "other", dns.RcodeRefused},
+	} {
+		req := &dns.Msg{
+			MsgHdr: dns.MsgHdr{Id: dns.Id()},
+			Question: []dns.Question{
+				{Name: "example.com.", Qtype: tt.Qtype, Qclass: dns.ClassINET},
+			},
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(req, tt.Rcode)
+
+		srv.Metrics.Start(req)(resp)
+		srv.Metrics.CacheMiss(landns.NewRequest("example.com.", tt.Qtype, true))
+		srv.Metrics.Error(landns.NewRequest("example.com.", tt.Qtype, true), fmt.Errorf("test error"))
+
+		m := srv.Get(t)
+		m.Assert(t, "landns_resolve_count", testutil.MetricsLabels{"source": "not-found", "type": tt.Label, "view": "default"}, 1)
+		m.Assert(t, "landns_resolve_duration_seconds_count", testutil.MetricsLabels{"source": "not-found", "type": tt.Label, "view": "default"}, 1)
+		m.Assert(t, "landns_response_count", testutil.MetricsLabels{"rcode": dns.RcodeToString[tt.Rcode], "view": "default"}, 1)
+		m.Assert(t, "landns_cache_count", testutil.MetricsLabels{"cache": "miss", "type": tt.Label}, 1)
+		m.Assert(t, "landns_resolve_error_count", testutil.MetricsLabels{"type": tt.Label}, 1)
+	}
+
+	srv.Metrics.UpstreamResult("127.0.0.1:53", 3*time.Millisecond, nil)
+	m := srv.Get(t)
+	m.Assert(t, "landns_upstream_request_duration_seconds_bucket", testutil.MetricsLabels{"upstream": "127.0.0.1:53", "le": "0.0025"}, 0)
+	m.Assert(t, "landns_upstream_request_duration_seconds_bucket", testutil.MetricsLabels{"upstream": "127.0.0.1:53", "le": "0.005"}, 1)
+	m.Assert(t, "landns_upstream_request_duration_seconds_count", testutil.MetricsLabels{"upstream": "127.0.0.1:53"}, 1)
+}
+
 func BenchmarkMetrics(b *testing.B) {
 	metrics := landns.NewMetrics("landns")
 
@@ -101,3 +183,31 @@ func BenchmarkMetrics(b *testing.B) {
 		metrics.Start(req)(resp)
 	}
 }
+
+func TestMetrics_View(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testutil.StartMetricsServer(ctx, t, "landns")
+
+	srv.Metrics.RegisterView("office")
+	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query", "view": "office"}, 0)
+	srv.Get(t).Assert(t, "landns_resolve_count", testutil.MetricsLabels{"source": "not-found", "type": "A", "view": "office"}, 0)
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Id: dns.Id()},
+		Question: []dns.Question{
+			{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		},
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	srv.Metrics.StartView("office", req)(resp)
+
+	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query", "view": "office"}, 1)
+	srv.Get(t).Assert(t, "landns_resolve_count", testutil.MetricsLabels{"source": "not-found", "type": "A", "view": "office"}, 1)
+	srv.Get(t).Assert(t, "landns_received_message_count", testutil.MetricsLabels{"type": "query", "view": "default"}, 0)
+}
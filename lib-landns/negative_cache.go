@@ -0,0 +1,99 @@
+package landns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultNegativeMinTTL is the default floor of TTL for negative cache.
+	DefaultNegativeMinTTL = 0 * time.Second
+
+	// DefaultNegativeMaxTTL is the default ceiling of TTL for negative cache.
+	DefaultNegativeMaxTTL = 1 * time.Hour
+)
+
+// negativeResponse is collector of upstream response for negative caching (RFC 2308).
+type negativeResponse struct {
+	rcode    int
+	answered bool
+	soa      *SoaRecord
+}
+
+// Hook is make ResponseWriterHook that collects response into negativeResponse.
+func (nr *negativeResponse) Hook(w ResponseWriter, onAdd func(Record) error) ResponseWriterHook {
+	return ResponseWriterHook{
+		Writer: w,
+		OnAdd: func(r Record) error {
+			nr.answered = true
+			if onAdd != nil {
+				return onAdd(r)
+			}
+			return nil
+		},
+		OnAddAuthority: func(r Record) error {
+			if soa, ok := r.(SoaRecord); ok && nr.soa == nil {
+				nr.soa = &soa
+			}
+			return nil
+		},
+		OnSetRcode: func(rcode int) {
+			nr.rcode = rcode
+		},
+	}
+}
+
+// TTL is calculate TTL for negative cache.
+//
+// The TTL is the smaller of SOA's TTL and SOA's MINIMUM field, and clamped into [min, max].
+// Returns false if the response is not negative response or not cacheable.
+func (nr *negativeResponse) TTL(min, max time.Duration) (uint32, bool) {
+	if nr.answered || nr.soa == nil {
+		return 0, false
+	}
+	if nr.rcode != dns.RcodeSuccess && nr.rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	ttl := nr.soa.TTL
+	if nr.soa.Minttl < ttl {
+		ttl = nr.soa.Minttl
+	}
+
+	if floor := uint32(min.Seconds()); ttl < floor {
+		ttl = floor
+	}
+	if ceil := uint32(max.Seconds()); max > 0 && ttl > ceil {
+		ttl = ceil
+	}
+
+	return ttl, ttl > 0
+}
+
+// Entry is make VolatileRecord of SOA for negative cache that cached at now.
+func (nr *negativeResponse) Entry(ttl uint32, now time.Time) (VolatileRecord, error) {
+	soa := *nr.soa
+	soa.TTL = ttl
+
+	rr, err := soa.ToRR()
+	if err != nil {
+		return VolatileRecord{}, err
+	}
+
+	return VolatileRecord{rr, now.Add(time.Duration(ttl) * time.Second)}, nil
+}
+
+// writeNegative is write negative response from cached SOA record.
+func writeNegative(w ResponseWriter, rcode int, soa VolatileRecord, now time.Time) error {
+	record, err := soa.RecordAt(now)
+	if err != nil {
+		return err
+	}
+
+	w.SetNoAuthoritative()
+	if rcode != dns.RcodeSuccess {
+		w.SetRcode(rcode)
+	}
+	return w.AddAuthority(record)
+}
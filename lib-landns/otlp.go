@@ -0,0 +1,41 @@
+package landns
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+)
+
+// NewOTLPExporter is make the span exporter that sends spans to OpenTelemetry collector via OTLP/HTTP.
+//
+// The endpoint is URL of OTLP/HTTP receiver like "http://localhost:4318". "/v1/traces" will be appended if endpoint has no path.
+func NewOTLPExporter(endpoint string, timeout time.Duration) (*otlptrace.Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, Error{TypeArgumentError, err, "failed to parse OTLP endpoint"}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, newError(TypeArgumentError, nil, "unsupported scheme of OTLP endpoint: %s", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+		otlptracehttp.WithTimeout(timeout),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, Error{TypeInternalError, err, "failed to make OTLP exporter"}
+	}
+	return exporter, nil
+}
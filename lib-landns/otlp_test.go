@@ -0,0 +1,184 @@
+package landns_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewOTLPExporter(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		paths = append(paths, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		Endpoint string
+		Path     string
+		Error    string
+	}{
+		{srv.URL, "/v1/traces", ""},
+		{srv.URL + "/", "/v1/traces", ""},
+		{srv.URL + "/custom/path", "/custom/path", ""},
+		{"grpc://localhost:4317", "", "unsupported scheme of OTLP endpoint: grpc://localhost:4317"},
+	}
+
+	spans := tracetest.SpanStubs{{Name: "span"}}.Snapshots()
+	for _, tt := range tests {
+		e, err := landns.NewOTLPExporter(tt.Endpoint, time.Second)
+		if tt.Error != "" {
+			if err == nil || err.Error() != tt.Error {
+				t.Errorf("%s: unexpected error: expected %q but got %v", tt.Endpoint, tt.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to make exporter: %s", tt.Endpoint, err)
+			continue
+		}
+
+		if err := e.ExportSpans(context.Background(), spans); err != nil {
+			t.Errorf("%s: failed to export: %s", tt.Endpoint, err)
+		}
+		e.Shutdown(context.Background())
+
+		mutex.Lock()
+		if len(paths) == 0 || paths[len(paths)-1] != tt.Path {
+			t.Errorf("%s: unexpected path: expected %s but got %v", tt.Endpoint, tt.Path, paths)
+		}
+		mutex.Unlock()
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Parallel()
+
+	var requests []*coltracepb.ExportTraceServiceRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Errorf("unexpected content type: %s", ct)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request: %s", err)
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("failed to decode request: %s", err)
+		}
+		requests = append(requests, &req)
+	}))
+	defer srv.Close()
+
+	exporter, err := landns.NewOTLPExporter(srv.URL, time.Second)
+	if err != nil {
+		t.Fatalf("failed to make exporter: %s", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "landns"))),
+	)
+	defer provider.Shutdown(context.Background())
+
+	ctx, parent := provider.Tracer(landns.TracerName).Start(context.Background(), "parent")
+	_, child := provider.Tracer(landns.TracerName).Start(ctx, "child")
+	child.SetAttributes(attribute.String("str", "hello"), attribute.Int("int", 42), attribute.Bool("bool", true))
+	child.RecordError(errors.New("test error"))
+	child.SetStatus(codes.Error, "test error")
+	child.End()
+	parent.End()
+
+	if len(requests) != 2 {
+		t.Fatalf("unexpected number of requests: expected 2 but got %d", len(requests))
+	}
+
+	var spans []*tracepb.Span
+	for _, req := range requests {
+		if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+			t.Fatalf("unexpected request: %s", req)
+		}
+		rs := req.ResourceSpans[0]
+		if attrs := rs.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value.GetStringValue() != "landns" {
+			t.Errorf("unexpected resource: %s", attrs)
+		}
+		if rs.ScopeSpans[0].Scope.Name != landns.TracerName {
+			t.Errorf("unexpected scope: %s", rs.ScopeSpans[0].Scope.Name)
+		}
+		spans = append(spans, rs.ScopeSpans[0].Spans...)
+	}
+
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatalf("unexpected spans: %s", spans)
+	}
+	if !bytes.Equal(spans[0].TraceId, spans[1].TraceId) || len(spans[0].TraceId) != 16 {
+		t.Errorf("unexpected trace ID: %x and %x", spans[0].TraceId, spans[1].TraceId)
+	}
+	if !bytes.Equal(spans[0].ParentSpanId, spans[1].SpanId) || len(spans[1].ParentSpanId) != 0 {
+		t.Errorf("unexpected parent span ID: %x and %x", spans[0].ParentSpanId, spans[1].ParentSpanId)
+	}
+
+	attrs := make(map[string]string)
+	for _, a := range spans[0].Attributes {
+		attrs[a.Key] = a.Value.String()
+	}
+	if attrs["str"] != `string_value:"hello"` || attrs["int"] != "int_value:42" || attrs["bool"] != "bool_value:true" {
+		t.Errorf("unexpected attributes: %v", attrs)
+	}
+
+	if len(spans[0].Events) != 1 || spans[0].Events[0].Name != "exception" {
+		t.Errorf("unexpected events: %v", spans[0].Events)
+	}
+	if spans[0].Status.Code != tracepb.Status_STATUS_CODE_ERROR || spans[0].Status.Message != "test error" {
+		t.Errorf("unexpected status: %v", spans[0].Status)
+	}
+	if spans[1].Status.Code != tracepb.Status_STATUS_CODE_UNSET {
+		t.Errorf("unexpected status: %v", spans[1].Status)
+	}
+}
+
+func TestOTLPExporter_ErrorHandling(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	exporter, err := landns.NewOTLPExporter(srv.URL, time.Second)
+	if err != nil {
+		t.Fatalf("failed to make exporter: %s", err)
+	}
+
+	spans := tracetest.SpanStubs{{Name: "span"}}.Snapshots()
+	if err := exporter.ExportSpans(context.Background(), spans); err == nil || !strings.HasSuffix(err.Error(), "400 Bad Request") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
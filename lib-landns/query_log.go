@@ -0,0 +1,397 @@
+package landns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"github.com/miekg/dns"
+)
+
+var (
+	// DefaultQueryLogBuffer is the default number of entries that QueryLogger can hold before write.
+	DefaultQueryLogBuffer = 1024
+)
+
+// QueryLogEntry is a record of query log that made for each DNS message.
+type QueryLogEntry struct {
+	Time     time.Time     // Time when received the query.
+	Client   net.IP        // Address of the client. It is the address in EDNS Client Subnet option if exists.
+	Remote   net.Addr      // Remote address of the connection. It may be nil.
+	Local    net.Addr      // Local address of the connection. It may be nil.
+	View     string        // Name of the view that used to resolve.
+	Query    *dns.Msg      // The received message.
+	Response *dns.Msg      // The sent message.
+	Resolver string        // Name of the MeasuredResolver that answered first. Empty if not answered.
+	Latency  time.Duration // Duration from receive the query to send the response.
+}
+
+// Question is getter of the first question in the query.
+func (e QueryLogEntry) Question() dns.Question {
+	if e.Query == nil || len(e.Query.Question) == 0 {
+		return dns.Question{}
+	}
+	return e.Query.Question[0]
+}
+
+// Protocol is getter of transport protocol like "udp" or "tcp". Returns empty string if unknown.
+func (e QueryLogEntry) Protocol() string {
+	switch e.Remote.(type) {
+	case *net.UDPAddr:
+		return "udp"
+	case *net.TCPAddr:
+		return "tcp"
+	default:
+		return ""
+	}
+}
+
+type jsonQueryLogEntry struct {
+	Time     string  `json:"time"`
+	Client   string  `json:"client,omitempty"`
+	Protocol string  `json:"protocol,omitempty"`
+	View     string  `json:"view"`
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Rcode    string  `json:"rcode"`
+	Answers  int     `json:"answers"`
+	Resolver string  `json:"resolver,omitempty"`
+	Latency  float64 `json:"latency_ms"`
+}
+
+// MarshalJSON is encode QueryLogEntry into JSON object.
+func (e QueryLogEntry) MarshalJSON() ([]byte, error) {
+	q := e.Question()
+
+	j := jsonQueryLogEntry{
+		Time:     e.Time.Format(time.RFC3339Nano),
+		Protocol: e.Protocol(),
+		View:     e.View,
+		Name:     q.Name,
+		Type:     QtypeToString(q.Qtype),
+		Resolver: e.Resolver,
+		Latency:  float64(e.Latency) / float64(time.Millisecond),
+	}
+	if e.Client != nil {
+		j.Client = e.Client.String()
+	}
+	if e.Response != nil {
+		j.Rcode = metricsRcode(e.Response.Rcode)
+		j.Answers = len(e.Response.Answer)
+	}
+
+	return json.Marshal(j)
+}
+
+// QueryLogSink is the interface of destination of query log.
+//
+// Write is called from single goroutine, so implementations don't have to be goroutine-safe.
+type QueryLogSink interface {
+	Write(entry QueryLogEntry) error
+	Close() error
+}
+
+// QueryLogger is the non-blocking writer of query log.
+//
+// Entries are buffered and written to Sink in background. Entries will be dropped if the buffer was full, to avoid slowing down DNS responses.
+type QueryLogger struct {
+	Sink    QueryLogSink
+	Metrics *Metrics
+
+	mu      sync.RWMutex
+	closed  bool
+	entries chan QueryLogEntry
+	done    chan struct{}
+}
+
+// NewQueryLogger is constructor of QueryLogger.
+//
+// bufferSize is the number of entries that can be held before write. DefaultQueryLogBuffer will be used if bufferSize is 0 or less.
+func NewQueryLogger(sink QueryLogSink, bufferSize int, metrics *Metrics) *QueryLogger {
+	if bufferSize <= 0 {
+		bufferSize = DefaultQueryLogBuffer
+	}
+
+	ql := &QueryLogger{
+		Sink:    sink,
+		Metrics: metrics,
+		entries: make(chan QueryLogEntry, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go ql.run()
+
+	return ql
+}
+
+func (ql *QueryLogger) run() {
+	defer close(ql.done)
+
+	for entry := range ql.entries {
+		if err := ql.Sink.Write(entry); err != nil {
+			logger.Warn("failed to write query log", logger.Fields{"reason": err})
+		}
+	}
+}
+
+// Log is add entry into the buffer. Returns false if the entry was dropped because the buffer was full or closed.
+func (ql *QueryLogger) Log(entry QueryLogEntry) bool {
+	ql.mu.RLock()
+	defer ql.mu.RUnlock()
+
+	if ql.closed {
+		return false
+	}
+
+	select {
+	case ql.entries <- entry:
+		return true
+	default:
+		ql.Metrics.QueryLogDropped()
+		return false
+	}
+}
+
+// Close is write all buffered entries and close Sink.
+func (ql *QueryLogger) Close() error {
+	ql.mu.Lock()
+	if ql.closed {
+		ql.mu.Unlock()
+		return nil
+	}
+	ql.closed = true
+	close(ql.entries)
+	ql.mu.Unlock()
+
+	<-ql.done
+
+	return ql.Sink.Close()
+}
+
+// JSONQueryLogSink is QueryLogSink that writes entries as JSON lines.
+type JSONQueryLogSink struct {
+	Writer io.Writer // Writer for output. It will be closed when closing sink if it implements io.Closer.
+}
+
+// NewJSONQueryLogSink is constructor of JSONQueryLogSink.
+func NewJSONQueryLogSink(w io.Writer) JSONQueryLogSink {
+	return JSONQueryLogSink{Writer: w}
+}
+
+// Write is write entry as a line of JSON.
+func (s JSONQueryLogSink) Write(entry QueryLogEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return Error{TypeInternalError, err, "failed to encode query log"}
+	}
+
+	if _, err := s.Writer.Write(append(b, '\n')); err != nil {
+		return Error{TypeExternalError, err, "failed to write query log"}
+	}
+	return nil
+}
+
+// Close is close Writer if it implements io.Closer.
+func (s JSONQueryLogSink) Close() error {
+	if c, ok := s.Writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// RotatingFile is io.WriteCloser that rotates file when it became larger than MaxSize.
+//
+// Rotated files are renamed to "PATH.1", "PATH.2", ..., and the files older than MaxBackups will be removed.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64 // Maximum size of file in bytes. 0 means never rotate.
+	MaxBackups int   // Number of rotated files to keep.
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	header []byte
+	footer []byte
+}
+
+// NewRotatingFile is constructor of RotatingFile. The file will be opened in append mode.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+
+	if err := rf.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// SetFrame is set header and footer that written at the beginning and the end of each file, for stream formats like Frame Streams of dnstap.
+//
+// The current file is rotated if it is not empty, because the header can't be written in the middle of the existing stream.
+func (rf *RotatingFile) SetFrame(header, footer []byte) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return newError(TypeInternalError, nil, "file already closed: %s", rf.Path)
+	}
+
+	rf.header = header
+	rf.footer = footer
+
+	if rf.size > 0 {
+		// The existing file has been finished by the previous process, so footer isn't needed.
+		return rf.rotate(false)
+	}
+	return rf.writeHeader()
+}
+
+func (rf *RotatingFile) open(flag int) error {
+	f, err := os.OpenFile(rf.Path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return Error{TypeExternalError, err, "failed to open file"}
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return Error{TypeExternalError, err, "failed to open file"}
+	}
+
+	rf.file = f
+	rf.size = stat.Size()
+	return nil
+}
+
+func (rf *RotatingFile) writeHeader() error {
+	n, err := rf.file.Write(rf.header)
+	rf.size += int64(n)
+	return wrapError(err, TypeExternalError, "failed to write file")
+}
+
+func (rf *RotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", rf.Path, n)
+}
+
+// rotate is rename the current file to backup and open new file.
+//
+// If failed to rename, the current file is opened again without footer, so that writes can continue into it.
+func (rf *RotatingFile) rotate(footer bool) error {
+	size := rf.size
+	if footer {
+		if _, err := rf.file.Write(rf.footer); err != nil {
+			return Error{TypeExternalError, err, "failed to write file"}
+		}
+	}
+	if err := rf.file.Close(); err != nil {
+		rf.file = nil
+		return Error{TypeExternalError, err, "failed to close file"}
+	}
+
+	if rf.MaxBackups > 0 {
+		os.Remove(rf.backupPath(rf.MaxBackups))
+		for i := rf.MaxBackups - 1; i > 0; i-- {
+			os.Rename(rf.backupPath(i), rf.backupPath(i+1))
+		}
+		if err := os.Rename(rf.Path, rf.backupPath(1)); err != nil {
+			if err := os.Truncate(rf.Path, size); err != nil {
+				logger.Error("failed to remove footer of file", logger.Fields{"path": rf.Path, "reason": err})
+			}
+			if err := rf.open(os.O_APPEND); err != nil {
+				rf.file = nil
+				return err
+			}
+			return Error{TypeExternalError, err, "failed to rotate file"}
+		}
+	}
+
+	if err := rf.open(os.O_TRUNC); err != nil {
+		rf.file = nil
+		return err
+	}
+	return rf.writeHeader()
+}
+
+// Write is write bytes into file, and rotate file if needed before write.
+//
+// If failed to rotate, bytes are written into the current file.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, newError(TypeInternalError, nil, "file already closed: %s", rf.Path)
+	}
+
+	if rf.MaxSize > 0 && rf.size > int64(len(rf.header)) && rf.size+int64(len(p)) > rf.MaxSize {
+		if err := rf.rotate(true); err != nil {
+			logger.Warn("failed to rotate file", logger.Fields{"path": rf.Path, "reason": err})
+			if rf.file == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close is write the footer and close the current file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	_, err := rf.file.Write(rf.footer)
+	if cerr := rf.file.Close(); err == nil {
+		err = cerr
+	}
+	rf.file = nil
+	return err
+}
+
+type answererKey struct{}
+
+// answerer is the recorder of name of resolver that answered to the query.
+type answerer struct {
+	sync.Mutex
+
+	name string
+}
+
+// contextWithAnswerer is make context that records name of the MeasuredResolver that answered first.
+func contextWithAnswerer(ctx context.Context) (context.Context, *answerer) {
+	a := &answerer{}
+	return context.WithValue(ctx, answererKey{}, a), a
+}
+
+// recordAnswerer is record name of resolver into the context if no resolver answered yet.
+func recordAnswerer(ctx context.Context, name string) {
+	if a, ok := ctx.Value(answererKey{}).(*answerer); ok {
+		a.Lock()
+		if a.name == "" {
+			a.name = name
+		}
+		a.Unlock()
+	}
+}
+
+// Name is getter of recorded name.
+func (a *answerer) Name() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.name
+}
@@ -0,0 +1,351 @@
+package landns_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+// QueryLogRecorder is a QueryLogSink that records entries in memory.
+type QueryLogRecorder struct {
+	sync.Mutex
+
+	Entries []landns.QueryLogEntry
+	Closed  bool
+	Block   chan struct{} // Write blocks until this channel is closed, if not nil.
+}
+
+func (r *QueryLogRecorder) Write(entry landns.QueryLogEntry) error {
+	if r.Block != nil {
+		<-r.Block
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.Entries = append(r.Entries, entry)
+	return nil
+}
+
+func (r *QueryLogRecorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	r.Closed = true
+	return nil
+}
+
+func TestQueryLogEntry_MarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	query := new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA)
+	response := new(dns.Msg).SetReply(query)
+	response.Answer = []dns.RR{
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 42}, AAAA: net.ParseIP("::1")},
+	}
+
+	entry := landns.QueryLogEntry{
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.UTC),
+		Client:   net.ParseIP("10.1.2.3"),
+		Remote:   &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345},
+		View:     "default",
+		Query:    query,
+		Response: response,
+		Resolver: "static",
+		Latency:  1500 * time.Microsecond,
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+
+	expect := `{"time":"2020-01-02T03:04:05.6Z","client":"10.1.2.3","protocol":"tcp","view":"default","name":"example.com.","type":"AAAA","rcode":"NOERROR","answers":1,"resolver":"static","latency_ms":1.5}`
+	if string(b) != expect {
+		t.Errorf("unexpected JSON:\nexpected: %s\nbut got:  %s", expect, string(b))
+	}
+
+	b, err = json.Marshal(landns.QueryLogEntry{Time: entry.Time})
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+
+	expect = `{"time":"2020-01-02T03:04:05.6Z","view":"","name":"","type":"UNKNOWN","rcode":"","answers":0,"latency_ms":0}`
+	if string(b) != expect {
+		t.Errorf("unexpected JSON:\nexpected: %s\nbut got:  %s", expect, string(b))
+	}
+}
+
+func TestJSONQueryLogSink(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	sink := landns.NewJSONQueryLogSink(buf)
+
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		entry := landns.QueryLogEntry{Query: new(dns.Msg).SetQuestion(name, dns.TypeA)}
+		if err := sink.Write(entry); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected number of lines: %d", len(lines))
+	}
+	for i, name := range []string{"a.example.com.", "b.example.com."} {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &v); err != nil {
+			t.Errorf("failed to parse line %d: %s", i, err)
+		} else if v["name"] != name {
+			t.Errorf("unexpected name at line %d: %v", i, v["name"])
+		}
+	}
+}
+
+func TestQueryLogger(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := testutil.StartMetricsServer(ctx, t, "landns")
+
+	sink := &QueryLogRecorder{Block: make(chan struct{})}
+	ql := landns.NewQueryLogger(sink, 2, srv.Metrics)
+
+	dropped := 0
+	for i := 0; i < 5; i++ {
+		if !ql.Log(landns.QueryLogEntry{View: "test"}) {
+			dropped++
+		}
+	}
+
+	// 1 entry is taken by the writer and blocked, and 2 entries are in the buffer.
+	if dropped < 2 || dropped > 3 {
+		t.Errorf("unexpected number of dropped entries: %d", dropped)
+	}
+	srv.Get(t).Assert(t, "landns_query_log_dropped_count", testutil.MetricsLabels{}, float64(dropped))
+
+	close(sink.Block)
+	if err := ql.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	if len(sink.Entries) != 5-dropped {
+		t.Errorf("unexpected number of entries: expected %d but got %d", 5-dropped, len(sink.Entries))
+	}
+	if !sink.Closed {
+		t.Errorf("sink was not closed")
+	}
+
+	if ql.Log(landns.QueryLogEntry{}) {
+		t.Errorf("closed logger accepted entry")
+	}
+	if err := ql.Close(); err != nil {
+		t.Errorf("failed to close twice: %s", err)
+	}
+}
+
+func TestHandler_QueryLog(t *testing.T) {
+	t.Parallel()
+
+	metrics := landns.NewMetrics("landns")
+	static := landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 100, Address: net.ParseIP("127.0.0.1")},
+	})
+	resolver := landns.ResolverSet{
+		landns.NewMeasuredResolver("empty", landns.NewSimpleResolver(nil), metrics),
+		landns.NewMeasuredResolver("static", static, metrics),
+	}
+
+	sink := &QueryLogRecorder{}
+	handler := landns.NewHandler(resolver, metrics)
+	handler.QueryLog = landns.NewQueryLogger(sink, 0, metrics)
+
+	remote := &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 12345}
+	for _, name := range []string{"example.com.", "notfound.example.com."} {
+		handler.ServeDNS(testutil.NewDummyDNSResponseWriter(remote), new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+
+	if err := handler.QueryLog.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	if len(sink.Entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d", len(sink.Entries))
+	}
+
+	tests := []struct {
+		Name     string
+		Answers  int
+		Resolver string
+	}{
+		{"example.com.", 1, "static"},
+		{"notfound.example.com.", 0, ""},
+	}
+	for i, tt := range tests {
+		e := sink.Entries[i]
+		if e.Question().Name != tt.Name || e.Question().Qtype != dns.TypeA {
+			t.Errorf("%d: unexpected question: %v", i, e.Question())
+		}
+		if len(e.Response.Answer) != tt.Answers {
+			t.Errorf("%d: unexpected number of answers: %d", i, len(e.Response.Answer))
+		}
+		if e.Resolver != tt.Resolver {
+			t.Errorf("%d: unexpected resolver: expected %q but got %q", i, tt.Resolver, e.Resolver)
+		}
+		if !e.Client.Equal(remote.IP) || e.Remote != remote || e.Protocol() != "udp" {
+			t.Errorf("%d: unexpected client: %s %s %s", i, e.Client, e.Remote, e.Protocol())
+		}
+		if e.View != landns.DefaultViewName {
+			t.Errorf("%d: unexpected view: %s", i, e.View)
+		}
+		if e.Latency <= 0 || time.Since(e.Time) > time.Minute {
+			t.Errorf("%d: unexpected time: %s %s", i, e.Time, e.Latency)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-query-log")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+	if err := ioutil.WriteFile(path, []byte("0\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	f, err := landns.NewRotatingFile(path, 4, 2)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+
+	for _, s := range []string{"1\n", "2\n", "3\n", "4\n", "5\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	for name, expect := range map[string]string{
+		"query.log":   "4\n5\n",
+		"query.log.1": "2\n3\n",
+		"query.log.2": "0\n1\n",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("failed to read %s: %s", name, err)
+		} else if string(b) != expect {
+			t.Errorf("%s: unexpected content: %q", name, string(b))
+		}
+	}
+
+	if _, err := f.Write([]byte("6\n")); err == nil {
+		t.Errorf("expected error after close but got nil")
+	}
+}
+
+func TestRotatingFile_SetFrame(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-query-log")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+	if err := ioutil.WriteFile(path, []byte("[0]"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	f, err := landns.NewRotatingFile(path, 6, 3)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+	if err := f.SetFrame([]byte("["), []byte("]")); err != nil {
+		t.Fatalf("failed to set frame: %s", err)
+	}
+
+	for _, s := range []string{"1", "2", "3", "4", "5", "6"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	for name, expect := range map[string]string{
+		"query.log":   "[6]",
+		"query.log.1": "[12345]",
+		"query.log.2": "[0]",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("failed to read %s: %s", name, err)
+		} else if string(b) != expect {
+			t.Errorf("%s: unexpected content: %q", name, string(b))
+		}
+	}
+}
+
+func TestRotatingFile_RenameFailure(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "landns-query-log")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+
+	// Backup path is a non-empty directory, so rotation fails.
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatalf("failed to make directory: %s", err)
+	}
+
+	f, err := landns.NewRotatingFile(path, 4, 1)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+	if err := f.SetFrame([]byte("["), []byte("]")); err != nil {
+		t.Fatalf("failed to set frame: %s", err)
+	}
+
+	for _, s := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("failed to write %s: %s", s, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	if b, err := ioutil.ReadFile(path); err != nil {
+		t.Errorf("failed to read: %s", err)
+	} else if string(b) != "[12345]" {
+		t.Errorf("unexpected content: %q", string(b))
+	}
+}
@@ -96,11 +96,27 @@ func NewRecordWithTTL(str string, ttl uint32) (Record, error) {
 
 // NewRecordWithExpire is make new Record from query string with expire time.
 func NewRecordWithExpire(str string, expire time.Time) (Record, error) {
-	if expire.Before(time.Now()) {
+	return NewRecordWithExpireAt(str, expire, DefaultClock.Now())
+}
+
+// NewRecordWithExpireAt is make new Record from query string with expire time, and calculates TTL at now.
+func NewRecordWithExpireAt(str string, expire, now time.Time) (Record, error) {
+	if expire.Before(now) {
 		return nil, newError(TypeExpirationError, nil, "expire can't be past time: %s", expire)
 	}
 
-	return NewRecordWithTTL(str, uint32(math.Round(time.Until(expire).Seconds())))
+	return NewRecordWithTTL(str, remainingTTL(expire, now))
+}
+
+// remainingTTL is calculate TTL in seconds from expire time.
+//
+// All components that have expire time use this function, so TTL decays in the same way everywhere.
+func remainingTTL(expire, now time.Time) uint32 {
+	ttl := math.Round(expire.Sub(now).Seconds())
+	if ttl < 0 {
+		return 0
+	}
+	return uint32(ttl)
 }
 
 // NewRecordFromRR is make new Record from dns.RR of package github.com/miekg/dns.
@@ -112,6 +128,18 @@ func NewRecordFromRR(rr dns.RR) (Record, error) {
 		return AddressRecord{Name: Domain(x.Hdr.Name), TTL: x.Hdr.Ttl, Address: x.AAAA}, nil
 	case *dns.NS:
 		return NsRecord{Name: Domain(x.Hdr.Name), Target: Domain(x.Ns)}, nil
+	case *dns.SOA:
+		return SoaRecord{
+			Name:    Domain(x.Hdr.Name),
+			TTL:     x.Hdr.Ttl,
+			Ns:      Domain(x.Ns),
+			Mbox:    Domain(x.Mbox),
+			Serial:  x.Serial,
+			Refresh: x.Refresh,
+			Retry:   x.Retry,
+			Expire:  x.Expire,
+			Minttl:  x.Minttl,
+		}, nil
 	case *dns.CNAME:
 		return CnameRecord{Name: Domain(x.Hdr.Name), TTL: x.Hdr.Ttl, Target: Domain(x.Target)}, nil
 	case *dns.PTR:
@@ -119,6 +147,9 @@ func NewRecordFromRR(rr dns.RR) (Record, error) {
 	case *dns.MX:
 		return MxRecord{Name: Domain(x.Hdr.Name), TTL: x.Hdr.Ttl, Preference: x.Preference, Target: Domain(x.Mx)}, nil
 	case *dns.TXT:
+		if len(x.Txt) == 0 {
+			return TxtRecord{Name: Domain(x.Hdr.Name), TTL: x.Hdr.Ttl}, nil
+		}
 		return TxtRecord{Name: Domain(x.Hdr.Name), TTL: x.Hdr.Ttl, Text: x.Txt[0]}, nil
 	case *dns.SRV:
 		return SrvRecord{
@@ -240,6 +271,82 @@ func (r NsRecord) Validate() error {
 	return r.Target.Validate()
 }
 
+// SoaRecord is the Record of SOA.
+type SoaRecord struct {
+	Name    Domain
+	TTL     uint32
+	Ns      Domain
+	Mbox    Domain
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minttl  uint32
+}
+
+// String is make record string.
+func (r SoaRecord) String() string {
+	return fmt.Sprintf(
+		"%s %d IN SOA %s %s %d %d %d %d %d",
+		r.Name,
+		r.TTL,
+		r.Ns,
+		r.Mbox,
+		r.Serial,
+		r.Refresh,
+		r.Retry,
+		r.Expire,
+		r.Minttl,
+	)
+}
+
+// WithoutTTL is make record string but mask TTL number.
+func (r SoaRecord) WithoutTTL() string {
+	return fmt.Sprintf(
+		"%s 0 IN SOA %s %s %d %d %d %d %d",
+		r.Name,
+		r.Ns,
+		r.Mbox,
+		r.Serial,
+		r.Refresh,
+		r.Retry,
+		r.Expire,
+		r.Minttl,
+	)
+}
+
+// GetName is getter to name of record.
+func (r SoaRecord) GetName() Domain {
+	return r.Name
+}
+
+// GetTTL is getter to TTL of record.
+func (r SoaRecord) GetTTL() uint32 {
+	return r.TTL
+}
+
+// GetQtype is getter to query type number like dns.TypeA or dns.TypeTXT of package github.com/miekg/dns.
+func (r SoaRecord) GetQtype() uint16 {
+	return dns.TypeSOA
+}
+
+// ToRR is converter to dns.RR of package github.com/miekg/dns
+func (r SoaRecord) ToRR() (dns.RR, error) {
+	rr, err := dns.NewRR(r.String())
+	return rr, wrapError(err, TypeInternalError, "failed to convert to RR")
+}
+
+// Validate is validator of record.
+func (r SoaRecord) Validate() error {
+	if err := r.Name.Validate(); err != nil {
+		return err
+	}
+	if err := r.Ns.Validate(); err != nil {
+		return err
+	}
+	return r.Mbox.Validate()
+}
+
 // CnameRecord is the Record of CNAME.
 type CnameRecord struct {
 	Name   Domain
@@ -503,18 +610,44 @@ func NewVolatileRecord(record string) (VolatileRecord, error) {
 
 // Record is Record getter.
 func (r VolatileRecord) Record() (Record, error) {
+	return r.RecordAt(DefaultClock.Now())
+}
+
+// RecordAt is Record getter that calculates TTL at now.
+func (r VolatileRecord) RecordAt(now time.Time) (Record, error) {
 	if r.Expire.Unix() > 0 {
-		ttl := math.Round(time.Until(r.Expire).Seconds())
-		if ttl < 0 {
+		if r.Expire.Before(now) {
 			return nil, newError(TypeExpirationError, nil, "this record is already expired: %s", r.Expire)
 		}
 
-		r.RR.Header().Ttl = uint32(ttl)
+		rr := dns.Copy(r.RR)
+		rr.Header().Ttl = remainingTTL(r.Expire, now)
+		return NewRecordFromRR(rr)
 	}
 
 	return NewRecordFromRR(r.RR)
 }
 
+// shareMinimumTTL is set the earliest expire in each RRset to all records in the RRset (RFC 2181 section 5.2).
+func shareMinimumTTL(records []VolatileRecord) {
+	type rrsetKey struct {
+		Name   string
+		Rrtype uint16
+	}
+
+	expires := make(map[rrsetKey]time.Time)
+	for _, r := range records {
+		key := rrsetKey{strings.ToLower(r.RR.Header().Name), r.RR.Header().Rrtype}
+		if e, ok := expires[key]; !ok || r.Expire.Before(e) {
+			expires[key] = r.Expire
+		}
+	}
+
+	for i, r := range records {
+		records[i].Expire = expires[rrsetKey{strings.ToLower(r.RR.Header().Name), r.RR.Header().Rrtype}]
+	}
+}
+
 // String is get printable string.
 func (r VolatileRecord) String() string {
 	text, _ := r.MarshalText()
@@ -545,7 +678,7 @@ func (r *VolatileRecord) UnmarshalText(text []byte) error {
 		}
 		r.Expire = time.Unix(i, 0)
 
-		if r.Expire.Before(time.Now()) {
+		if r.Expire.Before(DefaultClock.Now()) {
 			return newError(TypeExpirationError, nil, "failed to parse record: expire can't be past time: %s", r.Expire)
 		}
 	}
@@ -179,6 +179,13 @@ func TestRecords(t *testing.T) {
 			dns.TypeNS,
 			0,
 		},
+		{
+			landns.SoaRecord{Name: "example.com.", TTL: 30, Ns: "ns.example.com.", Mbox: "root.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minttl: 5},
+			"example.com. 30 IN SOA ns.example.com. root.example.com. 1 2 3 4 5",
+			"example.com. 0 IN SOA ns.example.com. root.example.com. 1 2 3 4 5",
+			dns.TypeSOA,
+			30,
+		},
 		{
 			landns.CnameRecord{Name: "cname.example.com.", TTL: 40, Target: "example.com."},
 			"cname.example.com. 40 IN CNAME example.com.",
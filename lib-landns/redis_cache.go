@@ -1,20 +1,34 @@
 package landns
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/miekg/dns"
 )
 
+// redisKeyPrefix is the prefix of all keys that RedisCache uses, for share Redis database with other applications.
+const redisKeyPrefix = "landns:"
+
 // RedisCache is redis cache manager for Resolver.
 type RedisCache struct {
 	addr     net.Addr
 	pool     *redis.Pool
+	flights  *flightGroup
 	upstream Resolver
 	metrics  *Metrics
+
+	NegativeMinTTL time.Duration // Floor of TTL for negative cache.
+	NegativeMaxTTL time.Duration // Ceiling of TTL for negative cache. Unlimited if 0.
+	Prefetch       time.Duration // Refresh cache in background if it hit when remaining TTL is shorter than this. Disabled if 0.
+	StaleTTL       time.Duration // Duration to keep expired records for serve-stale. Disabled if 0.
+	Clock          Clock         // Source of current time.
 }
 
 /*
@@ -42,8 +56,15 @@ func NewRedisCache(addr net.Addr, database int, password string, upstream Resolv
 	return RedisCache{
 		addr:     addr,
 		pool:     pool,
+		flights:  newFlightGroup(),
 		upstream: upstream,
 		metrics:  metrics,
+
+		NegativeMinTTL: DefaultNegativeMinTTL,
+		NegativeMaxTTL: DefaultNegativeMaxTTL,
+		Prefetch:       DefaultCachePrefetch,
+		StaleTTL:       DefaultCacheStaleTTL,
+		Clock:          DefaultClock,
 	}, nil
 }
 
@@ -52,15 +73,36 @@ func (rc RedisCache) String() string {
 	return fmt.Sprintf("RedisCache[%s, %s]", rc.addr, rc.upstream)
 }
 
+// WithUpstream is make a copy of RedisCache that shares the connection to Redis server, but uses another upstream resolver.
+//
+// Copies share the same cache entries, so only one of them should be used for Entries and Flush.
+func (rc RedisCache) WithUpstream(upstream Resolver) RedisCache {
+	rc.upstream = upstream
+	return rc
+}
+
 // Close is disconnect from Redis server.
 func (rc RedisCache) Close() error {
 	return wrapError(rc.pool.Close(), TypeExternalError, "failed to close Redis connection")
 }
 
-func (rc RedisCache) resolveFromUpstream(w ResponseWriter, r Request, key string) error {
-	rc.metrics.CacheHit(r)
+func redisCacheKeyOf(r Request) string {
+	return fmt.Sprintf("%s%s:%s", redisKeyPrefix, r.QtypeString(), r.Name)
+}
 
-	conn := rc.pool.Get()
+func negativeCacheKey(r Request, rcode int) string {
+	if rcode == dns.RcodeNameError {
+		return fmt.Sprintf("%snegative:NXDOMAIN:%s", redisKeyPrefix, r.Name)
+	}
+	return fmt.Sprintf("%snegative:%s:%s", redisKeyPrefix, r.QtypeString(), r.Name)
+}
+
+// update is resolve request using upstream resolver, and replace cache with the response.
+func (rc RedisCache) update(ctx context.Context, w ResponseWriter, r Request, key string) error {
+	conn, err := rc.pool.GetContext(ctx)
+	if err != nil {
+		return Error{TypeExternalError, err, "failed to connect to Redis"}
+	}
 	defer conn.Close()
 	if err := conn.Send("MULTI"); err != nil {
 		return Error{TypeExternalError, err, "failed to start transaction"}
@@ -71,90 +113,438 @@ func (rc RedisCache) resolveFromUpstream(w ResponseWriter, r Request, key string
 	commit := func() error {
 		return wrapError(conn.Send("EXEC"), TypeExternalError, "failed to execute transaction")
 	}
+	stale := uint32(rc.StaleTTL.Seconds())
+	now := rc.Clock.Now()
+
+	if err := conn.Send("DEL", key, negativeCacheKey(r, dns.RcodeNameError), negativeCacheKey(r, dns.RcodeSuccess)); err != nil {
+		rollback()
+		return Error{TypeExternalError, err, "failed to delete old records"}
+	}
 
 	ttl := uint32(math.MaxUint32)
-	wh := ResponseWriterHook{
-		Writer: w,
-		OnAdd: func(record Record) error {
-			if ttl > record.GetTTL() {
-				ttl = record.GetTTL()
-			}
+	var nr negativeResponse
+	wh := nr.Hook(w, func(record Record) error {
+		if ttl > record.GetTTL() {
+			ttl = record.GetTTL()
+		}
 
-			rr, err := record.ToRR()
-			if err != nil {
-				rollback()
-				return err
-			}
+		rr, err := record.ToRR()
+		if err != nil {
+			rollback()
+			return err
+		}
 
-			rec := VolatileRecord{
-				RR:     rr,
-				Expire: time.Now().Add(time.Duration(record.GetTTL()) * time.Second),
-			}
+		rec := VolatileRecord{
+			RR:     rr,
+			Expire: now.Add(time.Duration(record.GetTTL()) * time.Second),
+		}
 
-			if err := conn.Send("RPUSH", key, rec.String()); err != nil {
-				rollback()
-				return Error{TypeExternalError, err, "failed to push record"}
-			}
+		if err := conn.Send("RPUSH", key, rec.String()); err != nil {
+			rollback()
+			return Error{TypeExternalError, err, "failed to push record"}
+		}
 
-			return nil
-		},
-	}
+		return nil
+	})
 
-	if err := rc.upstream.Resolve(wh, r); err != nil {
+	if err := ResolveContext(ctx, rc.upstream, wh, r); err != nil {
 		rollback()
 		return err
 	}
 
-	if ttl == 0 {
+	if negTTL, ok := nr.TTL(rc.NegativeMinTTL, rc.NegativeMaxTTL); ok {
+		soa, err := nr.Entry(negTTL, now)
+		if err != nil {
+			rollback()
+			return err
+		}
+		if err := conn.Send("SET", negativeCacheKey(r, nr.rcode), soa.String(), "EX", negTTL+stale); err != nil {
+			rollback()
+			return Error{TypeExternalError, err, "failed to set negative cache"}
+		}
+		return commit()
+	}
+
+	if ttl == 0 || ttl == math.MaxUint32 {
 		return rollback()
 	}
 
-	if err := conn.Send("EXPIRE", key, ttl); err != nil {
+	if err := conn.Send("EXPIRE", key, ttl+stale); err != nil {
 		return Error{TypeExternalError, err, "failed to set expiration of records"}
 	}
 	return commit()
 }
 
-func (rc RedisCache) resolveFromCache(w ResponseWriter, r Request, cache []string) error {
+// resolveFromUpstream is resolve request using upstream resolver and update cache.
+//
+// Concurrent requests for the same key in this RedisCache share one upstream request.
+func (rc RedisCache) resolveFromUpstream(ctx context.Context, w ResponseWriter, r Request, key string) error {
 	rc.metrics.CacheMiss(r)
 
-	for _, str := range cache {
-		entry, err := NewVolatileRecord(str)
-		if err != nil {
-			return err
+	shared, err := rc.flights.Do(ctx, w, key, func(w ResponseWriter) error {
+		return rc.update(ctx, w, r, key)
+	})
+	if shared {
+		rc.metrics.CacheCoalesced(r)
+	}
+	return err
+}
+
+// refresh is start refreshing cache in background.
+//
+// Only one refreshing runs at the same time for each request, even if multiple RedisCaches share the same Redis server.
+func (rc RedisCache) refresh(ctx context.Context, conn redis.Conn, r Request, key string) {
+	lock := redisKeyPrefix + "refresh:" + strings.TrimPrefix(key, redisKeyPrefix)
+
+	if _, err := redis.String(conn.Do("SET", lock, "1", "NX", "EX", 10)); err != nil {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		rc.update(ctx, discardResponseWriter(), r, key)
+
+		conn := rc.pool.Get()
+		defer conn.Close()
+		conn.Do("DEL", lock)
+	}()
+}
+
+// writeCache is write cached records into ResponseWriter.
+func (rc RedisCache) writeCache(w ResponseWriter, records []VolatileRecord, now time.Time, stale bool) error {
+	w.SetNoAuthoritative()
+
+	for _, entry := range records {
+		if stale {
+			entry = staleRecord(entry, now)
 		}
 
-		if rec, err := entry.Record(); err != nil {
+		if rec, err := entry.RecordAt(now); err != nil {
 			continue
 		} else if err := w.Add(rec); err != nil {
 			return err
 		}
-
-		w.SetNoAuthoritative()
 	}
 
 	return nil
 }
 
+func (rc RedisCache) resolveFromCache(ctx context.Context, w ResponseWriter, r Request, conn redis.Conn, key string, cache []string) error {
+	now := rc.Clock.Now()
+	records := make([]VolatileRecord, len(cache))
+	ttl := time.Duration(math.MaxInt64)
+
+	for i, str := range cache {
+		entry, err := parseCachedRecord(str)
+		if err != nil {
+			return err
+		}
+		records[i] = entry
+
+		if delta := entry.Expire.Sub(now); delta < ttl {
+			ttl = delta
+		}
+	}
+
+	shareMinimumTTL(records)
+
+	if ttl+rc.StaleTTL < 1 {
+		return rc.resolveFromUpstream(ctx, w, r, key)
+	}
+
+	if ttl < 1 {
+		rc.metrics.CacheStaleHit(r)
+		rc.refresh(ctx, conn, r, key)
+		return rc.writeCache(w, records, now, true)
+	}
+
+	rc.metrics.CacheHit(r)
+	if ttl < rc.Prefetch {
+		rc.metrics.CachePrefetch(r)
+		rc.refresh(ctx, conn, r, key)
+	}
+	return rc.writeCache(w, records, now, false)
+}
+
+func (rc RedisCache) resolveFromNegativeCache(ctx context.Context, w ResponseWriter, r Request, conn redis.Conn, key string) (bool, error) {
+	negatives, err := redis.Strings(conn.Do("MGET", negativeCacheKey(r, dns.RcodeNameError), negativeCacheKey(r, dns.RcodeSuccess)))
+	if err != nil {
+		return false, Error{TypeExternalError, err, "failed to get negative cache"}
+	}
+
+	now := rc.Clock.Now()
+	for i, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		if negatives[i] == "" {
+			continue
+		}
+
+		soa, err := parseCachedRecord(negatives[i])
+		ttl := soa.Expire.Sub(now)
+		if err != nil || ttl+rc.StaleTTL < 1 {
+			continue
+		}
+
+		if ttl < 1 {
+			rc.metrics.CacheStaleHit(r)
+			rc.refresh(ctx, conn, r, key)
+			return true, writeNegative(w, rcode, staleRecord(soa, now), now)
+		}
+
+		rc.metrics.CacheNegativeHit(r)
+		if ttl < rc.Prefetch {
+			rc.metrics.CachePrefetch(r)
+			rc.refresh(ctx, conn, r, key)
+		}
+		return true, writeNegative(w, rcode, soa, now)
+	}
+
+	return false, nil
+}
+
 // Resolve is resolver using cache or the upstream resolver.
 func (rc RedisCache) Resolve(w ResponseWriter, r Request) error {
-	key := fmt.Sprintf("%s:%s", r.QtypeString(), r.Name)
+	return rc.ResolveContext(r.Context(), w, r)
+}
 
-	conn := rc.pool.Get()
+// ResolveContext is resolver using cache or the upstream resolver with context.
+func (rc RedisCache) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	ctx, span := startSpan(ctx, r, "RedisCache.Resolve")
+	defer endSpan(span, &err)
+
+	// Metrics records the cache result into the span via the context in Request.
+	r = r.WithContext(ctx)
+
+	key := redisCacheKeyOf(r)
+
+	conn, err := rc.pool.GetContext(ctx)
+	if err != nil {
+		return Error{TypeExternalError, err, "failed to connect to Redis"}
+	}
 	defer conn.Close()
 
 	resp, err := redis.Strings(conn.Do("LRANGE", key, 0, -1))
 	if err != nil {
 		return Error{TypeExternalError, err, "failed to get records"}
 	}
-	if len(resp) == 0 {
-		return rc.resolveFromUpstream(w, r, key)
+	if len(resp) > 0 {
+		return rc.resolveFromCache(ctx, w, r, conn, key, resp)
 	}
 
-	return rc.resolveFromCache(w, r, resp)
+	if ok, err := rc.resolveFromNegativeCache(ctx, w, r, conn, key); ok || err != nil {
+		return err
+	}
+
+	return rc.resolveFromUpstream(ctx, w, r, key)
 }
 
 // RecursionAvailable is returns same as upstream.
 func (rc RedisCache) RecursionAvailable() bool {
 	return rc.upstream.RecursionAvailable()
 }
+
+// redisCacheKey is parsed key of RedisCache.
+type redisCacheKey struct {
+	Key      string
+	Name     Domain
+	Qtype    uint16
+	Negative bool
+	Rcode    int
+}
+
+// parseRedisCacheKey is parse key of RedisCache. Returns false if the key is not cache entry, like keys of other applications.
+func parseRedisCacheKey(key string) (redisCacheKey, bool) {
+	k := redisCacheKey{Key: key}
+
+	if !strings.HasPrefix(key, redisKeyPrefix) {
+		return k, false
+	}
+	rest := key[len(redisKeyPrefix):]
+	if strings.HasPrefix(rest, "refresh:") {
+		return k, false
+	}
+	if strings.HasPrefix(rest, "negative:") {
+		k.Negative = true
+		rest = rest[len("negative:"):]
+	}
+
+	xs := strings.SplitN(rest, ":", 2)
+	if len(xs) != 2 || xs[1] == "" {
+		return k, false
+	}
+
+	k.Name = Domain(xs[1])
+	if k.Name.Validate() != nil {
+		return k, false
+	}
+
+	if k.Negative && xs[0] == "NXDOMAIN" {
+		k.Rcode = dns.RcodeNameError
+	} else if qtype, ok := dns.StringToType[xs[0]]; ok {
+		k.Qtype = qtype
+	} else if xs[0] == QtypeToString(dns.TypeNone) {
+		// Types that QtypeToString doesn't know are guessed from records.
+		k.Qtype = dns.TypeNone
+	} else {
+		return k, false
+	}
+
+	return k, true
+}
+
+// scan is get keys of cache entries that name matched to fn.
+func (rc RedisCache) scan(conn redis.Conn, fn func(Domain) bool) ([]redisCacheKey, error) {
+	var keys []redisCacheKey
+	found := make(map[string]struct{})
+
+	cursor := 0
+	for {
+		resp, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to scan keys"}
+		}
+
+		cursor, err = redis.Int(resp[0], nil)
+		if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to parse cursor"}
+		}
+		ks, err := redis.Strings(resp[1], nil)
+		if err != nil {
+			return nil, Error{TypeExternalError, err, "failed to parse keys"}
+		}
+
+		for _, k := range ks {
+			if _, ok := found[k]; ok {
+				continue
+			}
+			found[k] = struct{}{}
+
+			if key, ok := parseRedisCacheKey(k); ok && fn(key.Name) {
+				keys = append(keys, key)
+			}
+		}
+
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// entry is get CacheEntry for the key. Returns false if the key is already expired.
+func (rc RedisCache) entry(conn redis.Conn, key redisCacheKey, now time.Time) (CacheEntry, bool, error) {
+	if key.Negative {
+		str, err := redis.String(conn.Do("GET", key.Key))
+		if err == redis.ErrNil {
+			return CacheEntry{}, false, nil
+		} else if err != nil {
+			return CacheEntry{}, false, Error{TypeExternalError, err, "failed to get negative cache"}
+		}
+
+		soa, err := parseCachedRecord(str)
+		if err != nil {
+			return CacheEntry{}, false, err
+		}
+
+		entry, err := newNegativeCacheEntry(key.Name, key.Qtype, key.Rcode, soa, now)
+		return entry, err == nil && entry.TTL+rc.StaleTTL >= 1, err
+	}
+
+	strs, err := redis.Strings(conn.Do("LRANGE", key.Key, 0, -1))
+	if err != nil {
+		return CacheEntry{}, false, Error{TypeExternalError, err, "failed to get records"}
+	}
+	if len(strs) == 0 {
+		return CacheEntry{}, false, nil
+	}
+
+	records := make([]VolatileRecord, len(strs))
+	for i, str := range strs {
+		if records[i], err = parseCachedRecord(str); err != nil {
+			return CacheEntry{}, false, err
+		}
+	}
+	shareMinimumTTL(records)
+
+	if key.Qtype == dns.TypeNone {
+		key.Qtype = records[0].RR.Header().Rrtype
+	}
+
+	entry, err := newCacheEntry(key.Name, key.Qtype, records, now)
+	return entry, err == nil && entry.TTL+rc.StaleTTL >= 1, err
+}
+
+// Entries is getter to all entries in the cache, in order of name.
+func (rc RedisCache) Entries() ([]CacheEntry, error) {
+	conn := rc.pool.Get()
+	defer conn.Close()
+
+	keys, err := rc.scan(conn, func(Domain) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := rc.Clock.Now()
+	var entries []CacheEntry
+	for _, key := range keys {
+		entry, ok, err := rc.entry(conn, key, now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Qtype < entries[j].Qtype
+	})
+
+	return entries, nil
+}
+
+// flush is remove entries that matched to fn.
+func (rc RedisCache) flush(fn func(Domain) bool) (int, error) {
+	conn := rc.pool.Get()
+	defer conn.Close()
+
+	keys, err := rc.scan(conn, fn)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key.Key
+	}
+
+	n, err := redis.Int(conn.Do("DEL", args...))
+	if err != nil {
+		return 0, Error{TypeExternalError, err, "failed to delete cache"}
+	}
+	return n, nil
+}
+
+// Flush is remove entries for the name.
+func (rc RedisCache) Flush(name Domain) (int, error) {
+	return rc.flush(func(n Domain) bool {
+		return matchCacheName(n, name)
+	})
+}
+
+// FlushSuffix is remove entries for the suffix and its subdomains.
+func (rc RedisCache) FlushSuffix(suffix Domain) (int, error) {
+	return rc.flush(func(n Domain) bool {
+		return matchCacheSuffix(n, suffix)
+	})
+}
+
+// FlushAll is remove all entries.
+func (rc RedisCache) FlushAll() (int, error) {
+	return rc.flush(func(Domain) bool {
+		return true
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/macrat/landns/lib-landns"
@@ -43,6 +44,8 @@ func TestRedisCache(t *testing.T) {
 			if err != nil {
 				t.Fatalf("failed to connect redis server: %s", err)
 			}
+			clock := testutil.NewFakeClock()
+			resolver.Clock = clock
 			defer func() {
 				if err := resolver.Close(); err != nil {
 					t.Fatalf("failed to close: %s", err)
@@ -53,10 +56,151 @@ func TestRedisCache(t *testing.T) {
 				t.Errorf("unexpected string: %s", resolver)
 			}
 
-			tester(t, resolver)
+			tester(t, resolver, clock)
 		})
 	}
 
+	for _, tt := range NegativeCacheTests {
+		tester := tt.Tester
+
+		t.Run("negative/"+tt.Name, func(t *testing.T) {
+			prepareRedisDB(t)
+
+			tester(t, func(t testing.TB, upstream landns.Resolver, clock landns.Clock, minTTL, maxTTL time.Duration) landns.Resolver {
+				resolver, err := landns.NewRedisCache(redisAddr, 0, "", upstream, landns.NewMetrics("landns"))
+				if err != nil {
+					t.Fatalf("failed to connect redis server: %s", err)
+				}
+				resolver.Clock = clock
+				resolver.NegativeMinTTL = minTTL
+				resolver.NegativeMaxTTL = maxTTL
+				return resolver
+			})
+		})
+	}
+
+	for _, tt := range StaleCacheTests {
+		tester := tt.Tester
+
+		t.Run("stale/"+tt.Name, func(t *testing.T) {
+			prepareRedisDB(t)
+
+			tester(t, func(t testing.TB, upstream landns.Resolver, clock landns.Clock, prefetch, staleTTL time.Duration) landns.Resolver {
+				resolver, err := landns.NewRedisCache(redisAddr, 0, "", upstream, landns.NewMetrics("landns"))
+				if err != nil {
+					t.Fatalf("failed to connect redis server: %s", err)
+				}
+				resolver.Clock = clock
+				resolver.Prefetch = prefetch
+				resolver.StaleTTL = staleTTL
+				return resolver
+			})
+		})
+	}
+
+	for _, tt := range TTLCacheTests {
+		tester := tt.Tester
+
+		t.Run("ttl/"+tt.Name, func(t *testing.T) {
+			prepareRedisDB(t)
+
+			tester(t, func(t testing.TB, upstream landns.Resolver, clock landns.Clock) landns.Resolver {
+				resolver, err := landns.NewRedisCache(redisAddr, 0, "", upstream, landns.NewMetrics("landns"))
+				if err != nil {
+					t.Fatalf("failed to connect redis server: %s", err)
+				}
+				resolver.Clock = clock
+				return resolver
+			})
+		})
+	}
+
+	for _, tt := range CoalesceCacheTests {
+		tester := tt.Tester
+
+		t.Run("coalesce/"+tt.Name, func(t *testing.T) {
+			prepareRedisDB(t)
+
+			tester(t, func(t testing.TB, upstream landns.Resolver) landns.Resolver {
+				resolver, err := landns.NewRedisCache(redisAddr, 0, "", upstream, landns.NewMetrics("landns"))
+				if err != nil {
+					t.Fatalf("failed to connect redis server: %s", err)
+				}
+				return resolver
+			})
+		})
+	}
+
+	t.Run("inspect", func(t *testing.T) {
+		prepareRedisDB(t)
+
+		resolver, err := landns.NewRedisCache(redisAddr, 0, "", CacheTestUpstream(t), landns.NewMetrics("landns"))
+		if err != nil {
+			t.Fatalf("failed to connect redis server: %s", err)
+		}
+		resolver.Clock = testutil.NewFakeClock()
+		defer resolver.Close()
+
+		InspectCacheTest(t, resolver)
+	})
+
+	t.Run("foreignKeys", func(t *testing.T) {
+		prepareRedisDB(t)
+
+		conn, err := redis.Dial(redisAddr.Network(), redisAddr.String())
+		if err != nil {
+			t.Fatalf("failed to connect redis server: %s", err)
+		}
+		defer conn.Close()
+
+		foreign := []string{"session:abc", "A:example.com.", "landns:session:abc"}
+		for _, key := range foreign {
+			if _, err := conn.Do("SET", key, "value"); err != nil {
+				t.Fatalf("failed to set foreign key: %s", err)
+			}
+		}
+
+		resolver, err := landns.NewRedisCache(redisAddr, 0, "", CacheTestUpstream(t), landns.NewMetrics("landns"))
+		if err != nil {
+			t.Fatalf("failed to connect redis server: %s", err)
+		}
+		resolver.Clock = testutil.NewFakeClock()
+		defer resolver.Close()
+
+		InspectCacheTest(t, resolver)
+
+		for _, key := range foreign {
+			if n, err := redis.Int(conn.Do("EXISTS", key)); err != nil || n != 1 {
+				t.Errorf("foreign key %s was removed: %v", key, err)
+			}
+		}
+	})
+
+	t.Run("WithUpstream", func(t *testing.T) {
+		prepareRedisDB(t)
+
+		resolver, err := landns.NewRedisCache(redisAddr, 0, "", CacheTestUpstream(t), landns.NewMetrics("landns"))
+		if err != nil {
+			t.Fatalf("failed to connect redis server: %s", err)
+		}
+		defer resolver.Close()
+
+		another := resolver.WithUpstream(landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "another.example.com.", TTL: 100, Address: net.ParseIP("127.9.9.9")},
+		}))
+		defer another.Close()
+
+		AssertResolve(t, another, landns.NewRequest("another.example.com.", dns.TypeA, false), true, "another.example.com. 100 IN A 127.9.9.9")
+
+		entries, err := landns.CacheSet{resolver}.Entries()
+		if err != nil {
+			t.Fatalf("failed to get entries: %s", err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("unexpected entries: %v", entries)
+		}
+	})
+
 	t.Run("RecursionAvailable", func(t *testing.T) {
 		prepareRedisDB(t)
 
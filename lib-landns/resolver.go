@@ -1,8 +1,10 @@
 package landns
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"time"
 )
 
 // Resolver is the interface of record resolver.
@@ -20,8 +22,13 @@ type ResolverSet []Resolver
 
 // Resolve is resolver using all upstream resolvers.
 func (rs ResolverSet) Resolve(resp ResponseWriter, req Request) error {
+	return rs.ResolveContext(req.Context(), resp, req)
+}
+
+// ResolveContext is resolver using all upstream resolvers with context.
+func (rs ResolverSet) ResolveContext(ctx context.Context, resp ResponseWriter, req Request) error {
 	for _, r := range rs {
-		if err := r.Resolve(resp, req); err != nil {
+		if err := ResolveContext(ctx, r, resp, req); err != nil {
 			return err
 		}
 	}
@@ -60,6 +67,11 @@ type AlternateResolver []Resolver
 
 // Resolve is resolver using first respond upstream resolvers.
 func (ar AlternateResolver) Resolve(resp ResponseWriter, req Request) error {
+	return ar.ResolveContext(req.Context(), resp, req)
+}
+
+// ResolveContext is resolver using first respond upstream resolvers with context.
+func (ar AlternateResolver) ResolveContext(ctx context.Context, resp ResponseWriter, req Request) error {
 	resolved := false
 
 	resp = ResponseWriterHook{
@@ -68,10 +80,13 @@ func (ar AlternateResolver) Resolve(resp ResponseWriter, req Request) error {
 			resolved = true
 			return nil
 		},
+		OnSetRcode: func(rcode int) {
+			resolved = true
+		},
 	}
 
 	for _, r := range ar {
-		if err := r.Resolve(resp, req); err != nil {
+		if err := ResolveContext(ctx, r, resp, req); err != nil {
 			return err
 		}
 
@@ -106,3 +121,58 @@ func (ar AlternateResolver) Close() error {
 func (ar AlternateResolver) String() string {
 	return fmt.Sprintf("AlternateResolver%s", []Resolver(ar))
 }
+
+// MeasuredResolver is a wrapper of Resolver for collect metrics of each resolver.
+type MeasuredResolver struct {
+	Name     string // Name of resolver for label of metrics, like "static" or "cache".
+	Resolver Resolver
+	Metrics  *Metrics
+}
+
+// NewMeasuredResolver is constructor of MeasuredResolver.
+func NewMeasuredResolver(name string, resolver Resolver, metrics *Metrics) MeasuredResolver {
+	return MeasuredResolver{
+		Name:     name,
+		Resolver: resolver,
+		Metrics:  metrics,
+	}
+}
+
+// Resolve is resolver using the wrapped resolver.
+func (mr MeasuredResolver) Resolve(w ResponseWriter, r Request) error {
+	return mr.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolver using the wrapped resolver with context.
+func (mr MeasuredResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) error {
+	answered := false
+	hook := ResponseWriterHook{
+		Writer: w,
+		OnAdd: func(Record) error {
+			answered = true
+			recordAnswerer(ctx, mr.Name)
+			return nil
+		},
+	}
+
+	start := time.Now()
+	err := ResolveContext(ctx, mr.Resolver, hook, r)
+	mr.Metrics.ResolverResult(mr.Name, r, time.Since(start), answered, err)
+
+	return err
+}
+
+// RecursionAvailable is returns same as the wrapped resolver.
+func (mr MeasuredResolver) RecursionAvailable() bool {
+	return mr.Resolver.RecursionAvailable()
+}
+
+// Close is close the wrapped resolver.
+func (mr MeasuredResolver) Close() error {
+	return mr.Resolver.Close()
+}
+
+// String is returns simple human readable string.
+func (mr MeasuredResolver) String() string {
+	return fmt.Sprintf("%s=%s", mr.Name, mr.Resolver)
+}
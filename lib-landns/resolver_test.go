@@ -1,6 +1,7 @@
 package landns_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -222,3 +223,77 @@ func BenchmarkAlternateResolver(b *testing.B) {
 
 	b.StopTimer()
 }
+
+func TestAlternateResolver_Rcode(t *testing.T) {
+	t.Parallel()
+
+	resolver := landns.AlternateResolver{
+		testutil.ResponseResolver{
+			Rcode:     dns.RcodeNameError,
+			Authority: []landns.Record{landns.NsRecord{Name: "example.com.", Target: "ns.example.com."}},
+		},
+		testutil.ResponseResolver{
+			Answer: []landns.Record{landns.AddressRecord{Name: "example.com.", TTL: 42, Address: net.ParseIP("127.1.1.1")}},
+		},
+	}
+
+	w := testutil.NewDummyResponseWriter()
+	if err := resolver.Resolve(w, landns.NewRequest("example.com.", dns.TypeA, false)); err != nil {
+		t.Fatalf("failed to resolve: %s", err)
+	}
+
+	if w.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %d but got %d", dns.RcodeNameError, w.Rcode)
+	}
+	if len(w.Records) != 0 {
+		t.Errorf("unexpected answer: %s", w.Records)
+	}
+	if len(w.Authority) != 1 {
+		t.Errorf("unexpected authority: %s", w.Authority)
+	}
+}
+
+func TestMeasuredResolver(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := testutil.StartMetricsServer(ctx, t, "landns")
+
+	resolver := landns.NewMeasuredResolver("static", landns.SimpleResolver{
+		dns.TypeA: {
+			"example.com.": {
+				landns.AddressRecord{Name: "example.com.", TTL: 42, Address: net.ParseIP("127.1.1.1")},
+			},
+		},
+	}, metrics.Metrics)
+	defer func() {
+		if err := resolver.Close(); err != nil {
+			t.Errorf("failed to close: %s", err)
+		}
+	}()
+
+	if s := resolver.String(); s != "static=SimpleResolver[1 domains 1 types 1 records]" {
+		t.Errorf(`unexpected resolver string: "%s"`, s)
+	}
+
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, false), true, "example.com. 42 IN A 127.1.1.1")
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, false), true, "example.com. 42 IN A 127.1.1.1")
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeMX, false), true)
+
+	errorResolver := landns.NewMeasuredResolver("forward", testutil.DummyResolver{Error: true, Recursion: true}, metrics.Metrics)
+	if err := errorResolver.Resolve(testutil.EmptyResponseWriter{}, landns.NewRequest("example.com.", dns.TypeA, true)); err == nil {
+		t.Errorf("expected returns error but got nil")
+	}
+	if !errorResolver.RecursionAvailable() {
+		t.Errorf("unexpected recursion available: expected true but got false")
+	}
+
+	m := metrics.Get(t)
+	m.Assert(t, "landns_resolver_count", testutil.MetricsLabels{"resolver": "static", "type": "A", "result": "answered"}, 2)
+	m.Assert(t, "landns_resolver_count", testutil.MetricsLabels{"resolver": "static", "type": "MX", "result": "empty"}, 1)
+	m.Assert(t, "landns_resolver_count", testutil.MetricsLabels{"resolver": "forward", "type": "A", "result": "error"}, 1)
+	m.Assert(t, "landns_resolver_duration_seconds_count", testutil.MetricsLabels{"resolver": "static"}, 3)
+	m.Assert(t, "landns_resolver_duration_seconds_count", testutil.MetricsLabels{"resolver": "forward"}, 1)
+}
@@ -114,12 +114,13 @@ func (d DynamicAPI) GetRecordByID(path, req, remote string) (string, *HTTPError)
 	return records.String(), nil
 }
 
-func (d DynamicAPI) GetRecordsBySuffix(path, req, remote string) (string, *HTTPError) {
-	if path[len(path)-1] == '/' {
+// parseSuffixPath is parse reversed path like "com/example" to Domain.
+func parseSuffixPath(path string) (Domain, *HTTPError) {
+	if len(path) == 0 || path[len(path)-1] == '/' {
 		return "", &HTTPError{http.StatusNotFound, "not found"}
 	}
 
-	items := strings.Split(path[len("/v1/suffix/"):], "/")
+	items := strings.Split(path, "/")
 	rev := make([]string, len(items))
 	for i := range items {
 		rev[i] = items[len(items)-1-i]
@@ -130,6 +131,15 @@ func (d DynamicAPI) GetRecordsBySuffix(path, req, remote string) (string, *HTTPE
 		return "", &HTTPError{http.StatusNotFound, "not found"}
 	}
 
+	return domain, nil
+}
+
+func (d DynamicAPI) GetRecordsBySuffix(path, req, remote string) (string, *HTTPError) {
+	domain, e := parseSuffixPath(path[len("/v1/suffix/"):])
+	if e != nil {
+		return "", e
+	}
+
 	records, err := d.Resolver.SearchRecords(domain)
 	if err != nil {
 		return "", &HTTPError{http.StatusInternalServerError, "internal server error"}
@@ -229,3 +239,145 @@ func (d DynamicAPI) Handler() http.Handler {
 
 	return mux
 }
+
+// CacheAPI is API request handler for inspect and flush caches.
+type CacheAPI struct {
+	Caches CacheSet
+}
+
+func (c CacheAPI) getEntries(match func(Domain) bool) (string, *HTTPError) {
+	entries, err := c.Caches.Entries()
+	if err != nil {
+		return "", &HTTPError{http.StatusInternalServerError, "internal server error"}
+	}
+
+	var lines []string
+	for _, e := range entries {
+		if match(e.Name) {
+			lines = append(lines, e.String())
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func flushResult(n int, err error) (string, *HTTPError) {
+	if err != nil {
+		return "", &HTTPError{http.StatusInternalServerError, "internal server error"}
+	}
+	return fmt.Sprintf("; 200: flush:%d", n), nil
+}
+
+func parseNamePath(path string) (Domain, *HTTPError) {
+	name := Domain(path)
+	if strings.Contains(path, "/") || name.Validate() != nil {
+		return "", &HTTPError{http.StatusNotFound, "not found"}
+	}
+	return name.Normalized(), nil
+}
+
+func (c CacheAPI) GetAllEntries(path, req, remote string) (string, *HTTPError) {
+	return c.getEntries(func(Domain) bool {
+		return true
+	})
+}
+
+func (c CacheAPI) GetEntriesByName(path, req, remote string) (string, *HTTPError) {
+	name, e := parseNamePath(path[len("/v1/cache/name/"):])
+	if e != nil {
+		return "", e
+	}
+
+	return c.getEntries(func(n Domain) bool {
+		return matchCacheName(n, name)
+	})
+}
+
+func (c CacheAPI) GetEntriesBySuffix(path, req, remote string) (string, *HTTPError) {
+	suffix, e := parseSuffixPath(path[len("/v1/cache/suffix/"):])
+	if e != nil {
+		return "", e
+	}
+
+	return c.getEntries(func(n Domain) bool {
+		return matchCacheSuffix(n, suffix)
+	})
+}
+
+func (c CacheAPI) FlushAll(path, req, remote string) (string, *HTTPError) {
+	return flushResult(c.Caches.FlushAll())
+}
+
+func (c CacheAPI) FlushByName(path, req, remote string) (string, *HTTPError) {
+	name, e := parseNamePath(path[len("/v1/cache/name/"):])
+	if e != nil {
+		return "", e
+	}
+
+	return flushResult(c.Caches.Flush(name))
+}
+
+func (c CacheAPI) FlushBySuffix(path, req, remote string) (string, *HTTPError) {
+	suffix, e := parseSuffixPath(path[len("/v1/cache/suffix/"):])
+	if e != nil {
+		return "", e
+	}
+
+	return flushResult(c.Caches.FlushSuffix(suffix))
+}
+
+func (c CacheAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/v1/cache", httpHandlerSet{
+		"GET":    httpHandler(c.GetAllEntries),
+		"DELETE": httpHandler(c.FlushAll),
+	})
+	mux.Handle("/v1/cache/name/", httpHandlerSet{
+		"GET":    httpHandler(c.GetEntriesByName),
+		"DELETE": httpHandler(c.FlushByName),
+	})
+	mux.Handle("/v1/cache/suffix/", httpHandlerSet{
+		"GET":    httpHandler(c.GetEntriesBySuffix),
+		"DELETE": httpHandler(c.FlushBySuffix),
+	})
+	mux.Handle("/", HTTPError{http.StatusNotFound, "not found"})
+
+	return mux
+}
+
+// StatusAPI is API request handler for show static zones and status of upstream servers.
+type StatusAPI struct {
+	Static     []StaticZone
+	Forwarders []ForwardResolver
+}
+
+func (s StatusAPI) GetStaticRecords(path, req, remote string) (string, *HTTPError) {
+	var lines []string
+	for _, sr := range s.Static {
+		for _, r := range sr.Records() {
+			lines = append(lines, r.String())
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s StatusAPI) GetUpstreamStatus(path, req, remote string) (string, *HTTPError) {
+	var lines []string
+	for _, fr := range s.Forwarders {
+		for _, st := range fr.Status() {
+			lines = append(lines, st.String())
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s StatusAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/v1/static", httpHandlerSet{"GET": httpHandler(s.GetStaticRecords)})
+	mux.Handle("/v1/upstream", httpHandlerSet{"GET": httpHandler(s.GetUpstreamStatus)})
+	mux.Handle("/", HTTPError{http.StatusNotFound, "not found"})
+
+	return mux
+}
@@ -2,12 +2,15 @@ package landns_test
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/macrat/landns/lib-landns"
 	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
 )
 
 func TestDynamicAPI(t *testing.T) {
@@ -148,3 +151,149 @@ func TestDynamicAPI(t *testing.T) {
 		{"DELETE", "/v1/id/hello", "", 404, "; 404: not found\n"},
 	}))
 }
+
+func TestCacheAPI(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := testutil.NewFakeClock()
+
+	positive := landns.NewLocalCache(CacheTestUpstream(t), landns.NewMetrics("landns"))
+	positive.Clock = clock
+	positive.StaleTTL = time.Minute
+	defer positive.Close()
+
+	negative := landns.NewLocalCache(&NegativeCacheTestUpstream{}, landns.NewMetrics("landns"))
+	negative.Clock = clock
+	defer negative.Close()
+
+	for _, req := range []landns.Request{
+		landns.NewRequest("example.com.", dns.TypeA, false),
+		landns.NewRequest("example.com.", dns.TypeTXT, false),
+		landns.NewRequest("short.example.com.", dns.TypeA, false),
+	} {
+		if err := positive.Resolve(testutil.NewDummyResponseWriter(), req); err != nil {
+			t.Fatalf("failed to resolve: %s", err)
+		}
+	}
+	if err := negative.Resolve(testutil.NewDummyResponseWriter(), landns.NewRequest("nxdomain.example.com.", dns.TypeA, false)); err != nil {
+		t.Fatalf("failed to resolve: %s", err)
+	}
+
+	srv := testutil.StartHTTPServer(ctx, t, landns.CacheAPI{landns.CacheSet{positive, negative}}.Handler())
+
+	srv.Do(t, "GET", "/v1/cache", "").Assert(t, http.StatusOK, strings.Join([]string{
+		"short.example.com. 2 IN A 127.3.4.5",
+		"short.example.com. 2 IN A 127.4.5.6",
+		"example.com. 100 IN TXT \"hello world\"",
+		"example.com. 10 IN A 127.1.2.3",
+		"example.com. 10 IN A 127.2.3.4",
+		"; NXDOMAIN nxdomain.example.com. ; TTL:1",
+		"",
+	}, "\n"))
+	srv.Do(t, "GET", "/v1/cache/name/example.com", "").Assert(t, http.StatusOK, strings.Join([]string{
+		"example.com. 100 IN TXT \"hello world\"",
+		"example.com. 10 IN A 127.1.2.3",
+		"example.com. 10 IN A 127.2.3.4",
+		"",
+	}, "\n"))
+	srv.Do(t, "GET", "/v1/cache/suffix/com/example/nxdomain", "").Assert(t, http.StatusOK, "; NXDOMAIN nxdomain.example.com. ; TTL:1\n")
+
+	srv.Do(t, "DELETE", "/v1/cache/name/nxdomain.example.com", "").Assert(t, http.StatusOK, "; 200: flush:1\n")
+	srv.Do(t, "GET", "/v1/cache/suffix/com/example/nxdomain", "").Assert(t, http.StatusOK, "")
+
+	clock.Add(3 * time.Second)
+	srv.Do(t, "GET", "/v1/cache/name/short.example.com", "").Assert(t, http.StatusOK, strings.Join([]string{
+		"short.example.com. 0 IN A 127.3.4.5 ; Stale",
+		"short.example.com. 0 IN A 127.4.5.6 ; Stale",
+		"",
+	}, "\n"))
+	srv.Do(t, "GET", "/v1/cache/name/example.com", "").Assert(t, http.StatusOK, strings.Join([]string{
+		"example.com. 97 IN TXT \"hello world\"",
+		"example.com. 7 IN A 127.1.2.3",
+		"example.com. 7 IN A 127.2.3.4",
+		"",
+	}, "\n"))
+
+	srv.Do(t, "DELETE", "/v1/cache/suffix/com/example", "").Assert(t, http.StatusOK, "; 200: flush:3\n")
+	srv.Do(t, "GET", "/v1/cache", "").Assert(t, http.StatusOK, "")
+	srv.Do(t, "DELETE", "/v1/cache", "").Assert(t, http.StatusOK, "; 200: flush:0\n")
+
+	AssertResolve(t, positive, landns.NewRequest("example.com.", dns.TypeA, false), true, "example.com. 100 IN A 127.1.2.3", "example.com. 10 IN A 127.2.3.4")
+	srv.Do(t, "DELETE", "/v1/cache", "").Assert(t, http.StatusOK, "; 200: flush:1\n")
+
+	srv.Do(t, "GET", "/v1/cache/name/", "").Assert(t, http.StatusNotFound, "; 404: not found\n")
+	srv.Do(t, "GET", "/v1/cache/suffix/com/", "").Assert(t, http.StatusNotFound, "; 404: not found\n")
+	srv.Do(t, "GET", "/v1/cache/other", "").Assert(t, http.StatusNotFound, "; 404: not found\n")
+	srv.Do(t, "POST", "/v1/cache", "").Assert(t, http.StatusMethodNotAllowed, "; 405: method not allowed\n")
+}
+
+func TestStatusAPI(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	static := []landns.StaticZone{
+		landns.NewSimpleResolver([]landns.Record{
+			landns.TxtRecord{Name: "b.example.com.", TTL: 10, Text: "hello"},
+			landns.AddressRecord{Name: "b.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.2")},
+			landns.AddressRecord{Name: "a.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")},
+		}),
+		landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "c.example.com.", TTL: 20, Address: net.ParseIP("127.0.0.3")},
+		}),
+	}
+
+	forwarder := landns.NewForwardResolverWithUpstreams([]landns.Upstream{
+		{Protocol: landns.ProtocolUDP, Address: "127.0.0.1:53"},
+		{Protocol: landns.ProtocolTLS, Address: "127.0.0.1:853"},
+	}, time.Second, landns.NewMetrics("landns"))
+	defer forwarder.Close()
+
+	srv := testutil.StartHTTPServer(ctx, t, landns.StatusAPI{static, []landns.ForwardResolver{forwarder}}.Handler())
+
+	srv.Do(t, "GET", "/v1/static", "").Assert(t, http.StatusOK, strings.Join([]string{
+		"a.example.com. 10 IN A 127.0.0.1",
+		"b.example.com. 10 IN A 127.0.0.2",
+		"b.example.com. 10 IN TXT \"hello\"",
+		"c.example.com. 20 IN A 127.0.0.3",
+		"",
+	}, "\n"))
+
+	srv.Do(t, "GET", "/v1/upstream", "").Assert(t, http.StatusOK, strings.Join([]string{
+		"127.0.0.1:53 ; up fails:0 rtt:0s",
+		"tls://127.0.0.1:853 ; up fails:0 rtt:0s",
+		"",
+	}, "\n"))
+
+	srv.Do(t, "POST", "/v1/static", "").Assert(t, http.StatusMethodNotAllowed, "; 405: method not allowed\n")
+	srv.Do(t, "GET", "/v1/other", "").Assert(t, http.StatusNotFound, "; 404: not found\n")
+
+	empty := testutil.StartHTTPServer(ctx, t, landns.StatusAPI{}.Handler())
+	empty.Do(t, "GET", "/v1/static", "").Assert(t, http.StatusOK, "")
+	empty.Do(t, "GET", "/v1/upstream", "").Assert(t, http.StatusOK, "")
+}
+
+func TestAdminUI(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testutil.StartHTTPServer(ctx, t, landns.AdminUI{})
+
+	resp := srv.Do(t, "GET", "/ui/", "")
+	if resp.Status != http.StatusOK {
+		t.Errorf("unexpected status code: %d", resp.Status)
+	}
+	for _, path := range []string{`"/api/v1" + path`, `"/static"`, `"/upstream"`, `"/cache"`, `"/suffix/"`, `"/glob/"`, `"/id/"`} {
+		if !strings.Contains(resp.Body, path) {
+			t.Errorf("UI doesn't use API %s", path)
+		}
+	}
+
+	srv.Do(t, "POST", "/ui/", "").Assert(t, http.StatusMethodNotAllowed, "; 405: method not allowed\n")
+}
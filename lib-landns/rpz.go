@@ -0,0 +1,564 @@
+package landns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultRPZInterval is the default interval to check update of response policy zones.
+	DefaultRPZInterval = 30 * time.Second
+
+	// DefaultRPZTimeout is the default timeout for zone transfer of response policy zones.
+	DefaultRPZTimeout = 5 * time.Second
+)
+
+// RPZAction is the action of response policy.
+type RPZAction uint8
+
+const (
+	// RPZNXDomain is response NXDOMAIN. It is made by "CNAME ." in zone.
+	RPZNXDomain RPZAction = iota
+
+	// RPZNoData is response empty answer. It is made by "CNAME *." in zone.
+	RPZNoData
+
+	// RPZPassthru is response without rewrite, and stop evaluating other policies. It is made by "CNAME rpz-passthru." in zone.
+	RPZPassthru
+
+	// RPZDrop is not response anything. It is made by "CNAME rpz-drop." in zone.
+	RPZDrop
+
+	// RPZTCPOnly is response truncated message for UDP to force client to retry with TCP. It is made by "CNAME rpz-tcp-only." in zone.
+	RPZTCPOnly
+
+	// RPZLocalData is response records in zone instead of resolved records, like "A 10.0.0.1" or "CNAME walled-garden.example.com.".
+	RPZLocalData
+)
+
+// String is converter to human readable string.
+func (a RPZAction) String() string {
+	switch a {
+	case RPZNXDomain:
+		return "nxdomain"
+	case RPZNoData:
+		return "nodata"
+	case RPZPassthru:
+		return "passthru"
+	case RPZDrop:
+		return "drop"
+	case RPZTCPOnly:
+		return "tcp-only"
+	case RPZLocalData:
+		return "local-data"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText is make bytes text.
+func (a RPZAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// RPZSource is the source of records of response policy zone.
+type RPZSource interface {
+	// Version is get string that changes when the zone updated, like serial of SOA record.
+	Version(ctx context.Context) (string, error)
+
+	// Records is get all records in the zone including SOA record.
+	Records(ctx context.Context) ([]dns.RR, error)
+}
+
+// ParseRPZSource is parse source of response policy zone.
+//
+// Source can be path to zone file like "/etc/landns/rpz.zone", or URL for zone transfer from primary server like "axfr://127.0.0.1:53/rpz.example.".
+func ParseRPZSource(source string) (RPZSource, error) {
+	if !strings.HasPrefix(source, "axfr://") {
+		return RPZFile{Path: source}, nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, newError(TypeArgumentError, err, "invalid RPZ source: %s", source)
+	}
+
+	var zone Domain
+	if err := zone.UnmarshalText([]byte(strings.Trim(u.Path, "/"))); err != nil || zone == "." {
+		return nil, newError(TypeArgumentError, err, "invalid RPZ source: %s", source)
+	}
+
+	server := u.Host
+	if u.Port() == "" {
+		server = net.JoinHostPort(u.Hostname(), "53")
+	}
+
+	return RPZTransfer{Server: server, Zone: zone.Normalized(), Timeout: DefaultRPZTimeout}, nil
+}
+
+// RPZFile is the RPZSource of zone file.
+type RPZFile struct {
+	Path   string
+	Origin Domain // Origin for relative names. It is not required if zone file has $ORIGIN or names are absolute.
+}
+
+// String is returns simple human readable string.
+func (f RPZFile) String() string {
+	return f.Path
+}
+
+// Version is get stamp from modified time and size of the file.
+func (f RPZFile) Version(ctx context.Context) (string, error) {
+	_, stamp, err := listFiles("RPZ", []string{f.Path})
+	return stamp, err
+}
+
+// Records is read all records from the zone file.
+func (f RPZFile) Records(ctx context.Context) ([]dns.RR, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to read RPZ file"}
+	}
+	defer file.Close()
+
+	origin := ""
+	if f.Origin != "" {
+		origin = f.Origin.Normalized().String()
+	}
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(file, origin, f.Path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, Error{TypeArgumentError, err, "failed to parse RPZ file"}
+	}
+	return rrs, nil
+}
+
+// RPZTransfer is the RPZSource that transfers zone from primary server by AXFR.
+type RPZTransfer struct {
+	Server  string        // Address of primary server like "127.0.0.1:53".
+	Zone    Domain        // Name of the zone.
+	Timeout time.Duration // Timeout for each query and transfer.
+}
+
+// String is returns simple human readable string.
+func (t RPZTransfer) String() string {
+	return fmt.Sprintf("axfr://%s/%s", t.Server, t.Zone)
+}
+
+// Version is get serial of SOA record from primary server.
+func (t RPZTransfer) Version(ctx context.Context) (string, error) {
+	client := &dns.Client{Net: "tcp", Timeout: t.Timeout}
+
+	in, _, err := client.ExchangeContext(ctx, new(dns.Msg).SetQuestion(t.Zone.String(), dns.TypeSOA), t.Server)
+	if err != nil {
+		return "", Error{TypeExternalError, err, "failed to get SOA of RPZ"}
+	}
+	for _, rr := range in.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, t.Zone.String()) {
+			return strconv.FormatUint(uint64(soa.Serial), 10), nil
+		}
+	}
+	return "", newError(TypeExternalError, nil, "failed to get SOA of RPZ: %s", dns.RcodeToString[in.Rcode])
+}
+
+// Records is transfer all records from primary server.
+func (t RPZTransfer) Records(ctx context.Context) ([]dns.RR, error) {
+	tr := &dns.Transfer{DialTimeout: t.Timeout, ReadTimeout: t.Timeout}
+
+	ch, err := tr.In(new(dns.Msg).SetAxfr(t.Zone.String()), t.Server)
+	if err != nil {
+		return nil, Error{TypeExternalError, err, "failed to transfer RPZ"}
+	}
+
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return nil, Error{TypeExternalError, env.Error, "failed to transfer RPZ"}
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	// The SOA record appears at both of the first and the last of AXFR.
+	if len(rrs) > 1 && rrs[len(rrs)-1].Header().Rrtype == dns.TypeSOA {
+		rrs = rrs[:len(rrs)-1]
+	}
+	return rrs, nil
+}
+
+// RPZHit is the result of matching response policy.
+type RPZHit struct {
+	Zone    Domain    // Name of the matched response policy zone.
+	Trigger string    // Kind of trigger that matched, "qname" or "response-ip".
+	Rule    string    // The matched rule like "*.ads.example.com." or "192.168.0.0/16".
+	Name    string    // The name to be rewritten. It is the query name or the target of CNAME in the answer.
+	Action  RPZAction // Action of the policy.
+	Records []dns.RR  // Records for RPZLocalData. Owner names are names in the zone, so have to be replaced with Name.
+}
+
+type rpzRule struct {
+	name    string
+	action  RPZAction
+	records []dns.RR
+}
+
+type rpzIPRule struct {
+	network *net.IPNet
+	rule    *rpzRule
+}
+
+// rpzRules is parsed rules of response policy zone.
+type rpzRules struct {
+	exact    map[string]*rpzRule
+	wildcard map[string]*rpzRule // Rules like "*.example.com." that keyed by "example.com.".
+	ips      []rpzIPRule
+}
+
+// parseRPZIP is parse owner name of response IP trigger like "32.1.0.168.192" or "128.1.zz.db8.2001" without ".rpz-ip" suffix.
+func parseRPZIP(s string) (*net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, newError(TypeArgumentError, nil, "invalid rpz-ip trigger: %s", s)
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, newError(TypeArgumentError, nil, "invalid rpz-ip trigger: %s", s)
+	}
+
+	parts := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i >= 1; i-- {
+		parts = append(parts, labels[i])
+	}
+
+	var addr string
+	bits := 32
+	if len(parts) == 4 && !strings.Contains(s, "zz") && net.ParseIP(strings.Join(parts, ".")) != nil {
+		addr = strings.Join(parts, ".")
+	} else {
+		bits = 128
+		addr = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(addr, ":") {
+			addr = ":" + addr
+		}
+		if strings.HasSuffix(addr, ":") {
+			addr += ":"
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || prefix < 1 || prefix > bits {
+		return nil, newError(TypeArgumentError, nil, "invalid rpz-ip trigger: %s", s)
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	}
+
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}, nil
+}
+
+// rpzActionOf is get action of the record in response policy zone.
+func rpzActionOf(rr dns.RR) RPZAction {
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		return RPZLocalData
+	}
+
+	switch strings.ToLower(cname.Target) {
+	case ".":
+		return RPZNXDomain
+	case "*.":
+		return RPZNoData
+	case "rpz-passthru.":
+		return RPZPassthru
+	case "rpz-drop.":
+		return RPZDrop
+	case "rpz-tcp-only.":
+		return RPZTCPOnly
+	default:
+		return RPZLocalData
+	}
+}
+
+// parseRPZ is parse records of response policy zone. The zone name is taken from SOA record.
+//
+// Triggers of QNAME and response IP ("rpz-ip") are supported. Other triggers like "rpz-nsdname" are ignored.
+func parseRPZ(rrs []dns.RR) (Domain, rpzRules, error) {
+	rules := rpzRules{
+		exact:    make(map[string]*rpzRule),
+		wildcard: make(map[string]*rpzRule),
+	}
+
+	var zone string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			zone = strings.ToLower(rr.Header().Name)
+			break
+		}
+	}
+	if zone == "" {
+		return "", rules, newError(TypeArgumentError, nil, "no SOA record in RPZ")
+	}
+
+	ipRules := make(map[string]*rpzRule)
+
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if name == zone {
+			continue
+		}
+		if !strings.HasSuffix(name, "."+zone) {
+			logger.Debug("skip record out of RPZ", logger.Fields{"zone": zone, "name": name})
+			continue
+		}
+		trigger := strings.TrimSuffix(name, "."+zone)
+
+		var r *rpzRule
+
+		switch {
+		case strings.HasSuffix(trigger, ".rpz-ip"):
+			network, err := parseRPZIP(strings.TrimSuffix(trigger, ".rpz-ip"))
+			if err != nil {
+				return "", rules, err
+			}
+			key := network.String()
+			r = ipRules[key]
+			if r == nil {
+				r = &rpzRule{name: key, action: RPZLocalData}
+				ipRules[key] = r
+				rules.ips = append(rules.ips, rpzIPRule{network, r})
+			}
+		case strings.HasSuffix(trigger, ".rpz-nsdname"), strings.HasSuffix(trigger, ".rpz-nsip"), strings.HasSuffix(trigger, ".rpz-client-ip"):
+			logger.Debug("skip unsupported RPZ trigger", logger.Fields{"zone": zone, "name": name})
+			continue
+		case strings.HasPrefix(trigger, "*."):
+			key := strings.TrimPrefix(trigger, "*.") + "."
+			r = rules.wildcard[key]
+			if r == nil {
+				r = &rpzRule{name: trigger + ".", action: RPZLocalData}
+				rules.wildcard[key] = r
+			}
+		default:
+			key := trigger + "."
+			r = rules.exact[key]
+			if r == nil {
+				r = &rpzRule{name: key, action: RPZLocalData}
+				rules.exact[key] = r
+			}
+		}
+
+		if action := rpzActionOf(rr); action != RPZLocalData {
+			r.action = action
+		} else if r.action == RPZLocalData {
+			r.records = append(r.records, rr)
+		}
+	}
+
+	return Domain(zone), rules, nil
+}
+
+// matchName is find rule for the name. Exact rule is preferred, and then the closest wildcard rule.
+func (rs rpzRules) matchName(name string) *rpzRule {
+	if r, ok := rs.exact[name]; ok {
+		return r
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+		if r, ok := rs.wildcard[name]; ok {
+			return r
+		}
+	}
+}
+
+// matchIP is find rule for the address. The longest prefix is preferred.
+func (rs rpzRules) matchIP(ip net.IP) *rpzRule {
+	var found *rpzRule
+	longest := -1
+
+	for _, r := range rs.ips {
+		if !r.network.Contains(ip) {
+			continue
+		}
+		if size, _ := r.network.Mask.Size(); size > longest {
+			found = r.rule
+			longest = size
+		}
+	}
+	return found
+}
+
+// RPZ is the response policy zone, that reloads when the source updated.
+type RPZ struct {
+	Source   RPZSource
+	Interval time.Duration // Interval to check update of the zone.
+	Clock    Clock         // Source of current time.
+
+	mutex   sync.RWMutex
+	zone    Domain
+	rules   rpzRules
+	watcher fileWatcher
+}
+
+// NewRPZ is constructor of RPZ. Nothing is matched until Reload or Start called.
+func NewRPZ(source RPZSource) *RPZ {
+	return &RPZ{
+		Source:   source,
+		Interval: DefaultRPZInterval,
+		Clock:    DefaultClock,
+	}
+}
+
+// String is returns simple human readable string.
+func (z *RPZ) String() string {
+	return fmt.Sprintf("RPZ[%s]", z.Source)
+}
+
+// Zone is getter of name of the zone. It is empty until loaded.
+func (z *RPZ) Zone() Domain {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	return z.zone
+}
+
+// Reload is read the zone from source and replace rules. Rules are kept if failed to read.
+func (z *RPZ) Reload() error {
+	ctx := context.Background()
+
+	version, err := z.Source.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	rrs, err := z.Source.Records(ctx)
+	if err != nil {
+		return err
+	}
+
+	zone, rules, err := parseRPZ(rrs)
+	if err != nil {
+		return err
+	}
+
+	z.mutex.Lock()
+	z.zone = zone
+	z.rules = rules
+	z.mutex.Unlock()
+
+	z.watcher.loaded(version)
+	return nil
+}
+
+// version is get the current version of the zone.
+func (z *RPZ) version() (string, error) {
+	return z.Source.Version(context.Background())
+}
+
+// Start is read the zone and start watching update in background.
+func (z *RPZ) Start() error {
+	if err := z.Reload(); err != nil {
+		return err
+	}
+
+	z.watcher.start(z.Clock, z.Interval, "RPZ", logger.Fields{"source": z.Source}, z.version, z.Reload)
+	return nil
+}
+
+// Close is stop watching update of the zone.
+func (z *RPZ) Close() error {
+	z.watcher.stop()
+	return nil
+}
+
+func (z *RPZ) hit(trigger, name string, r *rpzRule) RPZHit {
+	return RPZHit{
+		Zone:    z.zone,
+		Trigger: trigger,
+		Rule:    r.name,
+		Name:    name,
+		Action:  r.action,
+		Records: r.records,
+	}
+}
+
+// Match is find policy for the response message.
+//
+// QNAME triggers are checked with the query name and targets of CNAME records in the answer, and then response IP triggers are checked with A and AAAA records in the answer.
+func (z *RPZ) Match(msg *dns.Msg) (RPZHit, bool) {
+	if len(msg.Question) == 0 {
+		return RPZHit{}, false
+	}
+	qname := strings.ToLower(msg.Question[0].Name)
+
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	names := []string{qname}
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			names = append(names, strings.ToLower(cname.Target))
+		}
+	}
+	for _, name := range names {
+		if r := z.rules.matchName(name); r != nil {
+			return z.hit("qname", name, r), true
+		}
+	}
+
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch x := rr.(type) {
+		case *dns.A:
+			ip = x.A
+		case *dns.AAAA:
+			ip = x.AAAA
+		default:
+			continue
+		}
+		if r := z.rules.matchIP(ip); r != nil {
+			return z.hit("response-ip", qname, r), true
+		}
+	}
+
+	return RPZHit{}, false
+}
+
+// RPZSet is list of response policy zones. Zones are evaluated in order, and the first matched policy is used.
+type RPZSet []*RPZ
+
+// Match is find policy for the response message from zones.
+func (rs RPZSet) Match(msg *dns.Msg) (RPZHit, bool) {
+	for _, z := range rs {
+		if hit, ok := z.Match(msg); ok {
+			return hit, true
+		}
+	}
+	return RPZHit{}, false
+}
+
+// Close is stop watching update of all zones.
+func (rs RPZSet) Close() error {
+	for _, z := range rs {
+		if err := z.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package landns_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+const rpzZone = `
+$ORIGIN rpz.example.
+$TTL 60
+@ IN SOA localhost. admin.localhost. 1 3600 600 86400 60
+@ IN NS localhost.
+
+nxdomain.example.com      CNAME .
+nodata.example.com        CNAME *.
+*.wildcard.example.com    CNAME .
+good.wildcard.example.com CNAME rpz-passthru.
+drop.example.com          CNAME rpz-drop.
+tcp.example.com           CNAME rpz-tcp-only.
+garden.example.com        A     10.0.0.1
+garden.example.com        AAAA  fd00::1
+redirect.example.com      CNAME walled.lan.
+
+24.0.0.0.198.rpz-ip       CNAME .
+32.1.0.0.198.rpz-ip       A     10.0.0.2
+128.1.zz.db8.2001.rpz-ip  CNAME *.
+ns.example.com.rpz-nsdname CNAME .
+`
+
+func writeRPZ(t *testing.T, content string) (path string, closer func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "landns-rpz")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err)
+	}
+
+	path = filepath.Join(dir, "rpz.zone")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write zone: %s", err)
+	}
+	return path, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseRPZSource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Source string
+		Expect string
+	}{
+		{"/etc/landns/rpz.zone", "/etc/landns/rpz.zone"},
+		{"axfr://127.0.0.1/rpz.example", "axfr://127.0.0.1:53/rpz.example."},
+		{"axfr://127.0.0.1:5353/rpz.example.", "axfr://127.0.0.1:5353/rpz.example."},
+	}
+
+	for _, tt := range tests {
+		s, err := landns.ParseRPZSource(tt.Source)
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", tt.Source, err)
+			continue
+		}
+		if got := s.(interface{ String() string }).String(); got != tt.Expect {
+			t.Errorf("%s: unexpected source: %s", tt.Source, got)
+		}
+	}
+
+	if _, err := landns.ParseRPZSource("axfr://127.0.0.1/"); err == nil || err.Error() != "invalid RPZ source: axfr://127.0.0.1/" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func makeResponse(name string, qtype uint16, answer ...string) *dns.Msg {
+	msg := new(dns.Msg).SetQuestion(name, qtype)
+	for _, a := range answer {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			panic(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return msg
+}
+
+func TestRPZ_Match(t *testing.T) {
+	t.Parallel()
+
+	path, closer := writeRPZ(t, rpzZone)
+	defer closer()
+
+	rpz := landns.NewRPZ(landns.RPZFile{Path: path})
+	if err := rpz.Reload(); err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if rpz.Zone() != "rpz.example." {
+		t.Errorf("unexpected zone: %s", rpz.Zone())
+	}
+
+	tests := []struct {
+		Msg     *dns.Msg
+		Trigger string
+		Rule    string
+		Name    string
+		Action  landns.RPZAction
+		Records int
+	}{
+		{makeResponse("nxdomain.example.com.", dns.TypeA), "qname", "nxdomain.example.com.", "nxdomain.example.com.", landns.RPZNXDomain, 0},
+		{makeResponse("NoData.Example.com.", dns.TypeA), "qname", "nodata.example.com.", "nodata.example.com.", landns.RPZNoData, 0},
+		{makeResponse("a.wildcard.example.com.", dns.TypeA), "qname", "*.wildcard.example.com.", "a.wildcard.example.com.", landns.RPZNXDomain, 0},
+		{makeResponse("good.wildcard.example.com.", dns.TypeA), "qname", "good.wildcard.example.com.", "good.wildcard.example.com.", landns.RPZPassthru, 0},
+		{makeResponse("drop.example.com.", dns.TypeA), "qname", "drop.example.com.", "drop.example.com.", landns.RPZDrop, 0},
+		{makeResponse("tcp.example.com.", dns.TypeA), "qname", "tcp.example.com.", "tcp.example.com.", landns.RPZTCPOnly, 0},
+		{makeResponse("garden.example.com.", dns.TypeA), "qname", "garden.example.com.", "garden.example.com.", landns.RPZLocalData, 2},
+		{makeResponse("alias.example.com.", dns.TypeA, "alias.example.com. 60 IN CNAME drop.example.com."), "qname", "drop.example.com.", "drop.example.com.", landns.RPZDrop, 0},
+		{makeResponse("www.example.com.", dns.TypeA, "www.example.com. 60 IN A 198.0.0.5"), "response-ip", "198.0.0.0/24", "www.example.com.", landns.RPZNXDomain, 0},
+		{makeResponse("www.example.com.", dns.TypeA, "www.example.com. 60 IN A 198.0.0.1"), "response-ip", "198.0.0.1/32", "www.example.com.", landns.RPZLocalData, 1},
+		{makeResponse("www.example.com.", dns.TypeAAAA, "www.example.com. 60 IN AAAA 2001:db8::1"), "response-ip", "2001:db8::1/128", "www.example.com.", landns.RPZNoData, 0},
+	}
+
+	for _, tt := range tests {
+		hit, ok := landns.RPZSet{rpz}.Match(tt.Msg)
+		name := tt.Msg.Question[0].Name
+		if !ok {
+			t.Errorf("%s: expected match but not", name)
+			continue
+		}
+		if hit.Zone != "rpz.example." || hit.Trigger != tt.Trigger || hit.Rule != tt.Rule || hit.Name != tt.Name || hit.Action != tt.Action || len(hit.Records) != tt.Records {
+			t.Errorf("%s: unexpected hit: %#v", name, hit)
+		}
+	}
+
+	for _, msg := range []*dns.Msg{
+		makeResponse("wildcard.example.com.", dns.TypeA),
+		makeResponse("ns.example.com.", dns.TypeA),
+		makeResponse("www.example.com.", dns.TypeA, "www.example.com. 60 IN A 198.0.1.1"),
+	} {
+		if hit, ok := rpz.Match(msg); ok {
+			t.Errorf("%s: expected not match but got: %#v", msg.Question[0].Name, hit)
+		}
+	}
+
+	// Rules are kept if failed to reload.
+	if err := ioutil.WriteFile(path, []byte("example.com. 60 IN A 127.0.0.1\n"), 0644); err != nil {
+		t.Fatalf("failed to write zone: %s", err)
+	}
+	if err := rpz.Reload(); err == nil || err.Error() != "no SOA record in RPZ" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := rpz.Match(makeResponse("nxdomain.example.com.", dns.TypeA)); !ok {
+		t.Errorf("rules were lost")
+	}
+
+	if err := landns.NewRPZ(landns.RPZFile{Path: filepath.Join(filepath.Dir(path), "not-exists")}).Start(); err == nil || !strings.HasPrefix(err.Error(), "failed to read RPZ file: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRPZ_Reload(t *testing.T) {
+	t.Parallel()
+
+	path, closer := writeRPZ(t, "@ 60 IN SOA localhost. admin.localhost. 1 3600 600 86400 60\n")
+	defer closer()
+
+	clock := testutil.NewFakeClock()
+	rpz := landns.NewRPZ(landns.RPZFile{Path: path, Origin: "rpz.example"})
+	rpz.Clock = clock
+	if err := rpz.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer rpz.Close()
+
+	msg := makeResponse("ads.example.com.", dns.TypeA)
+	if _, ok := rpz.Match(msg); ok {
+		t.Fatalf("unexpected initial state")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("@ 60 IN SOA localhost. admin.localhost. 2 3600 600 86400 60\nads.example.com 60 IN CNAME .\n"), 0644); err != nil {
+		t.Fatalf("failed to write zone: %s", err)
+	}
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Add(landns.DefaultRPZInterval)
+
+	for i := 0; i < 100; i++ {
+		if _, ok := rpz.Match(msg); ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("RPZ was not reloaded")
+}
+
+func TestRPZTransfer(t *testing.T) {
+	t.Parallel()
+
+	var zone []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(rpzZone), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		zone = append(zone, rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("failed to parse zone: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "rpz.example." {
+			w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+			return
+		}
+
+		switch r.Question[0].Qtype {
+		case dns.TypeAXFR:
+			ch := make(chan *dns.Envelope, 1)
+			go func() {
+				ch <- &dns.Envelope{RR: append(append([]dns.RR{}, zone...), zone[0])}
+				close(ch)
+			}()
+			new(dns.Transfer).Out(w, r, ch)
+		case dns.TypeSOA:
+			msg := new(dns.Msg).SetReply(r)
+			msg.Answer = zone[:1]
+			w.WriteMsg(msg)
+		default:
+			w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+		}
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	source := landns.RPZTransfer{Server: listener.Addr().String(), Zone: "rpz.example.", Timeout: time.Second}
+
+	version, err := source.Version(context.Background())
+	if err != nil || version != "1" {
+		t.Errorf("unexpected version: %q: %v", version, err)
+	}
+
+	rpz := landns.NewRPZ(source)
+	if err := rpz.Reload(); err != nil {
+		t.Fatalf("failed to transfer: %s", err)
+	}
+	if hit, ok := rpz.Match(makeResponse("garden.example.com.", dns.TypeA)); !ok || hit.Action != landns.RPZLocalData {
+		t.Errorf("unexpected hit: %#v", hit)
+	}
+
+	if _, err := (landns.RPZTransfer{Server: listener.Addr().String(), Zone: "other.example.", Timeout: time.Second}).Version(context.Background()); err == nil || err.Error() != "failed to get SOA of RPZ: REFUSED" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
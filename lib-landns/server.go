@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"time"
 
 	"github.com/macrat/landns/lib-landns/logger/httplog"
 	"github.com/miekg/dns"
@@ -13,11 +14,20 @@ import (
 
 // Server is the Landns server instance.
 type Server struct {
-	Name            string
-	Metrics         *Metrics
-	DynamicResolver DynamicResolver
-	Resolvers       Resolver // Resolvers for this server. Must include DynamicResolver.
-	DebugMode       bool
+	Name              string
+	Metrics           *Metrics
+	DynamicResolver   DynamicResolver
+	Resolvers         Resolver          // Resolvers for this server. Must include DynamicResolver.
+	Views             ViewSet           // Views for split-horizon. Resolvers will used if no view matched.
+	Caches            CacheSet          // Caches for inspection and flush API. API is disabled if empty.
+	StaticZones       []StaticZone      // Static zones for read-only API.
+	Forwarders        []ForwardResolver // Forwarders for upstream status API.
+	QueryTimeout      time.Duration     // Timeout for resolving each DNS message. 0 means unlimited.
+	QueryLog          *QueryLogger      // Logger for record each DNS message. Query log is disabled if nil.
+	Policy            RPZSet            // Response policy zones that applied to DNS responses. Nothing is applied if empty.
+	Signer            *DNSSECSigner     // Signer for DNSSEC. DNS responses are not signed if nil.
+	TrustedForwarders []*net.IPNet      // Networks of forwarders that allowed to tell client address by EDNS Client Subnet option. The option is ignored if empty.
+	DebugMode         bool
 }
 
 // HTTPHandler is getter of http.Handler.
@@ -31,11 +41,11 @@ func (s *Server) HTTPHandler() (http.Handler, error) {
 
 	if !s.DebugMode {
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			fmt.Fprintf(w, "<h1>%s</h1><a href=\"/metrics\">metrics</a> <a href=\"/api/v1\">records</a>\n", serverName)
+			fmt.Fprintf(w, "<h1>%s</h1><a href=\"/ui/\">admin</a> <a href=\"/metrics\">metrics</a> <a href=\"/api/v1\">records</a>\n", serverName)
 		})
 	} else {
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			fmt.Fprintf(w, "<h1>%s</h1><a href=\"/metrics\">metrics</a> <a href=\"/debug/pprof/\">pprof</a> <a href=\"/api/v1\">records</a>\n", serverName)
+			fmt.Fprintf(w, "<h1>%s</h1><a href=\"/ui/\">admin</a> <a href=\"/metrics\">metrics</a> <a href=\"/debug/pprof/\">pprof</a> <a href=\"/api/v1\">records</a>\n", serverName)
 		})
 
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -55,15 +65,40 @@ func (s *Server) HTTPHandler() (http.Handler, error) {
 
 	mux.Handle("/metrics", metrics)
 	if s.DynamicResolver != nil {
-		mux.Handle("/api/", http.StripPrefix("/api", DynamicAPI{s.DynamicResolver}.Handler()))
+		mux.Handle("/api/", http.StripPrefix("/api", tracingHandler{"DynamicAPI", DynamicAPI{s.DynamicResolver}.Handler()}))
 	}
+	if len(s.Caches) > 0 {
+		cache := http.StripPrefix("/api", tracingHandler{"CacheAPI", CacheAPI{s.Caches}.Handler()})
+		mux.Handle("/api/v1/cache", cache)
+		mux.Handle("/api/v1/cache/", cache)
+	}
+
+	status := http.StripPrefix("/api", tracingHandler{"StatusAPI", StatusAPI{s.StaticZones, s.Forwarders}.Handler()})
+	mux.Handle("/api/v1/static", status)
+	mux.Handle("/api/v1/upstream", status)
+
+	mux.Handle("/ui/", AdminUI{})
 
 	return httplog.HTTPLogger{Handler: mux}, nil
 }
 
+func (s *Server) dnsHandler() Handler {
+	h := NewHandler(s.Resolvers, s.Metrics)
+	h.Views = s.Views
+	h.Timeout = s.QueryTimeout
+	h.QueryLog = s.QueryLog
+	h.Policy = s.Policy
+	h.Signer = s.Signer
+	h.TrustedForwarders = s.TrustedForwarders
+	for _, v := range s.Views {
+		s.Metrics.RegisterView(v.Name)
+	}
+	return h
+}
+
 // DNSHandler is getter of dns.Handler of package github.com/miekg/dns
 func (s *Server) DNSHandler() dns.Handler {
-	return NewHandler(s.Resolvers, s.Metrics)
+	return s.dnsHandler()
 }
 
 // ListenAndServe is starter of server.
@@ -77,11 +112,17 @@ func (s *Server) ListenAndServe(ctx context.Context, apiAddress *net.TCPAddr, dn
 		Handler: httpHandler,
 	}
 
+	// Cancel resolving in-flight messages when server stopped.
+	dnsHandler := s.dnsHandler()
+	dnsHandler.BaseContext = func() context.Context {
+		return ctx
+	}
+
 	dnsServer := dns.Server{
 		Addr:      dnsAddress.String(),
 		Net:       dnsProto,
 		ReusePort: true,
-		Handler:   s.DNSHandler(),
+		Handler:   dnsHandler,
 	}
 
 	httpch := make(chan error)
@@ -46,7 +46,7 @@ func TestServer(t *testing.T) {
 			t.Errorf("unexpected status code: %d", resp.StatusCode)
 		}
 
-		expect := `<h1>Landns</h1><a href="/metrics">metrics</a> <a href="/api/v1">records</a>` + "\n"
+		expect := `<h1>Landns</h1><a href="/ui/">admin</a> <a href="/metrics">metrics</a> <a href="/api/v1">records</a>` + "\n"
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			t.Errorf("failed to read index page: %s", err)
@@ -55,12 +55,17 @@ func TestServer(t *testing.T) {
 		}
 	}
 
-	if u, err := c.Endpoint.Parse("/metrics"); err != nil {
-		t.Errorf("failed to make metrics url: %s", err)
-	} else if resp, err := http.Get(u.String()); err != nil {
-		t.Errorf("failed to get metrics: %s", err)
-	} else if resp.StatusCode != 200 {
-		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	for _, path := range []string{"/metrics", "/ui/", "/api/v1/static", "/api/v1/upstream"} {
+		if u, err := c.Endpoint.Parse(path); err != nil {
+			t.Errorf("failed to make %s url: %s", path, err)
+		} else if resp, err := http.Get(u.String()); err != nil {
+			t.Errorf("failed to get %s: %s", path, err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Errorf("%s: unexpected status code: %d", path, resp.StatusCode)
+			}
+		}
 	}
 }
 
@@ -81,8 +86,8 @@ func TestServer_DebugMode(t *testing.T) {
 		DebugMode bool
 		RootPage  string
 	}{
-		{false, `<h1>Landns</h1><a href="/metrics">metrics</a> <a href="/api/v1">records</a>` + "\n"},
-		{true, `<h1>Landns</h1><a href="/metrics">metrics</a> <a href="/debug/pprof/">pprof</a> <a href="/api/v1">records</a>` + "\n"},
+		{false, `<h1>Landns</h1><a href="/ui/">admin</a> <a href="/metrics">metrics</a> <a href="/api/v1">records</a>` + "\n"},
+		{true, `<h1>Landns</h1><a href="/ui/">admin</a> <a href="/metrics">metrics</a> <a href="/debug/pprof/">pprof</a> <a href="/api/v1">records</a>` + "\n"},
 	}
 
 	for _, tt := range tests {
@@ -1,13 +1,20 @@
 package landns
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sort"
 
 	"gopkg.in/yaml.v2"
 	"github.com/miekg/dns"
 )
 
+// StaticZone is the read-only zone that can list all records, like SimpleResolver and HostsResolver.
+type StaticZone interface {
+	Records() []Record
+}
+
 // SimpleResolver is a simple static implements of Resolver.
 type SimpleResolver map[uint16]map[Domain][]Record
 
@@ -41,8 +48,40 @@ func (sr SimpleResolver) String() string {
 	return fmt.Sprintf("SimpleResolver[%d domains %d types %d records]", len(domains), len(sr), records)
 }
 
+// Records is getter of all records in order of name and type.
+func (sr SimpleResolver) Records() []Record {
+	var records []Record
+	for _, domains := range sr {
+		for _, rs := range domains {
+			records = append(records, rs...)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].GetName() != records[j].GetName() {
+			return records[i].GetName() < records[j].GetName()
+		}
+		if records[i].GetQtype() != records[j].GetQtype() {
+			return records[i].GetQtype() < records[j].GetQtype()
+		}
+		return records[i].String() < records[j].String()
+	})
+
+	return records
+}
+
 // Resolve is resolve matched records.
 func (sr SimpleResolver) Resolve(w ResponseWriter, r Request) error {
+	return sr.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolve matched records.
+//
+// SimpleResolver never blocks, so ctx is used only for tracing.
+func (sr SimpleResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	_, span := startSpan(ctx, r, "SimpleResolver.Resolve")
+	defer endSpan(span, &err)
+
 	domains := sr[r.Qtype]
 	if domains == nil {
 		return nil
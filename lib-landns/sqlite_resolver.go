@@ -1,6 +1,7 @@
 package landns
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -20,7 +21,10 @@ type SqliteResolver struct {
 	path    string
 	db      *sql.DB
 	metrics *Metrics
+	invoke  chan struct{}
 	closer  chan struct{}
+
+	Clock Clock // Source of current time.
 }
 
 func NewSqliteResolver(path string, metrics *Metrics) (*SqliteResolver, error) {
@@ -33,7 +37,9 @@ func NewSqliteResolver(path string, metrics *Metrics) (*SqliteResolver, error) {
 		path:    path,
 		db:      db,
 		metrics: metrics,
+		invoke:  make(chan struct{}, 1),
 		closer:  make(chan struct{}),
+		Clock:   DefaultClock,
 	}
 
 	sr.mutex.Lock()
@@ -65,29 +71,38 @@ func (sr *SqliteResolver) manageExpire(interval time.Duration) {
 	sr.mutex.Lock()
 	stmt, err := sr.db.Prepare(`
 		DELETE FROM records
-		WHERE expire > 0 AND expire < strftime('%s', CURRENT_TIMESTAMP)
+		WHERE expire > 0 AND expire < ?
 	`)
 	sr.mutex.Unlock()
 	if err != nil && err.Error() != "sql: database is closed" {
 		panic(err.Error())
 	}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	// The timer starts when records set first time, so Clock can be replaced before use.
+	var timer <-chan time.Time
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer:
 			sr.mutex.Lock()
-			_, err := stmt.Exec()
+			_, err := stmt.Exec(sr.Clock.Now().Unix())
 			sr.mutex.Unlock()
 
 			if err != nil && err.Error() != "sql: database is closed" {
 				logger.Error("failed to delete expired records", logger.Fields{"reason": err})
 			}
+
+			timer = nil
+		case <-sr.invoke:
 		case <-sr.closer:
 			return
 		}
+
+		if timer == nil {
+			sr.mutex.Lock()
+			timer = sr.Clock.After(interval)
+			sr.mutex.Unlock()
+		}
 	}
 }
 
@@ -95,10 +110,10 @@ func (sr *SqliteResolver) String() string {
 	return fmt.Sprintf("SqliteResolver[%s]", sr.path)
 }
 
-func insertRecord(update, ins *sql.Stmt, r DynamicRecord) error {
+func insertRecord(update, ins *sql.Stmt, r DynamicRecord, now time.Time) error {
 	var expire int64
 	if r.Volatile {
-		expire = time.Now().Add(time.Duration(r.Record.GetTTL()) * time.Second).Unix()
+		expire = now.Add(time.Duration(r.Record.GetTTL()) * time.Second).Unix()
 	}
 
 	result, err := update.Exec(r.Record.GetTTL(), expire, r.Record.WithoutTTL())
@@ -128,7 +143,7 @@ func insertRecord(update, ins *sql.Stmt, r DynamicRecord) error {
 				Domain: r.Record.GetName(),
 			},
 			Volatile: r.Volatile,
-		})
+		}, now)
 	}
 
 	return nil
@@ -202,6 +217,7 @@ func (sr *SqliteResolver) SetRecords(rs DynamicRecordSet) error {
 	}
 	defer update.Close()
 
+	now := sr.Clock.Now()
 	for _, r := range rs {
 		if r.Disabled {
 			if err := dropRecord(dropWithID, dropWithoutID, r); err != nil {
@@ -209,17 +225,26 @@ func (sr *SqliteResolver) SetRecords(rs DynamicRecordSet) error {
 				return err
 			}
 		} else {
-			if err := insertRecord(update, ins, r); err != nil {
+			if err := insertRecord(update, ins, r, now); err != nil {
 				tx.Rollback()
 				return err
 			}
 		}
 	}
 
-	return wrapError(tx.Commit(), TypeExternalError, "failed to commit transaction")
+	if err := tx.Commit(); err != nil {
+		return Error{TypeExternalError, err, "failed to commit transaction"}
+	}
+
+	select {
+	case sr.invoke <- struct{}{}:
+	default:
+	}
+
+	return nil
 }
 
-func scanRecords(rows *sql.Rows) (DynamicRecordSet, error) {
+func scanRecords(rows *sql.Rows, now time.Time) (DynamicRecordSet, error) {
 	var ttl uint32
 	var expire int64
 	var text string
@@ -234,7 +259,7 @@ func scanRecords(rows *sql.Rows) (DynamicRecordSet, error) {
 
 		var err error
 		if expire != 0 {
-			dr.Record, err = NewRecordWithExpire(text, time.Unix(expire, 0))
+			dr.Record, err = NewRecordWithExpireAt(text, time.Unix(expire, 0), now)
 			dr.Volatile = true
 		} else {
 			dr.Record, err = NewRecordWithTTL(text, ttl)
@@ -253,23 +278,27 @@ func (sr *SqliteResolver) Records() (DynamicRecordSet, error) {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
+	now := sr.Clock.Now()
+
 	rows, err := sr.db.Query(`
 		SELECT id, ttl, expire, record FROM records
-		WHERE (expire = 0 OR expire > strftime('%s', CURRENT_TIMESTAMP))
+		WHERE (expire = 0 OR expire > ?)
 		ORDER BY id
-	`)
+	`, now.Unix())
 	if err != nil {
 		return DynamicRecordSet{}, Error{TypeInternalError, err, "failed to prepare query"}
 	}
 	defer rows.Close()
 
-	return scanRecords(rows)
+	return scanRecords(rows, now)
 }
 
 func (sr *SqliteResolver) SearchRecords(suffix Domain) (DynamicRecordSet, error) {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
+	now := sr.Clock.Now()
+
 	suf := suffix.String()
 	for _, rep := range []struct {
 		From string
@@ -285,21 +314,23 @@ func (sr *SqliteResolver) SearchRecords(suffix Domain) (DynamicRecordSet, error)
 	rows, err := sr.db.Query(`
 		SELECT id, ttl, expire, record FROM records
 		WHERE (name = ? OR name LIKE ? ESCAPE '\')
-		AND (expire = 0 OR expire > strftime('%s', CURRENT_TIMESTAMP))
+		AND (expire = 0 OR expire > ?)
 		ORDER BY id
-	`, suf, "%."+suf)
+	`, suf, "%."+suf, now.Unix())
 	if err != nil {
 		return DynamicRecordSet{}, Error{TypeInternalError, err, "failed to prepare query"}
 	}
 	defer rows.Close()
 
-	return scanRecords(rows)
+	return scanRecords(rows, now)
 }
 
 func (sr *SqliteResolver) GlobRecords(pattern string) (DynamicRecordSet, error) {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
+	now := sr.Clock.Now()
+
 	for _, rep := range []struct {
 		From string
 		To   string
@@ -315,32 +346,34 @@ func (sr *SqliteResolver) GlobRecords(pattern string) (DynamicRecordSet, error)
 	rows, err := sr.db.Query(`
 		SELECT id, ttl, expire, record FROM records
 		WHERE name LIKE ? ESCAPE '\'
-		AND (expire = 0 OR expire > strftime('%s', CURRENT_TIMESTAMP))
+		AND (expire = 0 OR expire > ?)
 		ORDER BY id
-	`, pattern)
+	`, pattern, now.Unix())
 	if err != nil {
 		return DynamicRecordSet{}, Error{TypeInternalError, err, "failed to prepare query"}
 	}
 	defer rows.Close()
 
-	return scanRecords(rows)
+	return scanRecords(rows, now)
 }
 
 func (sr *SqliteResolver) GetRecord(id int) (DynamicRecordSet, error) {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
+	now := sr.Clock.Now()
+
 	rows, err := sr.db.Query(`
 		SELECT id, ttl, expire, record FROM records
 		WHERE id = ?
-		AND (expire = 0 OR expire > strftime('%s', CURRENT_TIMESTAMP))
-	`, id)
+		AND (expire = 0 OR expire > ?)
+	`, id, now.Unix())
 	if err != nil {
 		return DynamicRecordSet{}, Error{TypeInternalError, err, "failed to prepare query"}
 	}
 	defer rows.Close()
 
-	return scanRecords(rows)
+	return scanRecords(rows, now)
 }
 
 func (sr *SqliteResolver) RemoveRecord(id int) error {
@@ -362,14 +395,24 @@ func (sr *SqliteResolver) RemoveRecord(id int) error {
 }
 
 func (sr *SqliteResolver) Resolve(w ResponseWriter, r Request) error {
+	return sr.ResolveContext(r.Context(), w, r)
+}
+
+// ResolveContext is resolver using sqlite database with context.
+func (sr *SqliteResolver) ResolveContext(ctx context.Context, w ResponseWriter, r Request) (err error) {
+	ctx, span := startSpan(ctx, r, "SqliteResolver.Resolve")
+	defer endSpan(span, &err)
+
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
-	rows, err := sr.db.Query(`
+	now := sr.Clock.Now()
+
+	rows, err := sr.db.QueryContext(ctx, `
 		SELECT record, ttl, expire FROM records
 		WHERE name = ? AND qtype = ?
-		AND (expire = 0 OR expire > strftime('%s', CURRENT_TIMESTAMP))
-	`, r.Name, r.QtypeString())
+		AND (expire = 0 OR expire > ?)
+	`, r.Name, r.QtypeString(), now.Unix())
 	if err != nil {
 		return Error{TypeInternalError, err, "failed to prepare query"}
 	}
@@ -388,7 +431,7 @@ func (sr *SqliteResolver) Resolve(w ResponseWriter, r Request) error {
 		var err error
 
 		if expire != 0 {
-			record, err = NewRecordWithExpire(text, time.Unix(expire, 0))
+			record, err = NewRecordWithExpireAt(text, time.Unix(expire, 0), now)
 		} else {
 			record, err = NewRecordWithTTL(text, ttl)
 		}
@@ -5,6 +5,20 @@ import (
 	"time"
 )
 
+// manualClock is Clock that moves only when set, and fires timers only when sent to the channel.
+type manualClock struct {
+	now   time.Time
+	after chan time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	return c.after
+}
+
 func TestSqliteResolver_manageExpire(t *testing.T) {
 	t.Parallel()
 
@@ -29,8 +43,13 @@ func TestSqliteResolver_manageExpire(t *testing.T) {
 		return num
 	}
 
+	clock := &manualClock{now: time.Now().Truncate(time.Second), after: make(chan time.Time)}
+
 	close(resolver.closer)
+	resolver.mutex.Lock()
 	resolver.closer = make(chan struct{})
+	resolver.Clock = clock
+	resolver.mutex.Unlock()
 	go resolver.manageExpire(1 * time.Second)
 
 	records, err := NewDynamicRecordSet(`
@@ -50,7 +69,12 @@ func TestSqliteResolver_manageExpire(t *testing.T) {
 		t.Errorf("unexpected number of records: expected 3 but got %d", num)
 	}
 
-	time.Sleep(3 * time.Second)
+	resolver.mutex.Lock()
+	clock.now = clock.now.Add(3 * time.Second)
+	resolver.mutex.Unlock()
+
+	clock.after <- clock.now // wait for the timer armed, and fire it.
+	clock.after <- clock.now // wait for the previous task done.
 
 	if num := recordsNum(); num != 2 {
 		t.Errorf("unexpected number of records: expected 2 but got %d", num)
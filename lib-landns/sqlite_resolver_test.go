@@ -2,8 +2,11 @@ package landns_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
 )
 
 func CreateSqliteResolver(t testing.TB) *landns.SqliteResolver {
@@ -43,6 +46,58 @@ func TestSqliteResolver(t *testing.T) {
 	}
 }
 
+func TestSqliteResolver_TTLDecay(t *testing.T) {
+	t.Parallel()
+
+	clock := testutil.NewFakeClock()
+	resolver := CreateSqliteResolver(t)
+	resolver.Clock = clock
+	defer resolver.Close()
+
+	records, err := landns.NewDynamicRecordSet(`
+		fixed.example.com. 100 IN TXT "fixed"
+		volatile.example.com. 100 IN TXT "volatile" ; Volatile
+	`)
+	if err != nil {
+		t.Fatalf("failed to make dynamic records: %s", err)
+	}
+	if err := resolver.SetRecords(records); err != nil {
+		t.Fatalf("failed to set records: %s", err)
+	}
+
+	fixed := landns.NewRequest("fixed.example.com.", dns.TypeTXT, false)
+	volatile := landns.NewRequest("volatile.example.com.", dns.TypeTXT, false)
+
+	AssertResolve(t, resolver, volatile, true, `volatile.example.com. 100 IN TXT "volatile"`)
+
+	clock.Add(30 * time.Second)
+	AssertResolve(t, resolver, fixed, true, `fixed.example.com. 100 IN TXT "fixed"`)
+	AssertResolve(t, resolver, volatile, true, `volatile.example.com. 70 IN TXT "volatile"`)
+
+	rs, err := resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	AssertDynamicRecordSet(t, []string{
+		`fixed.example.com. 100 IN TXT "fixed" ; ID:1`,
+		`volatile.example.com. 70 IN TXT "volatile" ; ID:2 Volatile`,
+	}, rs)
+
+	clock.Add(69 * time.Second)
+	AssertResolve(t, resolver, volatile, true, `volatile.example.com. 1 IN TXT "volatile"`)
+
+	clock.Add(1 * time.Second)
+	AssertResolve(t, resolver, volatile, true)
+
+	rs, err = resolver.Records()
+	if err != nil {
+		t.Fatalf("failed to get records: %s", err)
+	}
+	AssertDynamicRecordSet(t, []string{
+		`fixed.example.com. 100 IN TXT "fixed" ; ID:1`,
+	}, rs)
+}
+
 func BenchmarkSqliteResolver(b *testing.B) {
 	resolver := CreateSqliteResolver(b)
 	defer func() {
@@ -0,0 +1,39 @@
+package landns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultCachePrefetch is the default threshold of remaining TTL for prefetch. 0 means disabled.
+	DefaultCachePrefetch = 0 * time.Second
+
+	// DefaultCacheStaleTTL is the default duration to keep expired records for serve-stale (RFC 8767). 0 means disabled.
+	DefaultCacheStaleTTL = 0 * time.Second
+
+	// StaleAnswerTTL is the TTL of stale records in response. It is the value that recommended by RFC 8767.
+	StaleAnswerTTL = 30
+)
+
+// staleRecord is make copy of VolatileRecord that has StaleAnswerTTL at now.
+func staleRecord(r VolatileRecord, now time.Time) VolatileRecord {
+	return VolatileRecord{dns.Copy(r.RR), now.Add(StaleAnswerTTL * time.Second)}
+}
+
+// parseCachedRecord is parse VolatileRecord that may be already expired.
+func parseCachedRecord(text string) (record VolatileRecord, err error) {
+	err = record.UnmarshalText([]byte(text))
+	if e, ok := err.(Error); ok && e.Type == TypeExpirationError && record.RR != nil {
+		return record, nil
+	}
+	return record, err
+}
+
+// discardResponseWriter is make ResponseWriter that ignores all records, for background refresh.
+func discardResponseWriter() ResponseWriter {
+	return NewResponseCallback(func(Record) error {
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+)
+
+type fakeTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// FakeClock is landns.Clock for testing that moves only when Add called.
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+var _ landns.Clock = (*FakeClock)(nil)
+
+// NewFakeClock is make FakeClock that starts at the current time truncated to seconds.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Now().Truncate(time.Second)}
+}
+
+// Now is getter to current time of FakeClock.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// After is make channel that receives time when FakeClock moved over d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	}
+	return ch
+}
+
+// Add is move clock forward and fire timers that reached deadline.
+func (c *FakeClock) Add(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			timers = append(timers, t)
+		} else {
+			t.ch <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+// Timers is getter to the number of timers that waiting for FakeClock moves.
+func (c *FakeClock) Timers() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.timers)
+}
@@ -0,0 +1,59 @@
+package testutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/testutil"
+)
+
+func TestFakeClock(t *testing.T) {
+	t.Parallel()
+
+	clock := testutil.NewFakeClock()
+	start := clock.Now()
+
+	short := clock.After(1 * time.Second)
+	long := clock.After(3 * time.Second)
+	if n := clock.Timers(); n != 2 {
+		t.Fatalf("unexpected number of timers: expected 2 but got %d", n)
+	}
+
+	clock.Add(2 * time.Second)
+
+	if d := clock.Now().Sub(start); d != 2*time.Second {
+		t.Errorf("unexpected elapsed time: expected 2s but got %s", d)
+	}
+
+	select {
+	case now := <-short:
+		if !now.Equal(start.Add(2 * time.Second)) {
+			t.Errorf("unexpected fired time: %s", now)
+		}
+	default:
+		t.Errorf("short timer was not fired")
+	}
+
+	select {
+	case <-long:
+		t.Errorf("long timer was fired too early")
+	default:
+	}
+
+	if n := clock.Timers(); n != 1 {
+		t.Errorf("unexpected number of timers: expected 1 but got %d", n)
+	}
+
+	clock.Add(1 * time.Second)
+	select {
+	case <-long:
+	default:
+		t.Errorf("long timer was not fired")
+	}
+
+	select {
+	case <-clock.After(0):
+	default:
+		t.Errorf("timer with zero duration was not fired immediately")
+	}
+}
@@ -2,7 +2,12 @@ package testutil
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/macrat/landns/lib-landns"
@@ -44,6 +49,11 @@ func StartDNSServer(ctx context.Context, t SimpleTB, resolver landns.Resolver) D
 	return DNSServer{addr}
 }
 
+// Exchange is send a message to the server and returns the response message.
+func (d DNSServer) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	return dns.Exchange(msg, d.Addr.String())
+}
+
 // Assert is assertion tester for dns message exchange.
 func (d DNSServer) Assert(t SimpleTB, q dns.Question, expect ...string) {
 	t.Helper()
@@ -53,7 +63,7 @@ func (d DNSServer) Assert(t SimpleTB, q dns.Question, expect ...string) {
 		Question: []dns.Question{q},
 	}
 
-	in, err := dns.Exchange(msg, d.Addr.String())
+	in, err := d.Exchange(msg)
 	if err != nil {
 		t.Errorf("%s: failed to resolve: %s", d.Addr, err)
 		return
@@ -82,3 +92,144 @@ func (d DNSServer) Assert(t SimpleTB, q dns.Question, expect ...string) {
 		t.Errorf(msg, d.Addr)
 	}
 }
+
+// countListener is a net.Listener that counts accepted connections.
+type countListener struct {
+	net.Listener
+	count *int32
+}
+
+func (l countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.count, 1)
+	}
+	return conn, err
+}
+
+// StreamDNSServer is tester for DNS over TCP or DNS over TLS.
+type StreamDNSServer struct {
+	Addr  *net.TCPAddr
+	count *int32
+}
+
+// Connections is getter to the number of accepted connections.
+func (d StreamDNSServer) Connections() int {
+	return int(atomic.LoadInt32(d.count))
+}
+
+// StartTCPDNSServer is make dns.Server over TCP and start it.
+func StartTCPDNSServer(ctx context.Context, t SimpleTB, resolver landns.Resolver) StreamDNSServer {
+	return startStreamDNSServer(ctx, t, landns.NewHandler(resolver, landns.NewMetrics("landns")), nil)
+}
+
+// StartTLSDNSServer is make dns.Server over TLS and start it.
+func StartTLSDNSServer(ctx context.Context, t SimpleTB, resolver landns.Resolver, config *tls.Config) StreamDNSServer {
+	return startStreamDNSServer(ctx, t, landns.NewHandler(resolver, landns.NewMetrics("landns")), config)
+}
+
+func startStreamDNSServer(ctx context.Context, t SimpleTB, handler dns.Handler, config *tls.Config) StreamDNSServer {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: FindEmptyPort()}
+
+	l, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to listen dummy DNS: %s", err)
+	}
+
+	count := new(int32)
+	var listener net.Listener = countListener{l, count}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+
+	server := dns.Server{
+		Listener: listener,
+		Handler:  handler,
+	}
+
+	go func() {
+		err := server.ActivateAndServe()
+		if ctx.Err() == nil {
+			t.Fatalf("failed to serve dummy DNS: %s", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(); err != nil {
+			t.Fatalf("failed to stop dummy DNS: %s", err)
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond) // Wait for start DNS server
+
+	return StreamDNSServer{addr, count}
+}
+
+// StartDoHServer is make DNS over HTTPS server and start it.
+//
+// StartDoHServer returns URL of the server like "https://127.0.0.1:12345/dns-query".
+func StartDoHServer(ctx context.Context, t SimpleTB, resolver landns.Resolver, config *tls.Config) string {
+	handler := landns.NewHandler(resolver, landns.NewMetrics("landns"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rw := NewDummyDNSResponseWriter(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		handler.ServeDNS(rw, req)
+		if len(rw.Messages) != 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		resp, err := rw.Messages[0].Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	})
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: FindEmptyPort()}
+	server := http.Server{
+		Addr:      addr.String(),
+		Handler:   mux,
+		TLSConfig: config,
+	}
+
+	go func() {
+		err := server.ListenAndServeTLS("", "")
+		if ctx.Err() == nil {
+			t.Fatalf("failed to serve dummy DoH: %s", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			t.Fatalf("failed to stop dummy DoH: %s", err)
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond) // Wait for start HTTP server
+
+	return fmt.Sprintf("https://%s/dns-query", addr)
+}
@@ -1,8 +1,11 @@
 package testutil_test
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
@@ -82,3 +85,109 @@ func TestDNSServer(t *testing.T) {
 	tb.AssertErrors(t, "127.0.0.1:*: failed to resolve: read udp 127.0.0.1:*->127.0.0.1:*: read: connection refused")
 	tb.AssertFatals(t)
 }
+
+func TestDNSServer_Exchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testutil.StartDNSServer(ctx, t, testutil.ResponseResolver{
+		Rcode:     dns.RcodeNameError,
+		Authority: []landns.Record{landns.NsRecord{Name: "example.com.", Target: "ns.example.com."}},
+	})
+
+	in, err := srv.Exchange(new(dns.Msg).SetQuestion("notfound.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("failed to exchange: %s", err)
+	}
+
+	if in.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %s but got %s", dns.RcodeToString[dns.RcodeNameError], dns.RcodeToString[in.Rcode])
+	}
+	if len(in.Ns) != 1 || in.Ns[0].String() != "example.com.\t3600\tIN\tNS\tns.example.com." {
+		t.Errorf("unexpected authority: %s", in.Ns)
+	}
+}
+
+func TestStreamDNSServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.1.2")},
+	})
+	serverConfig, clientConfig := testutil.NewTLSConfig(t)
+
+	tcp := testutil.StartTCPDNSServer(ctx, t, resolver)
+	tls := testutil.StartTLSDNSServer(ctx, t, resolver, serverConfig)
+
+	clients := map[string]struct {
+		Server testutil.StreamDNSServer
+		Client *dns.Client
+	}{
+		"tcp": {tcp, &dns.Client{Net: "tcp"}},
+		"tls": {tls, &dns.Client{Net: "tcp-tls", TLSConfig: clientConfig}},
+	}
+
+	for name, c := range clients {
+		if n := c.Server.Connections(); n != 0 {
+			t.Errorf("%s: unexpected connections: %d", name, n)
+		}
+
+		in, _, err := c.Client.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA), c.Server.Addr.String())
+		if err != nil {
+			t.Errorf("%s: failed to exchange: %s", name, err)
+		} else if len(in.Answer) != 1 || in.Answer[0].String() != "example.com.\t123\tIN\tA\t127.0.1.2" {
+			t.Errorf("%s: unexpected answer: %s", name, in.Answer)
+		}
+
+		if n := c.Server.Connections(); n != 1 {
+			t.Errorf("%s: unexpected connections: %d", name, n)
+		}
+	}
+}
+
+func TestDoHServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.1.2")},
+	})
+	serverConfig, clientConfig := testutil.NewTLSConfig(t)
+
+	url := testutil.StartDoHServer(ctx, t, resolver, serverConfig)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+	req, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatalf("failed to pack: %s", err)
+	}
+
+	resp, err := client.Post(url, "application/dns-message", bytes.NewReader(req))
+	if err != nil {
+		t.Fatalf("failed to post: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		t.Fatalf("failed to unpack: %s", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].String() != "example.com.\t123\tIN\tA\t127.0.1.2" {
+		t.Errorf("unexpected answer: %s", in.Answer)
+	}
+
+	resp, err = client.Post(url, "text/plain", bytes.NewReader(req))
+	if err != nil {
+		t.Fatalf("failed to post: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+}
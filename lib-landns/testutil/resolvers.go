@@ -2,6 +2,7 @@ package testutil
 
 import (
 	"github.com/macrat/landns/lib-landns"
+	"github.com/miekg/dns"
 )
 
 // DummyResolver is stub of landns.Resolver.
@@ -27,3 +28,44 @@ func (dr DummyResolver) RecursionAvailable() bool {
 func (dr DummyResolver) Close() error {
 	return nil
 }
+
+// ResponseResolver is stub of landns.Resolver that always responses the same message.
+type ResponseResolver struct {
+	Rcode      int
+	Answer     []landns.Record
+	Authority  []landns.Record
+	Additional []landns.Record
+}
+
+// Resolve is write ResponseResolver.Rcode and records into landns.ResponseWriter.
+func (rr ResponseResolver) Resolve(w landns.ResponseWriter, r landns.Request) error {
+	if rr.Rcode != dns.RcodeSuccess {
+		w.SetRcode(rr.Rcode)
+	}
+	for _, x := range rr.Answer {
+		if err := w.Add(x); err != nil {
+			return err
+		}
+	}
+	for _, x := range rr.Authority {
+		if err := w.AddAuthority(x); err != nil {
+			return err
+		}
+	}
+	for _, x := range rr.Additional {
+		if err := w.AddAdditional(x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecursionAvailable is always returns false.
+func (rr ResponseResolver) RecursionAvailable() bool {
+	return false
+}
+
+// Close is nothing to do.
+func (rr ResponseResolver) Close() error {
+	return nil
+}
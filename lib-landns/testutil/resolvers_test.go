@@ -1,6 +1,7 @@
 package testutil_test
 
 import (
+	"net"
 	"testing"
 
 	"github.com/macrat/landns/lib-landns"
@@ -42,3 +43,39 @@ func TestDummyResolver(t *testing.T) {
 		}
 	}
 }
+
+func TestResponseResolver(t *testing.T) {
+	t.Parallel()
+
+	res := testutil.ResponseResolver{
+		Rcode:      dns.RcodeNameError,
+		Answer:     []landns.Record{landns.AddressRecord{Name: "example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")}},
+		Authority:  []landns.Record{landns.NsRecord{Name: "example.com.", Target: "ns.example.com."}},
+		Additional: []landns.Record{landns.AddressRecord{Name: "ns.example.com.", TTL: 20, Address: net.ParseIP("127.0.0.2")}},
+	}
+
+	w := testutil.NewDummyResponseWriter()
+	if err := res.Resolve(w, landns.NewRequest("example.com.", dns.TypeA, false)); err != nil {
+		t.Fatalf("failed to resolve: %s", err)
+	}
+
+	if w.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected rcode: expected %d but got %d", dns.RcodeNameError, w.Rcode)
+	}
+	if len(w.Records) != 1 || w.Records[0].String() != "example.com. 10 IN A 127.0.0.1" {
+		t.Errorf("unexpected answer: %s", w.Records)
+	}
+	if len(w.Authority) != 1 || w.Authority[0].String() != "example.com. IN NS ns.example.com." {
+		t.Errorf("unexpected authority: %s", w.Authority)
+	}
+	if len(w.Additional) != 1 || w.Additional[0].String() != "ns.example.com. 20 IN A 127.0.0.2" {
+		t.Errorf("unexpected additional: %s", w.Additional)
+	}
+
+	if res.RecursionAvailable() {
+		t.Errorf("unexpected recursion available: true")
+	}
+	if err := res.Close(); err != nil {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
@@ -1,13 +1,19 @@
 package testutil
 
 import (
+	"net"
+
 	"github.com/macrat/landns/lib-landns"
+	"github.com/miekg/dns"
 )
 
 // DummyResponseWriter is array stub of landns.ResponseWriter.
 type DummyResponseWriter struct {
 	Records       []landns.Record
+	Authority     []landns.Record
+	Additional    []landns.Record
 	Authoritative bool
+	Rcode         int
 }
 
 // NewDummyResponseWriter is constructor of DummyResponseWriter.
@@ -15,6 +21,7 @@ func NewDummyResponseWriter() *DummyResponseWriter {
 	return &DummyResponseWriter{
 		Records:       make([]landns.Record, 0, 10),
 		Authoritative: true,
+		Rcode:         dns.RcodeSuccess,
 	}
 }
 
@@ -24,6 +31,18 @@ func (rw *DummyResponseWriter) Add(r landns.Record) error {
 	return nil
 }
 
+// AddAuthority is adding record into DummyResponseWriter.Authority.
+func (rw *DummyResponseWriter) AddAuthority(r landns.Record) error {
+	rw.Authority = append(rw.Authority, r)
+	return nil
+}
+
+// AddAdditional is adding record into DummyResponseWriter.Additional.
+func (rw *DummyResponseWriter) AddAdditional(r landns.Record) error {
+	rw.Additional = append(rw.Additional, r)
+	return nil
+}
+
 // IsAuthoritative is returns value of DummyResponseWriter.Authoritative.
 func (rw *DummyResponseWriter) IsAuthoritative() bool {
 	return rw.Authoritative
@@ -34,6 +53,11 @@ func (rw *DummyResponseWriter) SetNoAuthoritative() {
 	rw.Authoritative = false
 }
 
+// SetRcode is set value to DummyResponseWriter.Rcode.
+func (rw *DummyResponseWriter) SetRcode(rcode int) {
+	rw.Rcode = rcode
+}
+
 // EmptyResponseWriter is empty stub of landns.ResponseWriter.
 type EmptyResponseWriter struct{}
 
@@ -42,6 +66,16 @@ func (rw EmptyResponseWriter) Add(r landns.Record) error {
 	return nil
 }
 
+// AddAuthority is nothing to do.
+func (rw EmptyResponseWriter) AddAuthority(r landns.Record) error {
+	return nil
+}
+
+// AddAdditional is nothing to do.
+func (rw EmptyResponseWriter) AddAdditional(r landns.Record) error {
+	return nil
+}
+
 // IsAuthoritative is always returns true.
 func (rw EmptyResponseWriter) IsAuthoritative() bool {
 	return true
@@ -50,3 +84,66 @@ func (rw EmptyResponseWriter) IsAuthoritative() bool {
 // SetNoAuthoritative is nothing to do.
 func (rw EmptyResponseWriter) SetNoAuthoritative() {
 }
+
+// SetRcode is nothing to do.
+func (rw EmptyResponseWriter) SetRcode(rcode int) {
+}
+
+// DummyDNSResponseWriter is stub of dns.ResponseWriter of package github.com/miekg/dns.
+type DummyDNSResponseWriter struct {
+	Local    net.Addr
+	Remote   net.Addr
+	Messages []*dns.Msg
+}
+
+// NewDummyDNSResponseWriter is constructor of DummyDNSResponseWriter.
+func NewDummyDNSResponseWriter(remote net.Addr) *DummyDNSResponseWriter {
+	return &DummyDNSResponseWriter{
+		Local:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+		Remote: remote,
+	}
+}
+
+// LocalAddr is returns value of DummyDNSResponseWriter.Local.
+func (rw *DummyDNSResponseWriter) LocalAddr() net.Addr {
+	return rw.Local
+}
+
+// RemoteAddr is returns value of DummyDNSResponseWriter.Remote.
+func (rw *DummyDNSResponseWriter) RemoteAddr() net.Addr {
+	return rw.Remote
+}
+
+// WriteMsg is adding message into DummyDNSResponseWriter.Messages.
+func (rw *DummyDNSResponseWriter) WriteMsg(msg *dns.Msg) error {
+	rw.Messages = append(rw.Messages, msg)
+	return nil
+}
+
+// Write is parse bytes as message and adding into DummyDNSResponseWriter.Messages.
+func (rw *DummyDNSResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	rw.Messages = append(rw.Messages, msg)
+	return len(b), nil
+}
+
+// Close is nothing to do.
+func (rw *DummyDNSResponseWriter) Close() error {
+	return nil
+}
+
+// TsigStatus is always returns nil.
+func (rw *DummyDNSResponseWriter) TsigStatus() error {
+	return nil
+}
+
+// TsigTimersOnly is nothing to do.
+func (rw *DummyDNSResponseWriter) TsigTimersOnly(bool) {
+}
+
+// Hijack is nothing to do.
+func (rw *DummyDNSResponseWriter) Hijack() {
+}
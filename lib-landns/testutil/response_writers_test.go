@@ -6,6 +6,7 @@ import (
 
 	"github.com/macrat/landns/lib-landns"
 	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
 )
 
 func TestDummyResponseWriter(t *testing.T) {
@@ -54,4 +55,54 @@ func TestEmptyResponseWriter(t *testing.T) {
 	if err := w.Add(landns.AddressRecord{Name: "example.com.", TTL: 42, Address: net.ParseIP("127.1.2.3")}); err != nil {
 		t.Fatalf("unexpected error: %#v", err)
 	}
+	if err := w.AddAuthority(landns.NsRecord{Name: "example.com.", Target: "ns.example.com."}); err != nil {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if err := w.AddAdditional(landns.AddressRecord{Name: "ns.example.com.", TTL: 42, Address: net.ParseIP("127.1.2.3")}); err != nil {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	w.SetRcode(dns.RcodeNameError)
+}
+
+func TestDummyDNSResponseWriter(t *testing.T) {
+	t.Parallel()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+	w := testutil.NewDummyDNSResponseWriter(remote)
+
+	if w.RemoteAddr().String() != remote.String() {
+		t.Errorf("unexpected remote address: expected %s but got %s", remote, w.RemoteAddr())
+	}
+	if w.LocalAddr().String() != "127.0.0.1:53" {
+		t.Errorf("unexpected local address: %s", w.LocalAddr())
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if err := w.WriteMsg(msg); err != nil {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack message: %s", err)
+	}
+	if n, err := w.Write(packed); err != nil {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if n != len(packed) {
+		t.Errorf("unexpected written length: expected %d but got %d", len(packed), n)
+	}
+
+	if len(w.Messages) != 2 {
+		t.Fatalf("unexpected messages length: %d", len(w.Messages))
+	}
+	for _, m := range w.Messages {
+		if m.Question[0].Name != "example.com." {
+			t.Errorf("unexpected message: %s", m)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Errorf("unexpected error: %#v", err)
+	}
 }
@@ -0,0 +1,41 @@
+package testutil_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/macrat/landns/lib-landns/testutil"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	serverConfig, clientConfig := testutil.NewTLSConfig(t)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	conn.Close()
+
+	if _, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{}); err == nil {
+		t.Errorf("expected certificate error but got nil")
+	}
+}
@@ -0,0 +1,93 @@
+package landns
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name of spans that made by Landns.
+//
+// Spans are made by the global TracerProvider of package go.opentelemetry.io/otel, so tracing is disabled until otel.SetTracerProvider is called.
+const TracerName = "github.com/macrat/landns/lib-landns"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// startSpan is start new span for resolving the request as a child of the span in ctx.
+//
+// Spans of resolvers that called with the returned context will be children of the new span.
+func startSpan(ctx context.Context, r Request, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append([]attribute.KeyValue{
+		attribute.String("dns.question.name", r.Name),
+		attribute.String("dns.question.type", dns.Type(r.Qtype).String()),
+	}, attrs...)
+
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan is end the span with the error that pointed by err.
+//
+// endSpan is designed for use with defer and named result.
+func endSpan(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// traceCache is record the result of cache like "hit" or "miss" into the span of request.
+func traceCache(r Request, result string) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("landns.cache.result", result))
+}
+
+// statusRecorder is http.ResponseWriter that records status code for tracing.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// tracingHandler is http.Handler that makes span for each request.
+//
+// Trace context in request headers will be used as the parent of span if the global propagator supports it.
+type tracingHandler struct {
+	Name    string
+	Handler http.Handler
+}
+
+func (th tracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	ctx, span := tracer().Start(
+		ctx,
+		th.Name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		),
+	)
+	defer span.End()
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	th.Handler.ServeHTTP(rec, r.WithContext(ctx))
+
+	span.SetAttributes(attribute.Int("http.status_code", rec.status))
+	if rec.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(rec.status))
+	}
+}
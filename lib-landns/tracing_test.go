@@ -0,0 +1,133 @@
+package landns_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, a := range span.Attributes() {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	metrics := landns.NewMetrics("landns")
+	upstream := landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 100, Address: net.ParseIP("127.0.0.1")},
+	})
+	cache := landns.NewLocalCache(upstream, metrics)
+	defer cache.Close()
+
+	handler := landns.NewHandler(landns.ResolverSet{landns.NewSimpleResolver(nil), cache}, metrics)
+
+	type expect struct {
+		Name   string
+		Parent string
+		Cache  string
+	}
+
+	tests := [][]expect{
+		{
+			{"SimpleResolver.Resolve", "Handler.ServeDNS", ""},
+			{"SimpleResolver.Resolve", "LocalCache.Resolve", ""},
+			{"LocalCache.Resolve", "Handler.ServeDNS", "miss"},
+			{"Handler.ServeDNS", "", ""},
+		},
+		{
+			{"SimpleResolver.Resolve", "Handler.ServeDNS", ""},
+			{"LocalCache.Resolve", "Handler.ServeDNS", "hit"},
+			{"Handler.ServeDNS", "", ""},
+		},
+	}
+
+	for i, tt := range tests {
+		before := len(recorder.Ended())
+
+		w := testutil.NewDummyDNSResponseWriter(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345})
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		handler.ServeDNS(w, msg)
+
+		spans := recorder.Ended()[before:]
+		if len(spans) != len(tt) {
+			t.Errorf("%d: unexpected number of spans: expected %d but got %d", i, len(tt), len(spans))
+			continue
+		}
+
+		names := make(map[string]string)
+		for _, s := range spans {
+			names[s.SpanContext().SpanID().String()] = s.Name()
+		}
+
+		for j, s := range spans {
+			if s.Name() != tt[j].Name {
+				t.Errorf("%d: unexpected span name: expected %s but got %s", i, tt[j].Name, s.Name())
+			}
+			if s.SpanContext().TraceID() != spans[len(spans)-1].SpanContext().TraceID() {
+				t.Errorf("%d: %s: unexpected trace ID", i, s.Name())
+			}
+			if parent := names[s.Parent().SpanID().String()]; parent != tt[j].Parent {
+				t.Errorf("%d: %s: unexpected parent: expected %q but got %q", i, s.Name(), tt[j].Parent, parent)
+			}
+			if cache := spanAttribute(s, "landns.cache.result"); cache != tt[j].Cache {
+				t.Errorf("%d: %s: unexpected cache result: expected %q but got %q", i, s.Name(), tt[j].Cache, cache)
+			}
+		}
+
+		if rcode := spanAttribute(spans[len(spans)-1], "dns.rcode"); rcode != "NOERROR" {
+			t.Errorf("%d: unexpected rcode: %s", i, rcode)
+		}
+		if name := spanAttribute(spans[0], "dns.question.name"); name != "example.com." {
+			t.Errorf("%d: unexpected question name: %s", i, name)
+		}
+	}
+}
+
+func TestTracing_Error(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	resolver := landns.NewForwardResolver(nil, 100*time.Millisecond, landns.NewMetrics("landns"))
+	resolver.Upstreams = []landns.Upstream{landns.UDPUpstream(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})}
+	defer resolver.Close()
+
+	req := landns.NewRequest("example.com.", dns.TypeA, true)
+	if err := resolver.Resolve(testutil.EmptyResponseWriter{}, req); err == nil {
+		t.Fatalf("expected error but got nil")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected number of spans: expected 2 but got %d", len(spans))
+	}
+
+	if spans[0].Name() != "ForwardResolver.exchange" || spans[1].Name() != "ForwardResolver.Resolve" {
+		t.Errorf("unexpected spans: %s, %s", spans[0].Name(), spans[1].Name())
+	}
+	if upstream := spanAttribute(spans[0], "landns.upstream"); upstream != "127.0.0.1:1" {
+		t.Errorf("unexpected upstream: %s", upstream)
+	}
+	for _, s := range spans {
+		if s.Status().Code.String() != "Error" {
+			t.Errorf("%s: unexpected status: %s", s.Name(), s.Status().Code)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package landns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macrat/landns/lib-landns/logger"
+	"github.com/miekg/dns"
+)
+
+// UpstreamProtocol is the protocol for communicate with upstream DNS server.
+type UpstreamProtocol string
+
+const (
+	// ProtocolUDP is plain DNS over UDP. It will retry over TCP if response was truncated.
+	ProtocolUDP UpstreamProtocol = "udp"
+
+	// ProtocolTCP is plain DNS over TCP.
+	ProtocolTCP UpstreamProtocol = "tcp"
+
+	// ProtocolTLS is DNS over TLS (RFC 7858).
+	ProtocolTLS UpstreamProtocol = "tls"
+
+	// ProtocolHTTPS is DNS over HTTPS (RFC 8484).
+	ProtocolHTTPS UpstreamProtocol = "https"
+)
+
+// Upstream is an upstream DNS server for ForwardResolver.
+type Upstream struct {
+	Protocol UpstreamProtocol
+	Address  string // "host:port" if Protocol is udp, tcp or tls. URL if Protocol is https.
+}
+
+// UDPUpstream is make Upstream from net.UDPAddr.
+func UDPUpstream(addr *net.UDPAddr) Upstream {
+	return Upstream{Protocol: ProtocolUDP, Address: addr.String()}
+}
+
+// ParseUpstream is parse upstream string like "8.8.8.8:53", "tcp://8.8.8.8", "tls://1.1.1.1:853" or "https://dns.example/dns-query".
+//
+// ParseUpstream uses UDP if scheme is omitted, and uses port 53 (or 853 for tls) if port number is omitted.
+func ParseUpstream(s string) (Upstream, error) {
+	if !strings.Contains(s, "://") {
+		addr, err := upstreamHostPort(s, "53")
+		if err != nil {
+			return Upstream{}, newError(TypeArgumentError, err, "invalid upstream address: %s", s)
+		}
+		return Upstream{Protocol: ProtocolUDP, Address: addr}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return Upstream{}, newError(TypeArgumentError, err, "invalid upstream address: %s", s)
+	}
+	if u.Host == "" {
+		return Upstream{}, newError(TypeArgumentError, nil, "invalid upstream address: %s: host is required", s)
+	}
+
+	proto := UpstreamProtocol(strings.ToLower(u.Scheme))
+	switch proto {
+	case ProtocolUDP, ProtocolTCP, ProtocolTLS:
+		if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+			return Upstream{}, newError(TypeArgumentError, nil, "invalid upstream address: %s: %s upstream can't have path, query or user", s, proto)
+		}
+
+		port := "53"
+		if proto == ProtocolTLS {
+			port = "853"
+		}
+		addr, err := upstreamHostPort(u.Host, port)
+		if err != nil {
+			return Upstream{}, newError(TypeArgumentError, err, "invalid upstream address: %s", s)
+		}
+		return Upstream{Protocol: proto, Address: addr}, nil
+	case ProtocolHTTPS:
+		u.Scheme = string(ProtocolHTTPS)
+		return Upstream{Protocol: ProtocolHTTPS, Address: u.String()}, nil
+	default:
+		return Upstream{}, newError(TypeArgumentError, nil, "invalid upstream address: %s: unsupported protocol: %s", s, u.Scheme)
+	}
+}
+
+func upstreamHostPort(s, defaultPort string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.Trim(s, "[]"), defaultPort
+	}
+
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", newError(TypeArgumentError, nil, "host is required")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// String is returns address string of upstream.
+//
+// UDP upstream is returns without scheme like "8.8.8.8:53", others are returns with scheme like "tls://1.1.1.1:853".
+func (u Upstream) String() string {
+	switch u.Protocol {
+	case ProtocolUDP, "":
+		return u.Address
+	case ProtocolHTTPS:
+		return u.Address
+	default:
+		return string(u.Protocol) + "://" + u.Address
+	}
+}
+
+// UnmarshalText is parse text to Upstream.
+func (u *Upstream) UnmarshalText(text []byte) error {
+	parsed, err := ParseUpstream(string(text))
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
+
+// MarshalText is make bytes text.
+func (u Upstream) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// upstreamTransport is a connection to an upstream server.
+type upstreamTransport interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+	Close() error
+}
+
+func newUpstreamTransport(u Upstream, timeout time.Duration, tlsConfig *tls.Config) upstreamTransport {
+	switch u.Protocol {
+	case ProtocolTCP:
+		return newStreamTransport("tcp", u.Address, timeout, nil)
+	case ProtocolTLS:
+		return newStreamTransport("tcp-tls", u.Address, timeout, tlsConfig)
+	case ProtocolHTTPS:
+		return newHTTPSTransport(u.Address, timeout, tlsConfig)
+	default:
+		return &udpTransport{
+			client: &dns.Client{
+				Net:     "udp",
+				Dialer:  &net.Dialer{Timeout: timeout},
+				Timeout: timeout,
+			},
+			addr: u.Address,
+			tcp:  newStreamTransport("tcp", u.Address, timeout, nil),
+		}
+	}
+}
+
+// upstreamTransports is a set of upstreamTransport that shared between copies of ForwardResolver.
+type upstreamTransports struct {
+	mutex      sync.Mutex
+	transports map[Upstream]upstreamTransport
+	timeout    time.Duration
+}
+
+func newUpstreamTransports(timeout time.Duration) *upstreamTransports {
+	return &upstreamTransports{
+		transports: make(map[Upstream]upstreamTransport),
+		timeout:    timeout,
+	}
+}
+
+func (ut *upstreamTransports) get(u Upstream, tlsConfig *tls.Config) upstreamTransport {
+	ut.mutex.Lock()
+	defer ut.mutex.Unlock()
+
+	t, ok := ut.transports[u]
+	if !ok {
+		t = newUpstreamTransport(u, ut.timeout, tlsConfig)
+		ut.transports[u] = t
+	}
+	return t
+}
+
+func (ut *upstreamTransports) Close() error {
+	ut.mutex.Lock()
+	defer ut.mutex.Unlock()
+
+	for u, t := range ut.transports {
+		if err := t.Close(); err != nil {
+			return err
+		}
+		delete(ut.transports, u)
+	}
+	return nil
+}
+
+// udpTransport is transport for plain DNS over UDP, and retry over TCP if response was truncated.
+type udpTransport struct {
+	client *dns.Client
+	addr   string
+	tcp    *streamTransport
+}
+
+type udpResult struct {
+	Msg *dns.Msg
+	RTT time.Duration
+	Err error
+}
+
+// exchange is send query over UDP, and returns when received response or ctx is done.
+//
+// The query keeps waiting response until timeout of client in background even if ctx is done, because package github.com/miekg/dns doesn't support cancellation.
+func (t *udpTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	ch := make(chan udpResult, 1)
+
+	go func() {
+		in, rtt, err := t.client.Exchange(msg, t.addr)
+		ch <- udpResult{in, rtt, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.Msg, r.RTT, r.Err
+	case <-ctx.Done():
+		return nil, time.Since(start), ctx.Err()
+	}
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	in, rtt, err := t.exchange(ctx, msg)
+	if err != nil || !in.Truncated {
+		return in, rtt, err
+	}
+
+	logger.Debug("truncated response from upstream; retry over TCP", logger.Fields{"upstream": t.addr})
+
+	in, tcpRTT, err := t.tcp.Exchange(ctx, msg)
+	return in, rtt + tcpRTT, err
+}
+
+func (t *udpTransport) Close() error {
+	return t.tcp.Close()
+}
+
+// streamTransport is transport for DNS over TCP or TLS.
+//
+// streamTransport reuses connection and sends multiple queries on the same connection without waiting response.
+type streamTransport struct {
+	mutex   sync.Mutex
+	client  *dns.Client
+	addr    string
+	timeout time.Duration
+	conn    *pipelineConn
+}
+
+func newStreamTransport(network, addr string, timeout time.Duration, tlsConfig *tls.Config) *streamTransport {
+	return &streamTransport{
+		client: &dns.Client{
+			Net:       network,
+			Dialer:    &net.Dialer{Timeout: timeout},
+			Timeout:   timeout,
+			TLSConfig: tlsConfig,
+		},
+		addr:    addr,
+		timeout: timeout,
+	}
+}
+
+// connect is returns current connection or make new connection. The second value is true if the connection is new.
+func (t *streamTransport) connect() (*pipelineConn, bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.conn != nil && t.conn.Err() == nil {
+		return t.conn, false, nil
+	}
+
+	conn, err := t.client.Dial(t.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	t.conn = newPipelineConn(conn)
+	return t.conn, true, nil
+}
+
+func (t *streamTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	conn, fresh, err := t.connect()
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+
+	in, err := conn.Exchange(ctx, msg, t.timeout)
+	if err != nil && !fresh && conn.Err() != nil {
+		// The connection might be closed by upstream while idle. Retry once with new connection.
+		if conn, _, err = t.connect(); err != nil {
+			return nil, time.Since(start), err
+		}
+		in, err = conn.Exchange(ctx, msg, t.timeout)
+	}
+	return in, time.Since(start), err
+}
+
+func (t *streamTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	return nil
+}
+
+// pipelineConn is a DNS connection that can send multiple queries without waiting responses.
+type pipelineConn struct {
+	conn       *dns.Conn
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	waiting map[uint16]chan *dns.Msg
+	err     error
+	done    chan struct{}
+}
+
+func newPipelineConn(conn *dns.Conn) *pipelineConn {
+	pc := &pipelineConn{
+		conn:    conn,
+		waiting: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+func (pc *pipelineConn) readLoop() {
+	for {
+		in, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.fail(err)
+			return
+		}
+
+		pc.mutex.Lock()
+		ch, ok := pc.waiting[in.Id]
+		delete(pc.waiting, in.Id)
+		pc.mutex.Unlock()
+
+		if ok {
+			ch <- in
+		}
+	}
+}
+
+func (pc *pipelineConn) fail(err error) {
+	pc.mutex.Lock()
+	if pc.err == nil {
+		pc.err = err
+		close(pc.done)
+	}
+	pc.mutex.Unlock()
+
+	pc.conn.Close()
+}
+
+// Err is returns the reason if connection was closed, otherwise returns nil.
+func (pc *pipelineConn) Err() error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return pc.err
+}
+
+func (pc *pipelineConn) Close() {
+	pc.fail(io.EOF)
+}
+
+func (pc *pipelineConn) register() (uint16, chan *dns.Msg, error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.err != nil {
+		return 0, nil, pc.err
+	}
+
+	id := dns.Id()
+	for _, ok := pc.waiting[id]; ok; _, ok = pc.waiting[id] {
+		id = dns.Id()
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	pc.waiting[id] = ch
+	return id, ch, nil
+}
+
+func (pc *pipelineConn) unregister(id uint16) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	delete(pc.waiting, id)
+}
+
+func (pc *pipelineConn) Exchange(ctx context.Context, msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	id, ch, err := pc.register()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.unregister(id)
+
+	originalID := msg.Id
+	msg.Id = id
+	defer func() { msg.Id = originalID }()
+
+	pc.writeMutex.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = pc.conn.WriteMsg(msg)
+	pc.writeMutex.Unlock()
+	if err != nil {
+		pc.fail(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case in := <-ch:
+		in.Id = originalID
+		return in, nil
+	case <-pc.done:
+		return nil, pc.Err()
+	case <-timer.C:
+		return nil, newError(TypeExternalError, nil, "timeout")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// httpsTransport is transport for DNS over HTTPS.
+type httpsTransport struct {
+	client *http.Client
+	url    string
+}
+
+func newHTTPSTransport(url string, timeout time.Duration, tlsConfig *tls.Config) *httpsTransport {
+	return &httpsTransport{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				DialContext:       (&net.Dialer{Timeout: timeout}).DialContext,
+				TLSClientConfig:   tlsConfig,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		},
+		url: url,
+	}
+}
+
+func (t *httpsTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	// RFC 8484 recommends to use ID 0 for cache friendliness.
+	originalID := msg.Id
+	msg.Id = 0
+	buf, err := msg.Pack()
+	msg.Id = originalID
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Since(start), newError(TypeExternalError, nil, "upstream returns HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, time.Since(start), err
+	}
+	in.Id = originalID
+
+	return in, time.Since(start), nil
+}
+
+func (t *httpsTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,204 @@
+package landns_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestUpstream_Encoding(t *testing.T) {
+	t.Parallel()
+
+	var u landns.Upstream
+
+	for input, expect := range map[string]string{
+		"8.8.8.8:53":                      "8.8.8.8:53",
+		"10.0.0.1":                        "10.0.0.1:53",
+		"127.0.0.1:8600":                  "127.0.0.1:8600",
+		"[::1]:5353":                      "[::1]:5353",
+		"::1":                             "[::1]:53",
+		"udp://8.8.8.8":                   "8.8.8.8:53",
+		"tcp://8.8.8.8":                   "tcp://8.8.8.8:53",
+		"TCP://[::1]:5353":                "tcp://[::1]:5353",
+		"tls://1.1.1.1":                   "tls://1.1.1.1:853",
+		"tls://dns.example:8853":          "tls://dns.example:8853",
+		"https://dns.example/dns-query":   "https://dns.example/dns-query",
+		"https://dns.example:8443/query":  "https://dns.example:8443/query",
+		"HTTPS://dns.example/dns-query?x": "https://dns.example/dns-query?x",
+	} {
+		if err := (&u).UnmarshalText([]byte(input)); err != nil {
+			t.Errorf("failed to unmarshal: %s: %s", input, err)
+		} else if result, err := u.MarshalText(); err != nil {
+			t.Errorf("failed to marshal: %s: %s", input, err)
+		} else if string(result) != expect {
+			t.Errorf("unexpected marshal result: expected %s but got %s", expect, string(result))
+		}
+	}
+
+	for input, expect := range map[string]string{
+		"127.0.0.1:foo":          "invalid upstream address: 127.0.0.1:foo: lookup tcp/foo: unknown port",
+		"ftp://10.0.0.1":         "invalid upstream address: ftp://10.0.0.1: unsupported protocol: ftp",
+		"tls://":                 "invalid upstream address: tls://: host is required",
+		"tcp://10.0.0.1/foo":     "invalid upstream address: tcp://10.0.0.1/foo: tcp upstream can't have path, query or user",
+		"https:///dns-query":     "invalid upstream address: https:///dns-query: host is required",
+		"udp://:53":              "invalid upstream address: udp://:53: host is required",
+		"tls://1.1.1.1:99999999": "invalid upstream address: tls://1.1.1.1:99999999: address 99999999: invalid port",
+	} {
+		if err := (&u).UnmarshalText([]byte(input)); err == nil {
+			t.Errorf("%s: expected error but got nil", input)
+		} else if err.Error() != expect {
+			t.Errorf("%s: unexpected error:\nexpected: %s\nbut got:  %s", input, expect, err)
+		}
+	}
+
+	if s := landns.UDPUpstream(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}).String(); s != "127.0.0.1:53" {
+		t.Errorf("unexpected UDP upstream: %s", s)
+	}
+}
+
+func upstreamTestResolver() landns.Resolver {
+	return landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 123, Address: net.ParseIP("127.0.0.1")},
+	})
+}
+
+func assertForwardResolve(t *testing.T, resolver landns.Resolver) {
+	t.Helper()
+
+	AssertResolve(t, resolver, landns.NewRequest("example.com.", dns.TypeA, true), false, "example.com. 123 IN A 127.0.0.1")
+}
+
+func TestForwardResolver_TCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := testutil.StartTCPDNSServer(ctx, t, upstreamTestResolver())
+
+	u, err := landns.ParseUpstream("tcp://" + srv.Addr.String())
+	if err != nil {
+		t.Fatalf("failed to parse upstream: %s", err)
+	}
+	resolver := landns.NewForwardResolverWithUpstreams([]landns.Upstream{u}, 1*time.Second, landns.NewMetrics("landns"))
+	defer resolver.Close()
+
+	for i := 0; i < 5; i++ {
+		assertForwardResolve(t, resolver)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertForwardResolve(t, resolver)
+		}()
+	}
+	wg.Wait()
+
+	if n := srv.Connections(); n != 1 {
+		t.Errorf("expected reuse connection but connected %d times", n)
+	}
+
+	if err := resolver.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+	assertForwardResolve(t, resolver)
+	if n := srv.Connections(); n != 2 {
+		t.Errorf("expected reconnect after close but connected %d times", n)
+	}
+}
+
+func TestForwardResolver_TLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConfig, clientConfig := testutil.NewTLSConfig(t)
+	srv := testutil.StartTLSDNSServer(ctx, t, upstreamTestResolver(), serverConfig)
+
+	u, err := landns.ParseUpstream("tls://" + srv.Addr.String())
+	if err != nil {
+		t.Fatalf("failed to parse upstream: %s", err)
+	}
+
+	untrusted := landns.NewForwardResolverWithUpstreams([]landns.Upstream{u}, 1*time.Second, landns.NewMetrics("landns"))
+	defer untrusted.Close()
+	if err := untrusted.Resolve(testutil.NewDummyResponseWriter(), landns.NewRequest("example.com.", dns.TypeA, true)); err == nil {
+		t.Errorf("expected certificate error but got nil")
+	}
+
+	resolver := landns.NewForwardResolverWithUpstreams([]landns.Upstream{u}, 1*time.Second, landns.NewMetrics("landns"))
+	resolver.TLSConfig = clientConfig
+	defer resolver.Close()
+
+	for i := 0; i < 5; i++ {
+		assertForwardResolve(t, resolver)
+	}
+
+	if n := srv.Connections(); n != 2 {
+		t.Errorf("expected reuse connection but connected %d times", n)
+	}
+}
+
+func TestForwardResolver_HTTPS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConfig, clientConfig := testutil.NewTLSConfig(t)
+	url := testutil.StartDoHServer(ctx, t, upstreamTestResolver(), serverConfig)
+
+	u, err := landns.ParseUpstream(url)
+	if err != nil {
+		t.Fatalf("failed to parse upstream: %s", err)
+	}
+
+	resolver := landns.NewForwardResolverWithUpstreams([]landns.Upstream{u}, 1*time.Second, landns.NewMetrics("landns"))
+	resolver.TLSConfig = clientConfig
+	defer resolver.Close()
+
+	for i := 0; i < 5; i++ {
+		assertForwardResolve(t, resolver)
+	}
+
+	u.Address += "/not-found"
+	resolver.Upstreams = []landns.Upstream{u}
+	if err := resolver.Resolve(testutil.NewDummyResponseWriter(), landns.NewRequest("example.com.", dns.TypeA, true)); err == nil {
+		t.Errorf("expected error but got nil")
+	}
+}
+
+func TestForwardResolver_Truncated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tcp := testutil.StartTCPDNSServer(ctx, t, upstreamTestResolver())
+
+	// UDP server that always returns truncated response on the same port as TCP server.
+	udp := dns.Server{
+		Addr: tcp.Addr.String(),
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Truncated = true
+			w.WriteMsg(msg)
+		}),
+	}
+	go udp.ListenAndServe()
+	defer udp.Shutdown()
+	time.Sleep(10 * time.Millisecond)
+
+	resolver := landns.NewForwardResolver([]*net.UDPAddr{{IP: tcp.Addr.IP, Port: tcp.Addr.Port}}, 1*time.Second, landns.NewMetrics("landns"))
+	defer resolver.Close()
+
+	assertForwardResolve(t, resolver)
+
+	if n := tcp.Connections(); n != 1 {
+		t.Errorf("expected retry over TCP but connected %d times", n)
+	}
+}
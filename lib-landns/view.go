@@ -0,0 +1,99 @@
+package landns
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultViewName is the name of view that used when any other view didn't match to the client.
+	DefaultViewName = "default"
+)
+
+// View is a set of Resolver that serves to clients in specified networks.
+type View struct {
+	Name     string
+	Networks []*net.IPNet
+	Resolver Resolver
+}
+
+// Contains is checker that the address is included in networks of this view or not.
+func (v View) Contains(ip net.IP) bool {
+	for _, n := range v.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String is returns simple human readable string.
+func (v View) String() string {
+	return fmt.Sprintf("View[%s %s %s]", v.Name, v.Networks, v.Resolver)
+}
+
+// ViewSet is list of View.
+//
+// ViewSet will use first matched view.
+type ViewSet []View
+
+// Find is find the View for the client address.
+//
+// Returns false if no view matched.
+func (vs ViewSet) Find(ip net.IP) (View, bool) {
+	if ip == nil {
+		return View{}, false
+	}
+
+	for _, v := range vs {
+		if v.Contains(ip) {
+			return v, true
+		}
+	}
+	return View{}, false
+}
+
+// ClientAddress is getter of client address of DNS request.
+//
+// ClientAddress returns address in the EDNS Client Subnet option if the request has it and the remote address is included in trusted networks, otherwise returns remote address of connection.
+// Client Subnet option is never used if trusted is empty, because any client can send forged option.
+func ClientAddress(w dns.ResponseWriter, r *dns.Msg, trusted []*net.IPNet) net.IP {
+	remote := remoteAddress(w)
+
+	if opt := r.IsEdns0(); opt != nil && remote != nil && containsNetwork(trusted, remote) {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.Address != nil {
+				return subnet.Address
+			}
+		}
+	}
+
+	return remote
+}
+
+// remoteAddress is getter of remote address of connection.
+func remoteAddress(w dns.ResponseWriter) net.IP {
+	if w == nil {
+		return nil
+	}
+
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+func containsNetwork(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
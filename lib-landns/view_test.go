@@ -0,0 +1,94 @@
+package landns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/macrat/landns/lib-landns"
+	"github.com/macrat/landns/lib-landns/testutil"
+	"github.com/miekg/dns"
+)
+
+func mustParseCIDR(t testing.TB, cidr string) *net.IPNet {
+	t.Helper()
+
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("failed to parse CIDR: %s", err)
+	}
+	return n
+}
+
+func TestViewSet_Find(t *testing.T) {
+	t.Parallel()
+
+	views := landns.ViewSet{
+		{Name: "office", Networks: []*net.IPNet{mustParseCIDR(t, "192.168.0.0/16")}},
+		{Name: "vpn", Networks: []*net.IPNet{mustParseCIDR(t, "10.8.0.0/24"), mustParseCIDR(t, "fd00::/8")}},
+		{Name: "overlap", Networks: []*net.IPNet{mustParseCIDR(t, "192.168.1.0/24")}},
+	}
+
+	tests := []struct {
+		IP     string
+		Name   string
+		Exists bool
+	}{
+		{"192.168.1.2", "office", true},
+		{"10.8.0.10", "vpn", true},
+		{"fd00::1", "vpn", true},
+		{"10.8.1.10", "", false},
+		{"127.0.0.1", "", false},
+	}
+
+	for _, tt := range tests {
+		v, ok := views.Find(net.ParseIP(tt.IP))
+		if ok != tt.Exists {
+			t.Errorf("%s: unexpected found: expected %v but got %v", tt.IP, tt.Exists, ok)
+		} else if v.Name != tt.Name {
+			t.Errorf("%s: unexpected view: expected %#v but got %#v", tt.IP, tt.Name, v.Name)
+		}
+	}
+
+	if _, ok := views.Find(nil); ok {
+		t.Errorf("nil address should not match to any view")
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	t.Parallel()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("127.1.2.3"), Port: 1234}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	if ip := landns.ClientAddress(testutil.NewDummyDNSResponseWriter(remote), req, nil); !ip.Equal(remote.IP) {
+		t.Errorf("unexpected client address: expected %s but got %s", remote.IP, ip)
+	}
+
+	tcpRemote := &net.TCPAddr{IP: net.ParseIP("127.2.3.4"), Port: 1234}
+	if ip := landns.ClientAddress(testutil.NewDummyDNSResponseWriter(tcpRemote), req, nil); !ip.Equal(tcpRemote.IP) {
+		t.Errorf("unexpected client address: expected %s but got %s", tcpRemote.IP, ip)
+	}
+
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("10.1.2.0"),
+	})
+
+	// Client Subnet option from untrusted remote is ignored.
+	if ip := landns.ClientAddress(testutil.NewDummyDNSResponseWriter(remote), req, nil); !ip.Equal(remote.IP) {
+		t.Errorf("unexpected client address: expected %s but got %s", remote.IP, ip)
+	}
+	if ip := landns.ClientAddress(testutil.NewDummyDNSResponseWriter(tcpRemote), req, []*net.IPNet{mustParseCIDR(t, "127.1.0.0/16")}); !ip.Equal(tcpRemote.IP) {
+		t.Errorf("unexpected client address: expected %s but got %s", tcpRemote.IP, ip)
+	}
+
+	if ip := landns.ClientAddress(testutil.NewDummyDNSResponseWriter(remote), req, []*net.IPNet{mustParseCIDR(t, "127.1.0.0/16")}); !ip.Equal(net.ParseIP("10.1.2.0")) {
+		t.Errorf("unexpected client address: expected 10.1.2.0 but got %s", ip)
+	}
+}
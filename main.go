@@ -3,11 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"github.com/macrat/landns/lib-landns"
 	"github.com/macrat/landns/lib-landns/logger"
@@ -37,6 +47,403 @@ func loadStatisResolvers(files []string) (resolver landns.ResolverSet, err error
 	return resolver, nil
 }
 
+// staticZones is pick static zones like SimpleResolver and HostsResolver from resolvers for read-only API.
+func staticZones(resolvers landns.ResolverSet) []landns.StaticZone {
+	zones := make([]landns.StaticZone, 0, len(resolvers))
+	for _, r := range resolvers {
+		if z, ok := r.(landns.StaticZone); ok {
+			zones = append(zones, z)
+		}
+	}
+	return zones
+}
+
+// parseNetworks is parse networks in CIDR notation or single addresses.
+func parseNetworks(texts []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, len(texts))
+	for i, text := range texts {
+		var n landns.Network
+		if err := n.UnmarshalText([]byte(text)); err != nil {
+			return nil, err
+		}
+		networks[i] = n.IPNet()
+	}
+	return networks, nil
+}
+
+// loadViews is make views from the configuration file.
+//
+// Each view falls back to fallback, like the blocklist and forwarders. The global resolver is used before fallback only by views that inherit global records.
+func loadViews(path string, makeDynamic func(prefix string) (landns.DynamicResolver, error), global landns.Resolver, fallback landns.AlternateResolver) (views landns.ViewSet, closer landns.ResolverSet, err error) {
+	defer func() {
+		if err != nil {
+			closer.Close()
+		}
+	}()
+
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf, err := landns.NewViewsConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, vc := range conf.Views {
+		resolvers, err := loadStatisResolvers(vc.Static)
+		if err != nil {
+			return nil, closer, fmt.Errorf("%s: %s", vc.Name, err)
+		}
+
+		for _, prefix := range vc.Dynamic {
+			r, err := makeDynamic(prefix)
+			if err != nil {
+				resolvers.Close()
+				return nil, closer, fmt.Errorf("%s: %s", vc.Name, err)
+			}
+			resolvers = append(resolvers, r)
+		}
+		closer = append(closer, resolvers)
+
+		chain := landns.AlternateResolver{resolvers}
+		if vc.InheritGlobal {
+			chain = append(chain, global)
+		}
+		chain = append(chain, fallback...)
+
+		views = append(views, landns.View{
+			Name:     vc.Name,
+			Networks: vc.IPNets(),
+			Resolver: chain,
+		})
+	}
+
+	return views, closer, nil
+}
+
+type forwarderConfig struct {
+	Upstreams []landns.Upstream
+	Timeout   time.Duration
+	Strategy  landns.ForwardStrategy
+	Cache     bool
+}
+
+// forwarderFactory is make a resolver for forwarding group. The factory is responsible for closing resolvers it made.
+type forwarderFactory func(forwarderConfig) (landns.Resolver, error)
+
+func loadForwardRules(configPath string, forwards map[string]string, makeForwarder forwarderFactory, defaults forwarderConfig) (rules []landns.ConditionalRule, err error) {
+	if configPath != "" {
+		config, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		conf, err := landns.NewForwardConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range conf.Names() {
+			g := conf.Groups[name]
+
+			fc := defaults
+			fc.Upstreams = g.Upstreams
+			if g.Timeout > 0 {
+				fc.Timeout = g.Timeout
+			}
+			if g.Strategy != nil {
+				fc.Strategy = *g.Strategy
+			}
+			if g.Cache != nil {
+				fc.Cache = *g.Cache
+			}
+
+			r, err := makeForwarder(fc)
+			if err != nil {
+				return rules, fmt.Errorf("%s: %s", name, err)
+			}
+			rules = append(rules, landns.ConditionalRule{Name: name, Suffixes: g.Domains, Resolver: r})
+		}
+	}
+
+	suffixes := make([]string, 0, len(forwards))
+	for suffix := range forwards {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+
+	for _, suffix := range suffixes {
+		fc := defaults
+		fc.Upstreams = nil
+		for _, addr := range strings.Split(forwards[suffix], ",") {
+			u, err := landns.ParseUpstream(strings.TrimSpace(addr))
+			if err != nil {
+				return rules, fmt.Errorf("%s: %s", suffix, err)
+			}
+			fc.Upstreams = append(fc.Upstreams, u)
+		}
+
+		r, err := makeForwarder(fc)
+		if err != nil {
+			return rules, fmt.Errorf("%s: %s", suffix, err)
+		}
+		rules = append(rules, landns.ConditionalRule{Name: suffix, Suffixes: []landns.Domain{landns.Domain(suffix)}, Resolver: r})
+	}
+
+	return rules, nil
+}
+
+// startTracing is setup exporting spans to the OTLP endpoint. Tracing is disabled if endpoint is empty.
+func startTracing(endpoint string) (stop func() error, err error) {
+	if endpoint == "" {
+		return func() error { return nil }, nil
+	}
+
+	exporter, err := landns.NewOTLPExporter(endpoint, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "landns"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() error {
+		return provider.Shutdown(context.Background())
+	}, nil
+}
+
+// openQueryLog is make QueryLogger that writes into the path. Query log is disabled if path is empty, and written to stdout if path is "-".
+func openQueryLog(path, format string, maxSize int64, maxBackups, bufferSize int, metrics *landns.Metrics) (*landns.QueryLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	var w io.Writer
+	if path == "-" {
+		w = struct{ io.Writer }{os.Stdout} // hide Close method for keep stdout opened
+	} else {
+		f, err := landns.NewRotatingFile(path, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	var sink landns.QueryLogSink
+	var err error
+	switch format {
+	case "json":
+		sink = landns.NewJSONQueryLogSink(w)
+	case "dnstap":
+		identity, _ := os.Hostname()
+		sink, err = landns.NewDnstapQueryLogSink(w, identity)
+	default:
+		err = fmt.Errorf("unknown format: %s", format)
+	}
+	if err != nil {
+		if c, ok := w.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
+	}
+
+	return landns.NewQueryLogger(sink, bufferSize, metrics), nil
+}
+
+// startLeaseImporters is start importing DHCP leases into resolver. Each spec is "FORMAT:PATH" like "dnsmasq:/var/lib/misc/dnsmasq.leases".
+func startLeaseImporters(specs []string, domain string, interval time.Duration, resolver landns.DynamicResolver) (importers []*landns.LeaseImporter, err error) {
+	defer func() {
+		if err != nil {
+			for _, li := range importers {
+				li.Close()
+			}
+		}
+	}()
+
+	for _, spec := range specs {
+		xs := strings.SplitN(spec, ":", 2)
+		if len(xs) != 2 {
+			return importers, fmt.Errorf("invalid lease file: %s", spec)
+		}
+
+		var format landns.LeaseFormat
+		if err := format.UnmarshalText([]byte(xs[0])); err != nil {
+			return importers, err
+		}
+
+		li := landns.NewLeaseImporter(xs[1], format, landns.Domain(domain), resolver)
+		li.Interval = interval
+		if err := li.Start(); err != nil {
+			return importers, fmt.Errorf("%s: %s", xs[1], err)
+		}
+		importers = append(importers, li)
+	}
+
+	return importers, nil
+}
+
+// startDockerDiscovery is start discovery of Docker containers into resolver. Returns nil if socket is empty.
+func startDockerDiscovery(socket, domain string, resolver landns.DynamicResolver) (*landns.DockerDiscovery, error) {
+	if socket == "" {
+		return nil, nil
+	}
+
+	var d landns.Domain
+	if err := d.UnmarshalText([]byte(domain)); err != nil {
+		return nil, err
+	}
+
+	dd := landns.NewDockerDiscovery(socket, d, resolver)
+	if err := dd.Start(); err != nil {
+		return nil, err
+	}
+	return dd, nil
+}
+
+// startKubernetesDiscovery is start discovery of Kubernetes services from API server and/or manifests directory into resolver.
+//
+// api is URL of API server or "in-cluster" for use service account of the pod.
+func startKubernetesDiscovery(api, tokenFile, caFile, manifests, domain string, resolver landns.DynamicResolver) (discoveries []*landns.KubernetesDiscovery, err error) {
+	defer func() {
+		if err != nil {
+			for _, kd := range discoveries {
+				kd.Close()
+			}
+		}
+	}()
+
+	var d landns.Domain
+	if err := d.UnmarshalText([]byte(domain)); err != nil {
+		return nil, err
+	}
+
+	var sources []landns.KubernetesSource
+	if api == "in-cluster" {
+		source, err := landns.NewInClusterKubernetesAPI()
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	} else if api != "" {
+		source, err := landns.NewKubernetesAPI(api, tokenFile, caFile)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if manifests != "" {
+		sources = append(sources, landns.KubernetesManifests{Dir: manifests})
+	}
+
+	for _, source := range sources {
+		kd := landns.NewKubernetesDiscovery(source, d, resolver)
+		if err := kd.Start(); err != nil {
+			return discoveries, err
+		}
+		discoveries = append(discoveries, kd)
+	}
+
+	return discoveries, nil
+}
+
+// startBlockResolver is load blocklists and start watching them. Returns nil if no blocklist specified.
+func startBlockResolver(blocklists, allowlists []string, response string, metrics *landns.Metrics) (*landns.BlockResolver, error) {
+	if len(blocklists) == 0 {
+		return nil, nil
+	}
+
+	br := landns.NewBlockResolver(blocklists, allowlists, metrics)
+	if err := br.Response.UnmarshalText([]byte(response)); err != nil {
+		return nil, err
+	}
+	if err := br.Start(); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// startRPZ is load response policy zones and start watching update of them.
+func startRPZ(sources []string, interval time.Duration) (policy landns.RPZSet, err error) {
+	defer func() {
+		if err != nil {
+			policy.Close()
+		}
+	}()
+
+	for _, s := range sources {
+		source, err := landns.ParseRPZSource(s)
+		if err != nil {
+			return policy, err
+		}
+
+		rpz := landns.NewRPZ(source)
+		rpz.Interval = interval
+		if err := rpz.Start(); err != nil {
+			return policy, fmt.Errorf("%s: %s", s, err)
+		}
+		policy = append(policy, rpz)
+	}
+
+	return policy, nil
+}
+
+// startDNSSECSigner is load DNSSEC keys and start watching them. Returns nil if no key specified.
+func startDNSSECSigner(paths []string, validity, interval time.Duration) (*landns.DNSSECSigner, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	signer := landns.NewDNSSECSigner(paths)
+	signer.Validity = validity
+	signer.Interval = interval
+	if err := signer.Start(); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// mdnsAddress is get address and interface for mDNS. loopback means using unicast on 127.0.0.1 instead of multicast, for testing.
+func mdnsAddress(ifname string, loopback bool) (*net.UDPAddr, *net.Interface, error) {
+	addr := landns.DefaultMdnsAddr
+	if loopback {
+		addr = landns.LoopbackMdnsAddr
+	}
+
+	if ifname == "" {
+		return addr, nil, nil
+	}
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, ifi, nil
+}
+
+// startMdnsPublisher is start publishing records of zone in resolver by mDNS. Returns nil if zone is empty.
+func startMdnsPublisher(zone string, interval time.Duration, addr *net.UDPAddr, ifi *net.Interface, resolver landns.DynamicResolver) (*landns.MdnsPublisher, error) {
+	if zone == "" {
+		return nil, nil
+	}
+
+	var d landns.Domain
+	if err := d.UnmarshalText([]byte(zone)); err != nil {
+		return nil, err
+	}
+
+	mp := landns.NewMdnsPublisher(resolver, d, addr, ifi)
+	mp.Interval = interval
+	if err := mp.Start(); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
 type service struct {
 	App       *kingpin.Application
 	Start     func(context.Context) error
@@ -45,9 +452,33 @@ type service struct {
 	APIListen *net.TCPAddr
 }
 
-func makeServer(args []string) (*service, error) {
+// closeAll is call closers in reverse order, and returns the first error.
+func closeAll(closers []func() error) error {
+	var err error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if e := closers[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func makeServer(args []string) (_ *service, err error) {
 	app := kingpin.New("landns", "A DNS server for developers for home use.")
+	hostsFiles := app.Flag("hosts", "Path to hosts file (like /etc/hosts) or directory of them for static-zone. Files are reloaded when changed.").PlaceHolder("PATH").Strings()
+	hostsTTL := app.Flag("hosts-ttl", "TTL for records from hosts files.").Default(fmt.Sprint(landns.DefaultHostsTTL)).Uint32()
+	hostsInterval := app.Flag("hosts-interval", "Interval to check update of hosts files.").Default(landns.DefaultHostsInterval.String()).Duration()
+	blocklists := app.Flag("blocklist", "Path to domain list in hosts, adblock or plain format, or directory of them, for block queries before recursive resolve. Files are reloaded when changed.").PlaceHolder("PATH").Strings()
+	allowlists := app.Flag("allowlist", "Path to domain list, or directory of them, that never blocked even if in blocklist.").PlaceHolder("PATH").Strings()
+	blockResponse := app.Flag("block-response", "Response for blocked queries.").Default(landns.BlockNXDomain.String()).Enum("nxdomain", "null", "refused")
+	rpzSources := app.Flag("rpz", "Response policy zone for rewrite responses. Path to zone file, or URL for zone transfer from primary server. (e.g. /etc/landns/rpz.zone, axfr://127.0.0.1:53/rpz.example.)").PlaceHolder("SOURCE").Strings()
+	rpzInterval := app.Flag("rpz-interval", "Interval to check update of response policy zones.").Default(landns.DefaultRPZInterval.String()).Duration()
+	dnssecKeys := app.Flag("dnssec-key", "Path to DNSSEC key file in BIND format (K<zone>+<alg>+<tag>.key with .private) or directory of them, for sign responses of local zones. Keys are reloaded when changed.").PlaceHolder("PATH").Strings()
+	dnssecValidity := app.Flag("dnssec-validity", "Validity period of DNSSEC signatures.").Default(landns.DefaultDNSSECValidity.String()).Duration()
+	dnssecInterval := app.Flag("dnssec-interval", "Interval to check update of DNSSEC key files.").Default(landns.DefaultDNSSECInterval.String()).Duration()
 	configFiles := app.Flag("config", "Path to static-zone configuration file.").Short('c').PlaceHolder("PATH").ExistingFiles()
+	viewConfig := app.Flag("views", "Path to split-horizon views configuration file.").PlaceHolder("PATH").ExistingFile()
+	ecsTrusted := app.Flag("ecs-trusted", "Network of forwarders that allowed to tell client address by EDNS Client Subnet option for select view. In default, the option is ignored. (e.g. 10.0.0.1, 10.0.0.0/24)").PlaceHolder("NETWORK").Strings()
 	sqlitePath := app.Flag("sqlite", "Path to dynamic-zone sqlite3 database path. In default, dynamic-zone will not save to disk.").Short('s').PlaceHolder("PATH").String()
 	etcdAddrs := app.Flag("etcd", "Address to dynamic-zone etcd database server. (e.g. localhost:2379)").PlaceHolder("ADDRESS").Strings()
 	etcdPrefix := app.Flag("etcd-prefix", "Prefix of etcd records.").Default("/landns").String()
@@ -55,18 +486,51 @@ func makeServer(args []string) (*service, error) {
 	apiListen := app.Flag("api-listen", "Address for API and metrics.").Short('l').Default(":9353").TCP()
 	dnsListen := app.Flag("dns-listen", "Address for listen.").Short('L').Default(":53").TCP()
 	dnsProtocol := app.Flag("dns-protocol", "Protocol for listen.").Default("udp").Enum("udp", "tcp")
-	upstreams := app.Flag("upstream", "Upstream DNS server for recursive resolve. (e.g. 8.8.8.8:53)").Short('u').PlaceHolder("ADDRESS").TCPList()
-	upstreamTimeout := app.Flag("upstream-timeout", "Timeout for recursive resolve.").Default("100ms").Duration()
+	queryTimeout := app.Flag("query-timeout", "Timeout for resolving each query. Resolving will be cancelled if exceeded. 0 means unlimited.").Default("5s").Duration()
+	upstreams := app.Flag("upstream", "Upstream DNS server for recursive resolve. (e.g. 8.8.8.8:53, tcp://8.8.8.8, tls://1.1.1.1:853, https://dns.google/dns-query)").Short('u').PlaceHolder("ADDRESS").Strings()
+	upstreamTimeout := app.Flag("upstream-timeout", "Timeout for recursive resolve. Must be greater than 0.").Default("100ms").Duration()
+	upstreamStrategy := app.Flag("upstream-strategy", "Strategy for select upstream server.").Default("sequential").Enum("sequential", "random", "fastest", "race")
+	upstreamMaxFails := app.Flag("upstream-max-fails", "Number of continuous failures to skip upstream server temporarily. 0 means never skip.").Default(strconv.Itoa(landns.DefaultMaxFails)).Int()
+	upstreamFailTimeout := app.Flag("upstream-fail-timeout", "Duration for skip failed upstream server.").Default(landns.DefaultFailTimeout.String()).Duration()
+	forwards := app.Flag("forward", "Upstream DNS servers for specified domain suffix. (e.g. corp.example.=10.0.0.1:53,10.0.0.2:53)").PlaceHolder("SUFFIX=ADDRESS").StringMap()
+	forwardConfig := app.Flag("forward-config", "Path to conditional forwarding configuration file.").PlaceHolder("PATH").ExistingFile()
 	cacheDisabled := app.Flag("disable-cache", "Disable cache for recursive resolve.").Bool()
+	negativeMinTTL := app.Flag("negative-cache-min-ttl", "Minimum TTL for caching NXDOMAIN and NODATA responses.").Default(landns.DefaultNegativeMinTTL.String()).Duration()
+	negativeMaxTTL := app.Flag("negative-cache-max-ttl", "Maximum TTL for caching NXDOMAIN and NODATA responses. 0 means unlimited.").Default(landns.DefaultNegativeMaxTTL.String()).Duration()
+	cacheMaxEntries := app.Flag("cache-max-entries", "Maximum number of entries in in-memory cache. 0 means unlimited.").Default(fmt.Sprint(landns.DefaultCacheMaxEntries)).Int()
+	cacheMaxBytes := app.Flag("cache-max-bytes", "Maximum size of records in in-memory cache in bytes. 0 means unlimited.").Default(fmt.Sprint(landns.DefaultCacheMaxBytes)).Int()
+	cachePrefetch := app.Flag("cache-prefetch", "Refresh cached records in background if queried when remaining TTL is shorter than this. 0 means disabled.").Default(landns.DefaultCachePrefetch.String()).Duration()
+	cacheStaleTTL := app.Flag("cache-stale-ttl", "Duration to serve expired records while upstream is unavailable (RFC 8767). 0 means disabled.").Default(landns.DefaultCacheStaleTTL.String()).Duration()
 	redisAddr := app.Flag("redis", "Address of Redis server for sharing recursive resolver's cache. (e.g. 127.0.0.1:6379)").PlaceHolder("ADDRESS").TCP()
 	redisPassword := app.Flag("redis-password", "Password of Redis server.").PlaceHolder("PASSWORD").String()
 	redisDatabase := app.Flag("redis-database", "Database ID of Redis server.").PlaceHolder("ID").Int()
 	metricsNamespace := app.Flag("metrics-namespace", "Namespace of prometheus metrics.").Default("landns").String()
+	queryLogPath := app.Flag("query-log", "Path to query log file. \"-\" means stdout. In default, query log is disabled.").PlaceHolder("PATH").String()
+	queryLogFormat := app.Flag("query-log-format", "Format of query log.").Default("json").Enum("json", "dnstap")
+	queryLogMaxSize := app.Flag("query-log-max-size", "Rotate query log file when it became larger than this size in bytes. 0 means never rotate.").Default("0").Int64()
+	queryLogMaxBackups := app.Flag("query-log-max-backups", "Number of rotated query log files to keep.").Default("3").Int()
+	queryLogBuffer := app.Flag("query-log-buffer", "Number of query log entries to buffer. Entries will be dropped if the buffer is full.").Default(strconv.Itoa(landns.DefaultQueryLogBuffer)).Int()
+	dhcpLeases := app.Flag("dhcp-leases", "DHCP lease file for import hostnames as dynamic records. (e.g. dnsmasq:/var/lib/misc/dnsmasq.leases, isc:/var/lib/dhcp/dhcpd.leases, kea:/var/lib/kea/kea-leases4.csv)").PlaceHolder("FORMAT:PATH").Strings()
+	dhcpDomain := app.Flag("dhcp-domain", "Domain suffix for hostnames of DHCP leases. (e.g. lan.) In default, hostnames are used as is.").PlaceHolder("DOMAIN").String()
+	dhcpInterval := app.Flag("dhcp-interval", "Interval to check update of DHCP lease files.").Default(landns.DefaultLeaseInterval.String()).Duration()
+	dockerSocket := app.Flag("docker", "Docker Engine API socket for discover containers as dynamic records. (e.g. "+landns.DefaultDockerSocket+")").PlaceHolder("PATH").String()
+	dockerDomain := app.Flag("docker-domain", "Domain suffix for Docker containers.").Default(landns.DefaultDockerDomain.String()).String()
+	kubernetesAPI := app.Flag("kubernetes-api", "URL of Kubernetes API server for discover services as dynamic records, or \"in-cluster\" to use service account of the pod. (e.g. https://192.168.1.10:6443)").PlaceHolder("URL").String()
+	kubernetesTokenFile := app.Flag("kubernetes-token-file", "Bearer token file for Kubernetes API server.").PlaceHolder("PATH").String()
+	kubernetesCAFile := app.Flag("kubernetes-ca-file", "CA certificate file for Kubernetes API server.").PlaceHolder("PATH").String()
+	kubernetesManifests := app.Flag("kubernetes-manifests", "Directory of Kubernetes manifests (Service and Endpoints) for discover services offline.").PlaceHolder("DIR").String()
+	kubernetesDomain := app.Flag("kubernetes-domain", "Cluster domain for Kubernetes services.").Default(landns.DefaultKubernetesDomain.String()).String()
+	mdnsEnabled := app.Flag("mdns", "Resolve .local names by querying multicast DNS.").Bool()
+	mdnsPublish := app.Flag("mdns-publish", "Zone of dynamic records to publish as .local names and DNS-SD services by multicast DNS. (e.g. lan.)").PlaceHolder("ZONE").String()
+	mdnsPublishInterval := app.Flag("mdns-publish-interval", "Interval to reload records to publish by multicast DNS.").Default(landns.DefaultMdnsPublishInterval.String()).Duration()
+	mdnsInterface := app.Flag("mdns-interface", "Network interface for multicast DNS. (e.g. eth0) In default, the system default interface is used.").PlaceHolder("NAME").String()
+	mdnsTimeout := app.Flag("mdns-timeout", "Timeout to wait responses of multicast DNS.").Default(landns.DefaultMdnsTimeout.String()).Duration()
+	mdnsLoopback := app.Flag("mdns-loopback", "Use unicast on "+landns.LoopbackMdnsAddr.String()+" instead of multicast for multicast DNS, for testing.").Bool()
+	otlpEndpoint := app.Flag("otlp-endpoint", "URL of OTLP/HTTP receiver for export traces. (e.g. http://localhost:4318) In default, tracing is disabled.").PlaceHolder("URL").String()
 	verbose := app.Flag("verbose", "Show verbose logs.").Short('v').Bool()
 	pprof := app.Flag("enable-pprof", "Enable pprof API.").Bool()
 
-	_, err := app.Parse(args)
-	if err != nil {
+	if _, err := app.Parse(args); err != nil {
 		return nil, err
 	}
 
@@ -78,10 +542,38 @@ func makeServer(args []string) (*service, error) {
 
 	metrics := landns.NewMetrics(*metricsNamespace)
 
-	resolvers, err := loadStatisResolvers(*configFiles)
+	// closers is functions to release started components. They are called in reverse order when failed to make server, or on Stop.
+	var closers []func() error
+	defer func() {
+		if err != nil {
+			closeAll(closers)
+		}
+	}()
+
+	trustedForwarders, err := parseNetworks(*ecsTrusted)
+	if err != nil {
+		return nil, fmt.Errorf("ecs-trusted: %s", err)
+	}
+
+	mdnsAddr, mdnsIface, err := mdnsAddress(*mdnsInterface, *mdnsLoopback)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %s", err)
+	}
+
+	staticResolvers, err := loadStatisResolvers(*configFiles)
 	if err != nil {
 		return nil, fmt.Errorf("static-zone: %s", err)
 	}
+	if len(*hostsFiles) > 0 {
+		hr := landns.NewHostsResolver(*hostsFiles)
+		hr.TTL = *hostsTTL
+		hr.Interval = *hostsInterval
+		if err := hr.Start(); err != nil {
+			return nil, fmt.Errorf("hosts: %s", err)
+		}
+		staticResolvers = append(staticResolvers, hr)
+	}
+	closers = append(closers, staticResolvers.Close)
 
 	var dynamicResolver landns.DynamicResolver
 	if *sqlitePath != "" && len(*etcdAddrs) != 0 {
@@ -97,37 +589,220 @@ func makeServer(args []string) (*service, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dynamic-zone: %s", err)
 	}
-	resolvers = append(resolvers, dynamicResolver)
+	closers = append(closers, dynamicResolver.Close)
+	resolvers := landns.ResolverSet{
+		landns.NewMeasuredResolver("static", staticResolvers, metrics),
+		landns.NewMeasuredResolver("dynamic", dynamicResolver, metrics),
+	}
+	if *mdnsEnabled {
+		mr := landns.NewMdnsResolver(mdnsAddr, mdnsIface)
+		mr.Timeout = *mdnsTimeout
+		closers = append(closers, mr.Close)
+		resolvers = append(resolvers, landns.NewMeasuredResolver("mdns", mr, metrics))
+	}
 
-	var resolver landns.Resolver = resolvers
+	if *upstreamTimeout <= 0 {
+		return nil, fmt.Errorf("recursive: upstream-timeout must be greater than 0: %s", *upstreamTimeout)
+	}
+	var strategy landns.ForwardStrategy
+	if err := strategy.UnmarshalText([]byte(*upstreamStrategy)); err != nil {
+		return nil, fmt.Errorf("recursive: %s", err)
+	}
+	forwarderDefaults := forwarderConfig{
+		Timeout:  *upstreamTimeout,
+		Strategy: strategy,
+		Cache:    !*cacheDisabled,
+	}
+
+	var caches landns.CacheSet
+	var sharedRedis *landns.RedisCache
+	var forwarders []landns.ForwardResolver
+	makeForwarder := func(conf forwarderConfig) (r landns.Resolver, err error) {
+		defer func() {
+			if err == nil {
+				closers = append(closers, r.Close)
+			}
+		}()
+
+		fr := landns.NewForwardResolverWithUpstreams(conf.Upstreams, conf.Timeout, metrics)
+		fr.Strategy = conf.Strategy
+		fr.MaxFails = *upstreamMaxFails
+		fr.FailTimeout = *upstreamFailTimeout
+		forwarders = append(forwarders, fr)
+
+		var forwardResolver landns.Resolver = landns.NewMeasuredResolver("forward", fr, metrics)
+		if !conf.Cache {
+			return forwardResolver, nil
+		}
+		if *redisAddr != nil {
+			// All forwarders share the same Redis database, so only the first one is added to caches.
+			if sharedRedis != nil {
+				return landns.NewMeasuredResolver("cache", sharedRedis.WithUpstream(forwardResolver), metrics), nil
+			}
+
+			redisCache, err := landns.NewRedisCache(*redisAddr, *redisDatabase, *redisPassword, forwardResolver, metrics)
+			if err != nil {
+				return nil, fmt.Errorf("Redis cache: %s", err)
+			}
+			redisCache.NegativeMinTTL = *negativeMinTTL
+			redisCache.NegativeMaxTTL = *negativeMaxTTL
+			redisCache.Prefetch = *cachePrefetch
+			redisCache.StaleTTL = *cacheStaleTTL
+			sharedRedis = &redisCache
+			caches = append(caches, redisCache)
+			return landns.NewMeasuredResolver("cache", redisCache, metrics), nil
+		}
+		localCache := landns.NewLocalCache(forwardResolver, metrics)
+		localCache.NegativeMinTTL = *negativeMinTTL
+		localCache.NegativeMaxTTL = *negativeMaxTTL
+		localCache.MaxEntries = *cacheMaxEntries
+		localCache.MaxBytes = *cacheMaxBytes
+		localCache.Prefetch = *cachePrefetch
+		localCache.StaleTTL = *cacheStaleTTL
+		caches = append(caches, localCache)
+		return landns.NewMeasuredResolver("cache", localCache, metrics), nil
+	}
+
+	var forwardResolver landns.Resolver
 	if len(*upstreams) > 0 {
-		us := make([]*net.UDPAddr, len(*upstreams))
+		fc := forwarderDefaults
+		fc.Upstreams = make([]landns.Upstream, len(*upstreams))
 		for i, u := range *upstreams {
-			us[i] = &net.UDPAddr{
-				IP:   u.IP,
-				Port: u.Port,
-				Zone: u.Zone,
+			if fc.Upstreams[i], err = landns.ParseUpstream(u); err != nil {
+				return nil, fmt.Errorf("recursive: %s", err)
 			}
 		}
-		var forwardResolver landns.Resolver = landns.NewForwardResolver(us, *upstreamTimeout, metrics)
-		if !*cacheDisabled {
-			if *redisAddr != nil {
-				forwardResolver, err = landns.NewRedisCache(*redisAddr, *redisDatabase, *redisPassword, forwardResolver, metrics)
-				if err != nil {
-					return nil, fmt.Errorf("recursive: Redis cache: %s", err)
-				}
-			} else {
-				forwardResolver = landns.NewLocalCache(forwardResolver, metrics)
+		forwardResolver, err = makeForwarder(fc)
+		if err != nil {
+			return nil, fmt.Errorf("recursive: %s", err)
+		}
+	}
+
+	rules, err := loadForwardRules(*forwardConfig, *forwards, makeForwarder, forwarderDefaults)
+	if err != nil {
+		return nil, fmt.Errorf("forward: %s", err)
+	}
+	if len(rules) > 0 {
+		// Resolvers of rules and the default are closed by closers, so ConditionalResolver is not closed.
+		conditional, err := landns.NewConditionalResolver(rules, forwardResolver)
+		if err != nil {
+			return nil, fmt.Errorf("forward: %s", err)
+		}
+		forwardResolver = conditional
+	}
+
+	blockResolver, err := startBlockResolver(*blocklists, *allowlists, *blockResponse, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("blocklist: %s", err)
+	}
+	if blockResolver != nil {
+		closers = append(closers, blockResolver.Close)
+	}
+
+	var fallback landns.AlternateResolver
+	if blockResolver != nil {
+		fallback = append(fallback, landns.NewMeasuredResolver("block", blockResolver, metrics))
+	}
+	if forwardResolver != nil {
+		fallback = append(fallback, forwardResolver)
+	}
+
+	var resolver landns.Resolver = resolvers
+	if len(fallback) > 0 {
+		resolver = append(landns.AlternateResolver{resolvers}, fallback...)
+	}
+
+	var views landns.ViewSet
+	var viewResolvers landns.ResolverSet
+	if *viewConfig != "" {
+		makeDynamic := func(prefix string) (landns.DynamicResolver, error) {
+			if len(*etcdAddrs) == 0 {
+				return nil, fmt.Errorf("dynamic-prefix is only available with etcd")
 			}
+			return landns.NewEtcdResolver(*etcdAddrs, prefix, *etcdTimeout, metrics)
 		}
-		resolver = landns.AlternateResolver{resolver, forwardResolver}
+
+		views, viewResolvers, err = loadViews(*viewConfig, makeDynamic, resolvers, fallback)
+		if err != nil {
+			return nil, fmt.Errorf("views: %s", err)
+		}
+		closers = append(closers, viewResolvers.Close)
+	}
+
+	stopTracing, err := startTracing(*otlpEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %s", err)
+	}
+	closers = append(closers, stopTracing)
+
+	queryLog, err := openQueryLog(*queryLogPath, *queryLogFormat, *queryLogMaxSize, *queryLogMaxBackups, *queryLogBuffer, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("query-log: %s", err)
+	}
+	if queryLog != nil {
+		closers = append(closers, queryLog.Close)
+	}
+
+	leaseImporters, err := startLeaseImporters(*dhcpLeases, *dhcpDomain, *dhcpInterval, dynamicResolver)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: %s", err)
+	}
+	for _, li := range leaseImporters {
+		closers = append(closers, li.Close)
+	}
+
+	dockerDiscovery, err := startDockerDiscovery(*dockerSocket, *dockerDomain, dynamicResolver)
+	if err != nil {
+		return nil, fmt.Errorf("docker: %s", err)
+	}
+	if dockerDiscovery != nil {
+		closers = append(closers, dockerDiscovery.Close)
+	}
+
+	kubernetesDiscoveries, err := startKubernetesDiscovery(*kubernetesAPI, *kubernetesTokenFile, *kubernetesCAFile, *kubernetesManifests, *kubernetesDomain, dynamicResolver)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %s", err)
+	}
+	for _, kd := range kubernetesDiscoveries {
+		closers = append(closers, kd.Close)
+	}
+
+	mdnsPublisher, err := startMdnsPublisher(*mdnsPublish, *mdnsPublishInterval, mdnsAddr, mdnsIface, dynamicResolver)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %s", err)
+	}
+	if mdnsPublisher != nil {
+		closers = append(closers, mdnsPublisher.Close)
+	}
+
+	policy, err := startRPZ(*rpzSources, *rpzInterval)
+	if err != nil {
+		return nil, fmt.Errorf("rpz: %s", err)
+	}
+	closers = append(closers, policy.Close)
+
+	signer, err := startDNSSECSigner(*dnssecKeys, *dnssecValidity, *dnssecInterval)
+	if err != nil {
+		return nil, fmt.Errorf("dnssec: %s", err)
+	}
+	if signer != nil {
+		closers = append(closers, signer.Close)
 	}
 
 	server := landns.Server{
-		Metrics:         metrics,
-		DynamicResolver: dynamicResolver,
-		Resolvers:       resolver,
-		DebugMode:       *pprof,
+		Metrics:           metrics,
+		DynamicResolver:   dynamicResolver,
+		Resolvers:         resolver,
+		Views:             views,
+		Caches:            caches,
+		StaticZones:       staticZones(staticResolvers),
+		Forwarders:        forwarders,
+		QueryTimeout:      *queryTimeout,
+		QueryLog:          queryLog,
+		Policy:            policy,
+		Signer:            signer,
+		TrustedForwarders: trustedForwarders,
+		DebugMode:         *pprof,
 	}
 	return &service{
 		App: app,
@@ -139,7 +814,9 @@ func makeServer(args []string) (*service, error) {
 				*dnsProtocol,
 			)
 		},
-		Stop:      resolver.Close,
+		Stop: func() error {
+			return closeAll(closers)
+		},
 		DNSListen: *dnsListen,
 		APIListen: *apiListen,
 	}, nil
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -76,6 +81,194 @@ address:
 	}
 }
 
+func TestLoadViews(t *testing.T) {
+	closer, staticPath, err := MakeDummyFile(`address:
+  example.com.: [192.168.1.1]`)
+	if err != nil {
+		t.Fatalf("failed to make dummy file: %s", err)
+	}
+	defer closer()
+
+	closer, viewPath, err := MakeDummyFile(fmt.Sprintf(`views:
+  - name: office
+    networks: [192.168.0.0/16]
+    static: [%s]
+  - name: vpn
+    networks: [10.8.0.0/24]
+    dynamic-prefix: [/landns/vpn]
+    inherit-global: true
+`, staticPath))
+	if err != nil {
+		t.Fatalf("failed to make dummy file: %s", err)
+	}
+	defer closer()
+
+	global := landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 10, Address: net.ParseIP("127.0.0.1")},
+		landns.AddressRecord{Name: "global.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.3")},
+	})
+	fallback := landns.AlternateResolver{landns.NewSimpleResolver([]landns.Record{
+		landns.AddressRecord{Name: "example.com.", TTL: 10, Address: net.ParseIP("127.0.0.4")},
+		landns.AddressRecord{Name: "fallback.example.com.", TTL: 10, Address: net.ParseIP("127.0.0.2")},
+	})}
+
+	prefixes := []string{}
+	makeDynamic := func(prefix string) (landns.DynamicResolver, error) {
+		prefixes = append(prefixes, prefix)
+		return landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+	}
+
+	views, resolvers, err := loadViews(viewPath, makeDynamic, global, fallback)
+	if err != nil {
+		t.Fatalf("failed to load views: %s", err)
+	}
+	defer func() {
+		if err := resolvers.Close(); err != nil {
+			t.Fatalf("failed to close resolvers: %s", err)
+		}
+	}()
+
+	if len(views) != 2 || views[0].Name != "office" || views[1].Name != "vpn" {
+		t.Fatalf("unexpected views: %s", views)
+	}
+	if len(prefixes) != 1 || prefixes[0] != "/landns/vpn" {
+		t.Errorf("unexpected dynamic prefixes: %s", prefixes)
+	}
+
+	for _, tt := range []struct {
+		View   int
+		Name   string
+		Expect string
+	}{
+		{0, "example.com.", "example.com. 3600 IN A 192.168.1.1"},
+		{0, "fallback.example.com.", "fallback.example.com. 10 IN A 127.0.0.2"},
+		{0, "global.example.com.", ""},
+		{1, "example.com.", "example.com. 10 IN A 127.0.0.1"},
+		{1, "fallback.example.com.", "fallback.example.com. 10 IN A 127.0.0.2"},
+		{1, "global.example.com.", "global.example.com. 10 IN A 127.0.0.3"},
+	} {
+		records := []string{}
+		writer := landns.NewResponseCallback(func(r landns.Record) error {
+			records = append(records, r.String())
+			return nil
+		})
+		expect := []string{}
+		if tt.Expect != "" {
+			expect = append(expect, tt.Expect)
+		}
+		if err := views[tt.View].Resolver.Resolve(writer, landns.NewRequest(tt.Name, dns.TypeA, false)); err != nil {
+			t.Errorf("failed to resolve: %s", err)
+		} else if !reflect.DeepEqual(records, expect) {
+			t.Errorf("%s: unexpected response: expected %s but got %s", views[tt.View].Name, expect, records)
+		}
+	}
+
+	if _, err := makeServer([]string{"--views", viewPath}); err == nil {
+		t.Errorf("expected error because dynamic-prefix without etcd but got nil")
+	} else if err.Error() != "views: vpn: dynamic-prefix is only available with etcd" {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if _, err := makeServer([]string{"--ecs-trusted", "10.0.0.0/33"}); err == nil || err.Error() != "ecs-trusted: invalid network: 10.0.0.0/33" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Resolvers of the view are closed if failed to make later dynamic resolver.
+	closer, brokenPath, err := MakeDummyFile(`views:
+  - name: vpn
+    networks: [10.8.0.0/24]
+    dynamic-prefix: [/landns/vpn, /landns/broken]
+`)
+	if err != nil {
+		t.Fatalf("failed to make dummy file: %s", err)
+	}
+	defer closer()
+
+	var made []landns.DynamicResolver
+	_, _, err = loadViews(brokenPath, func(prefix string) (landns.DynamicResolver, error) {
+		if prefix == "/landns/broken" {
+			return nil, fmt.Errorf("broken")
+		}
+		r, err := landns.NewSqliteResolver(":memory:", landns.NewMetrics("landns"))
+		made = append(made, r)
+		return r, err
+	}, global, fallback)
+	if err == nil || err.Error() != "vpn: broken" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(made) != 1 {
+		t.Fatalf("unexpected number of dynamic resolvers: %d", len(made))
+	}
+	if _, err := made[0].Records(); err == nil {
+		t.Errorf("dynamic resolver was not closed")
+	}
+}
+
+func TestLoadForwardRules(t *testing.T) {
+	closer, path, err := MakeDummyFile(`forward:
+  ad:
+    domains: [corp.example.]
+    upstreams: [10.0.0.1, 10.0.0.2:53]
+    timeout: 500ms
+    cache: false
+  consul:
+    domains: [consul.]
+    upstreams: [127.0.0.1:8600]
+    strategy: race
+`)
+	if err != nil {
+		t.Fatalf("failed to make dummy file: %s", err)
+	}
+	defer closer()
+
+	type call struct {
+		Upstreams string
+		Timeout   time.Duration
+		Strategy  landns.ForwardStrategy
+		Cache     bool
+	}
+	calls := []call{}
+	makeForwarder := func(conf forwarderConfig) (landns.Resolver, error) {
+		calls = append(calls, call{fmt.Sprint(conf.Upstreams), conf.Timeout, conf.Strategy, conf.Cache})
+		return testutil.DummyResolver{Recursion: true}, nil
+	}
+	defaults := forwarderConfig{Timeout: time.Second, Strategy: landns.StrategyRandom, Cache: true}
+
+	rules, err := loadForwardRules(path, map[string]string{"lan.": "192.168.1.1, 192.168.1.2:5353", "secure.": "tls://1.1.1.1, https://dns.example/dns-query"}, makeForwarder, defaults)
+	if err != nil {
+		t.Fatalf("failed to load rules: %s", err)
+	}
+
+	expectRules := []string{"ad[corp.example.]", "consul[consul.]", "lan.[lan.]", "secure.[secure.]"}
+	if len(rules) != len(expectRules) {
+		t.Fatalf("unexpected rules: %s", rules)
+	}
+	for i, r := range rules {
+		if fmt.Sprintf("%s%s", r.Name, r.Suffixes) != expectRules[i] {
+			t.Errorf("unexpected rule: expected %s but got %s%s", expectRules[i], r.Name, r.Suffixes)
+		}
+	}
+
+	expectCalls := []call{
+		{"[10.0.0.1:53 10.0.0.2:53]", 500 * time.Millisecond, landns.StrategyRandom, false},
+		{"[127.0.0.1:8600]", time.Second, landns.StrategyRace, true},
+		{"[192.168.1.1:53 192.168.1.2:5353]", time.Second, landns.StrategyRandom, true},
+		{"[tls://1.1.1.1:853 https://dns.example/dns-query]", time.Second, landns.StrategyRandom, true},
+	}
+	if len(calls) != len(expectCalls) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+	for i := range calls {
+		if calls[i] != expectCalls[i] {
+			t.Errorf("unexpected call: expected %v but got %v", expectCalls[i], calls[i])
+		}
+	}
+
+	if _, err := loadForwardRules("", map[string]string{"lan.": "foo:bar"}, makeForwarder, defaults); err == nil {
+		t.Errorf("expected error but got nil")
+	}
+}
+
 func startServer(t *testing.T, args []string) (*service, func()) {
 	service, err := makeServer(args)
 	if err != nil {
@@ -98,6 +291,33 @@ func startServer(t *testing.T, args []string) (*service, func()) {
 	}
 }
 
+func TestCloseAll(t *testing.T) {
+	var order []string
+	closer := func(name string, err error) func() error {
+		return func() error {
+			order = append(order, name)
+			return err
+		}
+	}
+
+	err := closeAll([]func() error{
+		closer("a", nil),
+		closer("b", fmt.Errorf("error of b")),
+		closer("c", fmt.Errorf("error of c")),
+		closer("d", nil),
+	})
+	if err == nil || err.Error() != "error of c" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(order, " ") != "d c b a" {
+		t.Errorf("unexpected order: %v", order)
+	}
+
+	if err := closeAll(nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
 func TestMakeServer(t *testing.T) {
 	t.Run("simple/make", func(t *testing.T) {
 		service, err := makeServer([]string{})
@@ -109,6 +329,24 @@ func TestMakeServer(t *testing.T) {
 		}
 	})
 
+	t.Run("tracing/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--otlp-endpoint", "grpc://localhost:4317"}); err == nil {
+			t.Fatalf("expected error but got nil")
+		} else if err.Error() != "tracing: unsupported scheme of OTLP endpoint: grpc://localhost:4317" {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("upstream-timeout/invalid", func(t *testing.T) {
+		for _, timeout := range []string{"0s", "-1s"} {
+			if _, err := makeServer([]string{"--upstream-timeout=" + timeout}); err == nil {
+				t.Errorf("%s: expected error but got nil", timeout)
+			} else if !strings.HasPrefix(err.Error(), "recursive: upstream-timeout must be greater than 0: ") {
+				t.Errorf("%s: unexpected error: %s", timeout, err)
+			}
+		}
+	})
+
 	t.Run("simple/run", func(t *testing.T) {
 		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", ":1053"})
 		defer cancel()
@@ -142,6 +380,321 @@ func TestMakeServer(t *testing.T) {
 			t.Errorf("unexpected response:\nexpected: [%s]\nbut got:  %s", expected, in.Answer)
 		}
 	})
+	t.Run("query-log", func(t *testing.T) {
+		closer, path, err := MakeDummyFile("ttl: 10\naddress:\n  example.com.: [127.0.1.2]\n")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		logCloser, logPath, err := MakeDummyFile("")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer logCloser()
+
+		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "-c", path, "--query-log", logPath})
+
+		msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		if _, err := dns.Exchange(msg, "127.0.0.1:1053"); err != nil {
+			t.Fatalf("failed to resolve example.com.: %s", err)
+		}
+		cancel()
+
+		log, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			t.Fatalf("failed to read query log: %s", err)
+		}
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(log, &entry); err != nil {
+			t.Fatalf("failed to parse query log: %s: %q", err, string(log))
+		}
+		if entry["name"] != "example.com." || entry["resolver"] != "static" || entry["answers"] != 1.0 || entry["client"] != "127.0.0.1" {
+			t.Errorf("unexpected query log: %s", string(log))
+		}
+	})
+	t.Run("query-log/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--query-log", "/no/such/directory/query.log"}); err == nil {
+			t.Fatalf("expected error but got nil")
+		} else if !strings.HasPrefix(err.Error(), "query-log: failed to open file: ") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("dhcp", func(t *testing.T) {
+		closer, path, err := MakeDummyFile(fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.10 alice *\n", time.Now().Add(time.Hour).Unix()))
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "--dhcp-leases", "dnsmasq:" + path, "--dhcp-domain", "lan"})
+		defer cancel()
+
+		in, err := dns.Exchange(new(dns.Msg).SetQuestion("alice.lan.", dns.TypeA), "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve alice.lan.: %s", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.1.10" {
+			t.Errorf("unexpected response: %s", in.Answer)
+		}
+	})
+	t.Run("dhcp/invalid", func(t *testing.T) {
+		for _, tt := range []struct {
+			Spec  string
+			Error string
+		}{
+			{"/path/to/leases", "dhcp: invalid lease file: /path/to/leases"},
+			{"unknown:/path/to/leases", "dhcp: unknown lease format: unknown"},
+			{"dnsmasq:/no/such/file", "dhcp: /no/such/file: failed to open lease file: "},
+		} {
+			if _, err := makeServer([]string{"--dhcp-leases", tt.Spec}); err == nil {
+				t.Errorf("%s: expected error but got nil", tt.Spec)
+			} else if !strings.HasPrefix(err.Error(), tt.Error) {
+				t.Errorf("%s: unexpected error: %s", tt.Spec, err)
+			}
+		}
+	})
+	t.Run("docker/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--docker", "/no/such/docker.sock"}); err == nil || !strings.HasPrefix(err.Error(), "docker: failed to connect to Docker: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := makeServer([]string{"--docker", "/no/such/docker.sock", "--docker-domain", "invalid..domain"}); err == nil || !strings.HasPrefix(err.Error(), "docker: invalid domain: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("kubernetes/invalid", func(t *testing.T) {
+		for _, tt := range []struct {
+			Args  []string
+			Error string
+		}{
+			{[]string{"--kubernetes-manifests", "/no/such/dir"}, "kubernetes: failed to read manifests directory: "},
+			{[]string{"--kubernetes-api", "https://127.0.0.1:6443", "--kubernetes-ca-file", "/no/such/ca.crt"}, "kubernetes: failed to read CA file: "},
+			{[]string{"--kubernetes-manifests", ".", "--kubernetes-domain", "invalid..domain"}, "kubernetes: invalid domain: "},
+		} {
+			if _, err := makeServer(tt.Args); err == nil || !strings.HasPrefix(err.Error(), tt.Error) {
+				t.Errorf("%s: unexpected error: %v", tt.Args, err)
+			}
+		}
+	})
+	t.Run("mdns", func(t *testing.T) {
+		service, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "--mdns", "--mdns-loopback", "--mdns-publish", "lan", "--mdns-publish-interval", "10ms", "--mdns-timeout", "100ms"})
+		defer cancel()
+
+		resp, err := http.Post(fmt.Sprintf("http://%s/api/v1", service.APIListen), "text/plain", strings.NewReader("printer.lan. 600 IN A 192.168.1.20"))
+		if err != nil {
+			t.Fatalf("failed to register record: %s", err)
+		}
+		resp.Body.Close()
+
+		var in *dns.Msg
+		for i := 0; i < 100; i++ {
+			in, err = dns.Exchange(new(dns.Msg).SetQuestion("printer.local.", dns.TypeA), "127.0.0.1:1053")
+			if err != nil {
+				t.Fatalf("failed to resolve printer.local.: %s", err)
+			}
+			if len(in.Answer) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.1.20" {
+			t.Errorf("unexpected response: %s", in.Answer)
+		}
+	})
+	t.Run("mdns/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--mdns", "--mdns-interface", "no-such-interface"}); err == nil || err.Error() != "mdns: route ip+net: no such network interface" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("hosts", func(t *testing.T) {
+		closer, path, err := MakeDummyFile("192.168.1.10 alice.example.com\n0.0.0.0 ads.example.com\n")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "--hosts", path})
+		defer cancel()
+
+		for name, expect := range map[string]string{"alice.example.com.": "192.168.1.10", "ads.example.com.": "0.0.0.0"} {
+			in, err := dns.Exchange(new(dns.Msg).SetQuestion(name, dns.TypeA), "127.0.0.1:1053")
+			if err != nil {
+				t.Fatalf("failed to resolve %s: %s", name, err)
+			}
+			if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != expect {
+				t.Errorf("%s: unexpected response: %s", name, in.Answer)
+			}
+		}
+	})
+	t.Run("hosts/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--hosts", "/no/such/hosts"}); err == nil || !strings.HasPrefix(err.Error(), "hosts: failed to read hosts file: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("blocklist", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		upstream := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "example.com.", TTL: 10, Address: net.ParseIP("127.1.2.3")},
+			landns.AddressRecord{Name: "ads.example.com.", TTL: 10, Address: net.ParseIP("127.1.2.4")},
+		}))
+
+		closer, path, err := MakeDummyFile("||ads.example.com^\n")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		_, stop := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "-u", upstream.Addr.String(), "--blocklist", path, "--block-response", "refused"})
+		defer stop()
+
+		in, err := dns.Exchange(new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA), "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve ads.example.com.: %s", err)
+		}
+		if in.Rcode != dns.RcodeRefused || len(in.Answer) != 0 {
+			t.Errorf("unexpected response: %s", in)
+		}
+
+		in, err = dns.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA), "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve example.com.: %s", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "127.1.2.3" {
+			t.Errorf("unexpected response: %s", in.Answer)
+		}
+	})
+	t.Run("blocklist/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--blocklist", "/no/such/list"}); err == nil || !strings.HasPrefix(err.Error(), "blocklist: failed to read blocklist file: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("rpz", func(t *testing.T) {
+		closer, hosts, err := MakeDummyFile("192.168.1.10 blocked.example.com\n192.168.1.11 garden.example.com\n")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		closer, zone, err := MakeDummyFile("$ORIGIN rpz.example.\n@ 60 IN SOA localhost. admin.localhost. 1 3600 600 86400 60\nblocked.example.com 60 IN CNAME .\ngarden.example.com 60 IN A 10.0.0.1\n")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "--hosts", hosts, "--rpz", zone})
+		defer cancel()
+
+		in, err := dns.Exchange(new(dns.Msg).SetQuestion("blocked.example.com.", dns.TypeA), "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve blocked.example.com.: %s", err)
+		}
+		if in.Rcode != dns.RcodeNameError || len(in.Answer) != 0 {
+			t.Errorf("unexpected response: %s", in)
+		}
+
+		in, err = dns.Exchange(new(dns.Msg).SetQuestion("garden.example.com.", dns.TypeA), "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve garden.example.com.: %s", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("unexpected response: %s", in.Answer)
+		}
+	})
+	t.Run("rpz/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--rpz", "/no/such/zone"}); err == nil || !strings.HasPrefix(err.Error(), "rpz: /no/such/zone: failed to read RPZ file: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("dnssec", func(t *testing.T) {
+		closer, hosts, err := MakeDummyFile("192.168.1.10 www.example.com\n")
+		if err != nil {
+			t.Fatalf("failed to make dummy file: %s", err)
+		}
+		defer closer()
+
+		dir, err := ioutil.TempDir("", "landns_test_")
+		if err != nil {
+			t.Fatalf("failed to make temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := key.Generate(256)
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		base := fmt.Sprintf("%s/Kexample.com.+013+%05d", dir, key.KeyTag())
+		if err := ioutil.WriteFile(base+".key", []byte(key.String()+"\n"), 0644); err != nil {
+			t.Fatalf("failed to write key: %s", err)
+		}
+		if err := ioutil.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+			t.Fatalf("failed to write key: %s", err)
+		}
+
+		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "--hosts", hosts, "--dnssec-key", dir})
+		defer cancel()
+
+		req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(4096, true)
+		in, err := dns.Exchange(req, "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve www.example.com.: %s", err)
+		}
+		if len(in.Answer) != 2 {
+			t.Fatalf("unexpected response: %s", in.Answer)
+		}
+		if sig, ok := in.Answer[1].(*dns.RRSIG); !ok || sig.Verify(key, in.Answer[:1]) != nil {
+			t.Errorf("unexpected signature: %s", in.Answer[1])
+		}
+
+		in, err = dns.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeDNSKEY), "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve example.com.: %s", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.DNSKEY).KeyTag() != key.KeyTag() {
+			t.Errorf("unexpected response: %s", in.Answer)
+		}
+	})
+	t.Run("dnssec/invalid", func(t *testing.T) {
+		if _, err := makeServer([]string{"--dnssec-key", "/no/such/key"}); err == nil || !strings.HasPrefix(err.Error(), "dnssec: failed to read DNSSEC key file: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("forward", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		upstream := testutil.StartDNSServer(ctx, t, landns.NewSimpleResolver([]landns.Record{
+			landns.AddressRecord{Name: "web.service.consul.", TTL: 10, Address: net.ParseIP("127.1.2.3")},
+		}))
+
+		_, stop := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "--forward", "consul.=" + upstream.Addr.String()})
+		defer stop()
+
+		msg := &dns.Msg{
+			MsgHdr: dns.MsgHdr{Id: dns.Id(), RecursionDesired: true},
+			Question: []dns.Question{
+				{Name: "web.service.consul.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+		}
+		in, err := dns.Exchange(msg, "127.0.0.1:1053")
+		if err != nil {
+			t.Fatalf("failed to resolve web.service.consul.: %s", err)
+		}
+
+		expected := "web.service.consul.\t10\tIN\tA\t127.1.2.3"
+		if len(in.Answer) != 1 || in.Answer[0].String() != expected {
+			t.Errorf("unexpected response:\nexpected: [%s]\nbut got:  %s", expected, in.Answer)
+		}
+	})
 	t.Run("upstream", func(t *testing.T) {
 		_, cancel := startServer(t, []string{"-l", fmt.Sprintf("127.0.0.1:%d", testutil.FindEmptyPort()), "-L", "127.0.0.1:1053", "-u", "8.8.8.8:53", "-u", "8.8.4.4:53", "-u", "1.1.1.1:53"})
 		defer cancel()